@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Attachment is a file uploaded to a room. It is linked to a message once
+// the message referencing it is sent.
+type Attachment struct {
+	Id           string `json:"id"`
+	Filename     string `json:"filename,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+const (
+	maxAttachmentsPerMessage   = 10
+	maxAttachmentFilename      = 255
+	maxAttachmentImagePixels   = 40_000_000
+	attachmentThumbnailMaxSide = 320
+)
+
+// Image types browsers can display safely, served inline instead of as a
+// download
+var inlineAttachmentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func attachmentKey(roomId int, id string) string {
+	return fmt.Sprintf("attachments/%d/%s/original", roomId, id)
+}
+
+func attachmentThumbnailKey(roomId int, id string) string {
+	return fmt.Sprintf("attachments/%d/%s/thumbnail.png", roomId, id)
+}
+
+// attachmentTypeAllowed matches a content type against patterns such as
+// "application/pdf" or "image/*".
+func attachmentTypeAllowed(contentType string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(contentType, prefix+"/") {
+				return true
+			}
+		} else if contentType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFilename keeps the base name of an uploaded file and drops control
+// characters, so it is safe to put in a Content-Disposition header.
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	if len(name) > maxAttachmentFilename {
+		name = strings.ToValidUTF8(name[:maxAttachmentFilename], "")
+	}
+	return name
+}
+
+// attachmentThumbnail returns a PNG preview and the dimensions of an image,
+// or nil if the data is not an image we can decode.
+func attachmentThumbnail(data []byte) ([]byte, int, int) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, 0
+	}
+	// Check the dimensions before decoding to avoid decompression bombs
+	if config.Width*config.Height > maxAttachmentImagePixels {
+		return nil, config.Width, config.Height
+	}
+
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil, config.Width, config.Height
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, fitThumbnail(img, attachmentThumbnailMaxSide)); err != nil {
+		return nil, 0, 0
+	}
+	b := img.Bounds()
+	return buf.Bytes(), b.Dx(), b.Dy()
+}
+
+type storedAttachment struct {
+	Attachment
+	RoomId       int
+	UploaderId   int
+	MessageId    string
+	StorageKey   string
+	ThumbnailKey string
+}
+
+var errAttachmentType = errors.New("file type is not allowed")
+
+// storeAttachment saves an uploaded file, and a thumbnail for images, and
+// records it as an unclaimed attachment of the room.
+func storeAttachment(store Store, storage Storage, cfg StorageConfig, roomId, uploaderId int, filename string, data []byte) (*storedAttachment, error) {
+	// Trust the content, not the type the client claims
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !attachmentTypeAllowed(contentType, cfg.AllowedAttachmentTypes) {
+		return nil, fmt.Errorf("%w: %s", errAttachmentType, contentType)
+	}
+
+	attachment := storedAttachment{
+		Attachment: Attachment{
+			Id:          generateId(),
+			Filename:    sanitizeFilename(filename),
+			ContentType: contentType,
+			Size:        int64(len(data)),
+		},
+		RoomId:     roomId,
+		UploaderId: uploaderId,
+	}
+	attachment.StorageKey = attachmentKey(roomId, attachment.Id)
+
+	if err := storage.Put(attachment.StorageKey, bytes.NewReader(data), contentType); err != nil {
+		return nil, fmt.Errorf("failed to store file: %v", err)
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		var thumbnail []byte
+		thumbnail, attachment.Width, attachment.Height = attachmentThumbnail(data)
+		if thumbnail != nil {
+			key := attachmentThumbnailKey(roomId, attachment.Id)
+			if err := storage.Put(key, bytes.NewReader(thumbnail), "image/png"); err != nil {
+				log.Printf("Error storing thumbnail for attachment %s: %v", attachment.Id, err)
+			} else {
+				attachment.ThumbnailKey = key
+			}
+		}
+	}
+
+	if err := store.SaveAttachment(&attachment); err != nil {
+		storage.Delete(attachment.StorageKey)
+		if attachment.ThumbnailKey != "" {
+			storage.Delete(attachment.ThumbnailKey)
+		}
+		return nil, err
+	}
+
+	return store.Attachment(attachment.Id)
+}
+
+// deleteAttachment removes a stored attachment and its files, e.g. when
+// the message it was stored for can't be posted.
+func deleteAttachment(store Store, storage Storage, attachment *storedAttachment) {
+	if err := store.DeleteAttachment(attachment.Id); err != nil {
+		log.Printf("Error deleting attachment %s: %v", attachment.Id, err)
+	}
+	for _, key := range []string{attachment.StorageKey, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := storage.Delete(key); err != nil {
+			log.Printf("Error deleting %s of attachment %s: %v", key, attachment.Id, err)
+		}
+	}
+}
+
+func handleUploadAttachment(store Store, storage Storage, cfg StorageConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		roomId, err := strconv.Atoi(r.PathValue("roomId"))
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		member, err := store.IsRoomMember(roomId, userId)
+		if err != nil {
+			http.Error(w, "Failed to check room membership: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !member {
+			http.Error(w, "You are not a member of this room", http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxAttachmentBytes+1024*1024)
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, cfg.MaxAttachmentBytes+1))
+		if err != nil {
+			http.Error(w, "Failed to read file", http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > cfg.MaxAttachmentBytes {
+			http.Error(w, fmt.Sprintf("File must be at most %d bytes", cfg.MaxAttachmentBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if len(data) == 0 {
+			http.Error(w, "File is empty", http.StatusBadRequest)
+			return
+		}
+
+		saved, err := storeAttachment(store, storage, cfg, roomId, userId, header.Filename, data)
+		if errors.Is(err, errAttachmentType) {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to save attachment: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(saved.Attachment); err != nil {
+			http.Error(w, "Failed to encode attachment: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetAttachment serves an attachment, or its thumbnail, to members of
+// the room it was uploaded to.
+func handleGetAttachment(store Store, storage Storage, thumbnail bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		attachment, err := store.Attachment(r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+			return
+		}
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account", http.StatusInternalServerError)
+			return
+		}
+		member, err := store.IsRoomMember(attachment.RoomId, userId)
+		if err != nil {
+			http.Error(w, "Failed to check room membership", http.StatusInternalServerError)
+			return
+		}
+		// Don't reveal which attachments exist to non-members
+		if !member {
+			http.NotFound(w, r)
+			return
+		}
+
+		key, contentType, disposition := attachment.StorageKey, attachment.ContentType, "attachment"
+		if thumbnail {
+			if attachment.ThumbnailKey == "" {
+				http.NotFound(w, r)
+				return
+			}
+			key, contentType, disposition = attachment.ThumbnailKey, "image/png", "inline"
+		} else if inlineAttachmentTypes[contentType] {
+			disposition = "inline"
+		}
+
+		object, info, err := storage.Open(key)
+		if err == ErrObjectNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+			return
+		}
+		defer object.Close()
+
+		// Attachments never change, but they must not end up in shared caches
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%t"`, attachment.Id, thumbnail))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		if _, err := io.Copy(w, object); err != nil {
+			log.Printf("Error sending attachment %s: %v", attachment.Id, err)
+		}
+	}
+}
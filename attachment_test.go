@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAttachmentTypeAllowed(t *testing.T) {
+	allowed := []string{"image/*", "application/pdf"}
+	tests := map[string]bool{
+		"image/png":       true,
+		"image/svg+xml":   true,
+		"application/pdf": true,
+		"application/zip": false,
+		"imagex/png":      false,
+		"text/plain":      false,
+	}
+	for contentType, want := range tests {
+		if got := attachmentTypeAllowed(contentType, allowed); got != want {
+			t.Errorf("attachmentTypeAllowed(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":             "report.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\Users\bob\notes.txt`: "notes.txt",
+		"evil\"\r\nname.txt":     "evilname.txt",
+		"  ":                     "file",
+		"/":                      "file",
+		strings.Repeat("é", 200): strings.Repeat("é", 127),
+	}
+	for name, want := range tests {
+		if got := sanitizeFilename(name); got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestStoreAttachment(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	cfg := StorageConfig{AllowedAttachmentTypes: []string{"image/*", "text/plain"}}
+
+	image, err := storeAttachment(store, storage, cfg, room.Id, aliceId, "photo.jpg", encodeTestPNG(t, halvesImage(640, 480)))
+	if err != nil {
+		t.Fatalf("storeAttachment: %v", err)
+	}
+	// The type comes from the content, not the file name
+	if image.ContentType != "image/png" || image.Filename != "photo.jpg" || image.Width != 640 || image.Height != 480 || image.ThumbnailKey == "" {
+		t.Errorf("stored image: %+v", image)
+	}
+	if _, info, err := storage.Open(image.ThumbnailKey); err != nil || info.Size == 0 {
+		t.Errorf("thumbnail: %+v, %v", info, err)
+	}
+
+	text, err := storeAttachment(store, storage, cfg, room.Id, aliceId, "notes.txt", []byte("some notes"))
+	if err != nil {
+		t.Fatalf("storeAttachment: %v", err)
+	}
+	if !strings.HasPrefix(text.ContentType, "text/plain") || text.ThumbnailKey != "" || text.Size != 10 {
+		t.Errorf("stored text: %+v", text)
+	}
+
+	if _, err := storeAttachment(store, storage, cfg, room.Id, aliceId, "doc.txt", []byte("%PDF-1.4 not text")); !errors.Is(err, errAttachmentType) {
+		t.Errorf("a PDF named .txt returned %v, want errAttachmentType", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Principal is the authenticated identity behind a request.
+type Principal struct {
+	Email string
+	// Set when the request was made with an API token; users signed in
+	// with a password have no scopes and may do everything.
+	TokenId int
+	Scopes  []string
+}
+
+// Can reports whether the principal may do what the scope covers.
+func (p *Principal) Can(scope string) bool {
+	return p.TokenId == 0 || slices.Contains(p.Scopes, scope)
+}
+
+type contextKey string
+
+const principalContextKey contextKey = "principal"
+
+// wsTokenProtocol is the WebSocket subprotocol used to carry a bearer token
+// during the handshake, for clients that cannot set an Authorization header:
+//
+//	new WebSocket(url, ["bearer", token])
+const wsTokenProtocol = "bearer"
+
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey).(*Principal)
+	return principal, ok
+}
+
+// tokenFromRequest extracts the bearer token from the Authorization header.
+// WebSocket handshakes may instead pass it as the second entry of the
+// Sec-WebSocket-Protocol header or, for older clients, in the token query
+// parameter. EventSource can't set headers either, so event streams may
+// also use the token parameter.
+func tokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return r.URL.Query().Get("token")
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == wsTokenProtocol {
+			return protocols[i+1]
+		}
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// authMiddleware lets requests with a valid user token through, unless the
+// account has been banned since the token was issued.
+func authMiddleware(store Store, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat-app"`)
+			http.Error(w, "Missing token", http.StatusUnauthorized)
+			return
+		}
+
+		email, err := validateJWT(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat-app", error="invalid_token"`)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if !checkNotBanned(store, w, email) {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, &Principal{Email: email})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkNotBanned writes the error response and returns false if the
+// account of a token is gone or banned.
+func checkNotBanned(store Store, w http.ResponseWriter, email string) bool {
+	userId, err := store.UserIdByEmail(email)
+	if err == sql.ErrNoRows {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chat-app", error="invalid_token"`)
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return false
+	}
+	if err != nil {
+		http.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return false
+	}
+	status, err := store.AccountStatus(userId)
+	if err != nil {
+		http.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return false
+	}
+	if status.Banned {
+		http.Error(w, errLoginBanned.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// tokenAuth is authMiddleware for the routes bots may use: besides user
+// tokens it accepts API tokens, as long as they carry the given scope.
+// Routes behind plain authMiddleware refuse API tokens.
+func tokenAuth(store Store, scope string, next http.Handler) http.Handler {
+	userAuth := authMiddleware(store, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := tokenFromRequest(r)
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			userAuth.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := authenticateAPIToken(store, token)
+		if err == sql.ErrNoRows {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat-app", error="invalid_token"`)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking API token: %v", err)
+			http.Error(w, "Failed to check token", http.StatusInternalServerError)
+			return
+		}
+		if !principal.Can(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat-app", error="insufficient_scope", scope="`+scope+`"`)
+			http.Error(w, "Token lacks the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalContextKey, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
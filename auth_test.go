@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestJWTKeys signs and checks tokens with a fixed secret for the
+// duration of a test.
+func useTestJWTKeys(t *testing.T) {
+	t.Helper()
+	keys, err := loadKeySet(JWTConfig{Algorithm: "HS256", Secret: "test-secret", Issuer: "chat-app", Audience: "chat-app", TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("loadKeySet: %v", err)
+	}
+	previous := jwtKeys
+	jwtKeys = keys
+	t.Cleanup(func() { jwtKeys = previous })
+}
+
+func testToken(t *testing.T, email string) string {
+	t.Helper()
+	token, err := generateJWT(email)
+	if err != nil {
+		t.Fatalf("generateJWT: %v", err)
+	}
+	return token
+}
+
+func TestAuthMiddlewareRefusesBannedAccounts(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	if err := store.BanUser(bobId); err != nil {
+		t.Fatalf("BanUser: %v", err)
+	}
+	if err := store.CreateBot(aliceId, "robot", "", ""); err != nil {
+		t.Fatalf("CreateBot: %v", err)
+	}
+	botId, _ := store.OwnedBotId(aliceId, "robot")
+	if _, err := store.CreateAPIToken(botId, "test", []string{ScopeReadRooms}, hashToken("chat_robot")); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name    string
+		handler http.Handler
+		token   string
+		want    int
+	}{
+		{"user", authMiddleware(store, ok), testToken(t, "alice@example.com"), http.StatusOK},
+		{"banned user", authMiddleware(store, ok), testToken(t, "bob@example.com"), http.StatusForbidden},
+		{"deleted user", authMiddleware(store, ok), testToken(t, "carol@example.com"), http.StatusUnauthorized},
+		{"no token", authMiddleware(store, ok), "", http.StatusUnauthorized},
+		{"user with token auth", tokenAuth(store, ScopeReadRooms, ok), testToken(t, "alice@example.com"), http.StatusOK},
+		{"banned user with token auth", tokenAuth(store, ScopeReadRooms, ok), testToken(t, "bob@example.com"), http.StatusForbidden},
+		{"API token", tokenAuth(store, ScopeReadRooms, ok), "chat_robot", http.StatusOK},
+		{"API token without the scope", tokenAuth(store, ScopePostMessages, ok), "chat_robot", http.StatusForbidden},
+		{"API token on a user route", authMiddleware(store, ok), "chat_robot", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+			if test.token != "" {
+				r.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			w := httptest.NewRecorder()
+			test.handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	websocketRequest := func(target string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		want    string
+	}{
+		{"bearer header", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+			r.Header.Set("Authorization", "bearer  abc ")
+			return r
+		}, "abc"},
+		{"other scheme", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/api/me?token=abc", nil)
+			r.Header.Set("Authorization", "Basic abc")
+			return r
+		}, ""},
+		{"query on a plain request", func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/api/me?token=abc", nil)
+		}, ""},
+		{"query on an event stream", func() *http.Request {
+			r := httptest.NewRequest(http.MethodGet, "/api/events?token=abc", nil)
+			r.Header.Set("Accept", "text/event-stream")
+			return r
+		}, "abc"},
+		{"WebSocket subprotocol", func() *http.Request {
+			r := websocketRequest("/ws?token=query")
+			r.Header.Set("Sec-WebSocket-Protocol", "bearer, abc")
+			return r
+		}, "abc"},
+		{"WebSocket query", func() *http.Request {
+			return websocketRequest("/ws?token=abc")
+		}, "abc"},
+	}
+	for _, test := range tests {
+		if got := tokenFromRequest(test.request()); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAuthMiddlewareSetsPrincipal(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+
+	var principal *Principal
+	handler := authMiddleware(store, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = principalFromContext(r.Context())
+	}))
+	serve := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(testToken(t, "alice@example.com")); w.Code != http.StatusOK || principal == nil || principal.Email != "alice@example.com" || principal.TokenId != 0 {
+		t.Fatalf("got status %d and principal %+v", w.Code, principal)
+	}
+	if !principal.Can(ScopePostMessages) {
+		t.Errorf("a user principal lacks a scope")
+	}
+
+	principal = nil
+	w := serve("not-a-token")
+	if w.Code != http.StatusUnauthorized || principal != nil {
+		t.Errorf("invalid token: got status %d and principal %+v", w.Code, principal)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, `error="invalid_token"`) {
+		t.Errorf("invalid token: WWW-Authenticate is %q", got)
+	}
+}
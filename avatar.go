@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Square sizes generated for every uploaded avatar, in pixels
+var avatarSizes = []int{32, 64, 128, 256}
+
+const (
+	defaultAvatarSize  = 128
+	maxAvatarDimension = 4096
+)
+
+var allowedAvatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+func avatarKey(userId int, version string, size int) string {
+	return fmt.Sprintf("avatars/%d/%s/%d.png", userId, version, size)
+}
+
+// avatarURL is the public address of an uploaded avatar. The version is part
+// of the path, so the response can be cached forever.
+func avatarURL(userId int, version string) string {
+	return fmt.Sprintf("/api/avatars/%d/%s", userId, version)
+}
+
+// processAvatar validates an uploaded image and returns PNG encoded square
+// thumbnails keyed by size. Re-encoding drops EXIF and any other metadata.
+func processAvatar(data []byte) (map[int][]byte, error) {
+	contentType := http.DetectContentType(data)
+	if !allowedAvatarTypes[contentType] {
+		return nil, fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	// Check the dimensions before decoding to avoid decompression bombs
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %v", err)
+	}
+	if config.Width > maxAvatarDimension || config.Height > maxAvatarDimension {
+		return nil, fmt.Errorf("image must be at most %dx%d pixels", maxAvatarDimension, maxAvatarDimension)
+	}
+
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %v", err)
+	}
+
+	thumbnails := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, squareThumbnail(img, size)); err != nil {
+			return nil, err
+		}
+		thumbnails[size] = buf.Bytes()
+	}
+	return thumbnails, nil
+}
+
+func deleteAvatarFiles(storage Storage, userId int, version string) {
+	for _, size := range avatarSizes {
+		if err := storage.Delete(avatarKey(userId, version, size)); err != nil {
+			log.Printf("Error deleting avatar %s: %v", avatarKey(userId, version, size), err)
+		}
+	}
+}
+
+func handleUploadAvatar(store Store, storage Storage, manager *ClientManager, maxBytes int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1024*1024)
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			http.Error(w, "Missing avatar file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+		if err != nil {
+			http.Error(w, "Failed to read avatar", http.StatusBadRequest)
+			return
+		}
+		if int64(len(data)) > maxBytes {
+			http.Error(w, fmt.Sprintf("Avatar must be at most %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		thumbnails, err := processAvatar(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		previous, err := store.AvatarVersion(userId)
+		if err != nil {
+			http.Error(w, "Failed to load avatar: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		version := strconv.FormatInt(time.Now().UnixNano(), 36)
+		for size, thumbnail := range thumbnails {
+			if err := storage.Put(avatarKey(userId, version, size), bytes.NewReader(thumbnail), "image/png"); err != nil {
+				deleteAvatarFiles(storage, userId, version)
+				http.Error(w, "Failed to store avatar: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := store.SetAvatarVersion(userId, version); err != nil {
+			deleteAvatarFiles(storage, userId, version)
+			http.Error(w, "Failed to save avatar: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previous != "" {
+			deleteAvatarFiles(storage, userId, previous)
+		}
+
+		profile, err := store.ProfileByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to get profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		manager.UpdateClientProfile(principal.Email, profile)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(meResponse{Email: principal.Email, Profile: *profile})
+		if err != nil {
+			http.Error(w, "Failed to encode profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleDeleteAvatar(store Store, storage Storage, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		version, err := store.AvatarVersion(userId)
+		if err != nil {
+			http.Error(w, "Failed to load avatar: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if version == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := store.DeleteAvatar(userId); err != nil {
+			http.Error(w, "Failed to delete avatar: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleteAvatarFiles(storage, userId, version)
+
+		if profile, err := store.ProfileByEmail(principal.Email); err == nil {
+			manager.UpdateClientProfile(principal.Email, profile)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleGetAvatar(storage Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userId, err := strconv.Atoi(r.PathValue("userId"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		version := r.PathValue("version")
+
+		size := defaultAvatarSize
+		if param := r.URL.Query().Get("size"); param != "" {
+			size, err = strconv.Atoi(param)
+			if err != nil {
+				http.Error(w, "Invalid size", http.StatusBadRequest)
+				return
+			}
+		}
+		if !slices.Contains(avatarSizes, size) {
+			http.Error(w, fmt.Sprintf("Size must be one of %v", avatarSizes), http.StatusBadRequest)
+			return
+		}
+
+		object, info, err := storage.Open(avatarKey(userId, version, size))
+		if err == ErrObjectNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to read avatar", http.StatusInternalServerError)
+			return
+		}
+		defer object.Close()
+
+		// Avatar URLs change with every upload, so the content never does
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, version, size))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		if _, err := io.Copy(w, object); err != nil {
+			log.Printf("Error sending avatar: %v", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+var (
+	testRed  = color.RGBA{255, 0, 0, 255}
+	testBlue = color.RGBA{0, 0, 255, 255}
+)
+
+// halvesImage is red on the left and blue on the right.
+func halvesImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := testRed
+			if x >= w/2 {
+				c = testBlue
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeTestPNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("png.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// closeTo compares colours loosely, as JPEG and averaging blur the edges.
+func closeTo(c color.Color, want color.RGBA) bool {
+	r, g, b, _ := c.RGBA()
+	near := func(got uint32, want uint8) bool {
+		diff := int(got>>8) - int(want)
+		return diff > -48 && diff < 48
+	}
+	return near(r, want.R) && near(g, want.G) && near(b, want.B)
+}
+
+func TestProcessAvatar(t *testing.T) {
+	thumbnails, err := processAvatar(encodeTestPNG(t, halvesImage(300, 200)))
+	if err != nil {
+		t.Fatalf("processAvatar: %v", err)
+	}
+	if len(thumbnails) != len(avatarSizes) {
+		t.Fatalf("got %d thumbnails, want %d", len(thumbnails), len(avatarSizes))
+	}
+	for _, size := range avatarSizes {
+		img, err := png.Decode(bytes.NewReader(thumbnails[size]))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d: thumbnail is %dx%d", size, b.Dx(), b.Dy())
+		}
+		// The centre square still shows both halves
+		if !closeTo(img.At(size/8, size/2), testRed) || !closeTo(img.At(size-1-size/8, size/2), testBlue) {
+			t.Errorf("size %d: thumbnail is not the centre of the image", size)
+		}
+	}
+
+	if _, err := processAvatar([]byte("GIF89a but not really")); err == nil {
+		t.Errorf("a broken image was accepted")
+	}
+	if _, err := processAvatar([]byte("<svg></svg>")); err == nil {
+		t.Errorf("an SVG image was accepted")
+	}
+	if _, err := processAvatar(encodeTestPNG(t, image.NewGray(image.Rect(0, 0, maxAvatarDimension+1, 1)))); err == nil {
+		t.Errorf("an image wider than %d pixels was accepted", maxAvatarDimension)
+	}
+}
+
+func TestFitThumbnail(t *testing.T) {
+	tests := []struct {
+		w, h, wantW, wantH int
+	}{
+		{400, 100, 100, 25},
+		{100, 400, 25, 100},
+		{50, 20, 50, 20},
+		{1000, 1, 100, 1},
+	}
+	for _, test := range tests {
+		b := fitThumbnail(image.NewRGBA(image.Rect(0, 0, test.w, test.h)), 100).Bounds()
+		if b.Dx() != test.wantW || b.Dy() != test.wantH {
+			t.Errorf("%dx%d fitted into 100: %dx%d, want %dx%d", test.w, test.h, b.Dx(), b.Dy(), test.wantW, test.wantH)
+		}
+	}
+}
+
+// withOrientation adds an EXIF segment with the orientation tag to a JPEG
+// file.
+func withOrientation(data []byte, orientation byte) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // header, first IFD at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0, // orientation, SHORT
+		0, 0, 0, 0, // no next IFD
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	length := len(segment) + 2
+	app1 := append([]byte{0xFF, 0xE1, byte(length >> 8), byte(length)}, segment...)
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestDecodeImageAppliesOrientation(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, halvesImage(64, 32), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+
+	// Orientation 6 means the camera was turned clockwise: the picture is
+	// turned back, so the red left half ends up on top
+	data := withOrientation(buf.Bytes(), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+	img, format, err := decodeImage(data)
+	if err != nil || format != "jpeg" {
+		t.Fatalf("decodeImage: %s, %v", format, err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 64 {
+		t.Fatalf("rotated image is %dx%d, want 32x64", b.Dx(), b.Dy())
+	}
+	if !closeTo(img.At(16, 8), testRed) || !closeTo(img.At(16, 56), testBlue) {
+		t.Errorf("image was not rotated clockwise")
+	}
+
+	if got := jpegOrientation(buf.Bytes()); got != 1 {
+		t.Errorf("jpegOrientation without EXIF = %d, want 1", got)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backups are consistent copies of the SQLite database taken with VACUUM
+// INTO while the server keeps running. PostgreSQL has pg_dump for that.
+
+var errBackupUnsupported = errors.New("only SQLite databases can be backed up and restored here; use pg_dump and pg_restore for PostgreSQL")
+
+// Backups taken into the backup directory are named after the time they
+// were taken, so that they sort by age
+const (
+	backupPrefix     = "chat-"
+	backupSuffix     = ".db"
+	backupTimeFormat = "20060102-150405.000"
+)
+
+type Backup struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+}
+
+// backupDatabase writes a snapshot of the database to path, which must not
+// exist yet.
+func backupDatabase(store Store, path string) error {
+	if store.Driver() != "sqlite" {
+		return errBackupUnsupported
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	// Written under another name first, so that a backup cut short is never
+	// taken for a whole one
+	partial := path + ".partial"
+	os.Remove(partial)
+	if err := store.Backup(partial); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// Backups takes backups into the backup directory and deletes the oldest
+// ones beyond the number to keep.
+type Backups struct {
+	store Store
+	cfg   BackupConfig
+	// One backup at a time
+	mu sync.Mutex
+}
+
+func NewBackups(store Store, cfg BackupConfig) *Backups {
+	return &Backups{store: store, cfg: cfg}
+}
+
+func (b *Backups) Create() (*Backup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	path := filepath.Join(b.cfg.Dir, name)
+	if err := backupDatabase(b.store, path); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Backed up the database to %s", path)
+
+	if err := b.prune(); err != nil {
+		log.Printf("Error deleting old backups: %v", err)
+	}
+	return &Backup{Name: name, Size: info.Size(), CreatedAt: formatTimestamp(info.ModTime())}, nil
+}
+
+// List returns the backups in the backup directory, newest first.
+func (b *Backups) List() ([]Backup, error) {
+	entries, err := os.ReadDir(b.cfg.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]Backup, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, Backup{Name: name, Size: info.Size(), CreatedAt: formatTimestamp(info.ModTime())})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+func (b *Backups) prune() error {
+	if b.cfg.Keep <= 0 {
+		return nil
+	}
+	backups, err := b.List()
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[min(b.cfg.Keep, len(backups)):] {
+		if err := os.Remove(filepath.Join(b.cfg.Dir, backup.Name)); err != nil {
+			return err
+		}
+		log.Printf("Deleted old backup %s", backup.Name)
+	}
+	return nil
+}
+
+// Schedule takes a backup every configured interval in the background.
+func (b *Backups) Schedule() {
+	if b.cfg.Interval <= 0 {
+		return
+	}
+	if b.store.Driver() != "sqlite" {
+		log.Printf("Scheduled backups are off: %v", errBackupUnsupported)
+		return
+	}
+	go b.scheduleLoop()
+}
+
+func (b *Backups) scheduleLoop() {
+	ticker := time.NewTicker(b.cfg.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := b.Create(); err != nil {
+			log.Printf("Error backing up the database: %v", err)
+		}
+	}
+}
+
+// runBackup implements the backup command. Without a file the backup goes
+// to the backup directory like a scheduled one.
+func runBackup(store Store, cfg BackupConfig, args []string) error {
+	switch len(args) {
+	case 0:
+		backup, err := NewBackups(store, cfg).Create()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backed up the database to %s\n", filepath.Join(cfg.Dir, backup.Name))
+	case 1:
+		if err := backupDatabase(store, args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Backed up the database to %s\n", args[0])
+	default:
+		return errors.New("usage: backup [file]")
+	}
+	return nil
+}
+
+// validateBackup checks that path holds an intact database this binary can
+// migrate and returns its schema version.
+func validateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	dsn, err := sqliteURI(path, url.Values{"mode": {"ro"}})
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return 0, fmt.Errorf("%s is not a SQLite database: %w", path, err)
+	}
+	if result != "ok" {
+		return 0, fmt.Errorf("%s is damaged: %s", path, result)
+	}
+	rows, err := db.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, err
+	}
+	broken := 0
+	for rows.Next() {
+		broken++
+	}
+	rows.Close()
+	if broken > 0 {
+		return 0, fmt.Errorf("%s has %d rows that break foreign keys", path, broken)
+	}
+
+	// Databases from before schema migrations are at version 0 and adopted
+	// when the server starts
+	var tables int
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('users', 'schema_migrations')"
+	if err := db.QueryRow(query).Scan(&tables); err != nil {
+		return 0, err
+	}
+	if tables == 0 {
+		return 0, fmt.Errorf("%s is not a chat database", path)
+	}
+	var version int
+	if tables == 2 {
+		if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		return 0, err
+	}
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return 0, fmt.Errorf("%s is at schema version %d, newer than this binary knows (%d)", path, version, latest)
+	}
+	return version, nil
+}
+
+// lockDatabase opens the SQLite database at path on a single connection
+// that holds an exclusive lock on the file until it is closed. It fails at
+// once rather than wait if another process, such as a running server, has
+// the database open.
+func lockDatabase(path string) (*sql.DB, error) {
+	dsn, err := sqliteURI(path, url.Values{"_pragma": {"busy_timeout(0)", "locking_mode(EXCLUSIVE)"}})
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	// In exclusive locking mode the lock is taken by the first write and
+	// then kept until the connection closes
+	if _, err := db.Exec("BEGIN EXCLUSIVE"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec("COMMIT"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// runRestore implements the restore command. It replaces the database file
+// with a backup once the backup is validated, after backing up the database
+// it replaces. It refuses while the database is in use, so the server must
+// be stopped; it migrates the restored database when it starts.
+func runRestore(cfg *Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: restore <backup file>")
+	}
+	if cfg.Database.Driver != "sqlite" {
+		return errBackupUnsupported
+	}
+	source, target := args[0], cfg.Database.Path
+	version, err := validateBackup(source)
+	if err != nil {
+		return err
+	}
+
+	// Copied next to the database first, so that the swap is a rename
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create database directory: %w", err)
+	}
+	staged := target + ".restore"
+	if err := copyFile(source, staged); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	defer os.Remove(staged)
+
+	// The lock is held until the backup is in place, so that a server
+	// started meanwhile can't write to the database being replaced
+	if _, err := os.Stat(target); err == nil {
+		lock, err := lockDatabase(target)
+		if err != nil {
+			return fmt.Errorf("%s is in use, stop the server before restoring: %w", target, err)
+		}
+		defer lock.Close()
+
+		store := &SQLiteStore{sqlStore{db: lock, driver: "sqlite"}}
+		saved, err := NewBackups(store, cfg.Backups).Create()
+		if err != nil {
+			return fmt.Errorf("failed to back up the current database: %w", err)
+		}
+		fmt.Printf("Backed up the current database to %s\n", filepath.Join(cfg.Backups.Dir, saved.Name))
+	}
+
+	// The log of the replaced database must not be replayed into the backup
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(target + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(staged, target); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s at schema version %d to %s\n", source, version, target)
+	return nil
+}
+
+func copyFile(source, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func handleGetBackups(backups *Backups) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := backups.List()
+		if err != nil {
+			http.Error(w, "Failed to list backups: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(list)
+		if err != nil {
+			http.Error(w, "Failed to encode backups: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleCreateBackup(backups *Backups) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		backup, err := backups.Create()
+		if err == errBackupUnsupported {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to back up the database: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		principal, _ := principalFromContext(r.Context())
+		log.Printf("Backup %s taken by %s", backup.Name, principal.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(backup)
+		if err != nil {
+			http.Error(w, "Failed to encode backup: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
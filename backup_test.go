@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSQLiteStore(filepath.Join(dir, "live.db"), time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+	migrateTestStore(t, store)
+
+	// The name must not be mistaken for URI parameters
+	good := filepath.Join(dir, "chat #1?.db")
+	if err := backupDatabase(store, good); err != nil {
+		t.Fatalf("backupDatabase: %v", err)
+	}
+	if version, err := validateBackup(good); err != nil || version == 0 {
+		t.Errorf("validateBackup(%q) = %d, %v; want the latest version", good, version, err)
+	}
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.db")
+	for _, path := range []string{garbage, missing} {
+		if _, err := validateBackup(path); err == nil {
+			t.Errorf("validateBackup(%q) succeeded", path)
+		}
+	}
+}
+
+func TestLockDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "main.db")
+	store, err := NewSQLiteStore(path, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	migrateTestStore(t, store)
+	store.Close()
+
+	lock, err := lockDatabase(path)
+	if err != nil {
+		t.Fatalf("lockDatabase: %v", err)
+	}
+	defer lock.Close()
+
+	store, err = NewSQLiteStore(path, 100*time.Millisecond)
+	if err == nil {
+		defer store.Close()
+		_, err = store.Users()
+	}
+	if err == nil {
+		t.Error("the database could be read while locked")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{
+		Database: DatabaseConfig{Driver: "sqlite", Path: filepath.Join(dir, "data", "main.db"), BusyTimeout: time.Second},
+		Backups:  BackupConfig{Dir: filepath.Join(dir, "backups")},
+	}
+	store, err := NewSQLiteStore(cfg.Database.Path, cfg.Database.BusyTimeout)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	migrateTestStore(t, store)
+	createTestUsers(t, store)
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := backupDatabase(store, backup); err != nil {
+		t.Fatalf("backupDatabase: %v", err)
+	}
+	if err := store.CreateUser("carol@example.com", []byte("hash-c"), "carol", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	// A server still has the database open
+	if err := runRestore(cfg, []string{backup}); err == nil {
+		t.Fatal("restore succeeded while the database was in use")
+	}
+	store.Close()
+
+	if err := runRestore(cfg, []string{backup}); err != nil {
+		t.Fatalf("runRestore: %v", err)
+	}
+	saved, err := NewBackups(nil, cfg.Backups).List()
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("got backups %v, %v; want the replaced database", saved, err)
+	}
+
+	store, err = NewSQLiteStore(cfg.Database.Path, cfg.Database.BusyTimeout)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+	for email, want := range map[string]bool{"alice@example.com": true, "carol@example.com": false} {
+		if _, err := store.UserIdByEmail(email); (err == nil) != want {
+			t.Errorf("UserIdByEmail(%q): %v", email, err)
+		}
+	}
+}
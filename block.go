@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// A blocked user can't send you direct messages and their room messages are
+// hidden from you. A muted user only has their room messages hidden.
+const (
+	BlockKindBlock = "block"
+	BlockKindMute  = "mute"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+type BlockEntry struct {
+	Profile
+	Kind      string `json:"kind"`
+	CreatedAt string `json:"created_at"`
+}
+
+// userIdByHandle is Store.UserIdByHandle returning errUserNotFound if there
+// is no such user.
+func userIdByHandle(store Store, handle string) (int, error) {
+	userId, err := store.UserIdByHandle(handle)
+	if err == sql.ErrNoRows {
+		return 0, errUserNotFound
+	}
+	return userId, err
+}
+
+// blockUser blocks or mutes the user with the given handle on behalf of
+// blockerId and applies it to the blocker's open connections right away.
+func blockUser(store Store, manager *ClientManager, blockerId int, handle, kind string) error {
+	if kind != BlockKindBlock && kind != BlockKindMute {
+		return fmt.Errorf("kind must be %q or %q", BlockKindBlock, BlockKindMute)
+	}
+	blockedId, err := userIdByHandle(store, handle)
+	if err != nil {
+		return err
+	}
+	if blockedId == blockerId {
+		return fmt.Errorf("you cannot %s yourself", kind)
+	}
+	if err := store.SetBlock(blockerId, blockedId, kind); err != nil {
+		return err
+	}
+	manager.SetIgnored(blockerId, blockedId, true)
+	return nil
+}
+
+// unblockUser lifts a block or mute of the given kind, either if kind is "".
+// It reports whether there was one.
+func unblockUser(store Store, manager *ClientManager, blockerId int, handle, kind string) (bool, error) {
+	blockedId, err := userIdByHandle(store, handle)
+	if err != nil {
+		return false, err
+	}
+	removed, err := store.RemoveBlock(blockerId, blockedId, kind)
+	if err != nil {
+		return false, err
+	}
+	if removed {
+		manager.SetIgnored(blockerId, blockedId, false)
+	}
+	return removed, nil
+}
+
+func handleGetBlocks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries, err := store.Blocks(userId)
+		if err != nil {
+			http.Error(w, "Failed to get blocks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			http.Error(w, "Failed to encode blocks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleBlockUser(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		// The body is optional and defaults to a full block
+		request := struct {
+			Kind string `json:"kind"`
+		}{Kind: BlockKindBlock}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = blockUser(store, manager, userId, r.PathValue("handle"), request.Kind)
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to block user: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleUnblockUser(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = unblockUser(store, manager, userId, r.PathValue("handle"), "")
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to unblock user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
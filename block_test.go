@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestBlockUser(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	manager := newTestNode(t, store, NewMemoryBroker())
+	client := &Client{UserId: aliceId}
+	manager.Clients["alice-1"] = client
+
+	if err := blockUser(store, manager, aliceId, "bob", "ignore"); err == nil {
+		t.Errorf("an unknown kind was accepted")
+	}
+	if err := blockUser(store, manager, aliceId, "nobody", BlockKindBlock); !errors.Is(err, errUserNotFound) {
+		t.Errorf("blocking an unknown handle returned %v, want errUserNotFound", err)
+	}
+	if err := blockUser(store, manager, aliceId, "alice", BlockKindMute); err == nil {
+		t.Errorf("a user could mute themselves")
+	}
+
+	if err := blockUser(store, manager, aliceId, "bob", BlockKindMute); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+	if kind, _ := store.BlockKind(aliceId, bobId); kind != BlockKindMute || !client.ignores(bobId) {
+		t.Errorf("after muting bob: kind %q, ignored %v", kind, client.ignores(bobId))
+	}
+
+	// /unblock lifts only blocks
+	if removed, err := unblockUser(store, manager, aliceId, "bob", BlockKindBlock); err != nil || removed {
+		t.Errorf("unblocking a mute = %v, %v", removed, err)
+	}
+	if kind, _ := store.BlockKind(aliceId, bobId); kind != BlockKindMute || !client.ignores(bobId) {
+		t.Errorf("after unblocking a mute: kind %q, ignored %v", kind, client.ignores(bobId))
+	}
+	if removed, err := unblockUser(store, manager, aliceId, "bob", BlockKindMute); err != nil || !removed {
+		t.Fatalf("unblockUser = %v, %v", removed, err)
+	}
+	if client.ignores(bobId) {
+		t.Errorf("the connection still ignores bob after unmuting")
+	}
+	if removed, err := unblockUser(store, manager, aliceId, "bob", ""); err != nil || removed {
+		t.Errorf("unblocking twice = %v, %v", removed, err)
+	}
+
+	// and /unmute only mutes
+	if err := blockUser(store, manager, aliceId, "bob", BlockKindBlock); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+	if removed, err := unblockUser(store, manager, aliceId, "bob", BlockKindMute); err != nil || removed {
+		t.Errorf("unmuting a block = %v, %v", removed, err)
+	}
+	if kind, _ := store.BlockKind(aliceId, bobId); kind != BlockKindBlock || !client.ignores(bobId) {
+		t.Errorf("after unmuting a block: kind %q, ignored %v", kind, client.ignores(bobId))
+	}
+}
+
+func TestBlockedSenderCannotSendDirectMessages(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	manager := newTestNode(t, store, NewMemoryBroker())
+	aliceConn, bobConn := &recordingConn{}, &recordingConn{}
+	manager.AddClient("alice-1", &Client{UserId: aliceId, Email: "alice@example.com", Handle: "alice", Conn: aliceConn})
+	bob := &Client{UserId: bobId, Email: "bob@example.com", Handle: "bob", Conn: bobConn}
+	manager.AddClient("bob-1", bob)
+
+	send := func() {
+		t.Helper()
+		data := []byte(`{"type": "direct", "target": "alice", "content": "psst"}`)
+		if err := handleClientMessage(bobConn, bob, manager, data, bob.Email); err != nil {
+			t.Fatalf("handleClientMessage: %v", err)
+		}
+	}
+
+	// A blocked sender is told the same as when alice is offline
+	if err := blockUser(store, manager, aliceId, "bob", BlockKindBlock); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+	send()
+	if got := bobConn.last(); got != "User alice not found." {
+		t.Errorf("bob was told %q", got)
+	}
+	if got := aliceConn.last(); got != "" {
+		t.Errorf("alice received %q from a blocked user", got)
+	}
+
+	// Muting only hides room messages
+	if err := blockUser(store, manager, aliceId, "bob", BlockKindMute); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+	send()
+	if got := aliceConn.last(); got != "psst" {
+		t.Errorf("alice received %q from a muted user, want psst", got)
+	}
+}
+
+func TestDeliverToRoomSkipsIgnoredSenders(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	if err := store.CreateUser("carol@example.com", []byte("hash-c"), "carol", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	carolId, _ := store.UserIdByEmail("carol@example.com")
+	manager := newTestNode(t, store, NewMemoryBroker())
+
+	conns := map[string]*recordingConn{}
+	for _, user := range []struct {
+		id     int
+		handle string
+	}{{aliceId, "alice"}, {bobId, "bob"}, {carolId, "carol"}} {
+		conns[user.handle] = &recordingConn{}
+		client := &Client{UserId: user.id, Email: user.handle + "@example.com", Handle: user.handle, Conn: conns[user.handle]}
+		manager.AddClient(user.handle+"-1", client)
+		if _, err := manager.JoinRoom("general", client); err != nil {
+			t.Fatalf("JoinRoom: %v", err)
+		}
+	}
+	// alice mutes bob, carol blocks him
+	if err := blockUser(store, manager, aliceId, "bob", BlockKindMute); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+	if err := blockUser(store, manager, carolId, "bob", BlockKindBlock); err != nil {
+		t.Fatalf("blockUser: %v", err)
+	}
+
+	manager.deliverToRoom("general", Message{Type: RegularMessage, Content: "from bob", SenderId: bobId}, "")
+	manager.deliverToRoom("general", Message{Type: RegularMessage, Content: "from carol", SenderId: carolId}, "")
+	want := map[string][]string{
+		"alice": {"from carol"},
+		"bob":   {"from bob", "from carol"},
+		"carol": {"from carol"},
+	}
+	for handle, conn := range conns {
+		var got []string
+		for _, message := range conn.messages {
+			if message.Type == RegularMessage {
+				got = append(got, message.Content)
+			}
+		}
+		if !slices.Equal(got, want[handle]) {
+			t.Errorf("%s received %q, want %q", handle, got, want[handle])
+		}
+	}
+}
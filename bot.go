@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Scopes an API token can carry
+const (
+	ScopeReadRooms    = "rooms:read"
+	ScopePostMessages = "messages:write"
+	ScopeManageRooms  = "rooms:manage"
+)
+
+var apiTokenScopes = []string{ScopeReadRooms, ScopePostMessages, ScopeManageRooms}
+
+const (
+	// API tokens start with this, so they can be told apart from JWTs
+	apiTokenPrefix = "chat_"
+	// Bots get an address in this reserved domain, which users can't
+	// register with
+	botEmailDomain = "bots.invalid"
+	maxBotsPerUser = 10
+)
+
+func botEmail(handle string) string {
+	return handle + "@" + botEmailDomain
+}
+
+func isBotEmail(email string) bool {
+	return strings.HasSuffix(strings.ToLower(email), "@"+botEmailDomain)
+}
+
+type APIToken struct {
+	Id         int      `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	// Only returned when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+// authenticateAPIToken returns the principal of a bot's API token, or
+// sql.ErrNoRows if the token is unknown, revoked or its bot deleted.
+func authenticateAPIToken(store Store, token string) (*Principal, error) {
+	return store.APITokenPrincipal(hashToken(token))
+}
+
+func createBot(store Store, ownerId int, handle, displayName, avatar string) error {
+	count, err := store.CountBots(ownerId)
+	if err != nil {
+		return err
+	}
+	if count >= maxBotsPerUser {
+		return fmt.Errorf("you can have at most %d bots", maxBotsPerUser)
+	}
+
+	err = store.CreateBot(ownerId, handle, displayName, avatar)
+	if err == errHandleTaken {
+		return fmt.Errorf("handle %q is already taken", handle)
+	}
+	return err
+}
+
+func createAPIToken(store Store, botId int, name string, scopes []string) (*APIToken, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	token := apiTokenPrefix + secret
+
+	created, err := store.CreateAPIToken(botId, name, scopes, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	created.Token = token
+	return created, nil
+}
+
+// ownedBotFromRequest resolves the {handle} path value to a bot of the
+// signed in user, writing the error response if there is none.
+func ownedBotFromRequest(store Store, w http.ResponseWriter, r *http.Request) (int, bool) {
+	principal, _ := principalFromContext(r.Context())
+	ownerId, err := store.UserIdByEmail(principal.Email)
+	if err != nil {
+		http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	botId, err := store.OwnedBotId(ownerId, r.PathValue("handle"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to get bot: "+err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return botId, true
+}
+
+func handleGetBots(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+		ownerId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bots, err := store.OwnedBots(ownerId)
+		if err != nil {
+			http.Error(w, "Failed to get bots: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(bots)
+		if err != nil {
+			http.Error(w, "Failed to encode bots: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleCreateBot(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request Profile
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Handle = strings.ToLower(strings.TrimSpace(request.Handle))
+		request.DisplayName = strings.TrimSpace(request.DisplayName)
+		if err := validateProfile(&request); err != nil {
+			http.Error(w, "Invalid bot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		principal, _ := principalFromContext(r.Context())
+		ownerId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := createBot(store, ownerId, request.Handle, request.DisplayName, request.Avatar); err != nil {
+			http.Error(w, "Failed to create bot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Bot %s created by %s", request.Handle, principal.Email)
+
+		bot, err := store.ProfileByHandle(request.Handle)
+		if err != nil {
+			http.Error(w, "Failed to get bot: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(bot)
+		if err != nil {
+			http.Error(w, "Failed to encode bot: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleDeleteBot(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		botId, ok := ownedBotFromRequest(store, w, r)
+		if !ok {
+			return
+		}
+		if err := store.DeleteBot(botId); err != nil {
+			http.Error(w, "Failed to delete bot: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		manager.DisconnectUser(botId, "This bot has been deleted.")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleGetBotTokens(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		botId, ok := ownedBotFromRequest(store, w, r)
+		if !ok {
+			return
+		}
+		tokens, err := store.APITokens(botId)
+		if err != nil {
+			http.Error(w, "Failed to get tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(tokens)
+		if err != nil {
+			http.Error(w, "Failed to encode tokens: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleCreateBotToken(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		botId, ok := ownedBotFromRequest(store, w, r)
+		if !ok {
+			return
+		}
+		var request struct {
+			Name   string   `json:"name"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" || len(request.Name) > 100 {
+			http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+			return
+		}
+		if len(request.Scopes) == 0 {
+			http.Error(w, "At least one scope is required: "+strings.Join(apiTokenScopes, ", "), http.StatusBadRequest)
+			return
+		}
+		for _, scope := range request.Scopes {
+			if !slices.Contains(apiTokenScopes, scope) {
+				http.Error(w, "Unknown scope "+scope+", expected one of "+strings.Join(apiTokenScopes, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+
+		token, err := createAPIToken(store, botId, request.Name, slices.Compact(slices.Sorted(slices.Values(request.Scopes))))
+		if err != nil {
+			http.Error(w, "Failed to create token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(token)
+		if err != nil {
+			http.Error(w, "Failed to encode token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleRevokeBotToken(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		botId, ok := ownedBotFromRequest(store, w, r)
+		if !ok {
+			return
+		}
+		tokenId, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		revoked, err := store.RevokeAPIToken(botId, tokenId)
+		if err != nil {
+			http.Error(w, "Failed to revoke token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.NotFound(w, r)
+			return
+		}
+		manager.DisconnectToken(tokenId, "The token of this connection has been revoked.")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
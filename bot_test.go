@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBotTokens(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	manager := newTestNode(t, store, NewMemoryBroker())
+
+	whoami := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+		fmt.Fprint(w, principal.Email)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/me/bots", authMiddleware(store, handleGetBots(store)))
+	mux.Handle("POST /api/me/bots", authMiddleware(store, handleCreateBot(store)))
+	mux.Handle("POST /api/me/bots/{handle}/tokens", authMiddleware(store, handleCreateBotToken(store)))
+	mux.Handle("DELETE /api/me/bots/{handle}/tokens/{id}", authMiddleware(store, handleRevokeBotToken(store, manager)))
+	mux.Handle("/api/ws", tokenAuth(store, ScopeReadRooms, handleWebSocket(manager)))
+	mux.Handle("GET /read", tokenAuth(store, ScopeReadRooms, whoami))
+	mux.Handle("GET /manage", tokenAuth(store, ScopeManageRooms, whoami))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method, path, token, body string) (int, string) {
+		t.Helper()
+		r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	alice, bob := testToken(t, "alice@example.com"), testToken(t, "bob@example.com")
+
+	if code, body := request("POST", "/api/me/bots", alice, `{"handle": "Deploy", "display_name": "Deploy"}`); code != http.StatusCreated {
+		t.Fatalf("creating a bot: %d %s", code, body)
+	}
+	invalid := []string{`{"handle": "deploy"}`, `{"handle": "alice"}`, `{"handle": "x"}`}
+	for _, bot := range invalid {
+		if code, _ := request("POST", "/api/me/bots", alice, bot); code != http.StatusBadRequest {
+			t.Errorf("creating bot %s: %d, want %d", bot, code, http.StatusBadRequest)
+		}
+	}
+	var bots []Profile
+	if _, body := request("GET", "/api/me/bots", alice, ""); json.Unmarshal([]byte(body), &bots) != nil || len(bots) != 1 || bots[0].Handle != "deploy" || !bots[0].Bot {
+		t.Errorf("bots of alice: %s", body)
+	}
+
+	tokenRequests := []struct {
+		token, body string
+		want        int
+	}{
+		{bob, `{"name": "ci", "scopes": ["rooms:read"]}`, http.StatusNotFound},
+		{alice, `{"name": "ci", "scopes": []}`, http.StatusBadRequest},
+		{alice, `{"name": "ci", "scopes": ["rooms:delete"]}`, http.StatusBadRequest},
+		{alice, `{"name": "", "scopes": ["rooms:read"]}`, http.StatusBadRequest},
+	}
+	for _, test := range tokenRequests {
+		if code, _ := request("POST", "/api/me/bots/deploy/tokens", test.token, test.body); code != test.want {
+			t.Errorf("creating token %s: %d, want %d", test.body, code, test.want)
+		}
+	}
+	code, body := request("POST", "/api/me/bots/deploy/tokens", alice, `{"name": "ci", "scopes": ["rooms:read", "messages:write", "rooms:read"]}`)
+	var token APIToken
+	if code != http.StatusCreated || json.Unmarshal([]byte(body), &token) != nil {
+		t.Fatalf("creating a token: %d %s", code, body)
+	}
+	if !strings.HasPrefix(token.Token, apiTokenPrefix) || !slices.Equal(token.Scopes, []string{ScopePostMessages, ScopeReadRooms}) {
+		t.Errorf("created token: %+v", token)
+	}
+
+	// The token is good for the scopes it carries, and only on the routes
+	// open to bots
+	if code, body := request("GET", "/read", token.Token, ""); code != http.StatusOK || body != botEmail("deploy") {
+		t.Errorf("route in scope: %d %s", code, body)
+	}
+	if code, _ := request("GET", "/manage", token.Token, ""); code != http.StatusForbidden {
+		t.Errorf("route out of scope: %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ := request("GET", "/api/me/bots", token.Token, ""); code != http.StatusUnauthorized {
+		t.Errorf("user route with an API token: %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Revoking the token closes the connections made with it
+	header := http.Header{"Authorization": {"Bearer " + token.Token}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	var joined Message
+	if err := ws.ReadJSON(&joined); err != nil || joined.Room.Name != "general" {
+		t.Fatalf("joining: %+v, %v", joined, err)
+	}
+
+	path := fmt.Sprintf("/api/me/bots/deploy/tokens/%d", token.Id)
+	if code, _ := request("DELETE", path, bob, ""); code != http.StatusNotFound {
+		t.Errorf("bob revoked alice's token: %d", code)
+	}
+	if code, body := request("DELETE", path, alice, ""); code != http.StatusNoContent {
+		t.Fatalf("revoking: %d %s", code, body)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var notice Message
+	for notice.Content != "The token of this connection has been revoked." {
+		if err := ws.ReadJSON(&notice); err != nil {
+			t.Fatalf("no notice before the connection closed: %v", err)
+		}
+	}
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Errorf("the connection is still open after revoking its token")
+	}
+	if code, _ := request("GET", "/read", token.Token, ""); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := request("DELETE", path, alice, ""); code != http.StatusNotFound {
+		t.Errorf("revoking twice: %d, want %d", code, http.StatusNotFound)
+	}
+}
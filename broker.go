@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Kinds of ClusterEvent
+const (
+	ClusterRoomMessage = "room_message"
+	ClusterDirect      = "direct"
+	ClusterModerators  = "moderators"
+	ClusterSlowMode    = "slow_mode"
+	ClusterFilters     = "filters"
+	ClusterProfile     = "profile"
+	ClusterIgnored     = "ignored"
+	ClusterMute        = "mute"
+	ClusterDisconnect  = "disconnect"
+	ClusterPresence    = "presence"
+)
+
+// ClusterEvent is something every node applies to the clients connected to
+// it, like a message for a room. Which fields are set depends on the kind.
+type ClusterEvent struct {
+	Kind string `json:"kind"`
+	// Node that published the event
+	Node    string   `json:"node"`
+	Room    string   `json:"room,omitempty"`
+	RoomId  int      `json:"room_id,omitempty"`
+	Message *Message `json:"message,omitempty"`
+	// Message.SenderId isn't part of the message's JSON
+	SenderId int `json:"sender_id,omitempty"`
+	// E-mail of a user not to deliver to, like the one who is typing
+	Exclude string `json:"exclude,omitempty"`
+	// Handle or e-mail the event is for, depending on the kind
+	Target    string    `json:"target,omitempty"`
+	UserId    int       `json:"user_id,omitempty"`
+	TokenId   int       `json:"token_id,omitempty"`
+	IgnoredId int       `json:"ignored_id,omitempty"`
+	Ignored   bool      `json:"ignored,omitempty"`
+	Seconds   int       `json:"seconds,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+	Profile   *Profile  `json:"profile,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// Users connected to the node, by handle
+	Users map[string]int `json:"users,omitempty"`
+}
+
+// Broker carries ClusterEvents between the nodes serving the chat, so that
+// several replicas can run behind a load balancer.
+type Broker interface {
+	// Publish sends an event to every node, this one included.
+	Publish(event ClusterEvent) error
+	// Subscribe registers a handler for the events of all nodes. Handlers
+	// are called one event at a time.
+	Subscribe(handler func(ClusterEvent))
+	Close() error
+}
+
+func newBroker(cfg BrokerConfig) (Broker, error) {
+	switch cfg.Driver {
+	case "memory":
+		return NewMemoryBroker(), nil
+	case "redis":
+		return NewRedisBroker(cfg)
+	default:
+		return nil, fmt.Errorf("unknown broker driver %q", cfg.Driver)
+	}
+}
+
+// MemoryBroker delivers events within the process, for a single node.
+// Handlers run before Publish returns.
+type MemoryBroker struct {
+	lock     sync.Mutex
+	handlers []func(ClusterEvent)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{}
+}
+
+func (b *MemoryBroker) Publish(event ClusterEvent) error {
+	b.lock.Lock()
+	handlers := b.handlers
+	b.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(handler func(ClusterEvent)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
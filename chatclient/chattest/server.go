@@ -0,0 +1,490 @@
+// Package chattest runs an in-process chat server for testing code built on
+// chatclient, much like net/http/httptest:
+//
+//	server := chattest.NewServer()
+//	defer server.Close()
+//	server.AddUser("ada@example.com", "password", "ada", "Ada")
+//	client := chatclient.New(server.URL)
+//
+// It speaks the same protocol as the real server for signing in, the REST
+// calls of chatclient and regular, direct, typing and join messages, and
+// keeps everything in memory. Moderation, filters, rate limits and the
+// other commands are left out.
+package chattest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-app/chatclient"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Server is a chat server listening on a local address.
+type Server struct {
+	// Base URL of the server, for chatclient.New
+	URL string
+
+	http     *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock     sync.Mutex
+	users    map[string]*user // by e-mail
+	tokens   map[string]*user
+	rooms    []*chatclient.Room
+	messages map[int][]chatclient.Message
+	conns    map[*conn]bool
+}
+
+type user struct {
+	email    string
+	password string
+	profile  chatclient.Profile
+}
+
+type conn struct {
+	ws        *websocket.Conn
+	user      *user
+	room      *chatclient.Room
+	writeLock sync.Mutex
+}
+
+func (c *conn) write(message chatclient.Message) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.ws.WriteJSON(message)
+}
+
+// NewServer starts a server with one room, general. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		users:    make(map[string]*user),
+		tokens:   make(map[string]*user),
+		rooms:    []*chatclient.Room{{Id: 1, Name: "general", CreatedAt: now()}},
+		messages: make(map[int][]chatclient.Message),
+		conns:    make(map[*conn]bool),
+		upgrader: websocket.Upgrader{Subprotocols: []string{"bearer"}},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/register", s.handleRegister)
+	mux.HandleFunc("POST /api/login", s.handleLogin)
+	mux.HandleFunc("/api/ws", s.auth(s.handleWebSocket))
+	mux.HandleFunc("GET /api/me", s.auth(s.handleGetMe))
+	mux.HandleFunc("GET /api/users", s.auth(s.handleGetUsers))
+	mux.HandleFunc("GET /api/users/{handle}", s.auth(s.handleGetUser))
+	mux.HandleFunc("GET /api/online-users", s.auth(s.handleGetOnlineUsers))
+	mux.HandleFunc("GET /api/rooms", s.auth(s.handleGetRooms))
+	mux.HandleFunc("GET /api/messages", s.auth(s.handleGetMessages))
+	mux.HandleFunc("PATCH /api/messages/{id}", s.auth(s.handleEditMessage))
+
+	s.http = httptest.NewServer(mux)
+	s.URL = s.http.URL
+	return s
+}
+
+// Close disconnects all clients and stops the server.
+func (s *Server) Close() {
+	s.DropConnections()
+	s.http.Close()
+}
+
+// AddUser creates an account that can sign in right away.
+func (s *Server) AddUser(email, password, handle, displayName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.users[email] = &user{
+		email:    email,
+		password: password,
+		profile:  chatclient.Profile{Handle: handle, DisplayName: displayName},
+	}
+}
+
+// AddBot creates a bot account that uses the given token, like an API
+// token of the real server.
+func (s *Server) AddBot(handle, displayName, token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	bot := &user{
+		email:   handle + "@bots.invalid",
+		profile: chatclient.Profile{Handle: handle, DisplayName: displayName, Bot: true},
+	}
+	s.users[bot.email] = bot
+	s.tokens[token] = bot
+}
+
+// Broadcast sends a message to everyone in a room, as if an integration had
+// posted it. The room is created if needed; missing ids and timestamps are
+// filled in.
+func (s *Server) Broadcast(roomName string, message chatclient.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.broadcastLocked(s.roomLocked(roomName), message)
+}
+
+// Messages returns the regular messages sent to a room so far.
+func (s *Server) Messages(roomName string) []chatclient.Message {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, room := range s.rooms {
+		if room.Name == roomName {
+			return append([]chatclient.Message(nil), s.messages[room.Id]...)
+		}
+	}
+	return nil
+}
+
+// DropConnections closes all WebSocket connections, e.g. to test that
+// clients reconnect.
+func (s *Server) DropConnections() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for c := range s.conns {
+		c.ws.Close()
+	}
+}
+
+func now() string {
+	return time.Now().Format(time.RFC3339)
+}
+
+func systemMessage(content string, room *chatclient.Room) chatclient.Message {
+	message := chatclient.Message{Type: chatclient.SystemMessage, Content: content, Sender: "system", Id: uuid.New().String(), Timestamp: now()}
+	if room != nil {
+		message.Room = *room
+	}
+	return message
+}
+
+// roomLocked returns the room with the given name, creating it if needed.
+func (s *Server) roomLocked(name string) *chatclient.Room {
+	for _, room := range s.rooms {
+		if room.Name == name {
+			return room
+		}
+	}
+	room := &chatclient.Room{Id: len(s.rooms) + 1, Name: name, CreatedAt: now()}
+	s.rooms = append(s.rooms, room)
+	return room
+}
+
+func (s *Server) broadcastLocked(room *chatclient.Room, message chatclient.Message) {
+	if message.Id == "" {
+		message.Id = uuid.New().String()
+	}
+	if message.Timestamp == "" {
+		message.Timestamp = now()
+	}
+	message.Room = *room
+	if message.Type == chatclient.RegularMessage {
+		s.messages[room.Id] = append(s.messages[room.Id], message)
+	}
+	for c := range s.conns {
+		if c.room == room {
+			c.write(message)
+		}
+	}
+}
+
+// auth answers 401 unless the request carries a token given out by login
+// or AddBot, the same ways the real server accepts them.
+func (s *Server) auth(next func(http.ResponseWriter, *http.Request, *user)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if header := r.Header.Get("Authorization"); header != "" {
+			token = strings.TrimPrefix(header, "Bearer ")
+		} else if protocols := websocket.Subprotocols(r); len(protocols) == 2 && protocols[0] == "bearer" {
+			token = protocols[1]
+		} else {
+			token = r.URL.Query().Get("token")
+		}
+
+		s.lock.Lock()
+		u := s.tokens[token]
+		s.lock.Unlock()
+		if u == nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r, u)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email       string `json:"email"`
+		Password    string `json:"password"`
+		Handle      string `json:"handle"`
+		DisplayName string `json:"display_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Email == "" || request.Password == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Handle == "" {
+		request.Handle, _, _ = strings.Cut(request.Email, "@")
+	}
+
+	s.lock.Lock()
+	_, exists := s.users[request.Email]
+	s.lock.Unlock()
+	if exists {
+		http.Error(w, "Registration failed: user already exists", http.StatusBadRequest)
+		return
+	}
+	s.AddUser(request.Email, request.Password, request.Handle, request.DisplayName)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	u := s.users[request.Email]
+	if u == nil || u.password == "" || u.password != request.Password {
+		http.Error(w, "Invalid e-mail or password", http.StatusUnauthorized)
+		return
+	}
+	token := uuid.New().String()
+	s.tokens[token] = u
+	writeJSON(w, http.StatusOK, map[string]string{"token": token})
+}
+
+func (s *Server) handleGetMe(w http.ResponseWriter, r *http.Request, u *user) {
+	writeJSON(w, http.StatusOK, chatclient.Me{Email: u.email, Profile: u.profile})
+}
+
+func (s *Server) handleGetUsers(w http.ResponseWriter, r *http.Request, _ *user) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	users := make([]chatclient.Profile, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u.profile)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Handle < users[j].Handle })
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request, _ *user) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, u := range s.users {
+		if u.profile.Handle == r.PathValue("handle") {
+			writeJSON(w, http.StatusOK, u.profile)
+			return
+		}
+	}
+	http.Error(w, "User not found", http.StatusNotFound)
+}
+
+func (s *Server) handleGetOnlineUsers(w http.ResponseWriter, r *http.Request, _ *user) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	seen := make(map[string]bool)
+	handles := make([]string, 0, len(s.conns))
+	for c := range s.conns {
+		if !seen[c.user.profile.Handle] {
+			seen[c.user.profile.Handle] = true
+			handles = append(handles, c.user.profile.Handle)
+		}
+	}
+	sort.Strings(handles)
+	writeJSON(w, http.StatusOK, handles)
+}
+
+func (s *Server) handleGetRooms(w http.ResponseWriter, r *http.Request, _ *user) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writeJSON(w, http.StatusOK, s.rooms)
+}
+
+func (s *Server) handleGetMessages(w http.ResponseWriter, r *http.Request, _ *user) {
+	roomId, err := strconv.Atoi(r.URL.Query().Get("roomId"))
+	if err != nil {
+		http.Error(w, "Invalid roomId", http.StatusBadRequest)
+		return
+	}
+	sender := r.URL.Query().Get("sender")
+	before := r.URL.Query().Get("before")
+	limit := 0
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages := make([]chatclient.Message, 0)
+	for _, message := range s.messages[roomId] {
+		if message.Id == before {
+			break
+		}
+		if sender == "" || message.Sender == sender {
+			messages = append(messages, message)
+		}
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
+
+func (s *Server) handleEditMessage(w http.ResponseWriter, r *http.Request, u *user) {
+	var request struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, room := range s.rooms {
+		for i, message := range s.messages[room.Id] {
+			if message.Id != r.PathValue("id") || message.Sender != u.profile.Handle {
+				continue
+			}
+			message.Content = request.Content
+			message.EditedAt = now()
+			s.messages[room.Id][i] = message
+
+			edited := message
+			edited.Type = chatclient.EditedMessage
+			s.broadcastLocked(room, edited)
+			writeJSON(w, http.StatusOK, message)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, u *user) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	c := &conn{ws: ws, user: u}
+	s.lock.Lock()
+	c.room = s.roomLocked("general")
+	s.conns[c] = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, c)
+		s.lock.Unlock()
+	}()
+
+	c.write(systemMessage("You have joined the room: general", c.room))
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var message chatclient.Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			message.Type = chatclient.InvalidMessage
+		}
+		s.handleClientMessage(c, message)
+	}
+}
+
+func (s *Server) handleClientMessage(c *conn, message chatclient.Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sender := c.user.profile
+	switch message.Type {
+	case chatclient.RegularMessage:
+		if message.Content == "" && len(message.Attachments) == 0 {
+			c.write(systemMessage("Chat message cannot be empty.", nil))
+			return
+		}
+		s.broadcastLocked(c.room, chatclient.Message{
+			Type:        chatclient.RegularMessage,
+			Content:     message.Content,
+			Sender:      sender.Handle,
+			SenderName:  sender.DisplayName,
+			Bot:         sender.Bot,
+			Attachments: message.Attachments,
+		})
+	case chatclient.DirectMessage:
+		found := false
+		for other := range s.conns {
+			if other.user.profile.Handle == message.Target {
+				other.write(chatclient.Message{
+					Type:       chatclient.DirectMessage,
+					Content:    message.Content,
+					Sender:     sender.Handle,
+					SenderName: sender.DisplayName,
+					Bot:        sender.Bot,
+					Id:         uuid.New().String(),
+					Timestamp:  now(),
+				})
+				found = true
+			}
+		}
+		if !found {
+			c.write(systemMessage(fmt.Sprintf("User %s not found.", message.Target), nil))
+		}
+	case chatclient.TypingMessage:
+		content := "stopped typing"
+		if message.Content == "true" {
+			content = "is typing..."
+		}
+		for other := range s.conns {
+			if other.room == c.room && other.user != c.user {
+				other.write(chatclient.Message{
+					Type:       chatclient.TypingMessage,
+					Content:    content,
+					Sender:     sender.Handle,
+					SenderName: sender.DisplayName,
+					Id:         uuid.New().String(),
+					Room:       *c.room,
+					Timestamp:  now(),
+				})
+			}
+		}
+	case chatclient.CommandMessage:
+		name, arg, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(message.Content), "/"), " ")
+		arg = strings.TrimSpace(arg)
+		switch {
+		case name == "join" && arg != "":
+			c.room = s.roomLocked(arg)
+			c.write(systemMessage("You have joined the room: "+c.room.Name, c.room))
+		case name == "join":
+			c.write(systemMessage("Invalid /join: missing room. Usage: /join <room>", nil))
+		default:
+			c.write(systemMessage(fmt.Sprintf("Unknown command /%s. Use /help for a list of commands.", name), nil))
+		}
+	default:
+		c.write(systemMessage("Invalid message format. Ensure your message is valid JSON.", nil))
+	}
+}
@@ -0,0 +1,210 @@
+package chatclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTOTPRequired is returned by Login for accounts with two-factor
+// authentication; sign in again with LoginTOTP.
+var ErrTOTPRequired = errors.New("chatclient: a two-factor code is required")
+
+// APIError is returned when the server answers with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+	// Set on 429 responses
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chatclient: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client talks to one chat server. Token is the bearer token sent with
+// every request: Login sets it, bots set it to their API token.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New creates a client for the server at baseURL, e.g.
+// "https://chat.example.com".
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a JSON request and decodes the JSON answer into out, if given.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return newAPIError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// Register creates an account. Depending on the server, the e-mail address
+// has to be verified before signing in.
+func (c *Client) Register(ctx context.Context, email, password, handle, displayName string) error {
+	request := map[string]string{
+		"email":        email,
+		"password":     password,
+		"handle":       handle,
+		"display_name": displayName,
+	}
+	return c.do(ctx, http.MethodPost, "/api/register", request, nil)
+}
+
+// Login signs in with an e-mail address and password and keeps the token
+// for the following requests.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	return c.LoginTOTP(ctx, email, password, "")
+}
+
+// LoginTOTP signs in to an account with two-factor authentication, with a
+// code from the authenticator app or a recovery code.
+func (c *Client) LoginTOTP(ctx context.Context, email, password, code string) error {
+	request := map[string]string{"email": email, "password": password}
+	if len(code) == 6 {
+		request["totp_code"] = code
+	} else if code != "" {
+		request["recovery_code"] = code
+	}
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/login", request, &response)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized && strings.Contains(apiErr.Message, `"totp_required"`) {
+		return ErrTOTPRequired
+	}
+	if err != nil {
+		return err
+	}
+	c.Token = response.Token
+	return nil
+}
+
+// Me returns the signed in user.
+func (c *Client) Me(ctx context.Context) (*Me, error) {
+	var me Me
+	if err := c.do(ctx, http.MethodGet, "/api/me", nil, &me); err != nil {
+		return nil, err
+	}
+	return &me, nil
+}
+
+// Users lists all users.
+func (c *Client) Users(ctx context.Context) ([]Profile, error) {
+	var users []Profile
+	err := c.do(ctx, http.MethodGet, "/api/users", nil, &users)
+	return users, err
+}
+
+// User returns the profile of the user with the given handle.
+func (c *Client) User(ctx context.Context, handle string) (*Profile, error) {
+	var profile Profile
+	if err := c.do(ctx, http.MethodGet, "/api/users/"+url.PathEscape(handle), nil, &profile); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+// OnlineUsers lists the handles of the users who are connected.
+func (c *Client) OnlineUsers(ctx context.Context) ([]string, error) {
+	var handles []string
+	err := c.do(ctx, http.MethodGet, "/api/online-users", nil, &handles)
+	return handles, err
+}
+
+// Rooms lists all rooms.
+func (c *Client) Rooms(ctx context.Context) ([]Room, error) {
+	var rooms []Room
+	err := c.do(ctx, http.MethodGet, "/api/rooms", nil, &rooms)
+	return rooms, err
+}
+
+// Messages returns the history of a room. A non-empty sender
+// only returns the messages of that user.
+func (c *Client) Messages(ctx context.Context, roomId int, sender string) ([]Message, error) {
+	query := url.Values{"roomId": {strconv.Itoa(roomId)}}
+	if sender != "" {
+		query.Set("sender", sender)
+	}
+	var messages []Message
+	err := c.do(ctx, http.MethodGet, "/api/messages?"+query.Encode(), nil, &messages)
+	return messages, err
+}
+
+// History returns up to limit messages of a room, oldest first: the
+// latest ones, or if before is a message id the ones before it.
+func (c *Client) History(ctx context.Context, roomId int, before string, limit int) ([]Message, error) {
+	query := url.Values{"roomId": {strconv.Itoa(roomId)}, "limit": {strconv.Itoa(limit)}}
+	if before != "" {
+		query.Set("before", before)
+	}
+	var messages []Message
+	err := c.do(ctx, http.MethodGet, "/api/messages?"+query.Encode(), nil, &messages)
+	return messages, err
+}
+
+// EditMessage replaces the content of one of your own messages.
+func (c *Client) EditMessage(ctx context.Context, id, content string) (*Message, error) {
+	var message Message
+	request := map[string]string{"content": content}
+	if err := c.do(ctx, http.MethodPatch, "/api/messages/"+url.PathEscape(id), request, &message); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
@@ -0,0 +1,161 @@
+package chatclient_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/chatclient"
+	"chat-app/chatclient/chattest"
+)
+
+func TestClientREST(t *testing.T) {
+	server := chattest.NewServer()
+	defer server.Close()
+	ctx := context.Background()
+
+	client := chatclient.New(server.URL + "/")
+	if err := client.Register(ctx, "ada@example.com", "password", "ada", "Ada"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	err := client.Login(ctx, "ada@example.com", "wrong")
+	var apiErr *chatclient.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Login with a wrong password = %v, want a 401 APIError", err)
+	}
+	if _, err := client.Me(ctx); err == nil {
+		t.Errorf("Me without signing in succeeded")
+	}
+	if err := client.Login(ctx, "ada@example.com", "password"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+
+	me, err := client.Me(ctx)
+	if err != nil || me.Email != "ada@example.com" || me.Handle != "ada" || me.DisplayName != "Ada" {
+		t.Errorf("Me = %+v, %v", me, err)
+	}
+	if _, err := client.User(ctx, "nobody"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("User of an unknown handle = %v, want a 404 APIError", err)
+	}
+	rooms, err := client.Rooms(ctx)
+	if err != nil || len(rooms) != 1 || rooms[0].Name != "general" {
+		t.Fatalf("Rooms = %+v, %v", rooms, err)
+	}
+
+	server.Broadcast("general", chatclient.Message{Type: chatclient.RegularMessage, Sender: "ada", Content: "first"})
+	server.Broadcast("general", chatclient.Message{Type: chatclient.RegularMessage, Sender: "bob", Content: "second"})
+	messages, err := client.Messages(ctx, rooms[0].Id, "ada")
+	if err != nil || len(messages) != 1 || messages[0].Content != "first" {
+		t.Fatalf("Messages from ada = %+v, %v", messages, err)
+	}
+	server.Broadcast("general", chatclient.Message{Type: chatclient.RegularMessage, Sender: "bob", Content: "third"})
+	latest, err := client.History(ctx, rooms[0].Id, "", 2)
+	if err != nil || len(latest) != 2 || latest[0].Content != "second" || latest[1].Content != "third" {
+		t.Fatalf("History of the latest two = %+v, %v", latest, err)
+	}
+	earlier, err := client.History(ctx, rooms[0].Id, latest[0].Id, 2)
+	if err != nil || len(earlier) != 1 || earlier[0].Content != "first" {
+		t.Errorf("History before %q = %+v, %v", latest[0].Content, earlier, err)
+	}
+	edited, err := client.EditMessage(ctx, messages[0].Id, "first, edited")
+	if err != nil || edited.Content != "first, edited" || edited.EditedAt == "" {
+		t.Errorf("EditMessage = %+v, %v", edited, err)
+	}
+}
+
+// receive waits for the next value sent on ch.
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+		var zero T
+		return zero
+	}
+}
+
+func TestConn(t *testing.T) {
+	server := chattest.NewServer()
+	defer server.Close()
+	server.AddUser("ada@example.com", "password", "ada", "Ada")
+	server.AddBot("deploy", "Deploy", "bot-token")
+	ctx := context.Background()
+
+	ada := chatclient.New(server.URL)
+	if err := ada.Login(ctx, "ada@example.com", "password"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	messages := make(chan chatclient.Message, 10)
+	system := make(chan chatclient.Message, 10)
+	direct := make(chan chatclient.Message, 10)
+	connects := make(chan bool, 10)
+	conn, err := ada.Connect(ctx, chatclient.Handlers{
+		OnMessage: func(m chatclient.Message) { messages <- m },
+		OnSystem:  func(m chatclient.Message) { system <- m },
+		OnDirect:  func(m chatclient.Message) { direct <- m },
+		OnConnect: func() { connects <- true },
+	})
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.Close()
+	receive(t, connects, "the connection")
+	receive(t, system, "joining general")
+
+	if err := conn.Join("ops"); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+	if m := receive(t, system, "joining ops"); m.Room.Name != "ops" {
+		t.Fatalf("joined %q, want ops", m.Room.Name)
+	}
+	if err := conn.Say("hello"); err != nil {
+		t.Fatalf("Say: %v", err)
+	}
+	if m := receive(t, messages, "the message"); m.Content != "hello" || m.Sender != "ada" || m.Room.Name != "ops" {
+		t.Errorf("received %+v", m)
+	}
+
+	// A bot signs in with its token and can send direct messages
+	bot := chatclient.New(server.URL)
+	bot.Token = "bot-token"
+	botConn, err := bot.Connect(ctx, chatclient.Handlers{})
+	if err != nil {
+		t.Fatalf("Connect as a bot: %v", err)
+	}
+	defer botConn.Close()
+	if err := botConn.Direct("ada", "deployed"); err != nil {
+		t.Fatalf("Direct: %v", err)
+	}
+	if m := receive(t, direct, "the direct message"); m.Content != "deployed" || !m.Bot || m.Name() != "Deploy" {
+		t.Errorf("received direct message %+v", m)
+	}
+
+	// After the connection drops it comes back in the room it was in
+	server.DropConnections()
+	receive(t, connects, "the reconnection")
+	receive(t, system, "joining general")
+	if m := receive(t, system, "joining ops again"); m.Room.Name != "ops" {
+		t.Errorf("rejoined %q, want ops", m.Room.Name)
+	}
+
+	// Bad tokens are refused for good
+	stranger := chatclient.New(server.URL)
+	stranger.Token = "no-such-token"
+	if _, err := stranger.Connect(ctx, chatclient.Handlers{}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Connect with a bad token = %v", err)
+	}
+
+	if err := conn.Close(); err != nil || conn.Err() != nil {
+		t.Errorf("Close = %v, Err = %v", err, conn.Err())
+	}
+	select {
+	case <-conn.Done():
+	default:
+		t.Errorf("Done is open after Close")
+	}
+}
@@ -0,0 +1,314 @@
+package chatclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrNotConnected is returned when sending while the connection is down.
+var ErrNotConnected = errors.New("chatclient: not connected")
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+	pingInterval      = 30 * time.Second
+	// A connection is given up if the server doesn't answer for this long
+	readTimeout  = 2*pingInterval + 10*time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// Handlers are called for the messages received over a connection, one at
+// a time, from the goroutine reading the connection. Nil handlers are
+// skipped.
+type Handlers struct {
+	// Regular messages in the current room
+	OnMessage func(Message)
+	OnDirect  func(Message)
+	// Notices from the server, like joining a room or being rate limited
+	OnSystem func(Message)
+	OnTyping func(TypingEvent)
+	// Edited, deleted and any other messages
+	OnOther func(Message)
+
+	// OnConnect is called whenever the connection is (re)established,
+	// OnDisconnect whenever it is lost.
+	OnConnect    func()
+	OnDisconnect func(error)
+}
+
+// Conn is a WebSocket connection to the server. When it is lost it is
+// reestablished with exponential backoff, and the room joined with Join is
+// joined again. Connections refused with 401 or 403 aren't retried.
+type Conn struct {
+	client   *Client
+	handlers Handlers
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	lock sync.Mutex
+	ws   *websocket.Conn
+	room string
+	err  error
+}
+
+// Connect opens a WebSocket connection with the token of the client. The
+// first attempt has to succeed; after that the connection is kept up until
+// Close is called or ctx is done.
+func (c *Client) Connect(ctx context.Context, handlers Handlers) (*Conn, error) {
+	ws, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	conn := &Conn{
+		client:   c,
+		handlers: handlers,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		ws:       ws,
+	}
+	go conn.run(ws)
+	return conn, nil
+}
+
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	wsURL := c.BaseURL + "/api/ws"
+	if rest, ok := strings.CutPrefix(wsURL, "http"); ok {
+		wsURL = "ws" + rest
+	}
+
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+	if err != nil && resp != nil {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return ws, err
+}
+
+// run reads the connection until it is closed for good.
+func (conn *Conn) run(ws *websocket.Conn) {
+	defer close(conn.done)
+	defer conn.cancel()
+
+	for {
+		if conn.handlers.OnConnect != nil {
+			conn.handlers.OnConnect()
+		}
+		err := conn.read(ws)
+
+		conn.lock.Lock()
+		conn.ws = nil
+		conn.lock.Unlock()
+		ws.Close()
+		if conn.ctx.Err() != nil {
+			return
+		}
+		if conn.handlers.OnDisconnect != nil {
+			conn.handlers.OnDisconnect(err)
+		}
+
+		ws, err = conn.reconnect()
+		if err != nil {
+			conn.lock.Lock()
+			conn.err = err
+			conn.lock.Unlock()
+			return
+		}
+	}
+}
+
+func (conn *Conn) read(ws *websocket.Conn) error {
+	ws.SetReadDeadline(time.Now().Add(readTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+					return
+				}
+			case <-stopPing:
+				return
+			case <-conn.ctx.Done():
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil {
+			continue
+		}
+		conn.dispatch(message)
+	}
+}
+
+func (conn *Conn) dispatch(message Message) {
+	h := conn.handlers
+	switch message.Type {
+	case RegularMessage:
+		if h.OnMessage != nil {
+			h.OnMessage(message)
+		}
+	case DirectMessage:
+		if h.OnDirect != nil {
+			h.OnDirect(message)
+		}
+	case SystemMessage:
+		if h.OnSystem != nil {
+			h.OnSystem(message)
+		}
+	case TypingMessage:
+		if h.OnTyping != nil {
+			h.OnTyping(TypingEvent{
+				Sender:     message.Sender,
+				SenderName: message.SenderName,
+				Room:       message.Room,
+				Typing:     message.Content == typingContent,
+			})
+		}
+	default:
+		if h.OnOther != nil {
+			h.OnOther(message)
+		}
+	}
+}
+
+// reconnect dials until it succeeds, the connection is closed or the server
+// refuses the token.
+func (conn *Conn) reconnect() (*websocket.Conn, error) {
+	delay := minReconnectDelay
+	for {
+		// Jitter keeps clients from coming back all at once after a restart
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-conn.ctx.Done():
+			return nil, conn.ctx.Err()
+		}
+
+		ws, err := conn.client.dial(conn.ctx)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden) {
+			return nil, err
+		}
+		if err == nil {
+			conn.lock.Lock()
+			conn.ws = ws
+			room := conn.room
+			conn.lock.Unlock()
+			if room != "" {
+				conn.Command("join " + room)
+			}
+			return ws, nil
+		}
+		delay = min(2*delay, maxReconnectDelay)
+	}
+}
+
+// Send writes a message to the server.
+func (conn *Conn) Send(message Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.ws == nil {
+		return ErrNotConnected
+	}
+	conn.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Say sends a message to the current room.
+func (conn *Conn) Say(content string, attachments ...Attachment) error {
+	return conn.Send(Message{Type: RegularMessage, Content: content, Attachments: attachments})
+}
+
+// Direct sends a direct message to the user with the given handle.
+func (conn *Conn) Direct(handle, content string) error {
+	return conn.Send(Message{Type: DirectMessage, Content: content, Target: handle})
+}
+
+// Typing tells the room whether the user is typing.
+func (conn *Conn) Typing(typing bool) error {
+	content := "false"
+	if typing {
+		content = "true"
+	}
+	return conn.Send(Message{Type: TypingMessage, Content: content})
+}
+
+// Command runs a command line like "slowmode 10"; the leading slash is
+// optional. The answer arrives as a system message.
+func (conn *Conn) Command(line string) error {
+	return conn.Send(Message{Type: CommandMessage, Content: strings.TrimPrefix(line, "/")})
+}
+
+// Join switches to another room, which is joined again after reconnecting.
+func (conn *Conn) Join(room string) error {
+	conn.lock.Lock()
+	conn.room = room
+	conn.lock.Unlock()
+	return conn.Command("join " + room)
+}
+
+// Close closes the connection and stops reconnecting.
+func (conn *Conn) Close() error {
+	conn.lock.Lock()
+	if conn.ws != nil {
+		conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+	}
+	conn.lock.Unlock()
+	conn.cancel()
+	<-conn.done
+	return nil
+}
+
+// Done is closed once the connection is closed for good.
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.done
+}
+
+// Err returns why the connection was closed for good, nil while it is
+// still open or after Close.
+func (conn *Conn) Err() error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if errors.Is(conn.err, context.Canceled) {
+		return nil
+	}
+	return conn.err
+}
@@ -0,0 +1,121 @@
+// Package chatclient is a Go client for the chat server. It covers signing
+// in, the REST API and the WebSocket connection, which reconnects by itself
+// and hands incoming messages to typed callbacks.
+//
+//	client := chatclient.New("https://chat.example.com")
+//	if err := client.Login(ctx, "ada@example.com", "password"); err != nil {
+//		log.Fatal(err)
+//	}
+//	conn, err := client.Connect(ctx, chatclient.Handlers{
+//		OnMessage: func(m chatclient.Message) { fmt.Println(m.Sender+":", m.Content) },
+//	})
+//
+// Bots set Token to an API token instead of signing in.
+package chatclient
+
+import "time"
+
+// MessageType is the type field of the messages exchanged over the
+// WebSocket connection.
+type MessageType string
+
+const (
+	RegularMessage MessageType = "regular"
+	DirectMessage  MessageType = "direct"
+	InvalidMessage MessageType = "invalid"
+	CommandMessage MessageType = "command"
+	SystemMessage  MessageType = "system"
+	TypingMessage  MessageType = "typing"
+	DeletedMessage MessageType = "deleted"
+	EditedMessage  MessageType = "edited"
+	ReportMessage  MessageType = "report"
+)
+
+// Message is the envelope of everything sent over the WebSocket connection
+// and of the messages returned by the REST API.
+type Message struct {
+	Type         MessageType `json:"type"`
+	Content      string      `json:"content"`
+	Sender       string      `json:"sender"`
+	SenderName   string      `json:"sender_name,omitempty"`
+	SenderAvatar string      `json:"sender_avatar,omitempty"`
+	Bot          bool        `json:"bot,omitempty"`
+	Deleted      bool        `json:"deleted,omitempty"`
+	EditedAt     string      `json:"edited_at,omitempty"`
+	// Seconds to wait before sending again, set on rate limit notices
+	RetryAfter  int          `json:"retry_after,omitempty"`
+	Id          string       `json:"id"`
+	Room        Room         `json:"room,omitempty"`
+	Target      string       `json:"target,omitempty"`
+	Timestamp   string       `json:"timestamp,omitempty"`
+	Reactions   []Reaction   `json:"reactions,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// Time parses the timestamp of the message, the zero time if it has none.
+func (m Message) Time() time.Time {
+	t, _ := time.Parse(time.RFC3339, m.Timestamp)
+	return t
+}
+
+// Name is the name to show for the sender: the display name if set,
+// otherwise the handle.
+func (m Message) Name() string {
+	if m.SenderName != "" {
+		return m.SenderName
+	}
+	return m.Sender
+}
+
+type Reaction struct {
+	Id      string `json:"id"`
+	Content string `json:"content"`
+	Author  string `json:"author"`
+}
+
+type Attachment struct {
+	Id           string `json:"id"`
+	Filename     string `json:"filename,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+}
+
+type Room struct {
+	Id              int    `json:"id"`
+	Name            string `json:"name"`
+	CreatedAt       string `json:"created_at,omitempty"`
+	SlowModeSeconds int    `json:"slow_mode_seconds,omitempty"`
+}
+
+// Profile is the public part of a user account.
+type Profile struct {
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Avatar      string `json:"avatar,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
+}
+
+// Me is the profile of the signed in user.
+type Me struct {
+	Email string `json:"email"`
+	Profile
+}
+
+// TypingEvent tells that a user in the current room started or stopped
+// typing.
+type TypingEvent struct {
+	Sender     string
+	SenderName string
+	Room       Room
+	Typing     bool
+}
+
+// The server describes typing events in words
+const typingContent = "is typing..."
@@ -1,21 +1,72 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// ClientConn is the connection of a client, a webSocketConn for
+// WebSocket clients. Messages are written as JSON encoded Messages; gateways
+// for other protocols, like IRC, translate them.
+type ClientConn interface {
+	WriteMessage(messageType int, data []byte) error
+	Close() error
+}
+
+// webSocketConn serializes the writes to a WebSocket connection, which
+// allows one writer at a time; messages for a client are written from the
+// goroutines of every sender.
+type webSocketConn struct {
+	*websocket.Conn
+	writeLock sync.Mutex
+}
+
+func (c *webSocketConn) WriteMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
 type Client struct {
-	Email      string
-	Conn       *websocket.Conn
-	Room       *Room
-	IsTyping   bool
-	LastTyping time.Time
+	UserId      int
+	Email       string
+	Handle      string
+	DisplayName string
+	AvatarURL   string
+	Conn        ClientConn
+	Room        *Room
+	IsTyping    bool
+	LastTyping  time.Time
+	// Ids of users this client has blocked or muted
+	Ignored    map[int]bool
+	Role       string
+	MutedUntil time.Time
+	IsBot      bool
+	// Scopes of the API token a bot connected with, see Principal
+	TokenId int
+	Scopes  []string
+}
+
+// Name returns the name other users see for this client.
+func (c *Client) Name() string {
+	if c.DisplayName != "" {
+		return c.DisplayName
+	}
+	return c.Handle
+}
+
+func (c *Client) can(scope string) bool {
+	return c.TokenId == 0 || slices.Contains(c.Scopes, scope)
+}
+
+func (c *Client) ignores(userId int) bool {
+	return userId != 0 && c.Ignored[userId]
 }
 
 type ClientManager struct {
@@ -24,33 +75,109 @@ type ClientManager struct {
 	History []string
 	Rooms   map[string]*Room
 	Lock    sync.Mutex
-	Db      *sql.DB
+	Store   Store
+	Filters *ContentFilters
+	Limiter *RateLimiter
+	// Slash commands; more can be registered before the server starts
+	Commands *CommandRegistry
+	Webhooks *WebhookDispatcher
+	// Carries room traffic and other events to the clients of every node,
+	// see cluster.go
+	Broker Broker
+	NodeId string
+	// Users connected to the other nodes, by node id
+	remoteNodes      map[string]remoteNode
+	presenceInterval time.Duration
 }
 
-func NewClientManager(db *sql.DB) *ClientManager {
-	return &ClientManager{
-		Clients: make(map[string]*Client),
-		Emails:  make(map[string]bool),
-		History: make([]string, 0),
-		Rooms:   make(map[string]*Room),
-		Db:      db,
+func NewClientManager(store Store, filters *ContentFilters, limiter *RateLimiter, webhooks *WebhookDispatcher, broker Broker, presenceInterval time.Duration) *ClientManager {
+	commands := NewCommandRegistry()
+	registerBuiltinCommands(commands)
+	cm := &ClientManager{
+		Clients:          make(map[string]*Client),
+		Emails:           make(map[string]bool),
+		History:          make([]string, 0),
+		Rooms:            make(map[string]*Room),
+		Store:            store,
+		Filters:          filters,
+		Limiter:          limiter,
+		Commands:         commands,
+		Webhooks:         webhooks,
+		Broker:           broker,
+		NodeId:           generateId(),
+		remoteNodes:      make(map[string]remoteNode),
+		presenceInterval: presenceInterval,
 	}
+	filters.publish = cm.publish
+	broker.Subscribe(cm.applyClusterEvent)
+	go cm.announcePresenceEvery(presenceInterval)
+	return cm
 }
 
 func (cm *ClientManager) AddClient(id string, client *Client) {
 	cm.Lock.Lock()
-	defer cm.Lock.Unlock()
-
 	cm.Clients[id] = client
 	log.Printf("Client %s - %s added. Total clients: %d\n", client.Email, id, len(cm.Clients))
+	cm.Lock.Unlock()
+
+	cm.announcePresence()
 }
 
 func (cm *ClientManager) RemoveClient(id string) {
+	cm.Lock.Lock()
+	if client, ok := cm.Clients[id]; ok {
+		delete(cm.Clients, id)
+		cm.leaveRoomLocked(client)
+	}
+	log.Printf("Client %s removed. Total clients: %d\n", id, len(cm.Clients))
+	cm.Lock.Unlock()
+
+	cm.announcePresence()
+}
+
+// leaveRoomLocked takes a client out of its room. Rooms hold one connection
+// per user, so if the user is still in the room on another connection, that
+// one takes its place. Must be called with cm.Lock held.
+func (cm *ClientManager) leaveRoomLocked(client *Client) {
+	room := client.Room
+	if room == nil || room.Clients[client.Email] != client {
+		return
+	}
+	delete(room.Clients, client.Email)
+	for _, other := range cm.Clients {
+		if other != client && other.Email == client.Email && other.Room == room {
+			room.Clients[client.Email] = other
+			return
+		}
+	}
+	cm.Webhooks.Dispatch(*room, EventMemberLeft, nil, webhookUserOf(client))
+}
+
+// LeaveRoom takes a client out of its room without joining another.
+func (cm *ClientManager) LeaveRoom(client *Client) {
 	cm.Lock.Lock()
 	defer cm.Lock.Unlock()
 
-	delete(cm.Clients, id)
-	log.Printf("Client %s removed. Total clients: %d\n", id, len(cm.Clients))
+	cm.leaveRoomLocked(client)
+	client.Room = nil
+}
+
+// RoomClients returns the clients in a room, one per user, ordered by
+// handle.
+func (cm *ClientManager) RoomClients(roomName string) []*Client {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	room, exists := cm.Rooms[roomName]
+	if !exists {
+		return nil
+	}
+	clients := make([]*Client, 0, len(room.Clients))
+	for _, client := range room.Clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Handle < clients[j].Handle })
+	return clients
 }
 
 func (cm *ClientManager) BroadcastMessage(message []byte) {
@@ -78,6 +205,215 @@ func (cm *ClientManager) FindClientByEmail(email string) *Client {
 	return nil
 }
 
+func (cm *ClientManager) FindClientByHandle(handle string) *Client {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	handle = strings.ToLower(handle)
+	for _, client := range cm.Clients {
+		if client.Handle == handle {
+			return client
+		}
+	}
+	return nil
+}
+
+// UpdateClientProfile refreshes the name shown for every connection of the
+// user after the profile was edited.
+func (cm *ClientManager) UpdateClientProfile(email string, profile *Profile) {
+	cm.publish(ClusterEvent{Kind: ClusterProfile, Target: email, Profile: profile})
+}
+
+func (cm *ClientManager) applyProfile(email string, profile *Profile) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if client.Email == email {
+			client.Handle = profile.Handle
+			client.DisplayName = profile.DisplayName
+			client.AvatarURL = profile.AvatarURL
+		}
+	}
+}
+
+// SetIgnored updates the block list of every connection of a user.
+func (cm *ClientManager) SetIgnored(userId, ignoredId int, ignored bool) {
+	cm.publish(ClusterEvent{Kind: ClusterIgnored, UserId: userId, IgnoredId: ignoredId, Ignored: ignored})
+}
+
+func (cm *ClientManager) applyIgnored(userId, ignoredId int, ignored bool) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if client.UserId != userId {
+			continue
+		}
+		if client.Ignored == nil {
+			client.Ignored = make(map[int]bool)
+		}
+		if ignored {
+			client.Ignored[ignoredId] = true
+		} else {
+			delete(client.Ignored, ignoredId)
+		}
+	}
+}
+
+// SetMutedUntil silences every connection of a user until the given time.
+func (cm *ClientManager) SetMutedUntil(userId int, until time.Time) {
+	cm.publish(ClusterEvent{Kind: ClusterMute, UserId: userId, Until: until})
+}
+
+func (cm *ClientManager) applyMute(userId int, until time.Time) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if client.UserId == userId {
+			client.MutedUntil = until
+			if err := sendMessage(client.Conn, SystemMessage, "You have been muted until "+until.UTC().Format(time.RFC3339)+".", "system", nil); err != nil {
+				log.Printf("Error notifying client %s about mute: %v", client.Email, err)
+			}
+		}
+	}
+}
+
+// DisconnectUser closes every connection of a user after telling them why.
+func (cm *ClientManager) DisconnectUser(userId int, reason string) {
+	cm.publish(ClusterEvent{Kind: ClusterDisconnect, UserId: userId, Reason: reason})
+}
+
+// DisconnectToken closes the connections made with an API token.
+func (cm *ClientManager) DisconnectToken(tokenId int, reason string) {
+	cm.publish(ClusterEvent{Kind: ClusterDisconnect, TokenId: tokenId, Reason: reason})
+}
+
+// applyDisconnect closes the connections of a user or, if tokenId is set,
+// those made with the token.
+func (cm *ClientManager) applyDisconnect(userId, tokenId int, reason string) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if (tokenId != 0 && client.TokenId == tokenId) || (tokenId == 0 && client.UserId == userId) {
+			sendMessage(client.Conn, SystemMessage, reason, "system", nil)
+			client.Conn.Close()
+		}
+	}
+}
+
+// NotifyModerators sends a message to every connected moderator.
+func (cm *ClientManager) NotifyModerators(message Message) {
+	cm.publish(ClusterEvent{Kind: ClusterModerators, Message: &message})
+}
+
+func (cm *ClientManager) deliverToModerators(message Message) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if isModeratorRole(client.Role) {
+			if err := writeMessage(client.Conn, message); err != nil {
+				log.Printf("Error notifying moderator %s: %v", client.Email, err)
+			}
+		}
+	}
+}
+
+// SetRoomSlowMode changes the slow mode of a room and tells its members.
+func (cm *ClientManager) SetRoomSlowMode(roomName string, seconds int) {
+	cm.publish(ClusterEvent{Kind: ClusterSlowMode, Room: roomName, Seconds: seconds})
+}
+
+func (cm *ClientManager) applySlowMode(roomName string, seconds int) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	room, exists := cm.Rooms[roomName]
+	if !exists {
+		return
+	}
+	room.SlowModeSeconds = seconds
+
+	notice := "Slow mode is off."
+	if seconds > 0 {
+		notice = fmt.Sprintf("Slow mode is on: one message every %d seconds.", seconds)
+	}
+	for _, client := range room.Clients {
+		if err := sendMessage(client.Conn, SystemMessage, notice, "system", room); err != nil {
+			log.Printf("Error notifying client %s about slow mode: %v", client.Email, err)
+		}
+	}
+}
+
+// OnlineHandles returns the handles of the users connected to any node,
+// each listed once even if the user has several connections.
+func (cm *ClientManager) OnlineHandles() []string {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	seen := make(map[string]bool)
+	handles := make([]string, 0, len(cm.Clients))
+	add := func(handle string) {
+		if !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+	}
+	for _, client := range cm.Clients {
+		add(client.Handle)
+	}
+	for _, node := range cm.liveNodesLocked() {
+		for handle := range node.users {
+			add(handle)
+		}
+	}
+	sort.Strings(handles)
+	return handles
+}
+
+// FindOnlineUser returns the id of the user with the handle if they are
+// connected to any node.
+func (cm *ClientManager) FindOnlineUser(handle string) (int, bool) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	handle = strings.ToLower(handle)
+	for _, client := range cm.Clients {
+		if client.Handle == handle {
+			return client.UserId, true
+		}
+	}
+	for _, node := range cm.liveNodesLocked() {
+		if userId, ok := node.users[handle]; ok {
+			return userId, true
+		}
+	}
+	return 0, false
+}
+
+// SendDirect delivers a direct message to the user with the handle, on
+// whichever node they are connected to.
+func (cm *ClientManager) SendDirect(handle string, message Message) {
+	cm.publish(ClusterEvent{Kind: ClusterDirect, Target: strings.ToLower(handle), Message: &message, SenderId: message.SenderId})
+}
+
+func (cm *ClientManager) deliverDirect(handle string, message Message) {
+	cm.Lock.Lock()
+	defer cm.Lock.Unlock()
+
+	for _, client := range cm.Clients {
+		if client.Handle == handle {
+			if err := writeMessage(client.Conn, message); err != nil {
+				log.Printf("Error sending direct message to client %s: %v", client.Email, err)
+			}
+			return
+		}
+	}
+}
+
 func (cm *ClientManager) GetOrCreateRoom(roomName string) *Room {
 	cm.Lock.Lock()
 	defer cm.Lock.Unlock()
@@ -101,19 +437,24 @@ func (cm *ClientManager) GetOrCreateRoom(roomName string) *Room {
 
 func (cm *ClientManager) JoinRoom(roomName string, client *Client) (*Room, error) {
 	log.Printf("Attempting to join room: %s for client: %s", roomName, client.Email)
-	dbRoom, err := getRoomByName(cm.Db, roomName)
+	dbRoom, err := cm.Store.RoomByName(roomName)
 	if err != nil {
 		return nil, fmt.Errorf("error getting room from database %s: %v", roomName, err)
 	}
 
 	if dbRoom == nil {
-		newRoom, err := createRoom(cm.Db, roomName)
+		newRoom, err := cm.Store.CreateRoom(roomName)
 		if err != nil {
 			return nil, fmt.Errorf("error creating room %s: %v", roomName, err)
 		}
 		dbRoom = newRoom
 	}
 
+	if err := cm.Store.AddRoomMember(dbRoom.Id, client.UserId); err != nil {
+		return nil, fmt.Errorf("error adding member to room %s: %v", roomName, err)
+	}
+
+	cm.Lock.Lock()
 	room, exists := cm.Rooms[roomName]
 	if !exists {
 		room = &Room{
@@ -123,42 +464,68 @@ func (cm *ClientManager) JoinRoom(roomName string, client *Client) (*Room, error
 		}
 	}
 
-	cm.Lock.Lock()
-	defer cm.Lock.Unlock()
-
+	room.Id = dbRoom.Id
+	room.SlowModeSeconds = dbRoom.SlowModeSeconds
 	cm.Rooms[roomName] = room
+	if client.Room != room {
+		cm.leaveRoomLocked(client)
+	}
+	if _, present := room.Clients[client.Email]; !present {
+		cm.Webhooks.Dispatch(*room, EventMemberJoined, nil, webhookUserOf(client))
+	}
 	room.Clients[client.Email] = client
 	client.Room = room
+	notice := newMessage(SystemMessage, fmt.Sprintf("%s has joined the room.", client.Name()), "system", room)
+	cm.Lock.Unlock()
 
-	// Notify other room members
-	for email, roomClient := range room.Clients {
-		if email != client.Email { // Don't notify the client who just joined
-			if err := sendMessage(roomClient.Conn, SystemMessage, fmt.Sprintf("%s has joined the room.", client.Email), "system", room); err != nil {
-				log.Printf("Error notifying client %s about join: %v\n", email, err)
-			}
-		}
-	}
+	// Notify other room members, on every node
+	cm.publish(ClusterEvent{Kind: ClusterRoomMessage, Room: roomName, Message: &notice, SenderId: client.UserId, Exclude: client.Email})
 
 	log.Printf("Successfully joined room %s", roomName)
 	return room, nil
 }
 
-func (cm *ClientManager) BroadcastMessageToRoom(roomName string, message []byte, user string) {
+// BroadcastMessageToRoom sends a message to everyone in the room. A nil
+// sender marks it as a system message.
+func (cm *ClientManager) BroadcastMessageToRoom(roomName string, message []byte, sender *Client) {
+	msg := newMessage(RegularMessage, string(message), "system", nil)
+	if sender != nil {
+		msg = newMessageFrom(RegularMessage, string(message), sender, nil)
+	}
+	cm.BroadcastToRoom(roomName, msg)
+}
+
+// BroadcastToRoom sends a prepared message to everyone in the room, so all
+// members see the same message id.
+func (cm *ClientManager) BroadcastToRoom(roomName string, message Message) {
+	log.Printf("Broadcasting message to room %s: %s", roomName, message.Content)
+	cm.publish(ClusterEvent{Kind: ClusterRoomMessage, Room: roomName, Message: &message, SenderId: message.SenderId})
+}
+
+// deliverToRoom writes a room message to the members connected to this
+// node, except for the user with the excluded e-mail address and those
+// ignoring the sender.
+func (cm *ClientManager) deliverToRoom(roomName string, message Message, exclude string) {
 	cm.Lock.Lock()
 	defer cm.Lock.Unlock()
 
-	log.Printf("Broadcasting message to room %s: %s", roomName, string(message))
-
+	// Nobody on this node has joined the room
 	room, exists := cm.Rooms[roomName]
 	if !exists {
-		log.Printf("Room %s does not exist", roomName)
 		return
 	}
 
-	room.History = append(room.History, string(message))
+	// Notices about a member, like typing, aren't history
+	if exclude == "" {
+		room.History = append(room.History, message.Content)
+	}
+	message.Room = Room{Id: room.Id, Name: room.Name}
 
-	for _, client := range room.Clients {
-		if err := sendMessage(client.Conn, RegularMessage, string(message), user, room); err != nil {
+	for email, client := range room.Clients {
+		if email == exclude || client.ignores(message.SenderId) {
+			continue
+		}
+		if err := writeMessage(client.Conn, message); err != nil {
 			log.Printf("Error sending message to client %s: %v\n", client.Email, err)
 		}
 	}
@@ -166,9 +533,8 @@ func (cm *ClientManager) BroadcastMessageToRoom(roomName string, message []byte,
 
 func (cm *ClientManager) UpdateClientTypingStatus(client *Client, isTyping bool) {
 	cm.Lock.Lock()
-	defer cm.Lock.Unlock()
-
 	if client.IsTyping == isTyping {
+		cm.Lock.Unlock()
 		return
 	}
 
@@ -176,41 +542,18 @@ func (cm *ClientManager) UpdateClientTypingStatus(client *Client, isTyping bool)
 	client.LastTyping = time.Now()
 
 	// Don't broadcast if clien is not in room
-	if client.Room == nil {
+	room := client.Room
+	if room == nil {
+		cm.Lock.Unlock()
 		return
 	}
-
-	// Broadcast typing status to other users in the same room
-	for _, roomClient := range client.Room.Clients {
-		// Don't send to yourself
-		if roomClient != client {
-			typingMessage := Message{
-				Type:      TypingMessage,
-				Content:   "",
-				Sender:    client.Email,
-				Id:        generateId(),
-				Timestamp: time.Now().Format(time.RFC3339),
-				Room: Room{
-					Id:   client.Room.Id,
-					Name: client.Room.Name,
-				},
-			}
-
-			if isTyping {
-				typingMessage.Content = "is typing..."
-			} else {
-				typingMessage.Content = "stopped typing"
-			}
-
-			msgBytes, err := json.Marshal(typingMessage)
-			if err != nil {
-				log.Printf("Error marshalling typing message: %v\n", err)
-				continue
-			}
-
-			if err := roomClient.Conn.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
-				log.Printf("Error sending typing message: %v", err)
-			}
-		}
+	typingMessage := newMessageFrom(TypingMessage, "stopped typing", client, room)
+	cm.Lock.Unlock()
+	if isTyping {
+		typingMessage.Content = "is typing..."
 	}
+
+	// Broadcast typing status to other users in the same room; not to
+	// yourself or to users who blocked you
+	cm.publish(ClusterEvent{Kind: ClusterRoomMessage, Room: room.Name, Message: &typingMessage, SenderId: client.UserId, Exclude: client.Email})
 }
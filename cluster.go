@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Several nodes can serve the chat at once. Whatever has to reach clients
+// on other nodes, like a message for a room, is published to the Broker as
+// a ClusterEvent and every node, the publishing one included, applies it to
+// its own clients. Each node also announces the users connected to it, so
+// online lists and direct messages span the cluster.
+
+// remoteNode is what another node last announced.
+type remoteNode struct {
+	users   map[string]int
+	expires time.Time
+}
+
+// publish sends an event to every node. Should the broker fail, the event
+// is still applied here, so that at least the users of this node see it.
+// Must not be called with cm.Lock held, as the memory broker applies events
+// before returning.
+func (cm *ClientManager) publish(event ClusterEvent) {
+	event.Node = cm.NodeId
+	if err := cm.Broker.Publish(event); err != nil {
+		log.Printf("Error publishing %s event: %v", event.Kind, err)
+		cm.applyClusterEvent(event)
+	}
+}
+
+func (cm *ClientManager) applyClusterEvent(event ClusterEvent) {
+	if event.Message != nil {
+		event.Message.SenderId = event.SenderId
+	}
+
+	switch event.Kind {
+	case ClusterRoomMessage:
+		cm.deliverToRoom(event.Room, *event.Message, event.Exclude)
+	case ClusterDirect:
+		cm.deliverDirect(event.Target, *event.Message)
+	case ClusterModerators:
+		cm.deliverToModerators(*event.Message)
+	case ClusterSlowMode:
+		cm.applySlowMode(event.Room, event.Seconds)
+	case ClusterFilters:
+		cm.Filters.forget(event.RoomId)
+	case ClusterProfile:
+		cm.applyProfile(event.Target, event.Profile)
+		// The handle may have changed
+		if event.Node == cm.NodeId {
+			cm.announcePresence()
+		}
+	case ClusterIgnored:
+		cm.applyIgnored(event.UserId, event.IgnoredId, event.Ignored)
+	case ClusterMute:
+		cm.applyMute(event.UserId, event.Until)
+	case ClusterDisconnect:
+		cm.applyDisconnect(event.UserId, event.TokenId, event.Reason)
+	case ClusterPresence:
+		cm.updatePresence(event)
+	default:
+		log.Printf("Ignoring unknown cluster event %q", event.Kind)
+	}
+}
+
+// announcePresence tells the other nodes which users are connected here.
+func (cm *ClientManager) announcePresence() {
+	cm.Lock.Lock()
+	users := make(map[string]int)
+	for _, client := range cm.Clients {
+		users[client.Handle] = client.UserId
+	}
+	cm.Lock.Unlock()
+
+	cm.publish(ClusterEvent{Kind: ClusterPresence, Users: users})
+}
+
+// announcePresenceEvery repeats the announcement, which keeps this node
+// listed and heals announcements lost to broker outages.
+func (cm *ClientManager) announcePresenceEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cm.announcePresence()
+
+		cm.Lock.Lock()
+		for id, node := range cm.remoteNodes {
+			if time.Now().After(node.expires) {
+				log.Printf("Node %s stopped announcing itself", id)
+				delete(cm.remoteNodes, id)
+			}
+		}
+		cm.Lock.Unlock()
+	}
+}
+
+func (cm *ClientManager) updatePresence(event ClusterEvent) {
+	if event.Node == cm.NodeId {
+		return
+	}
+
+	cm.Lock.Lock()
+	_, known := cm.remoteNodes[event.Node]
+	cm.remoteNodes[event.Node] = remoteNode{
+		users:   event.Users,
+		expires: time.Now().Add(3 * cm.presenceInterval),
+	}
+	cm.Lock.Unlock()
+
+	// A node that just started knows nobody yet
+	if !known {
+		log.Printf("Node %s joined the cluster", event.Node)
+		cm.announcePresence()
+	}
+}
+
+// liveNodesLocked returns the other nodes that announced themselves
+// recently. Must be called with cm.Lock held.
+func (cm *ClientManager) liveNodesLocked() []remoteNode {
+	nodes := make([]remoteNode, 0, len(cm.remoteNodes))
+	for _, node := range cm.remoteNodes {
+		if time.Now().Before(node.expires) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a ClientManager standing for one node of a cluster
+// whose nodes share broker and store.
+func newTestNode(t *testing.T, store Store, broker Broker) *ClientManager {
+	t.Helper()
+	filters, err := NewContentFilters(store, FilterConfig{})
+	if err != nil {
+		t.Fatalf("NewContentFilters: %v", err)
+	}
+	webhooks := NewWebhookDispatcher(store, WebhookConfig{QueueSize: 10})
+	limits := RateLimitConfig{ConnectionPerMinute: 600, ConnectionBurst: 100, UserPerMinute: 600, UserBurst: 100, RoomPerMinute: 600, RoomBurst: 100}
+	return NewClientManager(store, filters, NewRateLimiter(limits), webhooks, broker, time.Hour)
+}
+
+func TestFilterChangesReachEveryNode(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	room, err := store.CreateRoom("general")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	broker := NewMemoryBroker()
+	a, b := newTestNode(t, store, broker), newTestNode(t, store, broker)
+
+	rejected := func(node *ClientManager) bool {
+		t.Helper()
+		pipeline, err := node.Filters.ForRoom(room.Id)
+		if err != nil {
+			t.Fatalf("ForRoom: %v", err)
+		}
+		return pipeline.Apply("hello there").Rejected
+	}
+
+	// Both nodes cache the defaults, which let the message through
+	if rejected(a) || rejected(b) {
+		t.Fatal("the defaults rejected the message")
+	}
+	if err := a.Filters.SetRoomRules(room.Id, FilterRules{MaxLength: 5}); err != nil {
+		t.Fatalf("SetRoomRules: %v", err)
+	}
+	if !rejected(a) || !rejected(b) {
+		t.Error("a node still applies the old rules after SetRoomRules")
+	}
+	if err := b.Filters.ResetRoomRules(room.Id); err != nil {
+		t.Fatalf("ResetRoomRules: %v", err)
+	}
+	if rejected(a) || rejected(b) {
+		t.Error("a node still applies the old rules after ResetRoomRules")
+	}
+}
+
+// Room messages, direct messages and the online list span the nodes, over
+// either broker.
+func TestMessagesReachEveryNode(t *testing.T) {
+	brokers := []struct {
+		name string
+		open func(t *testing.T) (Broker, Broker)
+	}{
+		{"memory", func(t *testing.T) (Broker, Broker) {
+			broker := NewMemoryBroker()
+			return broker, broker
+		}},
+		{"redis", func(t *testing.T) (Broker, Broker) {
+			server := startFakeRedis(t, "")
+			return newTestRedisBroker(t, server, ""), newTestRedisBroker(t, server, "")
+		}},
+	}
+	for _, brokers := range brokers {
+		t.Run(brokers.name, func(t *testing.T) {
+			store := openTestSQLiteStore(t)
+			aliceId, bobId := createTestUsers(t, store)
+			brokerA, brokerB := brokers.open(t)
+			a, b := newTestNode(t, store, brokerA), newTestNode(t, store, brokerB)
+
+			// alice is connected to node a, bob to node b
+			aliceConn, bobConn := &recordingConn{}, &recordingConn{}
+			alice := &Client{UserId: aliceId, Email: "alice@example.com", Handle: "alice", Conn: aliceConn}
+			bob := &Client{UserId: bobId, Email: "bob@example.com", Handle: "bob", Conn: bobConn}
+			a.AddClient("alice-1", alice)
+			b.AddClient("bob-1", bob)
+			for node, client := range map[*ClientManager]*Client{a: alice, b: bob} {
+				if _, err := node.JoinRoom("general", client); err != nil {
+					t.Fatalf("JoinRoom: %v", err)
+				}
+			}
+			received := func(conn *recordingConn, messageType MessageType, content string) func() bool {
+				return func() bool {
+					conn.lock.Lock()
+					defer conn.lock.Unlock()
+					return slices.ContainsFunc(conn.messages, func(m Message) bool {
+						return m.Type == messageType && m.Content == content
+					})
+				}
+			}
+
+			// Each node lists the users of both
+			for _, node := range []*ClientManager{a, b} {
+				waitFor(t, "the online list of both nodes", func() bool {
+					return slices.Equal(node.OnlineHandles(), []string{"alice", "bob"})
+				})
+			}
+
+			a.BroadcastToRoom("general", newMessageFrom(RegularMessage, "hello bob", alice, nil))
+			waitFor(t, "the room message on the other node", received(bobConn, RegularMessage, "hello bob"))
+			waitFor(t, "the room message on the sender's node", received(aliceConn, RegularMessage, "hello bob"))
+
+			data := []byte(`{"type": "direct", "target": "bob", "content": "psst"}`)
+			if err := handleClientMessage(aliceConn, alice, a, data, alice.Email); err != nil {
+				t.Fatalf("handleClientMessage: %v", err)
+			}
+			waitFor(t, "the direct message on the other node", received(bobConn, DirectMessage, "psst"))
+			if received(aliceConn, SystemMessage, "User bob not found.")() {
+				t.Error("bob was not found on the other node")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// Command chat is a terminal client for the chat server.
+//
+//	go run ./cmd/chat -server http://localhost:8090 -email ada@example.com
+//
+// Lines are sent to the current room; /join, /dm, /users and the other
+// commands are translated into protocol messages. Bots pass -token (or
+// CHAT_TOKEN) instead of signing in.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+
+	"chat-app/chatclient"
+)
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func main() {
+	server := flag.String("server", getEnv("CHAT_SERVER", "http://localhost:8090"), "URL of the chat server")
+	email := flag.String("email", os.Getenv("CHAT_EMAIL"), "e-mail address to sign in with")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "API token to use instead of signing in")
+	room := flag.String("room", "general", "room to join")
+	history := flag.Int("history", 20, "number of earlier messages to show when joining a room")
+	flag.Parse()
+	log.SetFlags(0)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	input := bufio.NewScanner(os.Stdin)
+	client := chatclient.New(*server)
+	client.Token = *token
+	if client.Token == "" {
+		if err := login(ctx, client, input, *email); err != nil {
+			log.Fatalf("Login failed: %v", err)
+		}
+	}
+
+	me, err := client.Me(ctx)
+	if err != nil {
+		log.Fatalf("Failed to load account: %v", err)
+	}
+	rooms, err := client.Rooms(ctx)
+	if err != nil {
+		log.Fatalf("Failed to list rooms: %v", err)
+	}
+	// Like after reconnecting, general is only passed through on the way
+	// to another room
+	t := &terminal{client: client, history: *history, out: os.Stdout, room: *room, rejoining: *room != "general"}
+	t.printf("Signed in as %s. Rooms: %s", me.Handle, roomNames(rooms))
+	t.printf("Type /help for commands, /quit to leave.")
+
+	conn, err := client.Connect(ctx, t.handlers())
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	t.conn = conn
+	if *room != "general" {
+		conn.Join(*room)
+	}
+
+	lines := make(chan string)
+	go func() {
+		for input.Scan() {
+			lines <- input.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok || !t.handleInput(ctx, line) {
+				return
+			}
+		case <-conn.Done():
+			if err := conn.Err(); err != nil {
+				log.Fatalf("Connection closed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// login asks for what is missing to sign in, including the second factor
+// for accounts that have it.
+func login(ctx context.Context, client *chatclient.Client, input *bufio.Scanner, email string) error {
+	if email == "" {
+		email = prompt(input, "E-mail: ")
+	}
+	password := os.Getenv("CHAT_PASSWORD")
+	if password == "" {
+		password = readPassword(input, "Password: ")
+	}
+
+	err := client.Login(ctx, email, password)
+	if errors.Is(err, chatclient.ErrTOTPRequired) {
+		code := prompt(input, "Two-factor code: ")
+		err = client.LoginTOTP(ctx, email, password, code)
+	}
+	return err
+}
+
+func prompt(input *bufio.Scanner, label string) string {
+	fmt.Print(label)
+	input.Scan()
+	return strings.TrimSpace(input.Text())
+}
+
+// readPassword prompts without echoing the input where stty is available.
+func readPassword(input *bufio.Scanner, label string) string {
+	stty := func(args ...string) error {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return prompt(input, label)
+	}
+	defer fmt.Println()
+	defer stty("echo")
+	return prompt(input, label)
+}
+
+func roomNames(rooms []chatclient.Room) string {
+	names := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		names = append(names, room.Name)
+	}
+	return strings.Join(names, ", ")
+}
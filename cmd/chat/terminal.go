@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"chat-app/chatclient"
+)
+
+const joinedPrefix = "You have joined the room: "
+
+// terminal renders incoming messages and turns input lines into protocol
+// messages.
+type terminal struct {
+	client  *chatclient.Client
+	conn    *chatclient.Conn
+	history int
+	out     io.Writer
+
+	lock sync.Mutex
+	// The room the user asked for and the one whose scrollback was shown
+	// last. After reconnecting the server puts the client in general
+	// before it rejoins room, which shouldn't show scrollback again.
+	room      string
+	roomId    int
+	connected bool
+	rejoining bool
+}
+
+func (t *terminal) printf(format string, args ...any) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	fmt.Fprintf(t.out, format+"\n", args...)
+}
+
+func (t *terminal) handlers() chatclient.Handlers {
+	return chatclient.Handlers{
+		OnMessage: func(m chatclient.Message) { t.printMessage(m, "") },
+		OnDirect:  func(m chatclient.Message) { t.printMessage(m, "(DM) ") },
+		OnSystem:  t.onSystem,
+		OnTyping: func(e chatclient.TypingEvent) {
+			if e.Typing {
+				name := e.SenderName
+				if name == "" {
+					name = e.Sender
+				}
+				t.printf("        %s is typing...", name)
+			}
+		},
+		OnOther: func(m chatclient.Message) {
+			switch m.Type {
+			case chatclient.EditedMessage:
+				t.printMessage(m, "(edited) ")
+			case chatclient.DeletedMessage:
+				t.printf("-- A message from %s was deleted", m.Name())
+			}
+		},
+		OnConnect: func() {
+			t.lock.Lock()
+			reconnected := t.connected
+			t.connected = true
+			// The first connection keeps what main set up
+			if reconnected {
+				t.rejoining = true
+			}
+			t.lock.Unlock()
+			if reconnected {
+				t.printf("-- Reconnected")
+			}
+		},
+		OnDisconnect: func(err error) {
+			t.printf("-- Connection lost (%v), reconnecting...", err)
+		},
+	}
+}
+
+func (t *terminal) printMessage(m chatclient.Message, prefix string) {
+	name := m.Name()
+	if m.Bot {
+		name += " [bot]"
+	}
+	stamp := m.Time().Local().Format("15:04")
+	t.printf("[%s] %s%s: %s", stamp, prefix, name, m.Content)
+	for _, attachment := range m.Attachments {
+		t.printf("        [%s] %s", attachment.Filename, attachment.URL)
+	}
+}
+
+func (t *terminal) onSystem(m chatclient.Message) {
+	if m.RetryAfter > 0 {
+		t.printf("-- %s (retry in %ds)", m.Content, m.RetryAfter)
+		return
+	}
+	t.printf("-- %s", m.Content)
+
+	if !strings.HasPrefix(m.Content, joinedPrefix) || m.Room.Id == 0 {
+		return
+	}
+	t.lock.Lock()
+	passing := t.rejoining && m.Room.Name != t.room
+	if m.Room.Name == t.room {
+		t.rejoining = false
+	}
+	changed := !passing && t.roomId != m.Room.Id
+	if !passing {
+		t.roomId = m.Room.Id
+	}
+	t.lock.Unlock()
+	if changed {
+		t.showScrollback(m.Room)
+	}
+}
+
+func (t *terminal) showScrollback(room chatclient.Room) {
+	if t.history <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	messages, err := t.client.History(ctx, room.Id, "", t.history)
+	if err != nil {
+		t.printf("-- Failed to load history: %v", err)
+		return
+	}
+	for _, m := range messages {
+		t.printMessage(m, "")
+	}
+}
+
+const helpText = `Commands:
+  /join <room>          switch rooms
+  /dm <handle> <text>   send a direct message
+  /users                list the users in the room
+  /rooms                list all rooms
+  /online               list who is online
+  /quit                 leave
+Other commands are run by the server; its /help follows.`
+
+// handleInput sends one line typed by the user. It returns false when the
+// user wants to leave.
+func (t *terminal) handleInput(ctx context.Context, line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	if !strings.HasPrefix(line, "/") {
+		t.report(t.conn.Say(line))
+		return true
+	}
+
+	name, rest, _ := strings.Cut(line[1:], " ")
+	rest = strings.TrimSpace(rest)
+	switch name {
+	case "quit", "exit":
+		return false
+	case "help":
+		t.printf("%s", helpText)
+		t.report(t.conn.Command("help"))
+	case "join":
+		if rest == "" {
+			t.printf("-- Usage: /join <room>")
+			return true
+		}
+		t.lock.Lock()
+		t.room = rest
+		t.lock.Unlock()
+		t.report(t.conn.Join(rest))
+	case "dm", "msg":
+		handle, text, _ := strings.Cut(rest, " ")
+		text = strings.TrimSpace(text)
+		if handle == "" || text == "" {
+			t.printf("-- Usage: /dm <handle> <text>")
+			return true
+		}
+		if err := t.conn.Direct(strings.TrimPrefix(handle, "@"), text); err != nil {
+			t.report(err)
+			return true
+		}
+		t.printf("[%s] (DM to %s) %s", time.Now().Format("15:04"), handle, text)
+	case "rooms":
+		rooms, err := t.client.Rooms(ctx)
+		if err != nil {
+			t.report(err)
+			return true
+		}
+		t.printf("-- Rooms: %s", roomNames(rooms))
+	case "online":
+		handles, err := t.client.OnlineUsers(ctx)
+		if err != nil {
+			t.report(err)
+			return true
+		}
+		t.printf("-- Online: %s", strings.Join(handles, ", "))
+	default:
+		t.report(t.conn.Command(line))
+	}
+	return true
+}
+
+func (t *terminal) report(err error) {
+	if err != nil {
+		t.printf("-- %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/chatclient"
+	"chat-app/chatclient/chattest"
+)
+
+// output returns what the terminal printed so far.
+func (t *terminal) output() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.out.(*bytes.Buffer).String()
+}
+
+// waitOutput waits until the terminal has printed want count times.
+func waitOutput(t *testing.T, term *terminal, want string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(term.output(), want) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, printed:\n%s", want, term.output())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	server := chattest.NewServer()
+	defer server.Close()
+	server.AddUser("ada@example.com", "password", "ada", "Ada")
+	for _, content := range []string{"one", "two", "three"} {
+		server.Broadcast("ops", chatclient.Message{Type: chatclient.RegularMessage, Sender: "bob", Content: "ops " + content})
+	}
+	server.Broadcast("general", chatclient.Message{Type: chatclient.RegularMessage, Sender: "bob", Content: "general chatter"})
+
+	ctx := context.Background()
+	client := chatclient.New(server.URL)
+	if err := client.Login(ctx, "ada@example.com", "password"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	// Started with -room ops -history 2
+	term := &terminal{client: client, history: 2, out: &bytes.Buffer{}, room: "ops", rejoining: true}
+	conn, err := client.Connect(ctx, term.handlers())
+	if err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	defer conn.Close()
+	term.conn = conn
+	conn.Join("ops")
+
+	// Only the scrollback of ops is shown, and only the last two messages
+	waitOutput(t, term, "ops three", 1)
+	if out := term.output(); strings.Contains(out, "general chatter") || strings.Contains(out, "ops one") || !strings.Contains(out, "ops two") {
+		t.Errorf("scrollback after joining ops:\n%s", out)
+	}
+
+	// Reconnecting passes through general again without showing anything
+	server.DropConnections()
+	waitOutput(t, term, "-- Reconnected", 1)
+	waitOutput(t, term, "You have joined the room: ops", 2)
+	if out := term.output(); strings.Contains(out, "general chatter") || strings.Count(out, "ops three") != 1 {
+		t.Errorf("scrollback after reconnecting:\n%s", out)
+	}
+
+	inputs := []struct {
+		line, want string
+	}{
+		{"hello ops", "Ada: hello ops"},
+		{"/dm ada", "-- Usage: /dm <handle> <text>"},
+		{"/dm @ada psst", "(DM) Ada: psst"},
+		{"/join", "-- Usage: /join <room>"},
+		{"/rooms", "-- Rooms: general, ops"},
+		{"/online", "-- Online: ada"},
+		{"/frobnicate", "Unknown command /frobnicate"},
+	}
+	for _, input := range inputs {
+		if !term.handleInput(ctx, input.line) {
+			t.Fatalf("handleInput(%q) wants to quit", input.line)
+		}
+		waitOutput(t, term, input.want, 1)
+	}
+	if term.handleInput(ctx, "/quit") {
+		t.Errorf("/quit does not quit")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CommandPermission is the lowest role allowed to run a command.
+type CommandPermission int
+
+const (
+	PermissionEveryone CommandPermission = iota
+	PermissionModerator
+	PermissionAdmin
+)
+
+func (p CommandPermission) allows(role string) bool {
+	switch p {
+	case PermissionModerator:
+		return isModeratorRole(role)
+	case PermissionAdmin:
+		return role == RoleAdmin
+	default:
+		return true
+	}
+}
+
+type ArgType int
+
+const (
+	ArgString ArgType = iota
+	ArgInt
+)
+
+type CommandArg struct {
+	Name     string
+	Type     ArgType
+	Optional bool
+	// Rest takes the remainder of the line, spaces included. Only the last
+	// argument can have it.
+	Rest bool
+}
+
+func (a CommandArg) usage() string {
+	name := a.Name
+	if a.Rest {
+		name += "..."
+	}
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// CommandArgs holds the parsed arguments of a command by name.
+type CommandArgs map[string]string
+
+func (a CommandArgs) String(name string) string {
+	return a[name]
+}
+
+// Int returns an argument declared as ArgInt, which has already been
+// validated, or 0 if it was left out.
+func (a CommandArgs) Int(name string) int {
+	value, _ := strconv.Atoi(a[name])
+	return value
+}
+
+// CommandContext is what a command handler gets to work with.
+type CommandContext struct {
+	Manager *ClientManager
+	Client  *Client
+	Args    CommandArgs
+}
+
+// Reply sends a system message to the client who ran the command.
+func (ctx *CommandContext) Reply(format string, args ...any) error {
+	return sendMessage(ctx.Client.Conn, SystemMessage, fmt.Sprintf(format, args...), "system", ctx.Client.Room)
+}
+
+type Command struct {
+	Name        string
+	Args        []CommandArg
+	Description string
+	Permission  CommandPermission
+	// Scope an API token needs to run the command, if any
+	Scope string
+	// NeedsRoom refuses the command until the client has joined a room.
+	NeedsRoom bool
+	// Handler replies to the client itself. A returned error is reported as
+	// a failure to handle the message.
+	Handler func(ctx *CommandContext) error
+}
+
+func (c *Command) Usage() string {
+	parts := []string{"/" + c.Name}
+	for _, arg := range c.Args {
+		parts = append(parts, arg.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseArgs splits the text after the command name into its declared
+// arguments.
+func (c *Command) parseArgs(text string) (CommandArgs, error) {
+	args := make(CommandArgs)
+	rest := strings.TrimSpace(text)
+	for _, arg := range c.Args {
+		var value string
+		if arg.Rest {
+			value, rest = rest, ""
+		} else {
+			value, rest, _ = strings.Cut(rest, " ")
+			rest = strings.TrimSpace(rest)
+		}
+		if value == "" {
+			if !arg.Optional {
+				return nil, fmt.Errorf("missing %s. Usage: %s", arg.Name, c.Usage())
+			}
+			continue
+		}
+		if arg.Type == ArgInt {
+			if _, err := strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("%s must be a number. Usage: %s", arg.Name, c.Usage())
+			}
+		}
+		args[arg.Name] = value
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("too many arguments. Usage: %s", c.Usage())
+	}
+	return args, nil
+}
+
+// CommandRegistry holds the slash commands clients can run. Commands can be
+// added from anywhere with Register; the parser doesn't need to know them.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]*Command
+}
+
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]*Command)}
+}
+
+func (r *CommandRegistry) Register(cmd Command) error {
+	name := strings.ToLower(strings.TrimPrefix(cmd.Name, "/"))
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Handler == nil {
+		return fmt.Errorf("command %s has no handler", name)
+	}
+	for i, arg := range cmd.Args {
+		if arg.Rest && i != len(cmd.Args)-1 {
+			return fmt.Errorf("command %s: only the last argument can take the rest of the line", name)
+		}
+	}
+	cmd.Name = name
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.commands[name]; exists {
+		return fmt.Errorf("command %s is already registered", name)
+	}
+	r.commands[name] = &cmd
+	return nil
+}
+
+func (r *CommandRegistry) Lookup(name string) *Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.commands[strings.ToLower(name)]
+}
+
+// Available returns the commands a user with the given role may run, sorted
+// by name.
+func (r *CommandRegistry) Available(role string) []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	commands := make([]*Command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		if cmd.Permission.allows(role) {
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name < commands[j].Name
+	})
+	return commands
+}
+
+func (r *CommandRegistry) Help(role string) string {
+	var sb strings.Builder
+	sb.WriteString("Available commands:")
+	for _, cmd := range r.Available(role) {
+		sb.WriteString("\n " + cmd.Usage() + " - " + cmd.Description)
+	}
+	return sb.String()
+}
+
+// Run parses and runs a command line such as "join general" for client.
+func (r *CommandRegistry) Run(manager *ClientManager, client *Client, line string) error {
+	line = strings.TrimPrefix(strings.TrimSpace(line), "/")
+	name, text, _ := strings.Cut(line, " ")
+
+	cmd := r.Lookup(name)
+	// Commands the client isn't allowed to run look the same as unknown ones
+	if cmd == nil || !cmd.Permission.allows(client.Role) {
+		return sendMessage(client.Conn, SystemMessage, fmt.Sprintf("Unknown command /%s. Use /help for a list of commands.", name), "system", nil)
+	}
+	if cmd.Scope != "" && !client.can(cmd.Scope) {
+		return sendMessage(client.Conn, SystemMessage, "This token can't run /"+cmd.Name+", it needs the "+cmd.Scope+" scope.", "system", nil)
+	}
+	if cmd.NeedsRoom && client.Room == nil {
+		return sendMessage(client.Conn, SystemMessage, "You must join a room first. Use /join <roomName>", "system", nil)
+	}
+	args, err := cmd.parseArgs(text)
+	if err != nil {
+		return sendMessage(client.Conn, SystemMessage, "Invalid /"+cmd.Name+": "+err.Error(), "system", nil)
+	}
+	return cmd.Handler(&CommandContext{Manager: manager, Client: client, Args: args})
+}
+
+// registerBuiltinCommands adds the commands every server has.
+func registerBuiltinCommands(r *CommandRegistry) {
+	builtins := []Command{
+		{
+			Name:        "help",
+			Description: "List the available commands",
+			Handler: func(ctx *CommandContext) error {
+				return ctx.Reply("%s", r.Help(ctx.Client.Role))
+			},
+		},
+		{
+			Name:        "users",
+			Description: "List connected users",
+			Handler: func(ctx *CommandContext) error {
+				var sb strings.Builder
+				for _, handle := range ctx.Manager.OnlineHandles() {
+					sb.WriteString(handle + "\n")
+				}
+				return ctx.Reply("%s", sb.String())
+			},
+		},
+		{
+			Name:        "join",
+			Args:        []CommandArg{{Name: "room", Rest: true}},
+			Description: "Join a room, creating it if needed",
+			Scope:       ScopeManageRooms,
+			Handler: func(ctx *CommandContext) error {
+				room, err := ctx.Manager.JoinRoom(ctx.Args.String("room"), ctx.Client)
+				if err != nil {
+					return ctx.Reply("Failed to join room: %v", err)
+				}
+				return sendMessage(ctx.Client.Conn, SystemMessage, "You have joined the room: "+room.Name, "system", room)
+			},
+		},
+		blockCommand("block", BlockKindBlock, "blocked", "Stop receiving messages from a user"),
+		blockCommand("mute", BlockKindMute, "muted", "Hide a user's room messages"),
+		unblockCommand("unblock", BlockKindBlock, "blocked", "Undo a block"),
+		unblockCommand("unmute", BlockKindMute, "muted", "Undo a mute"),
+		{
+			Name:        "slowmode",
+			Args:        []CommandArg{{Name: "seconds", Type: ArgInt}},
+			Description: "Set slow mode for the current room, 0 turns it off",
+			Permission:  PermissionModerator,
+			Scope:       ScopeManageRooms,
+			NeedsRoom:   true,
+			Handler: func(ctx *CommandContext) error {
+				seconds := ctx.Args.Int("seconds")
+				if seconds < 0 || seconds > maxSlowModeSeconds {
+					return ctx.Reply("Seconds must be between 0 and %d.", maxSlowModeSeconds)
+				}
+				room := ctx.Client.Room
+				if err := ctx.Manager.Store.SetRoomSlowMode(room.Id, seconds); err != nil {
+					return err
+				}
+				ctx.Manager.SetRoomSlowMode(room.Name, seconds)
+				return nil
+			},
+		},
+	}
+	for _, cmd := range builtins {
+		if err := r.Register(cmd); err != nil {
+			log.Fatalf("Failed to register command: %v", err)
+		}
+	}
+}
+
+func blockCommand(name, kind, done, description string) Command {
+	return Command{
+		Name:        name,
+		Args:        []CommandArg{{Name: "handle"}},
+		Description: description,
+		Handler: func(ctx *CommandContext) error {
+			handle := ctx.Args.String("handle")
+			if err := blockUser(ctx.Manager.Store, ctx.Manager, ctx.Client.UserId, handle, kind); err != nil {
+				return ctx.Reply("Failed to %s %s: %v", name, handle, err)
+			}
+			return ctx.Reply("%s is now %s.", handle, done)
+		},
+	}
+}
+
+func unblockCommand(name, kind, done, description string) Command {
+	return Command{
+		Name:        name,
+		Args:        []CommandArg{{Name: "handle"}},
+		Description: description,
+		Handler: func(ctx *CommandContext) error {
+			handle := ctx.Args.String("handle")
+			removed, err := unblockUser(ctx.Manager.Store, ctx.Manager, ctx.Client.UserId, handle, kind)
+			if err != nil {
+				return ctx.Reply("Failed to %s %s: %v", name, handle, err)
+			}
+			if !removed {
+				return ctx.Reply("%s is not %s.", handle, done)
+			}
+			return ctx.Reply("%s is no longer %s.", handle, done)
+		},
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	cmd := &Command{Name: "kick", Args: []CommandArg{
+		{Name: "user"},
+		{Name: "minutes", Type: ArgInt, Optional: true},
+		{Name: "reason", Optional: true, Rest: true},
+	}}
+
+	args, err := cmd.parseArgs("  bob 10 being  rude ")
+	if err != nil || args.String("user") != "bob" || args.Int("minutes") != 10 || args.String("reason") != "being  rude" {
+		t.Errorf("parseArgs = %v, %v", args, err)
+	}
+	if args, err := cmd.parseArgs("bob"); err != nil || len(args) != 1 || args.Int("minutes") != 0 {
+		t.Errorf("parseArgs without the optional arguments = %v, %v", args, err)
+	}
+	if _, err := cmd.parseArgs(""); err == nil || !strings.Contains(err.Error(), "missing user") {
+		t.Errorf("parseArgs without the user = %v", err)
+	}
+	if _, err := cmd.parseArgs("bob soon"); err == nil || !strings.Contains(err.Error(), "must be a number") {
+		t.Errorf("parseArgs with a word for minutes = %v", err)
+	}
+	if got := cmd.Usage(); got != "/kick <user> [minutes] [reason...]" {
+		t.Errorf("Usage = %q", got)
+	}
+
+	short := &Command{Name: "ping"}
+	if _, err := short.parseArgs("extra"); err == nil || !strings.Contains(err.Error(), "too many arguments") {
+		t.Errorf("parseArgs with an extra argument = %v", err)
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	r := NewCommandRegistry()
+	ran := 0
+	handler := func(ctx *CommandContext) error {
+		ran++
+		return ctx.Reply("hello %s", ctx.Args.String("name"))
+	}
+
+	invalid := []Command{
+		{Name: "", Handler: handler},
+		{Name: "two words", Handler: handler},
+		{Name: "nohandler"},
+		{Name: "rest", Args: []CommandArg{{Name: "a", Rest: true}, {Name: "b"}}, Handler: handler},
+	}
+	for _, cmd := range invalid {
+		if err := r.Register(cmd); err == nil {
+			t.Errorf("Register(%+v) was accepted", cmd)
+		}
+	}
+	if err := r.Register(Command{Name: "/Greet", Args: []CommandArg{{Name: "name"}}, Description: "Say hello", Handler: handler}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := r.Register(Command{Name: "greet", Handler: handler}); err == nil {
+		t.Errorf("a command was registered twice")
+	}
+	if err := r.Register(Command{Name: "purge", Description: "Delete everything", Permission: PermissionAdmin, Handler: handler}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if err := r.Register(Command{Name: "topic", Description: "Set the topic", Scope: ScopeManageRooms, NeedsRoom: true, Handler: handler}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if help := r.Help(RoleUser); help != "Available commands:\n /greet <name> - Say hello\n /topic - Set the topic" {
+		t.Errorf("help for users: %q", help)
+	}
+	if help := r.Help(RoleAdmin); !strings.Contains(help, "/purge") {
+		t.Errorf("help for admins leaves out /purge: %q", help)
+	}
+
+	conn := &recordingConn{}
+	user := &Client{UserId: 1, Role: RoleUser, Conn: conn}
+	tests := []struct {
+		client *Client
+		line   string
+		want   string
+	}{
+		{user, "/GREET bob", "hello bob"},
+		{user, "/greet", "Invalid /greet: missing name"},
+		{user, "/purge", "Unknown command /purge"},
+		{user, "/nothing", "Unknown command /nothing"},
+		{user, "/topic", "You must join a room first"},
+		{&Client{Role: RoleUser, Conn: conn, TokenId: 1, Scopes: []string{ScopePostMessages}}, "/topic", "it needs the " + ScopeManageRooms + " scope"},
+		{&Client{Role: RoleAdmin, Conn: conn}, "/purge", "hello "},
+	}
+	for _, test := range tests {
+		if err := r.Run(nil, test.client, test.line); err != nil {
+			t.Fatalf("Run(%q): %v", test.line, err)
+		}
+		if got := conn.last(); !strings.Contains(got, test.want) {
+			t.Errorf("Run(%q) replied %q, want %q", test.line, got, test.want)
+		}
+	}
+	if ran != 2 {
+		t.Errorf("handlers ran %d times, want 2", ran)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JWTConfig struct {
+	Algorithm        string
+	Secret           string
+	PreviousSecrets  map[string]string
+	SigningKeyFile   string
+	KeyId            string
+	VerificationKeys map[string]string
+	Issuer           string
+	Audience         string
+	TTL              time.Duration
+}
+
+type MailConfig struct {
+	Driver       string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	From         string
+	LogFile      string
+}
+
+type AccountConfig struct {
+	PublicURL                string
+	RequireEmailVerification bool
+	VerificationTokenTTL     time.Duration
+	PasswordResetTokenTTL    time.Duration
+	TOTPIssuer               string
+	TOTPEncryptionKey        string
+	// Accounts given the moderator and admin roles on start-up
+	ModeratorEmails []string
+	AdminEmails     []string
+}
+
+type LoginGuardConfig struct {
+	FreeAttempts     int
+	BackoffBase      time.Duration
+	BackoffMax       time.Duration
+	AccountThreshold int
+	IPThreshold      int
+	LockoutDuration  time.Duration
+	Window           time.Duration
+	TrustProxy       bool
+}
+
+type StorageConfig struct {
+	Driver                 string
+	Dir                    string
+	S3Endpoint             string
+	S3Bucket               string
+	S3Region               string
+	S3AccessKey            string
+	S3SecretKey            string
+	S3PathStyle            bool
+	MaxAvatarBytes         int64
+	MaxAttachmentBytes     int64
+	AllowedAttachmentTypes []string
+}
+
+// Limits are in messages per minute, with bursts of up to Burst messages.
+type RateLimitConfig struct {
+	ConnectionPerMinute int
+	ConnectionBurst     int
+	UserPerMinute       int
+	UserBurst           int
+	RoomPerMinute       int
+	RoomBurst           int
+	// Password reset e-mails per client IP and per address
+	PasswordResetPerHour int
+	PasswordResetBurst   int
+}
+
+type FilterConfig struct {
+	// JSON file with the default FilterRules
+	RulesFile        string
+	MaxMessageLength int
+}
+
+type WebhookConfig struct {
+	Workers     int
+	QueueSize   int
+	Timeout     time.Duration
+	MaxAttempts int
+	// Retries wait BackoffBase, then twice as long each time, up to BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Let webhooks post to loopback, link-local and private addresses
+	AllowPrivate bool
+}
+
+type IRCConfig struct {
+	// Address of the IRC listener, e.g. ":6667"; off when empty
+	Addr       string
+	ServerName string
+	// Serve IRC over TLS when both are set
+	TLSCert string
+	TLSKey  string
+	// Idle clients are pinged after this long and dropped after twice as long
+	PingInterval time.Duration
+}
+
+type SessionConfig struct {
+	// Sessions nobody has read from for this long are closed
+	IdleTimeout time.Duration
+	// Messages kept for a session between reads
+	BufferSize int
+	// Longest a poll waits for messages; also the SSE keep-alive interval
+	PollTimeout time.Duration
+}
+
+type BrokerConfig struct {
+	// "memory" for a single node or "redis" to run several
+	Driver        string
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	Channel       string
+	// How often nodes announce who is connected to them; a node that
+	// misses three announcements is taken as gone
+	PresenceInterval time.Duration
+}
+
+type DatabaseConfig struct {
+	// "sqlite" or "postgres"
+	Driver string
+	// SQLite database file
+	Path string
+	// How long SQLite waits for a lock held by another connection
+	BusyTimeout time.Duration
+	// Postgres connection URL
+	URL string
+	// Apply pending migrations on start-up rather than refuse to start
+	AutoMigrate bool
+}
+
+type BackupConfig struct {
+	// Directory of the backups taken by the server and the backup command
+	Dir string
+	// How often the server takes a backup; zero turns scheduled backups off
+	Interval time.Duration
+	// Number of backups kept in Dir, the oldest are deleted; zero keeps all
+	Keep int
+}
+
+type Config struct {
+	// Address the HTTP server listens on
+	Addr       string
+	Database   DatabaseConfig
+	Backups    BackupConfig
+	JWT        JWTConfig
+	Mail       MailConfig
+	Account    AccountConfig
+	LoginGuard LoginGuardConfig
+	Storage    StorageConfig
+	Filters    FilterConfig
+	RateLimit  RateLimitConfig
+	Webhooks   WebhookConfig
+	IRC        IRCConfig
+	Sessions   SessionConfig
+	Broker     BrokerConfig
+}
+
+func loadConfig() *Config {
+	return &Config{
+		Addr: getEnv("HTTP_ADDR", ":8090"),
+		Database: DatabaseConfig{
+			Driver:      getEnv("DB_DRIVER", "sqlite"),
+			Path:        getEnv("DB_PATH", "./data/main.db"),
+			BusyTimeout: getEnvDuration("DB_BUSY_TIMEOUT", 5*time.Second),
+			URL:         os.Getenv("DATABASE_URL"),
+			AutoMigrate: getEnvBool("DB_AUTO_MIGRATE", true),
+		},
+		Backups: BackupConfig{
+			Dir:      getEnv("BACKUP_DIR", "./data/backups"),
+			Interval: getEnvDuration("BACKUP_INTERVAL", 0),
+			Keep:     getEnvInt("BACKUP_KEEP", 7),
+		},
+		JWT: JWTConfig{
+			Algorithm:        getEnv("JWT_ALGORITHM", "HS256"),
+			Secret:           os.Getenv("JWT_SECRET"),
+			PreviousSecrets:  getEnvMap("JWT_PREVIOUS_SECRETS"),
+			SigningKeyFile:   os.Getenv("JWT_SIGNING_KEY_FILE"),
+			KeyId:            os.Getenv("JWT_KEY_ID"),
+			VerificationKeys: getEnvMap("JWT_VERIFICATION_KEYS"),
+			Issuer:           getEnv("JWT_ISSUER", "chat-app"),
+			Audience:         getEnv("JWT_AUDIENCE", "chat-app"),
+			TTL:              getEnvDuration("JWT_TTL", 24*time.Hour),
+		},
+		Mail: MailConfig{
+			Driver:       getEnv("MAILER", "log"),
+			SMTPAddr:     os.Getenv("SMTP_ADDR"),
+			SMTPUsername: os.Getenv("SMTP_USERNAME"),
+			SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+			From:         os.Getenv("MAIL_FROM"),
+			LogFile:      os.Getenv("MAIL_LOG_FILE"),
+		},
+		Account: AccountConfig{
+			PublicURL:                strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:8090"), "/"),
+			RequireEmailVerification: getEnvBool("REQUIRE_EMAIL_VERIFICATION", false),
+			VerificationTokenTTL:     getEnvDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour),
+			PasswordResetTokenTTL:    getEnvDuration("PASSWORD_RESET_TTL", time.Hour),
+			TOTPIssuer:               getEnv("TOTP_ISSUER", "Chat App"),
+			TOTPEncryptionKey:        os.Getenv("TOTP_ENCRYPTION_KEY"),
+			ModeratorEmails:          getEnvList("MODERATOR_EMAILS", ""),
+			AdminEmails:              getEnvList("ADMIN_EMAILS", ""),
+		},
+		LoginGuard: LoginGuardConfig{
+			FreeAttempts:     getEnvInt("LOGIN_FREE_ATTEMPTS", 3),
+			BackoffBase:      getEnvDuration("LOGIN_BACKOFF_BASE", time.Second),
+			BackoffMax:       getEnvDuration("LOGIN_BACKOFF_MAX", 5*time.Minute),
+			AccountThreshold: getEnvInt("LOGIN_ACCOUNT_LOCKOUT_THRESHOLD", 10),
+			IPThreshold:      getEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 50),
+			LockoutDuration:  getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+			Window:           getEnvDuration("LOGIN_ATTEMPT_WINDOW", time.Hour),
+			TrustProxy:       getEnvBool("TRUST_PROXY", false),
+		},
+		Storage: StorageConfig{
+			Driver:                 getEnv("STORAGE_DRIVER", "local"),
+			Dir:                    getEnv("STORAGE_DIR", "./data/uploads"),
+			S3Endpoint:             os.Getenv("S3_ENDPOINT"),
+			S3Bucket:               os.Getenv("S3_BUCKET"),
+			S3Region:               getEnv("S3_REGION", "us-east-1"),
+			S3AccessKey:            os.Getenv("S3_ACCESS_KEY"),
+			S3SecretKey:            os.Getenv("S3_SECRET_KEY"),
+			S3PathStyle:            getEnvBool("S3_PATH_STYLE", true),
+			MaxAvatarBytes:         int64(getEnvInt("AVATAR_MAX_BYTES", 5*1024*1024)),
+			MaxAttachmentBytes:     int64(getEnvInt("ATTACHMENT_MAX_BYTES", 25*1024*1024)),
+			AllowedAttachmentTypes: getEnvList("ATTACHMENT_ALLOWED_TYPES", "image/*,text/plain,application/pdf,application/zip,application/x-gzip,application/json"),
+		},
+		Filters: FilterConfig{
+			RulesFile:        os.Getenv("FILTER_RULES_FILE"),
+			MaxMessageLength: getEnvInt("MESSAGE_MAX_LENGTH", 4000),
+		},
+		RateLimit: RateLimitConfig{
+			ConnectionPerMinute:  getEnvInt("RATE_LIMIT_CONNECTION_PER_MINUTE", 60),
+			ConnectionBurst:      getEnvInt("RATE_LIMIT_CONNECTION_BURST", 10),
+			UserPerMinute:        getEnvInt("RATE_LIMIT_USER_PER_MINUTE", 90),
+			UserBurst:            getEnvInt("RATE_LIMIT_USER_BURST", 15),
+			RoomPerMinute:        getEnvInt("RATE_LIMIT_ROOM_PER_MINUTE", 600),
+			RoomBurst:            getEnvInt("RATE_LIMIT_ROOM_BURST", 60),
+			PasswordResetPerHour: getEnvInt("RATE_LIMIT_PASSWORD_RESET_PER_HOUR", 5),
+			PasswordResetBurst:   getEnvInt("RATE_LIMIT_PASSWORD_RESET_BURST", 3),
+		},
+		Webhooks: WebhookConfig{
+			Workers:      getEnvInt("WEBHOOK_WORKERS", 4),
+			QueueSize:    getEnvInt("WEBHOOK_QUEUE_SIZE", 1000),
+			Timeout:      getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+			MaxAttempts:  getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+			BackoffBase:  getEnvDuration("WEBHOOK_BACKOFF_BASE", 5*time.Second),
+			BackoffMax:   getEnvDuration("WEBHOOK_BACKOFF_MAX", 10*time.Minute),
+			AllowPrivate: getEnvBool("WEBHOOK_ALLOW_PRIVATE", false),
+		},
+		IRC: IRCConfig{
+			Addr:         os.Getenv("IRC_ADDR"),
+			ServerName:   getEnv("IRC_SERVER_NAME", "chat-app"),
+			TLSCert:      os.Getenv("IRC_TLS_CERT"),
+			TLSKey:       os.Getenv("IRC_TLS_KEY"),
+			PingInterval: getEnvPositiveDuration("IRC_PING_INTERVAL", 90*time.Second),
+		},
+		Sessions: SessionConfig{
+			IdleTimeout: getEnvPositiveDuration("SESSION_IDLE_TIMEOUT", time.Minute),
+			BufferSize:  getEnvPositiveInt("SESSION_BUFFER_SIZE", 500),
+			PollTimeout: getEnvPositiveDuration("LONG_POLL_TIMEOUT", 25*time.Second),
+		},
+		Broker: BrokerConfig{
+			Driver:           getEnv("BROKER_DRIVER", "memory"),
+			RedisAddr:        getEnv("REDIS_ADDR", "localhost:6379"),
+			RedisPassword:    os.Getenv("REDIS_PASSWORD"),
+			RedisDB:          getEnvInt("REDIS_DB", 0),
+			Channel:          getEnv("BROKER_CHANNEL", "chat-app"),
+			PresenceInterval: getEnvPositiveDuration("PRESENCE_INTERVAL", 10*time.Second),
+		},
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvPositiveInt is getEnvInt for settings that must be at least one,
+// like the size of a buffer.
+func getEnvPositiveInt(key string, fallback int) int {
+	parsed := getEnvInt(key, fallback)
+	if parsed <= 0 {
+		log.Printf("Invalid value for %s (%q), using default %d", key, os.Getenv(key), fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %t", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %s", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvPositiveDuration is getEnvDuration for settings that must be longer
+// than zero, like the interval of a ticker.
+func getEnvPositiveDuration(key string, fallback time.Duration) time.Duration {
+	parsed := getEnvDuration(key, fallback)
+	if parsed <= 0 {
+		log.Printf("Invalid value for %s (%q), using default %s", key, os.Getenv(key), fallback)
+		return fallback
+	}
+	return parsed
+}
+
+// getEnvList parses a comma separated list.
+func getEnvList(key, fallback string) []string {
+	var result []string
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// getEnvMap parses a comma separated list of key=value pairs,
+// e.g. "old=/keys/old.pem,older=/keys/older.pem".
+func getEnvMap(key string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Printf("Ignoring malformed entry in %s: %q", key, pair)
+			continue
+		}
+		result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return result
+}
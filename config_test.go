@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetEnvPositiveDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 10 * time.Second},
+		{"5s", 5 * time.Second},
+		{"0", 10 * time.Second},
+		{"-1m", 10 * time.Second},
+		{"soon", 10 * time.Second},
+	}
+	for _, test := range tests {
+		t.Setenv("TEST_INTERVAL", test.value)
+		if got := getEnvPositiveDuration("TEST_INTERVAL", 10*time.Second); got != test.want {
+			t.Errorf("getEnvPositiveDuration with %q = %s, want %s", test.value, got, test.want)
+		}
+	}
+}
+
+func TestGetEnvPositiveInt(t *testing.T) {
+	tests := map[string]int{"": 500, "20": 20, "0": 500, "-3": 500, "many": 500}
+	for value, want := range tests {
+		t.Setenv("TEST_SIZE", value)
+		if got := getEnvPositiveInt("TEST_SIZE", 500); got != want {
+			t.Errorf("getEnvPositiveInt with %q = %d, want %d", value, got, want)
+		}
+	}
+}
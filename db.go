@@ -2,21 +2,28 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
-	_ "modernc.org/sqlite"
 )
 
-func connectDB() *sql.DB {
-	db, err := sql.Open("sqlite", "./data/main.db")
-
-	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
-	}
-
-	if err := db.Ping(); err != nil {
-		log.Fatalf("Error verifying database connection: %v", err)
-	}
-	return db
+// upgradeLegacySchema brings a SQLite database created before there were
+// migrations, by any earlier version, up to the schema of the first
+// migration. The functions below used to run on every start.
+func upgradeLegacySchema(db *sql.DB) {
+	createUserTable(db)
+	creatRoomTable(db)
+	createMessageTable(db)
+	createRecoveryCodeTable(db)
+	createLoginAttemptTable(db)
+	createAvatarTable(db)
+	createRoomMemberTable(db)
+	createAttachmentTable(db)
+	createUserBlockTable(db)
+	createReportTable(db)
+	createRoomFilterTable(db)
+	createWebhookTables(db)
+	createIncomingWebhookTable(db)
+	createAPITokenTable(db)
 }
 
 func createUserTable(db *sql.DB) {
@@ -24,12 +31,70 @@ func createUserTable(db *sql.DB) {
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		email TEXT UNIQUE NOT NULL,
-		password TEXT NOT NULL
+		password TEXT NOT NULL,
+		email_verified INTEGER NOT NULL DEFAULT 0,
+		totp_secret TEXT,
+		totp_enabled INTEGER NOT NULL DEFAULT 0,
+		totp_last_step INTEGER NOT NULL DEFAULT 0,
+		handle TEXT,
+		display_name TEXT,
+		avatar TEXT,
+		timezone TEXT,
+		bio TEXT,
+		role TEXT NOT NULL DEFAULT 'user',
+		banned INTEGER NOT NULL DEFAULT 0,
+		muted_until DATETIME,
+		is_bot INTEGER NOT NULL DEFAULT 0,
+		owner_id INTEGER
 	);
 	`
 	if _, err := db.Exec(query); err != nil {
 		log.Fatalf("Error creating users table: %v", err)
 	}
+
+	// Columns added after the table was first released
+	columns := []struct{ name, definition string }{
+		{"email_verified", "INTEGER NOT NULL DEFAULT 0"},
+		{"totp_secret", "TEXT"},
+		{"totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+		{"totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+		{"handle", "TEXT"},
+		{"display_name", "TEXT"},
+		{"avatar", "TEXT"},
+		{"timezone", "TEXT"},
+		{"bio", "TEXT"},
+		{"role", "TEXT NOT NULL DEFAULT 'user'"},
+		{"banned", "INTEGER NOT NULL DEFAULT 0"},
+		{"muted_until", "DATETIME"},
+		{"is_bot", "INTEGER NOT NULL DEFAULT 0"},
+		{"owner_id", "INTEGER"},
+	}
+	for _, column := range columns {
+		if err := addColumnIfMissing(db, "users", column.name, column.definition); err != nil {
+			log.Fatalf("Error updating users table: %v", err)
+		}
+	}
+
+	if err := backfillHandles(db); err != nil {
+		log.Fatalf("Error assigning user handles: %v", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_handle ON users (handle)"); err != nil {
+		log.Fatalf("Error creating users handle index: %v", err)
+	}
+}
+
+func createRecoveryCodeTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating recovery_codes table: %v", err)
+	}
 }
 
 func creatRoomTable(db *sql.DB) {
@@ -37,12 +102,17 @@ func creatRoomTable(db *sql.DB) {
 	CREATE TABLE IF NOT EXISTS rooms (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT UNIQUE NOT NULL,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		slow_mode_seconds INTEGER NOT NULL DEFAULT 0
 	);
 	`
 	if _, err := db.Exec(query); err != nil {
 		log.Fatalf("Error creating rooms table: %v", err)
 	}
+
+	if err := addColumnIfMissing(db, "rooms", "slow_mode_seconds", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		log.Fatalf("Error updating rooms table: %v", err)
+	}
 }
 
 func createMessageTable(db *sql.DB) {
@@ -59,4 +129,287 @@ func createMessageTable(db *sql.DB) {
 	if _, err := db.Exec(query); err != nil {
 		log.Fatalf("Error creating rooms table: %v", err)
 	}
+
+	// Columns added after the table was first released
+	columns := []struct{ name, definition string }{
+		{"deleted_at", "DATETIME"},
+		{"edited_at", "DATETIME"},
+		{"sender_name", "TEXT"},
+		{"sender_avatar", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := addColumnIfMissing(db, "messages", column.name, column.definition); err != nil {
+			log.Fatalf("Error updating messages table: %v", err)
+		}
+	}
+}
+
+// addColumnIfMissing adds a column to an existing table. CREATE TABLE IF NOT
+// EXISTS leaves tables from older versions untouched, so new columns have
+// to be added separately.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func createLoginAttemptTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		success INTEGER NOT NULL,
+		reason TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts (email, created_at);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating login_attempts table: %v", err)
+	}
+}
+
+func createAvatarTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS avatars (
+		user_id INTEGER PRIMARY KEY,
+		version TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating avatars table: %v", err)
+	}
+}
+
+func createRoomMemberTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS room_members (
+		room_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (room_id, user_id)
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating room_members table: %v", err)
+	}
+
+	// Everyone who wrote in a room before membership was tracked is a member
+	backfill := `
+	INSERT OR IGNORE INTO room_members (room_id, user_id)
+	SELECT DISTINCT messages.room_id, users.id FROM messages JOIN users ON users.email = messages.sender;
+	`
+	if _, err := db.Exec(backfill); err != nil {
+		log.Fatalf("Error backfilling room_members table: %v", err)
+	}
+}
+
+func createAttachmentTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id TEXT PRIMARY KEY,
+		room_id INTEGER NOT NULL,
+		uploader_id INTEGER NOT NULL,
+		message_id TEXT,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		storage_key TEXT NOT NULL,
+		thumbnail_key TEXT,
+		width INTEGER,
+		height INTEGER,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments (message_id);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating attachments table: %v", err)
+	}
+}
+
+func createUserBlockTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_blocks (
+		blocker_id INTEGER NOT NULL,
+		blocked_id INTEGER NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'block',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (blocker_id, blocked_id)
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating user_blocks table: %v", err)
+	}
+}
+
+func createReportTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		reporter_id INTEGER NOT NULL,
+		reported_user_id INTEGER NOT NULL,
+		message_id TEXT,
+		reason TEXT NOT NULL,
+		details TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'open',
+		resolution TEXT,
+		note TEXT,
+		resolved_by INTEGER,
+		resolved_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_reports_status ON reports (status, created_at);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating reports table: %v", err)
+	}
+}
+
+func createRoomFilterTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS room_filters (
+		room_id INTEGER PRIMARY KEY,
+		rules TEXT NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating room_filters table: %v", err)
+	}
+}
+
+func createWebhookTables(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS room_webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_room_webhooks_room ON room_webhooks (room_id);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		delivery_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		delivery_id TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_webhook ON webhook_dead_letters (webhook_id, id);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating webhook tables: %v", err)
+	}
+}
+
+func createIncomingWebhookTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS incoming_webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		room_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		avatar_url TEXT NOT NULL DEFAULT '',
+		token_hash TEXT UNIQUE NOT NULL,
+		created_by INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating incoming_webhooks table: %v", err)
+	}
+}
+
+func createAPITokenTable(db *sql.DB) {
+	query := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		last_used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_api_tokens_user ON api_tokens (user_id);
+	`
+	if _, err := db.Exec(query); err != nil {
+		log.Fatalf("Error creating api_tokens table: %v", err)
+	}
+}
+
+// backfillHandles gives every account created before profiles existed a
+// handle derived from its e-mail address.
+func backfillHandles(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, email FROM users WHERE handle IS NULL OR handle = ''")
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		id    int
+		email string
+	}
+	var users []pending
+	for rows.Next() {
+		var u pending
+		if err := rows.Scan(&u.id, &u.email); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		handle, err := uniqueHandle(&SQLiteStore{sqlStore{db: db}}, handleFromEmail(u.email))
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE users SET handle = ? WHERE id = ?", handle, u.id); err != nil {
+			return err
+		}
+		log.Printf("Assigned handle %s to user %d", handle, u.id)
+	}
+	return nil
 }
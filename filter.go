@@ -0,0 +1,547 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FilterAction is what happens to a message that trips a filter.
+type FilterAction string
+
+const (
+	FilterAllow  FilterAction = ""
+	FilterReject FilterAction = "reject"
+	FilterMask   FilterAction = "mask"
+	FilterFlag   FilterAction = "flag"
+)
+
+func (a FilterAction) valid() bool {
+	return a == FilterReject || a == FilterMask || a == FilterFlag
+}
+
+// FilterResult is the verdict of a filter. Masking filters return the
+// cleaned up content.
+type FilterResult struct {
+	Action  FilterAction
+	Content string
+	Reason  string
+}
+
+// Filter inspects the content of an inbound chat message. Filters are
+// combined into a FilterPipeline; new kinds of checks only have to
+// implement this interface.
+type Filter interface {
+	Apply(content string) FilterResult
+}
+
+// FilterPipeline runs filters in order. Masks are applied cumulatively, a
+// reject stops the pipeline, and flags are collected.
+type FilterPipeline struct {
+	filters []Filter
+}
+
+// PipelineResult is the outcome of running a message through a pipeline.
+type PipelineResult struct {
+	Rejected bool
+	Content  string
+	// Reasons for rejecting or flagging the message
+	Reasons []string
+}
+
+func (p *FilterPipeline) Apply(content string) PipelineResult {
+	result := PipelineResult{Content: content}
+	for _, filter := range p.filters {
+		verdict := filter.Apply(result.Content)
+		switch verdict.Action {
+		case FilterReject:
+			return PipelineResult{Rejected: true, Content: result.Content, Reasons: []string{verdict.Reason}}
+		case FilterMask:
+			result.Content = verdict.Content
+		case FilterFlag:
+			result.Reasons = append(result.Reasons, verdict.Reason)
+		}
+	}
+	return result
+}
+
+// Flagged reports whether the message should be sent to the moderation
+// queue.
+func (r PipelineResult) Flagged() bool {
+	return !r.Rejected && len(r.Reasons) > 0
+}
+
+// FilterRules configures the built-in filters. A zero value disables a rule.
+type FilterRules struct {
+	BlockedWords    []string     `json:"blocked_words,omitempty"`
+	BlockedPatterns []string     `json:"blocked_patterns,omitempty"`
+	WordAction      FilterAction `json:"word_action,omitempty"`
+
+	AllowedDomains []string     `json:"allowed_domains,omitempty"`
+	DeniedDomains  []string     `json:"denied_domains,omitempty"`
+	LinkAction     FilterAction `json:"link_action,omitempty"`
+
+	MaxLength    int          `json:"max_length,omitempty"`
+	LengthAction FilterAction `json:"length_action,omitempty"`
+
+	// Longest allowed run of the same character, e.g. "!!!!!!"
+	MaxRepeatedChars int `json:"max_repeated_chars,omitempty"`
+	// Largest allowed share of upper case letters in messages of at least
+	// 12 letters, between 0 and 1
+	MaxUppercaseRatio float64      `json:"max_uppercase_ratio,omitempty"`
+	SpamAction        FilterAction `json:"spam_action,omitempty"`
+}
+
+// Build validates the rules and compiles them into a pipeline.
+func (rules FilterRules) Build() (*FilterPipeline, error) {
+	pipeline := &FilterPipeline{}
+	add := func(action FilterAction, fallback FilterAction, build func(FilterAction) (Filter, error)) error {
+		if action == "" {
+			action = fallback
+		}
+		if !action.valid() {
+			return fmt.Errorf("invalid filter action %q", action)
+		}
+		filter, err := build(action)
+		if err != nil {
+			return err
+		}
+		pipeline.filters = append(pipeline.filters, filter)
+		return nil
+	}
+
+	if rules.MaxLength > 0 {
+		err := add(rules.LengthAction, FilterReject, func(action FilterAction) (Filter, error) {
+			return &LengthFilter{Max: rules.MaxLength, Action: action}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Before the masking filters, whose asterisks would look like spam
+	if rules.MaxRepeatedChars > 0 || rules.MaxUppercaseRatio > 0 {
+		if rules.MaxUppercaseRatio > 1 {
+			return nil, fmt.Errorf("max_uppercase_ratio must be between 0 and 1")
+		}
+		err := add(rules.SpamAction, FilterReject, func(action FilterAction) (Filter, error) {
+			return &SpamFilter{MaxRepeatedChars: rules.MaxRepeatedChars, MaxUppercaseRatio: rules.MaxUppercaseRatio, Action: action}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rules.BlockedWords) > 0 || len(rules.BlockedPatterns) > 0 {
+		err := add(rules.WordAction, FilterMask, func(action FilterAction) (Filter, error) {
+			return NewWordFilter(rules.BlockedWords, rules.BlockedPatterns, action)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(rules.AllowedDomains) > 0 || len(rules.DeniedDomains) > 0 {
+		err := add(rules.LinkAction, FilterReject, func(action FilterAction) (Filter, error) {
+			return &LinkFilter{Allowed: rules.AllowedDomains, Denied: rules.DeniedDomains, Action: action}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pipeline, nil
+}
+
+// WordFilter matches whole words case-insensitively, plus arbitrary regular
+// expressions. Masking replaces each match with asterisks.
+type WordFilter struct {
+	patterns []*regexp.Regexp
+	Action   FilterAction
+}
+
+func NewWordFilter(words, patterns []string, action FilterAction) (*WordFilter, error) {
+	filter := &WordFilter{Action: action}
+	if len(words) > 0 {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+		}
+		filter.patterns = append(filter.patterns, regexp.MustCompile(`(?i)\b(?:`+strings.Join(quoted, "|")+`)\b`))
+	}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocked pattern %q: %v", pattern, err)
+		}
+		filter.patterns = append(filter.patterns, re)
+	}
+	return filter, nil
+}
+
+func (f *WordFilter) Apply(content string) FilterResult {
+	masked, matched := content, false
+	for _, re := range f.patterns {
+		masked = re.ReplaceAllStringFunc(masked, func(match string) string {
+			matched = true
+			return strings.Repeat("*", utf8.RuneCountInString(match))
+		})
+	}
+	if !matched {
+		return FilterResult{}
+	}
+	return FilterResult{Action: f.Action, Content: masked, Reason: "contains blocked words"}
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// LinkFilter checks the domains of links. Denied domains always match; if
+// allowed domains are configured, links to any other domain match too.
+// Subdomains count as their parent domain.
+type LinkFilter struct {
+	Allowed []string
+	Denied  []string
+	Action  FilterAction
+}
+
+func domainMatches(host string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *LinkFilter) forbidden(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Hostname() == "" {
+		return true
+	}
+	host := strings.ToLower(u.Hostname())
+	if domainMatches(host, f.Denied) {
+		return true
+	}
+	return len(f.Allowed) > 0 && !domainMatches(host, f.Allowed)
+}
+
+func (f *LinkFilter) Apply(content string) FilterResult {
+	matched := false
+	masked := linkPattern.ReplaceAllStringFunc(content, func(link string) string {
+		if !f.forbidden(link) {
+			return link
+		}
+		matched = true
+		return "[link removed]"
+	})
+	if !matched {
+		return FilterResult{}
+	}
+	return FilterResult{Action: f.Action, Content: masked, Reason: "contains links to domains that are not allowed"}
+}
+
+// LengthFilter limits the number of characters. Masking truncates.
+type LengthFilter struct {
+	Max    int
+	Action FilterAction
+}
+
+func (f *LengthFilter) Apply(content string) FilterResult {
+	if utf8.RuneCountInString(content) <= f.Max {
+		return FilterResult{}
+	}
+	runes := []rune(content)
+	return FilterResult{
+		Action:  f.Action,
+		Content: string(runes[:f.Max]),
+		Reason:  fmt.Sprintf("longer than %d characters", f.Max),
+	}
+}
+
+// SpamFilter catches long runs of one character and shouting. Masking
+// shortens the runs and lowers the case.
+type SpamFilter struct {
+	MaxRepeatedChars  int
+	MaxUppercaseRatio float64
+	Action            FilterAction
+}
+
+const minLettersForUppercaseCheck = 12
+
+func (f *SpamFilter) Apply(content string) FilterResult {
+	var reasons []string
+	masked := content
+
+	if f.MaxRepeatedChars > 0 {
+		var sb strings.Builder
+		var previous rune
+		run, repeated := 0, false
+		for _, r := range content {
+			if r == previous {
+				run++
+			} else {
+				previous, run = r, 1
+			}
+			if run > f.MaxRepeatedChars {
+				repeated = true
+				continue
+			}
+			sb.WriteRune(r)
+		}
+		if repeated {
+			masked = sb.String()
+			reasons = append(reasons, "repeated characters")
+		}
+	}
+
+	if f.MaxUppercaseRatio > 0 {
+		letters, upper := 0, 0
+		for _, r := range content {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		if letters >= minLettersForUppercaseCheck && float64(upper)/float64(letters) > f.MaxUppercaseRatio {
+			masked = strings.ToLower(masked)
+			reasons = append(reasons, "too many capital letters")
+		}
+	}
+
+	if len(reasons) == 0 {
+		return FilterResult{}
+	}
+	return FilterResult{Action: f.Action, Content: masked, Reason: "looks like spam: " + strings.Join(reasons, ", ")}
+}
+
+// ContentFilters hands out the pipeline for a room. Rooms without their own
+// rules use the defaults. Filters added with Use run for every room, after
+// the configured ones.
+type ContentFilters struct {
+	store    Store
+	defaults FilterRules
+	extra    []Filter
+
+	mu    sync.Mutex
+	cache map[int]*FilterPipeline
+	// Tells every node that the rules of a room changed, so that they drop
+	// the pipeline they cached; set by NewClientManager
+	publish func(ClusterEvent)
+}
+
+func NewContentFilters(store Store, cfg FilterConfig) (*ContentFilters, error) {
+	defaults := FilterRules{MaxLength: cfg.MaxMessageLength}
+	if cfg.RulesFile != "" {
+		data, err := os.ReadFile(cfg.RulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading filter rules: %v", err)
+		}
+		if err := json.Unmarshal(data, &defaults); err != nil {
+			return nil, fmt.Errorf("error parsing filter rules %s: %v", cfg.RulesFile, err)
+		}
+	}
+	if _, err := defaults.Build(); err != nil {
+		return nil, fmt.Errorf("invalid filter rules: %v", err)
+	}
+
+	return &ContentFilters{
+		store:    store,
+		defaults: defaults,
+		cache:    make(map[int]*FilterPipeline),
+	}, nil
+}
+
+// Use adds a filter to every pipeline.
+func (cf *ContentFilters) Use(filter Filter) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	cf.extra = append(cf.extra, filter)
+	clear(cf.cache)
+}
+
+// Rules returns the rules in effect for a room and whether they are room
+// specific. A roomId of 0 stands for direct messages, which always use the
+// defaults.
+func (cf *ContentFilters) Rules(roomId int) (FilterRules, bool, error) {
+	data, err := cf.store.RoomFilterRules(roomId)
+	if err == sql.ErrNoRows {
+		return cf.defaults, false, nil
+	}
+	if err != nil {
+		return FilterRules{}, false, err
+	}
+
+	var rules FilterRules
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return FilterRules{}, false, fmt.Errorf("invalid filter rules for room %d: %v", roomId, err)
+	}
+	return rules, true, nil
+}
+
+func (cf *ContentFilters) ForRoom(roomId int) (*FilterPipeline, error) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	if pipeline, ok := cf.cache[roomId]; ok {
+		return pipeline, nil
+	}
+
+	rules, _, err := cf.Rules(roomId)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := rules.Build()
+	if err != nil {
+		return nil, err
+	}
+	pipeline.filters = append(pipeline.filters, cf.extra...)
+	cf.cache[roomId] = pipeline
+	return pipeline, nil
+}
+
+// SetRoomRules replaces the rules of a room. They apply instead of the
+// defaults, not in addition to them.
+func (cf *ContentFilters) SetRoomRules(roomId int, rules FilterRules) error {
+	if _, err := rules.Build(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+
+	if err := cf.store.SetRoomFilterRules(roomId, string(data)); err != nil {
+		return err
+	}
+	cf.changed(roomId)
+	return nil
+}
+
+// ResetRoomRules makes a room use the defaults again.
+func (cf *ContentFilters) ResetRoomRules(roomId int) error {
+	if err := cf.store.DeleteRoomFilterRules(roomId); err != nil {
+		return err
+	}
+	cf.changed(roomId)
+	return nil
+}
+
+// changed drops the cached pipeline of a room here at once and on the other
+// nodes by way of a cluster event.
+func (cf *ContentFilters) changed(roomId int) {
+	cf.forget(roomId)
+	if cf.publish != nil {
+		cf.publish(ClusterEvent{Kind: ClusterFilters, RoomId: roomId})
+	}
+}
+
+func (cf *ContentFilters) forget(roomId int) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	delete(cf.cache, roomId)
+}
+
+// flagMessage files a report on behalf of the content filters.
+func flagMessage(store Store, manager *ClientManager, senderId int, messageId string, reasons []string, content string) {
+	details := "Flagged by content filter: " + strings.Join(reasons, "; ")
+	if messageId == "" {
+		details += "\n\n" + content
+	}
+	id, err := store.CreateReport(0, senderId, messageId, "filter", details)
+	if err != nil {
+		log.Printf("Error flagging message from user %d: %v", senderId, err)
+		return
+	}
+	if report, err := getReport(store, id); err == nil {
+		manager.NotifyModerators(newMessage(ReportMessage, fmt.Sprintf("New report #%d against %s: filter", id, report.ReportedUser.Handle), "system", nil))
+	}
+}
+
+type roomFiltersResponse struct {
+	RoomId int         `json:"room_id"`
+	Custom bool        `json:"custom"`
+	Rules  FilterRules `json:"rules"`
+}
+
+func handleGetRoomFilters(filters *ContentFilters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, err := strconv.Atoi(r.PathValue("roomId"))
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+
+		rules, custom, err := filters.Rules(roomId)
+		if err != nil {
+			http.Error(w, "Failed to get filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(roomFiltersResponse{RoomId: roomId, Custom: custom, Rules: rules})
+		if err != nil {
+			http.Error(w, "Failed to encode filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleSetRoomFilters(store Store, filters *ContentFilters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, err := strconv.Atoi(r.PathValue("roomId"))
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		if _, err := store.RoomById(roomId); err == sql.ErrNoRows {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+
+		var rules FilterRules
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := filters.SetRoomRules(roomId, rules); err != nil {
+			http.Error(w, "Failed to update filters: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(roomFiltersResponse{RoomId: roomId, Custom: true, Rules: rules})
+		if err != nil {
+			http.Error(w, "Failed to encode filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleResetRoomFilters(filters *ContentFilters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, err := strconv.Atoi(r.PathValue("roomId"))
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		if err := filters.ResetRoomRules(roomId); err != nil {
+			http.Error(w, "Failed to reset filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFilterPipeline(t *testing.T) {
+	pipeline, err := FilterRules{
+		BlockedWords:     []string{"darn"},
+		BlockedPatterns:  []string{`\d{4}-\d{4}`},
+		DeniedDomains:    []string{"evil.com"},
+		MaxLength:        50,
+		MaxRepeatedChars: 3,
+		SpamAction:       FilterFlag,
+	}.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	tests := []struct {
+		content  string
+		rejected bool
+		want     string
+		reasons  []string
+	}{
+		{"hello", false, "hello", nil},
+		{"Darn it, darned thing", false, "**** it, darned thing", nil},
+		{"card 1234-5678", false, "card *********", nil},
+		{"see https://good.com", false, "see https://good.com", nil},
+		{"see http://www.evil.com/x", true, "see http://www.evil.com/x", []string{"contains links to domains that are not allowed"}},
+		{"see www.sub.Evil.com", true, "see www.sub.Evil.com", []string{"contains links to domains that are not allowed"}},
+		{strings.Repeat("a", 51), true, strings.Repeat("a", 51), []string{"longer than 50 characters"}},
+		{"darn!!!!", false, "****!!!!", []string{"looks like spam: repeated characters"}},
+	}
+	for _, test := range tests {
+		result := pipeline.Apply(test.content)
+		if result.Rejected != test.rejected || result.Content != test.want || !slices.Equal(result.Reasons, test.reasons) {
+			t.Errorf("Apply(%q) = %+v, want rejected=%v content=%q reasons=%q", test.content, result, test.rejected, test.want, test.reasons)
+		}
+		if result.Flagged() != (!test.rejected && len(test.reasons) > 0) {
+			t.Errorf("Apply(%q).Flagged() = %v", test.content, result.Flagged())
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	links := &LinkFilter{Allowed: []string{"example.com"}, Action: FilterMask}
+	spam := &SpamFilter{MaxUppercaseRatio: 0.5, Action: FilterMask}
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		content string
+		want    FilterResult
+	}{
+		{"allowed domain", links, "docs at https://docs.example.com", FilterResult{}},
+		{"other domain", links, "go to www.other.org now", FilterResult{FilterMask, "go to [link removed] now", "contains links to domains that are not allowed"}},
+		{"shouting", spam, "THIS IS VERY LOUD", FilterResult{FilterMask, "this is very loud", "looks like spam: too many capital letters"}},
+		{"short shouting", spam, "HI THERE", FilterResult{}},
+		{"truncated", &LengthFilter{Max: 3, Action: FilterMask}, "héllo", FilterResult{FilterMask, "hél", "longer than 3 characters"}},
+	}
+	for _, test := range tests {
+		if got := test.filter.Apply(test.content); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFilterRulesValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules FilterRules
+	}{
+		{"unknown action", FilterRules{BlockedWords: []string{"darn"}, WordAction: "delete"}},
+		{"bad pattern", FilterRules{BlockedPatterns: []string{"("}}},
+		{"uppercase ratio", FilterRules{MaxUppercaseRatio: 2}},
+	}
+	for _, test := range tests {
+		if _, err := test.rules.Build(); err == nil {
+			t.Errorf("%s: rules were accepted", test.name)
+		}
+	}
+}
+
+func TestContentFiltersRoomRules(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+	filters, err := NewContentFilters(store, FilterConfig{MaxMessageLength: 10})
+	if err != nil {
+		t.Fatalf("NewContentFilters: %v", err)
+	}
+	filters.Use(&WordFilter{})
+
+	apply := func(roomId int, content string) PipelineResult {
+		t.Helper()
+		pipeline, err := filters.ForRoom(roomId)
+		if err != nil {
+			t.Fatalf("ForRoom: %v", err)
+		}
+		return pipeline.Apply(content)
+	}
+
+	if !apply(room.Id, "longer than ten").Rejected {
+		t.Errorf("the default length limit does not apply")
+	}
+
+	// Room rules replace the defaults
+	if err := filters.SetRoomRules(room.Id, FilterRules{BlockedWords: []string{"darn"}}); err != nil {
+		t.Fatalf("SetRoomRules: %v", err)
+	}
+	if result := apply(room.Id, "longer than ten, darn"); result.Rejected || result.Content != "longer than ten, ****" {
+		t.Errorf("with room rules got %+v", result)
+	}
+	if rules, custom, err := filters.Rules(room.Id); err != nil || !custom || !slices.Equal(rules.BlockedWords, []string{"darn"}) {
+		t.Errorf("Rules = %+v, %v, %v", rules, custom, err)
+	}
+	if !apply(0, "longer than ten").Rejected {
+		t.Errorf("direct messages do not use the defaults")
+	}
+
+	if err := filters.SetRoomRules(room.Id, FilterRules{LinkAction: "delete", DeniedDomains: []string{"evil.com"}}); err == nil {
+		t.Errorf("invalid room rules were accepted")
+	}
+
+	if err := filters.ResetRoomRules(room.Id); err != nil {
+		t.Fatalf("ResetRoomRules: %v", err)
+	}
+	if !apply(room.Id, "longer than ten").Rejected {
+		t.Errorf("the defaults do not apply after a reset")
+	}
+	if pipeline, _ := filters.ForRoom(room.Id); len(pipeline.filters) != 2 {
+		t.Errorf("pipeline has %d filters, want the length filter and the one added with Use", len(pipeline.filters))
+	}
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
+	Subprotocols: []string{wsTokenProtocol},
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for simplicity (not recommended in production).
 	},
@@ -25,35 +28,75 @@ func ping(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// loadClient loads the account behind a principal for a new connection.
+// Banned accounts get errLoginBanned.
+func loadClient(store Store, principal *Principal) (*Client, error) {
+	profile, err := store.ProfileByEmail(principal.Email)
+	if err != nil {
+		return nil, err
+	}
+	userId, err := store.UserIdByEmail(principal.Email)
+	if err != nil {
+		return nil, err
+	}
+	status, err := store.AccountStatus(userId)
+	if err != nil {
+		return nil, err
+	}
+	if status.Banned {
+		return nil, errLoginBanned
+	}
+	ignored, err := store.IgnoredUsers(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		UserId:      userId,
+		Email:       principal.Email,
+		Handle:      profile.Handle,
+		DisplayName: profile.DisplayName,
+		AvatarURL:   profile.AvatarURL,
+		Ignored:     ignored,
+		Role:        status.Role,
+		MutedUntil:  status.MutedUntil,
+		IsBot:       profile.Bot,
+		TokenId:     principal.TokenId,
+		Scopes:      principal.Scopes,
+	}, nil
+}
+
 func handleWebSocket(manager *ClientManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract the token from query parameters
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			http.Error(w, "Missing token", http.StatusUnauthorized)
+		// The handshake has already been authenticated by authMiddleware
+		principal, ok := principalFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		email := principal.Email
 
-		// Validate the JWT token
-		email, err := validateJWT(token)
+		client, err := loadClient(manager.Store, principal)
+		if err == errLoginBanned {
+			http.Error(w, "Account is banned", http.StatusForbidden)
+			return
+		}
 		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			http.Error(w, "Failed to load account", http.StatusInternalServerError)
 			return
 		}
 
 		// Upgrade the HTTP connection to a WebSocket connection
-		conn, err := upgrader.Upgrade(w, r, nil)
+		ws, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Error upgrading to WebSocket: ", err)
 			return
 		}
+		conn := &webSocketConn{Conn: ws}
 		defer conn.Close()
 
 		clientID := uuid.New().String()
-		client := &Client{
-			Conn:  conn,
-			Email: email,
-		}
+		client.Conn = conn
 		manager.AddClient(clientID, client)
 
 		room, err := manager.JoinRoom("general", client)
@@ -89,73 +132,125 @@ func handleWebSocket(manager *ClientManager) http.HandlerFunc {
 
 		// Cleanup when the client disconnects
 		manager.RemoveClient(clientID)
+		manager.Limiter.Forget(client)
 		sendMessage(conn, SystemMessage, "You have left the chat.", "system", nil)
 	}
 }
 
-func handleClientMessage(conn *websocket.Conn, client *Client, manager *ClientManager, message []byte, email string) error {
+func handleClientMessage(conn ClientConn, client *Client, manager *ClientManager, message []byte, email string) error {
 	// parse the message
 	parsedMessage := parseMessage(string(message))
 
-	// Check if the client has joined a room
-	if client.Room == nil && parsedMessage.Type != CommandMessage {
+	// Check if the client has joined a room. Direct messages don't need one,
+	// IRC clients may send them before joining a channel.
+	if client.Room == nil && parsedMessage.Type != CommandMessage && parsedMessage.Type != DirectMessage {
 		sendMessage(conn, SystemMessage, "You must join a room first. Use /join <roomName>", "system", nil)
 		return nil
 	}
 
+	if (parsedMessage.Type == RegularMessage || parsedMessage.Type == DirectMessage || parsedMessage.Type == TypingMessage) && !client.can(ScopePostMessages) {
+		sendMessage(conn, SystemMessage, "This token can't post messages, it needs the "+ScopePostMessages+" scope.", "system", nil)
+		return nil
+	}
+
 	if parsedMessage.Type == TypingMessage {
 		isTyping := parsedMessage.Content == "true"
 		manager.UpdateClientTypingStatus(client, isTyping)
 		return nil
 	}
 
+	if (parsedMessage.Type == RegularMessage || parsedMessage.Type == DirectMessage) && time.Now().Before(client.MutedUntil) {
+		sendMessage(conn, SystemMessage, "You are muted until "+client.MutedUntil.UTC().Format(time.RFC3339)+".", "system", nil)
+		return nil
+	}
+
+	if parsedMessage.Type == RegularMessage || parsedMessage.Type == DirectMessage {
+		roomId, slowMode := 0, time.Duration(0)
+		if parsedMessage.Type == RegularMessage {
+			roomId, slowMode = client.Room.Id, time.Duration(client.Room.SlowModeSeconds)*time.Second
+		}
+		if limited := manager.Limiter.Allow(client, roomId, slowMode); limited != nil {
+			notice := newMessage(SystemMessage, limited.Error(), "system", nil)
+			notice.RetryAfter = int(math.Ceil(limited.Wait.Seconds()))
+			writeMessage(conn, notice)
+			return nil
+		}
+	}
+
 	switch parsedMessage.Type {
 	case RegularMessage:
 		log.Printf("[%s]: %s\n", email, parsedMessage.Content)
-		manager.BroadcastMessageToRoom(client.Room.Name, []byte(fmt.Sprintf(parsedMessage.Content)), email)
-		err := saveMessageToDb(manager.Db, parsedMessage, parsedMessage.Room.Id, client.Email)
+		pipeline, err := manager.Filters.ForRoom(client.Room.Id)
+		if err != nil {
+			return err
+		}
+		verdict := pipeline.Apply(parsedMessage.Content)
+		if verdict.Rejected {
+			sendMessage(conn, SystemMessage, "Message rejected: "+verdict.Reasons[0], "system", nil)
+			return nil
+		}
+		message := newMessageFrom(RegularMessage, verdict.Content, client, client.Room)
+
+		if len(parsedMessage.Attachments) > 0 {
+			attachments, err := manager.Store.ClaimAttachments(parsedMessage.Attachments, client.Room.Id, client.UserId, message.Id)
+			if err != nil {
+				sendMessage(conn, SystemMessage, "Invalid attachments: "+err.Error(), "system", nil)
+				return nil
+			}
+			message.Attachments = attachments
+		}
+
+		err = manager.Store.SaveMessage(message, client.Room.Id)
 		if err != nil {
 			log.Printf("Error saving message to DB: %v", err)
 			sendMessage(conn, SystemMessage, "Error saving message to DB: "+err.Error(), "system", nil)
 		}
+		manager.BroadcastToRoom(client.Room.Name, message)
+		manager.Webhooks.Dispatch(*client.Room, EventMessageCreated, &message, nil)
+		if verdict.Flagged() {
+			flagMessage(manager.Store, manager, client.UserId, message.Id, verdict.Reasons, message.Content)
+		}
 	case DirectMessage:
 		log.Printf("[DM from %s to %s]: %s\n", email, parsedMessage.Target, parsedMessage.Content)
-		targetClient := manager.FindClientByEmail(parsedMessage.Target)
-		if targetClient != nil {
-			sendMessage(targetClient.Conn, DirectMessage, parsedMessage.Content, email, nil)
-		} else {
-			sendMessage(conn, SystemMessage, fmt.Sprintf("User %s not found.", parsedMessage.Target), "system", nil)
-		}
-	case CommandMessage:
-		switch parsedMessage.Command {
-		case UsersCommand:
-			var sb strings.Builder
-			for key, val := range manager.Emails {
-				if val {
-					sb.WriteString(key + "\n")
-				}
+		// Blocked senders get the same answer as for users who are offline, so
+		// they can't tell they were blocked
+		targetId, online := manager.FindOnlineUser(parsedMessage.Target)
+		if online {
+			kind, err := manager.Store.BlockKind(targetId, client.UserId)
+			if err != nil {
+				return err
+			}
+			if kind == BlockKindBlock {
+				online = false
 			}
-			sendMessage(conn, SystemMessage, sb.String(), "system", nil)
-		case JoinCommand:
-			roomName := parsedMessage.Content
-			if _, err := manager.JoinRoom(roomName, client); err != nil {
-				log.Printf("Failed to join room: %v", err)
-				sendMessage(conn, SystemMessage, "Failed to join room: "+err.Error(), "system", nil)
+		}
+		if online {
+			// Direct messages don't belong to a room and use the default filters
+			pipeline, err := manager.Filters.ForRoom(0)
+			if err != nil {
 				return err
 			}
-
-			// Notify room members
-			manager.BroadcastMessageToRoom(roomName, []byte(fmt.Sprintf("%s has joined the room.", email)), "system")
-		default:
-			sendMessage(conn, SystemMessage, "Invalid command. Use /help for a list of commands.", "system", nil)
+			verdict := pipeline.Apply(parsedMessage.Content)
+			if verdict.Rejected {
+				sendMessage(conn, SystemMessage, "Message rejected: "+verdict.Reasons[0], "system", nil)
+				return nil
+			}
+			manager.SendDirect(parsedMessage.Target, newMessageFrom(DirectMessage, verdict.Content, client, nil))
+			if verdict.Flagged() {
+				flagMessage(manager.Store, manager, client.UserId, "", verdict.Reasons, verdict.Content)
+			}
+		} else {
+			sendMessage(conn, SystemMessage, fmt.Sprintf("User %s not found.", parsedMessage.Target), "system", nil)
 		}
+	case CommandMessage:
+		return manager.Commands.Run(manager, client, parsedMessage.Content)
 	case InvalidMessage:
 		sendMessage(conn, SystemMessage, parsedMessage.Content, "system", nil)
 	}
 	return nil
 }
 
-func handleRegisterUser(db *sql.DB) http.HandlerFunc {
+func handleRegisterUser(store Store, mailer Mailer, cfg AccountConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var user User
 		err := json.NewDecoder(r.Body).Decode(&user)
@@ -164,34 +259,157 @@ func handleRegisterUser(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// register the user
-		err = registerUser(db, user.Email, user.Password)
-		if err != nil {
+		// register the user. A registered address gets the same answer as a
+		// new one, so that registering can't be used to probe for accounts;
+		// its owner is told by e-mail instead.
+		err = registerUser(store, user.Email, user.Password, user.Handle, user.DisplayName)
+		if err != nil && err != errEmailTaken {
 			http.Error(w, "Registration failed: "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
+		// The e-mails are sent in the background so that both cases take
+		// as long. A failed verification e-mail can be retried via the
+		// password reset flow, so don't fail the registration over it.
+		go func(email string, registered bool) {
+			send, kind := sendVerificationEmail, "verification"
+			if registered {
+				send, kind = sendAlreadyRegisteredEmail, "already registered"
+			}
+			if err := send(mailer, cfg, email); err != nil {
+				log.Printf("Error sending %s e-mail to %s: %v", kind, email, err)
+			}
+		}(user.Email, err == errEmailTaken)
+
 		w.WriteHeader(http.StatusCreated)
 	}
 }
 
-func handleLoginUser(db *sql.DB) http.HandlerFunc {
+type loginRequest struct {
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	TOTPCode     string `json:"totp_code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// Reasons for checkLogin to refuse a login
+var (
+	errLoginInvalid             = errors.New("Invalid e-mail or password")
+	errLoginBanned              = errors.New("Account is banned")
+	errLoginUnverified          = errors.New("E-mail address is not verified")
+	errLoginTOTPRequired        = errors.New("Two-factor code required")
+	errLoginInvalidSecondFactor = errors.New("Invalid two-factor code")
+)
+
+// loginThrottledError refuses logins while the account or IP is locked out.
+type loginThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *loginThrottledError) Error() string {
+	return "Too many failed login attempts, try again later"
+}
+
+// checkLogin verifies the credentials of a login from ip, including the
+// lockout, ban, e-mail verification and second factor, and records the
+// attempt. It is shared by the HTTP login and the IRC gateway.
+func checkLogin(store Store, cfg AccountConfig, guard *LoginGuard, user loginRequest, ip string) error {
+	if wait := guard.Check(user.Email, ip); wait > 0 {
+		recordLoginAttempt(store, user.Email, ip, false, "throttled")
+		return &loginThrottledError{Wait: wait}
+	}
+
+	// loginFailed records the failure
+	loginFailed := func(reason string, err error) error {
+		if guard.RecordFailure(user.Email, ip) {
+			log.Printf("Locking out login for %s from %s after repeated failures", user.Email, ip)
+		}
+		recordLoginAttempt(store, user.Email, ip, false, reason)
+		return err
+	}
+
+	isValid, err := loginUser(store, user.Email, user.Password)
+	if err != nil {
+		return err
+	}
+	if !isValid {
+		return loginFailed("invalid_credentials", errLoginInvalid)
+	}
+
+	userId, err := store.UserIdByEmail(user.Email)
+	if err != nil {
+		return err
+	}
+	status, err := store.AccountStatus(userId)
+	if err != nil {
+		return err
+	}
+	if status.Banned {
+		return errLoginBanned
+	}
+
+	if cfg.RequireEmailVerification {
+		verified, err := store.EmailVerified(user.Email)
+		if err != nil {
+			return err
+		}
+		if !verified {
+			return errLoginUnverified
+		}
+	}
+
+	// Second step: accounts with 2FA need a TOTP or recovery code as well
+	state, err := store.TOTPState(user.Email)
+	if err != nil {
+		return err
+	}
+	if state.Enabled {
+		if user.TOTPCode == "" && user.RecoveryCode == "" {
+			return errLoginTOTPRequired
+		}
+
+		ok, err := verifySecondFactor(store, state, user.TOTPCode, user.RecoveryCode)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return loginFailed("invalid_second_factor", errLoginInvalidSecondFactor)
+		}
+	}
+
+	guard.RecordSuccess(user.Email)
+	return nil
+}
+
+func handleLoginUser(store Store, cfg AccountConfig, guard *LoginGuard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var user User
+		var user loginRequest
 		err := json.NewDecoder(r.Body).Decode(&user)
 		if err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		isValid, err := loginUser(db, user.Email, user.Password)
-		if err != nil {
-			http.Error(w, "Login failed: "+err.Error(), http.StatusInternalServerError)
+		err = checkLogin(store, cfg, guard, user, guard.ClientIP(r))
+		var throttled *loginThrottledError
+		switch {
+		case errors.As(err, &throttled):
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(throttled.Wait)))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
 			return
-		}
-
-		if !isValid {
-			http.Error(w, "Invalid e-mail or password", http.StatusUnauthorized)
+		case err == errLoginTOTPRequired:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]bool{"totp_required": true})
+			return
+		case err == errLoginInvalid || err == errLoginInvalidSecondFactor:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err == errLoginBanned || err == errLoginUnverified:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, "Login failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
@@ -214,9 +432,113 @@ func handleLoginUser(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func handleGetUsers(db *sql.DB) http.HandlerFunc {
+func handleVerifyEmail(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		users, err := getAllUsers(db)
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		email, _, err := validatePurposeToken(req.Token, purposeVerifyEmail)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.MarkEmailVerified(email); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to verify e-mail: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleForgotPassword(store Store, mailer Mailer, cfg AccountConfig, limiter *RateLimiter, limits RateLimitConfig, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Limited per address too, so that nobody can flood an inbox from
+		// many IPs; the limit applies whether or not the address is registered
+		keys := []string{"reset-ip:" + guard.ClientIP(r), "reset-email:" + normalizeEmail(req.Email)}
+		if wait := limiter.AllowKeys(keys, limits.PasswordResetPerHour, limits.PasswordResetBurst); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			http.Error(w, "Too many password reset requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		// Always answer the same way and send in the background, so the
+		// response does not reveal whether the address is registered.
+		go func(email string) {
+			err := sendPasswordResetEmail(store, mailer, cfg, email)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Error sending password reset e-mail to %s: %v", email, err)
+			}
+		}(req.Email)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func handleResetPassword(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token    string `json:"token"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		email, fingerprint, err := validatePurposeToken(req.Token, purposePasswordReset)
+		if err != nil {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+
+		// The fingerprint changes with the password, which makes the token single use
+		current, err := passwordFingerprint(store, email)
+		if err != nil || current != fingerprint {
+			http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+
+		if err := validatePassword(req.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := updatePassword(store, email, req.Password); err != nil {
+			http.Error(w, "Failed to reset password: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Receiving the reset link proves ownership of the address
+		if err := store.MarkEmailVerified(email); err != nil {
+			log.Printf("Error marking %s as verified: %v", email, err)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleGetUsers(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := store.Users()
 		if err != nil {
 			http.Error(w, "Failed to get users: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -231,7 +553,7 @@ func handleGetUsers(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func handleGetMessages(db *sql.DB) http.HandlerFunc {
+func handleGetMessages(store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		roomParam := r.URL.Query().Get("roomId")
 
@@ -245,9 +567,25 @@ func handleGetMessages(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Invalid roomId", http.StatusBadRequest)
 			return
 		}
-		userEmail := r.URL.Query().Get("sender")
+		senderHandle := r.URL.Query().Get("sender")
+		before := r.URL.Query().Get("before")
+		limit := 0
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		principal, _ := principalFromContext(r.Context())
+		viewerId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		messages, err := getMessages(db, roomId, userEmail)
+		messages, err := store.Messages(roomId, senderHandle, viewerId, before, limit)
 		if err != nil {
 			http.Error(w, "Failed to get messages: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -262,9 +600,97 @@ func handleGetMessages(db *sql.DB) http.HandlerFunc {
 	}
 }
 
-func handleGetRooms(db *sql.DB) http.HandlerFunc {
+// handleEditMessage lets users change the text of their own room messages.
+// The new text goes through the room's content filters like a new message.
+func handleEditMessage(store Store, manager *ClientManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rooms, err := getAllRooms(db)
+		var request struct {
+			Content string `json:"content"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		message, err := store.MessageById(r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		principal, _ := principalFromContext(r.Context())
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if message.Deleted || message.SenderId != userId {
+			http.NotFound(w, r)
+			return
+		}
+		status, err := store.AccountStatus(userId)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if status.Banned {
+			http.Error(w, "Account is banned", http.StatusForbidden)
+			return
+		}
+		if time.Now().Before(status.MutedUntil) {
+			http.Error(w, "You are muted until "+status.MutedUntil.UTC().Format(time.RFC3339), http.StatusForbidden)
+			return
+		}
+		if request.Content == "" && len(message.Attachments) == 0 {
+			http.Error(w, "Chat message cannot be empty", http.StatusBadRequest)
+			return
+		}
+
+		pipeline, err := manager.Filters.ForRoom(message.Room.Id)
+		if err != nil {
+			http.Error(w, "Failed to load content filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		verdict := pipeline.Apply(request.Content)
+		if verdict.Rejected {
+			http.Error(w, "Message rejected: "+verdict.Reasons[0], http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := store.EditMessage(message.Id, verdict.Content); err != nil {
+			http.Error(w, "Failed to edit message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		message, err = store.MessageById(message.Id)
+		if err != nil {
+			http.Error(w, "Failed to get message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		edited := *message
+		edited.Type = EditedMessage
+		manager.BroadcastToRoom(message.Room.Name, edited)
+		manager.Webhooks.Dispatch(message.Room, EventMessageEdited, message, nil)
+		if verdict.Flagged() {
+			flagMessage(store, manager, userId, message.Id, verdict.Reasons, message.Content)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(message)
+		if err != nil {
+			http.Error(w, "Failed to encode message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleGetRooms(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := store.Rooms()
 		if err != nil {
 			http.Error(w, "Failed to get rooms: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -281,14 +707,7 @@ func handleGetRooms(db *sql.DB) http.HandlerFunc {
 
 func handleGetOnlineUsers(cm *ClientManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cm.Lock.Lock()
-		defer cm.Lock.Unlock()
-
-		users := make([]string, 0, len(cm.Clients))
-		for clientID, client := range cm.Clients {
-			users = append(users, client.Email)
-			log.Printf("Found online user: %s (ID: %s)", client.Email, clientID)
-		}
+		users := cm.OnlineHandles()
 
 		w.Header().Set("Content-Type", "application/json")
 		err := json.NewEncoder(w).Encode(users)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMailer hands the e-mails it is asked to send to the test.
+type testMailer chan [2]string
+
+func (m testMailer) Send(to, subject, body string) error {
+	m <- [2]string{to, subject}
+	return nil
+}
+
+func (m testMailer) expect(t *testing.T, to, subject string) {
+	t.Helper()
+	select {
+	case mail := <-m:
+		if mail != [2]string{to, subject} {
+			t.Errorf("sent %q to %s, want %q to %s", mail[1], mail[0], subject, to)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no e-mail sent to %s", to)
+	}
+}
+
+func TestRegisterUserHidesRegisteredAddresses(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	mailer := make(testMailer, 1)
+	handler := handleRegisterUser(store, mailer, AccountConfig{PublicURL: "http://chat.test"})
+
+	register := func(body string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := register(`{"email": "carol@example.com", "password": "password123"}`); code != http.StatusCreated {
+		t.Errorf("registering a new address returned %d, want %d", code, http.StatusCreated)
+	}
+	mailer.expect(t, "carol@example.com", "Confirm your e-mail address")
+
+	if code := register(`{"email": "alice@example.com", "password": "password123"}`); code != http.StatusCreated {
+		t.Errorf("registering a registered address returned %d, want %d", code, http.StatusCreated)
+	}
+	mailer.expect(t, "alice@example.com", "You already have an account")
+
+	if code := register(`{"email": "dave@example.com", "password": "password123", "handle": "bob"}`); code != http.StatusBadRequest {
+		t.Errorf("registering a taken handle returned %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestForgotPasswordIsRateLimited(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	limits := RateLimitConfig{PasswordResetPerHour: 1, PasswordResetBurst: 2}
+	mailer := make(testMailer, 10)
+	handler := handleForgotPassword(store, mailer, AccountConfig{}, NewRateLimiter(limits), limits, NewLoginGuard(LoginGuardConfig{}))
+
+	forgot := func(ip, email string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/password/forgot", strings.NewReader(`{"email": "`+email+`"}`))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	tests := []struct {
+		name  string
+		ip    string
+		email string
+		want  int
+	}{
+		{"first", "192.0.2.1", "alice@example.com", http.StatusAccepted},
+		{"second", "192.0.2.1", "alice@example.com", http.StatusAccepted},
+		{"address over the limit", "192.0.2.2", "Alice@example.com", http.StatusTooManyRequests},
+		{"other address", "192.0.2.2", "bob@example.com", http.StatusAccepted},
+		{"unregistered address", "192.0.2.2", "carol@example.com", http.StatusAccepted},
+		{"IP over the limit", "192.0.2.2", "dave@example.com", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		w := forgot(test.ip, test.email)
+		if w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.want)
+		}
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After header", test.name)
+		}
+	}
+
+	// Only the accepted requests for registered addresses send an e-mail
+	for range 3 {
+		select {
+		case <-mailer:
+		case <-time.After(5 * time.Second):
+			t.Fatal("fewer reset e-mails sent than accepted requests")
+		}
+	}
+}
+
+func TestGetMessagesPages(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, ids := createTestRoom(t, store, aliceId, bobId)
+	handler := handleGetMessages(store)
+	target := "/api/messages?roomId=" + strconv.Itoa(room.Id)
+
+	for _, limit := range []string{"0", "-1", "many"} {
+		if w := serveAs(handler, "alice@example.com", "GET", target+"&limit="+limit, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("limit %s answered %d, want 400", limit, w.Code)
+		}
+	}
+
+	w := serveAs(handler, "alice@example.com", "GET", target+"&limit=2&before="+ids[4], "")
+	var messages []Message
+	if err := json.NewDecoder(w.Body).Decode(&messages); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET %d, %v", w.Code, err)
+	}
+	if got := messageIds(messages); !slices.Equal(got, ids[2:4]) {
+		t.Errorf("got messages %v, want %v", got, ids[2:4])
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Sender of messages posted through incoming webhooks. They show the name
+// and avatar of the webhook, or those given with the message.
+const webhookSender = "webhook"
+
+// IncomingWebhook lets other systems post into a room. The token is only
+// returned when the webhook is created.
+type IncomingWebhook struct {
+	Id        int    `json:"id"`
+	RoomId    int    `json:"room_id"`
+	Name      string `json:"name"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+	CreatedAt string `json:"created_at"`
+	Token     string `json:"token,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+func validateWebhookIdentity(name, avatarURL string) error {
+	if utf8.RuneCountInString(name) > maxDisplayNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxDisplayNameLength)
+	}
+	// Avatars are loaded by the clients, not the server, so any address does
+	if avatarURL != "" && (validateWebhookURL(avatarURL, true) != nil || len(avatarURL) > maxAvatarURLLength) {
+		return fmt.Errorf("avatar must be an http(s) URL")
+	}
+	return nil
+}
+
+// handleIncomingWebhook posts a message into the room of the webhook whose
+// token is in the URL. Attachments are sent inline, base64 encoded.
+func handleIncomingWebhook(store Store, manager *ClientManager, storage Storage, cfg StorageConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, err := store.IncomingWebhookByTokenHash(hashToken(r.PathValue("token")))
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if wait := manager.Limiter.AllowWebhook(hook.Id, hook.RoomId); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+			http.Error(w, "Too many messages, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		// Base64 makes attachments a third larger
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxAttachmentBytes/3*4+1024*1024)
+		var request struct {
+			Text        string `json:"text"`
+			Username    string `json:"username"`
+			IconURL     string `json:"icon_url"`
+			Attachments []struct {
+				Filename string `json:"filename"`
+				Data     []byte `json:"data"`
+			} `json:"attachments"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Text = strings.TrimSpace(request.Text)
+		request.Username = strings.TrimSpace(request.Username)
+		if request.Text == "" && len(request.Attachments) == 0 {
+			http.Error(w, "Text or attachments are required", http.StatusBadRequest)
+			return
+		}
+		if len(request.Attachments) > maxAttachmentsPerMessage {
+			http.Error(w, fmt.Sprintf("A message can have at most %d attachments", maxAttachmentsPerMessage), http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhookIdentity(request.Username, request.IconURL); err != nil {
+			http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, attachment := range request.Attachments {
+			if len(attachment.Data) == 0 {
+				http.Error(w, "Attachment is empty", http.StatusBadRequest)
+				return
+			}
+			if int64(len(attachment.Data)) > cfg.MaxAttachmentBytes {
+				http.Error(w, fmt.Sprintf("File must be at most %d bytes", cfg.MaxAttachmentBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+
+		room, err := store.RoomById(hook.RoomId)
+		if err != nil {
+			http.Error(w, "Failed to get room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Integrations go through the room's filters too. There is no user
+		// to report, so flagged content is let through.
+		pipeline, err := manager.Filters.ForRoom(room.Id)
+		if err != nil {
+			http.Error(w, "Failed to load content filters: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		verdict := pipeline.Apply(request.Text)
+		if verdict.Rejected {
+			http.Error(w, "Message rejected: "+verdict.Reasons[0], http.StatusUnprocessableEntity)
+			return
+		}
+
+		message := newMessage(RegularMessage, verdict.Content, webhookSender, room)
+		message.SenderName = hook.Name
+		if request.Username != "" {
+			message.SenderName = request.Username
+		}
+		message.SenderAvatar = hook.AvatarURL
+		message.WebhookId = hook.Id
+		if request.IconURL != "" {
+			message.SenderAvatar = request.IconURL
+		}
+
+		// Attachments stored so far are deleted again if the message
+		// can't be posted
+		var stored []*storedAttachment
+		discard := func() {
+			for _, attachment := range stored {
+				deleteAttachment(store, storage, attachment)
+			}
+		}
+		if len(request.Attachments) > 0 {
+			refs := make([]Attachment, 0, len(request.Attachments))
+			for _, attachment := range request.Attachments {
+				saved, err := storeAttachment(store, storage, cfg, room.Id, 0, attachment.Filename, attachment.Data)
+				if errors.Is(err, errAttachmentType) {
+					discard()
+					http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+					return
+				}
+				if err != nil {
+					discard()
+					http.Error(w, "Failed to save attachment: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				stored = append(stored, saved)
+				refs = append(refs, saved.Attachment)
+			}
+			message.Attachments, err = store.ClaimAttachments(refs, room.Id, 0, message.Id)
+			if err != nil {
+				discard()
+				http.Error(w, "Failed to save attachments: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := store.SaveMessage(message, room.Id); err != nil {
+			discard()
+			http.Error(w, "Failed to save message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		manager.BroadcastToRoom(room.Name, message)
+		manager.Webhooks.Dispatch(*room, EventMessageCreated, &message, nil)
+		log.Printf("Incoming webhook %d posted to room %s", hook.Id, room.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(message)
+		if err != nil {
+			http.Error(w, "Failed to encode message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleGetIncomingWebhooks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, _, err := webhookPathIds(r)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		hooks, err := store.RoomIncomingWebhooks(roomId)
+		if err != nil {
+			http.Error(w, "Failed to get webhooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(hooks)
+		if err != nil {
+			http.Error(w, "Failed to encode webhooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleCreateIncomingWebhook(store Store, cfg AccountConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, _, err := webhookPathIds(r)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Name      string `json:"name"`
+			AvatarURL string `json:"avatar_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Name = strings.TrimSpace(request.Name)
+		if request.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhookIdentity(request.Name, request.AvatarURL); err != nil {
+			http.Error(w, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := store.RoomById(roomId); err == sql.ErrNoRows {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		principal, _ := principalFromContext(r.Context())
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to get user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		token, err := generateSecret()
+		if err != nil {
+			http.Error(w, "Failed to generate token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		hook := IncomingWebhook{RoomId: roomId, Name: request.Name, AvatarURL: request.AvatarURL, Token: token}
+		if err := store.CreateIncomingWebhook(&hook, hashToken(token), userId); err != nil {
+			http.Error(w, "Failed to create webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hook.URL = cfg.PublicURL + "/api/hooks/" + token
+		log.Printf("Incoming webhook %d created for room %d by %s", hook.Id, roomId, principal.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(hook)
+		if err != nil {
+			http.Error(w, "Failed to encode webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleDeleteIncomingWebhook(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, id, err := webhookPathIds(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		deleted, err := store.DeleteIncomingWebhook(roomId, id)
+		if err != nil {
+			http.Error(w, "Failed to delete webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncomingWebhook(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+	manager := newTestNode(t, store, NewMemoryBroker())
+	if err := manager.Filters.SetRoomRules(room.Id, FilterRules{BlockedWords: []string{"darn"}, MaxLength: 40}); err != nil {
+		t.Fatalf("SetRoomRules: %v", err)
+	}
+	storageDir := t.TempDir()
+	storage, err := NewLocalStorage(storageDir)
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	cfg := StorageConfig{MaxAttachmentBytes: 1024, AllowedAttachmentTypes: []string{"text/plain"}}
+
+	hook := IncomingWebhook{RoomId: room.Id, Name: "CI", AvatarURL: "https://ci.example.com/logo.png"}
+	if err := store.CreateIncomingWebhook(&hook, hashToken("ci-token"), aliceId); err != nil {
+		t.Fatalf("CreateIncomingWebhook: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/hooks/{token}", handleIncomingWebhook(store, manager, storage, cfg))
+
+	post := func(token, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/api/hooks/"+token, strings.NewReader(body)))
+		return rec
+	}
+
+	tests := []struct {
+		token, body string
+		status      int
+	}{
+		{"wrong-token", `{"text": "hi"}`, http.StatusNotFound},
+		{"ci-token", `{"text": "  "}`, http.StatusBadRequest},
+		{"ci-token", `not json`, http.StatusBadRequest},
+		{"ci-token", `{"text": "hi", "icon_url": "javascript:alert(1)"}`, http.StatusBadRequest},
+		{"ci-token", `{"text": "` + strings.Repeat("a", 41) + `"}`, http.StatusUnprocessableEntity},
+		{"ci-token", `{"attachments": [{"filename": "a.pdf", "data": "JVBERi0xLjQ="}]}`, http.StatusUnsupportedMediaType},
+		{"ci-token", `{"attachments": [{"filename": "a.txt", "data": "YnVpbGQgbG9n"}, {"filename": "a.pdf", "data": "JVBERi0xLjQ="}]}`, http.StatusUnsupportedMediaType},
+		{"ci-token", `{"attachments": [{"filename": "a.txt", "data": "` + strings.Repeat("QUFB", 400) + `"}]}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		if rec := post(test.token, test.body); rec.Code != test.status {
+			t.Errorf("POST %s %s: %d %s, want %d", test.token, test.body, rec.Code, rec.Body, test.status)
+		}
+	}
+	// Attachments stored before a later one failed are gone again
+	var attachments int
+	if err := store.(*SQLiteStore).db.QueryRow("SELECT COUNT(*) FROM attachments").Scan(&attachments); err != nil || attachments != 0 {
+		t.Errorf("%d attachments left after failed posts, %v", attachments, err)
+	}
+	var files []string
+	filepath.WalkDir(storageDir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 0 {
+		t.Errorf("files left after failed posts: %v", files)
+	}
+
+	rec := post("ci-token", `{"text": "build darn failed", "attachments": [{"filename": "log.txt", "data": "YnVpbGQgbG9n"}]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	var message Message
+	if err := json.NewDecoder(rec.Body).Decode(&message); err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+	if message.Content != "build **** failed" || message.SenderName != "CI" || message.SenderAvatar != hook.AvatarURL ||
+		len(message.Attachments) != 1 || message.Attachments[0].Filename != "log.txt" {
+		t.Errorf("posted message: %+v", message)
+	}
+
+	rec = post("ci-token", `{"text": "deployed", "username": "Deploy bot", "icon_url": "https://ci.example.com/deploy.png"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	messages, err := store.Messages(room.Id, "", aliceId, "", 0)
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	last := messages[len(messages)-1]
+	if first := messages[len(messages)-2]; first.Id != message.Id || first.WebhookId != hook.Id {
+		t.Errorf("saved message: %+v", first)
+	}
+	if last.Content != "deployed" || last.SenderName != "Deploy bot" || last.SenderAvatar != "https://ci.example.com/deploy.png" {
+		t.Errorf("saved message: %+v", last)
+	}
+}
+
+func TestIncomingWebhookRateLimit(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+	manager := newTestNode(t, store, NewMemoryBroker())
+	// Each webhook can post twice and the room takes three posts, so ci is
+	// stopped by its own limit and deploy by the room's
+	manager.Limiter = NewRateLimiter(RateLimitConfig{UserPerMinute: 1, UserBurst: 2, RoomPerMinute: 1, RoomBurst: 3})
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocalStorage: %v", err)
+	}
+	handler := handleIncomingWebhook(store, manager, storage, StorageConfig{MaxAttachmentBytes: 1024})
+
+	for _, token := range []string{"ci-token", "deploy-token"} {
+		hook := IncomingWebhook{RoomId: room.Id, Name: token}
+		if err := store.CreateIncomingWebhook(&hook, hashToken(token), aliceId); err != nil {
+			t.Fatalf("CreateIncomingWebhook: %v", err)
+		}
+	}
+	post := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/hooks/"+token, strings.NewReader(`{"text": "hi"}`))
+		r.SetPathValue("token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	for i, test := range []struct {
+		token  string
+		status int
+	}{
+		{"ci-token", http.StatusCreated},
+		{"ci-token", http.StatusCreated},
+		{"ci-token", http.StatusTooManyRequests},
+		{"deploy-token", http.StatusCreated},
+		{"deploy-token", http.StatusTooManyRequests},
+	} {
+		rec := post(test.token)
+		if rec.Code != test.status {
+			t.Errorf("post %d with %s: %d %s, want %d", i+1, test.token, rec.Code, rec.Body, test.status)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("post %d with %s has no Retry-After", i+1, test.token)
+		}
+	}
+}
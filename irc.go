@@ -0,0 +1,876 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// IRC numeric replies used by the gateway (RFC 2812)
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplCreated          = "003"
+	rplMyInfo           = "004"
+	rplISupport         = "005"
+	rplUModeIs          = "221"
+	rplUnaway           = "305"
+	rplNowAway          = "306"
+	rplIsOn             = "303"
+	rplWhoisUser        = "311"
+	rplWhoisServer      = "312"
+	rplEndOfWho         = "315"
+	rplEndOfWhois       = "318"
+	rplListStart        = "321"
+	rplList             = "322"
+	rplListEnd          = "323"
+	rplChannelModeIs    = "324"
+	rplNoTopic          = "331"
+	rplWhoReply         = "352"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errCannotSendToChan = "404"
+	errNoRecipient      = "411"
+	errNoTextToSend     = "412"
+	errUnknownCommand   = "421"
+	errNoMotd           = "422"
+	errErroneousNick    = "432"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+	errYoureBanned      = "465"
+	errBadChanMask      = "476"
+)
+
+const (
+	// Lines are limited to 512 bytes including the CR LF
+	ircMaxLine      = 512
+	ircWriteTimeout = 10 * time.Second
+	// Lines waiting to be written to a connection; a client that falls
+	// this far behind is disconnected
+	ircSendQueue = 256
+	// Room every connection lands in over WebSocket. IRC clients join it
+	// themselves, so API tokens don't need rooms:manage for it.
+	ircDefaultRoom = "general"
+)
+
+// IRCGateway lets IRC clients take part in the chat. Each IRC connection is
+// a Client of the ClientManager, so IRC and WebSocket users share rooms,
+// direct messages, filters, rate limits and moderation.
+//
+// Clients sign in with PASS: the account password, with the nick being the
+// handle (or the USER name an e-mail address), or an API token. Accounts
+// with two-factor authentication append ":<code>" to the password. Like a
+// WebSocket connection, an IRC connection is in one room at a time; joining
+// a channel parts the current one.
+type IRCGateway struct {
+	store   Store
+	manager *ClientManager
+	guard   *LoginGuard
+	cfg     IRCConfig
+	account AccountConfig
+	started time.Time
+}
+
+func NewIRCGateway(store Store, manager *ClientManager, guard *LoginGuard, cfg IRCConfig, account AccountConfig) *IRCGateway {
+	return &IRCGateway{
+		store:   store,
+		manager: manager,
+		guard:   guard,
+		cfg:     cfg,
+		account: account,
+		started: time.Now(),
+	}
+}
+
+// ListenAndServe accepts IRC connections until the listener fails.
+func (g *IRCGateway) ListenAndServe() error {
+	var listener net.Listener
+	var err error
+	if g.cfg.TLSCert != "" && g.cfg.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(g.cfg.TLSCert, g.cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		listener, err = tls.Listen("tcp", g.cfg.Addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if err != nil {
+			return err
+		}
+	} else {
+		listener, err = net.Listen("tcp", g.cfg.Addr)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("IRC gateway listening on %s", g.cfg.Addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go newIRCConn(g, conn).serve()
+	}
+}
+
+// ircConn is one IRC connection. As the ClientConn of its Client it turns
+// the messages of the ClientManager into IRC lines. Lines are queued and
+// written by a goroutine of their own, so that a slow client holds up
+// nobody else.
+type ircConn struct {
+	gateway   *IRCGateway
+	conn      net.Conn
+	queue     chan string
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Registration; the connection is registered once client is set
+	nick           string
+	user           string
+	pass           string
+	capNegotiating bool
+	client         *Client
+	clientId       string
+	away           bool
+}
+
+func newIRCConn(gateway *IRCGateway, conn net.Conn) *ircConn {
+	return &ircConn{
+		gateway: gateway,
+		conn:    conn,
+		queue:   make(chan string, ircSendQueue),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *ircConn) serve() {
+	defer c.Close()
+	go c.write()
+
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go c.ping(stopPing)
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 0, ircMaxLine), 8192)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.gateway.cfg.PingInterval))
+		if !scanner.Scan() {
+			break
+		}
+		command, params := parseIRCLine(scanner.Text())
+		if command == "" {
+			continue
+		}
+		if !c.handle(command, params) {
+			break
+		}
+	}
+
+	if c.client != nil {
+		c.gateway.manager.RemoveClient(c.clientId)
+		c.gateway.manager.Limiter.Forget(c.client)
+		log.Printf("IRC client %s disconnected", c.client.Email)
+	}
+}
+
+// ping keeps idle connections alive; clients that don't answer run into
+// the read deadline.
+func (c *ircConn) ping(stop chan struct{}) {
+	ticker := time.NewTicker(c.gateway.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.send("", "PING", c.gateway.cfg.ServerName)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// parseIRCLine splits a line into its command and parameters, dropping
+// message tags and the prefix.
+func parseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var params []string
+	line = strings.TrimLeft(line, " ")
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			params = append(params, line[1:])
+			break
+		}
+		param, rest, _ := strings.Cut(line, " ")
+		params = append(params, param)
+		line = strings.TrimLeft(rest, " ")
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return strings.ToUpper(params[0]), params[1:]
+}
+
+// ircText replaces the characters that would end a line early, so that
+// text from users can't inject commands.
+var ircText = strings.NewReplacer("\r", " ", "\n", " ", "\x00", " ")
+
+// send queues one line. The last parameter may contain spaces.
+func (c *ircConn) send(prefix, command string, params ...string) {
+	var sb strings.Builder
+	if prefix != "" {
+		sb.WriteString(":" + ircText.Replace(prefix) + " ")
+	}
+	sb.WriteString(command)
+	for i, param := range params {
+		param = ircText.Replace(param)
+		sb.WriteString(" ")
+		if i == len(params)-1 && (param == "" || strings.ContainsRune(param, ' ') || strings.HasPrefix(param, ":")) {
+			sb.WriteString(":")
+		}
+		sb.WriteString(param)
+	}
+	sb.WriteString("\r\n")
+
+	select {
+	case c.queue <- sb.String():
+	case <-c.closed:
+	default:
+		// The queued lines would never be read either
+		log.Printf("IRC client %s stopped reading, closing the connection", c.conn.RemoteAddr())
+		c.Close()
+		c.conn.Close()
+	}
+}
+
+// write writes the queued lines until the connection is closed. Lines
+// queued by then are still written, like the ERROR line a client is
+// disconnected with.
+func (c *ircConn) write() {
+	defer c.conn.Close()
+	for {
+		select {
+		case line := <-c.queue:
+			if !c.writeLine(line) {
+				return
+			}
+		case <-c.closed:
+			for {
+				select {
+				case line := <-c.queue:
+					if !c.writeLine(line) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *ircConn) writeLine(line string) bool {
+	c.conn.SetWriteDeadline(time.Now().Add(ircWriteTimeout))
+	_, err := c.conn.Write([]byte(line))
+	return err == nil
+}
+
+// numeric sends a numeric reply from the server to the client.
+func (c *ircConn) numeric(code string, params ...string) {
+	target := c.nick
+	if c.client != nil {
+		target = c.client.Handle
+	}
+	if target == "" {
+		target = "*"
+	}
+	c.send(c.gateway.cfg.ServerName, code, append([]string{target}, params...)...)
+}
+
+// notice sends a notice from the server to the client or a channel.
+func (c *ircConn) notice(target, text string) {
+	for _, line := range c.split(c.gateway.cfg.ServerName, "NOTICE", target, text) {
+		c.send(c.gateway.cfg.ServerName, "NOTICE", target, line)
+	}
+}
+
+// split breaks text into lines that fit into IRC messages.
+func (c *ircConn) split(prefix, command, target, text string) []string {
+	limit := ircMaxLine - len(":"+prefix+" "+command+" "+target+" :\r\n")
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			line = " "
+		}
+		for len(line) > limit {
+			cut := limit
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			lines = append(lines, line[:cut])
+			line = line[cut:]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func ircMask(nick string) string {
+	return nick + "!" + nick + "@chat"
+}
+
+// ircNick returns the nick a message is shown from. Names given by
+// webhooks may contain characters nicks can't.
+func (c *ircConn) ircNick(m Message) string {
+	if m.Sender == "system" {
+		return c.gateway.cfg.ServerName
+	}
+	if m.Sender != webhookSender || m.SenderName == "" {
+		return m.Sender
+	}
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '!' || r == '@' || r == ':' || r == ',' || r == '#' || r < 32 {
+			return '_'
+		}
+		return r
+	}, m.SenderName)
+}
+
+// Close ends the connection once the lines queued so far are written.
+func (c *ircConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// WriteMessage translates a message of the ClientManager into IRC lines and
+// queues them. It is called with the ClientManager lock held, so it must
+// not call back into the manager.
+func (c *ircConn) WriteMessage(_ int, data []byte) error {
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	channel := ""
+	if m.Room.Name != "" {
+		channel = "#" + m.Room.Name
+	}
+	switch m.Type {
+	case RegularMessage, DirectMessage:
+		// IRC clients show what they sent themselves
+		if m.Sender == c.client.Handle && m.Type == RegularMessage {
+			return nil
+		}
+		target := channel
+		if m.Type == DirectMessage {
+			target = c.client.Handle
+		}
+		nick := c.ircNick(m)
+		text := m.Content
+		for _, attachment := range m.Attachments {
+			text += "\n[" + attachment.Filename + "] " + c.gateway.account.PublicURL + attachment.URL
+		}
+		for _, line := range c.split(ircMask(nick), "PRIVMSG", target, strings.TrimLeft(text, "\n")) {
+			c.send(ircMask(nick), "PRIVMSG", target, line)
+		}
+	case EditedMessage:
+		c.notice(channel, c.ircNick(m)+" edited a message: "+m.Content)
+	case DeletedMessage:
+		c.notice(channel, "A message was removed by a moderator.")
+	case TypingMessage:
+	default:
+		target := channel
+		if target == "" {
+			target = c.client.Handle
+		}
+		c.notice(target, m.Content)
+	}
+	return nil
+}
+
+// handle runs one command from the client. It returns false when the
+// connection should be closed.
+func (c *ircConn) handle(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		c.handleCap(params)
+		return true
+	case "PING":
+		c.send(c.gateway.cfg.ServerName, "PONG", c.gateway.cfg.ServerName, strings.Join(params, " "))
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.send("", "ERROR", "Closing link")
+		return false
+	}
+
+	if c.client == nil {
+		return c.handleRegistration(command, params)
+	}
+
+	switch command {
+	case "PASS", "USER":
+		c.numeric(errAlreadyRegistred, "You may not reregister")
+	case "NICK":
+		if len(params) > 0 && !strings.EqualFold(params[0], c.client.Handle) {
+			c.numeric(errErroneousNick, params[0], "Your nick is your handle; change it in your profile")
+		}
+	case "JOIN":
+		c.handleJoin(params)
+	case "PART":
+		c.handlePart(params)
+	case "PRIVMSG", "NOTICE":
+		c.handlePrivmsg(command, params)
+	case "NAMES":
+		c.handleNames(params)
+	case "WHO":
+		c.handleWho(params)
+	case "WHOIS":
+		c.handleWhois(params)
+	case "LIST":
+		c.handleList()
+	case "ISON":
+		c.handleIsOn(params)
+	case "TOPIC":
+		if len(params) > 0 {
+			c.numeric(rplNoTopic, params[0], "No topic is set")
+		}
+	case "MODE":
+		if len(params) > 0 && strings.HasPrefix(params[0], "#") {
+			c.numeric(rplChannelModeIs, params[0], "+")
+		} else {
+			c.numeric(rplUModeIs, "+")
+		}
+	case "AWAY":
+		c.away = len(params) > 0 && params[0] != ""
+		if c.away {
+			c.numeric(rplNowAway, "You have been marked as being away")
+		} else {
+			c.numeric(rplUnaway, "You are no longer marked as being away")
+		}
+	case "MOTD":
+		c.numeric(errNoMotd, "MOTD File is missing")
+	default:
+		// Commands of the registry, like SLOWMODE 10 or USERS
+		name := strings.ToLower(command)
+		if c.gateway.manager.Commands.Lookup(name) == nil {
+			c.numeric(errUnknownCommand, command, "Unknown command")
+			return true
+		}
+		line := strings.TrimSpace(name + " " + strings.Join(params, " "))
+		if err := c.gateway.manager.Commands.Run(c.gateway.manager, c.client, line); err != nil {
+			log.Printf("Error running IRC command %s: %v", name, err)
+		}
+	}
+	return true
+}
+
+func (c *ircConn) handleCap(params []string) {
+	if len(params) == 0 {
+		return
+	}
+	switch strings.ToUpper(params[0]) {
+	case "LS":
+		// No capabilities; registration waits for CAP END
+		c.capNegotiating = c.client == nil
+		c.send(c.gateway.cfg.ServerName, "CAP", "*", "LS", "")
+	case "REQ":
+		if len(params) > 1 {
+			c.send(c.gateway.cfg.ServerName, "CAP", "*", "NAK", params[1])
+		}
+	case "END":
+		c.capNegotiating = false
+		if c.client == nil && c.nick != "" && c.user != "" {
+			c.register()
+		}
+	}
+}
+
+func (c *ircConn) handleRegistration(command string, params []string) bool {
+	switch command {
+	case "PASS":
+		if len(params) == 0 {
+			c.numeric(errNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		c.pass = params[0]
+	case "NICK":
+		if len(params) == 0 {
+			c.numeric(errNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		c.nick = params[0]
+	case "USER":
+		if len(params) < 4 {
+			c.numeric(errNeedMoreParams, command, "Not enough parameters")
+			return true
+		}
+		c.user = params[0]
+	default:
+		c.numeric(errNotRegistered, "You have not registered")
+		return true
+	}
+
+	if c.nick != "" && c.user != "" && !c.capNegotiating {
+		return c.register()
+	}
+	return true
+}
+
+// register signs the connection in once NICK and USER are known.
+func (c *ircConn) register() bool {
+	g := c.gateway
+	ip, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+
+	principal, err := c.authenticate(ip)
+	var throttled *loginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		c.send("", "ERROR", fmt.Sprintf("%s (retry in %ds)", err.Error(), retryAfterSeconds(throttled.Wait)))
+		return false
+	case err == errLoginBanned:
+		c.numeric(errYoureBanned, err.Error())
+		c.send("", "ERROR", err.Error())
+		return false
+	case err == errLoginInvalid || err == errLoginInvalidSecondFactor || err == errLoginUnverified || err == errLoginTOTPRequired:
+		c.numeric(errPasswdMismatch, err.Error())
+		c.send("", "ERROR", err.Error())
+		return false
+	case err != nil:
+		log.Printf("Error signing in IRC client %s: %v", c.nick, err)
+		c.send("", "ERROR", "Login failed")
+		return false
+	}
+
+	client, err := loadClient(g.store, principal)
+	if err != nil {
+		log.Printf("Error loading IRC client %s: %v", principal.Email, err)
+		c.send("", "ERROR", "Failed to load account")
+		return false
+	}
+	client.Conn = c
+	c.client = client
+	c.clientId = uuid.New().String()
+	g.manager.AddClient(c.clientId, client)
+	log.Printf("IRC client %s connected as %s", principal.Email, client.Handle)
+
+	handle := client.Handle
+	c.numeric(rplWelcome, "Welcome to "+g.cfg.ServerName+", "+handle)
+	c.numeric(rplYourHost, "Your host is "+g.cfg.ServerName)
+	c.numeric(rplCreated, "This server was created "+g.started.UTC().Format(time.RFC1123))
+	c.numeric(rplMyInfo, g.cfg.ServerName, "chat-app", "i", "o")
+	c.numeric(rplISupport, "CHANTYPES=#", "PREFIX=(o)@", "NETWORK="+g.cfg.ServerName, "CASEMAPPING=ascii", "are supported by this server")
+	c.numeric(errNoMotd, "MOTD File is missing")
+	c.notice(handle, "You are in one room at a time: joining a channel parts the current one.")
+	return true
+}
+
+// authenticate checks the PASS of the connection.
+func (c *ircConn) authenticate(ip string) (*Principal, error) {
+	g := c.gateway
+	if c.pass == "" {
+		return nil, errLoginInvalid
+	}
+
+	if strings.HasPrefix(c.pass, apiTokenPrefix) {
+		principal, err := authenticateAPIToken(g.store, c.pass)
+		if err == sql.ErrNoRows {
+			return nil, errLoginInvalid
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !principal.Can(ScopeReadRooms) {
+			return nil, errLoginInvalid
+		}
+		return principal, nil
+	}
+
+	email := c.user
+	if !strings.Contains(email, "@") {
+		var err error
+		email, err = g.store.EmailByHandle(c.nick)
+		if err == sql.ErrNoRows {
+			return nil, errLoginInvalid
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	login := loginRequest{Email: email, Password: c.pass}
+	state, err := g.store.TOTPState(email)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && state.Enabled {
+		if i := strings.LastIndex(c.pass, ":"); i >= 0 {
+			login.Password = c.pass[:i]
+			if code := c.pass[i+1:]; strings.Contains(code, "-") {
+				login.RecoveryCode = code
+			} else {
+				login.TOTPCode = code
+			}
+		}
+	}
+	if err := checkLogin(g.store, g.account, g.guard, login, ip); err != nil {
+		return nil, err
+	}
+	return &Principal{Email: email}, nil
+}
+
+// roomOf returns the room name of a channel, "" if it isn't one.
+func roomOf(channel string) string {
+	if !strings.HasPrefix(channel, "#") || len(channel) < 2 {
+		return ""
+	}
+	return channel[1:]
+}
+
+func (c *ircConn) handleJoin(params []string) {
+	if len(params) == 0 {
+		c.numeric(errNeedMoreParams, "JOIN", "Not enough parameters")
+		return
+	}
+	if params[0] == "0" {
+		c.handlePart(nil)
+		return
+	}
+
+	// Only one room at a time, so of several channels the last one wins
+	channels := strings.Split(params[0], ",")
+	channel := channels[len(channels)-1]
+	name := roomOf(channel)
+	if name == "" {
+		c.numeric(errBadChanMask, channel, "Bad Channel Mask")
+		return
+	}
+	if name != ircDefaultRoom && !c.client.can(ScopeManageRooms) {
+		c.notice(c.client.Handle, "This token can't join "+channel+", it needs the "+ScopeManageRooms+" scope.")
+		return
+	}
+	previous := c.client.Room
+	if previous != nil && previous.Name == name {
+		return
+	}
+
+	room, err := c.gateway.manager.JoinRoom(name, c.client)
+	if err != nil {
+		c.notice(c.client.Handle, "Failed to join room: "+err.Error())
+		return
+	}
+	mask := ircMask(c.client.Handle)
+	if previous != nil {
+		c.send(mask, "PART", "#"+previous.Name, "Joined "+channel)
+	}
+	c.send(mask, "JOIN", "#"+room.Name)
+	c.numeric(rplNoTopic, "#"+room.Name, "No topic is set")
+	c.handleNames([]string{"#" + room.Name})
+}
+
+func (c *ircConn) handlePart(params []string) {
+	room := c.client.Room
+	if room == nil {
+		if len(params) > 0 {
+			c.numeric(errNotOnChannel, params[0], "You're not on that channel")
+		}
+		return
+	}
+	if len(params) > 0 && roomOf(params[0]) != room.Name {
+		c.numeric(errNotOnChannel, params[0], "You're not on that channel")
+		return
+	}
+	c.gateway.manager.LeaveRoom(c.client)
+	c.send(ircMask(c.client.Handle), "PART", "#"+room.Name, "Leaving")
+}
+
+func (c *ircConn) handlePrivmsg(command string, params []string) {
+	if len(params) == 0 {
+		c.numeric(errNoRecipient, "No recipient given ("+command+")")
+		return
+	}
+	if len(params) < 2 || params[1] == "" {
+		c.numeric(errNoTextToSend, "No text to send")
+		return
+	}
+	target, text := params[0], params[1]
+
+	// CTCP: actions are sent as emphasized text, the rest is dropped
+	if strings.HasPrefix(text, "\x01") {
+		action, ok := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+		if !ok {
+			return
+		}
+		text = "*" + action + "*"
+	}
+
+	message := Message{Type: DirectMessage, Target: target, Content: text}
+	if strings.HasPrefix(target, "#") {
+		room := c.client.Room
+		if room == nil || roomOf(target) != room.Name {
+			c.numeric(errCannotSendToChan, target, "Cannot send to channel, join it first")
+			return
+		}
+		message = Message{Type: RegularMessage, Content: text}
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	if err := handleClientMessage(c, c.client, c.gateway.manager, data, c.client.Email); err != nil {
+		log.Printf("Error handling IRC message: %v", err)
+		c.notice(c.client.Handle, "Error handling message: "+err.Error())
+	}
+}
+
+// channelClients returns the clients in the room of a channel, the
+// current room if none is given.
+func (c *ircConn) channelClients(params []string) (string, []*Client) {
+	channel := ""
+	if len(params) > 0 {
+		channel = strings.Split(params[0], ",")[0]
+	} else if room := c.client.Room; room != nil {
+		channel = "#" + room.Name
+	}
+	if roomOf(channel) == "" {
+		return channel, nil
+	}
+	return channel, c.gateway.manager.RoomClients(roomOf(channel))
+}
+
+func (c *ircConn) handleNames(params []string) {
+	channel, clients := c.channelClients(params)
+	if channel == "" {
+		c.numeric(rplEndOfNames, "*", "End of /NAMES list")
+		return
+	}
+
+	names := make([]string, 0, len(clients))
+	for _, client := range clients {
+		name := client.Handle
+		if isModeratorRole(client.Role) {
+			name = "@" + name
+		}
+		names = append(names, name)
+	}
+	// Keep the replies within the line length
+	for len(names) > 0 {
+		n := min(len(names), 40)
+		c.numeric(rplNamReply, "=", channel, strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	c.numeric(rplEndOfNames, channel, "End of /NAMES list")
+}
+
+func (c *ircConn) handleWho(params []string) {
+	mask := "*"
+	if len(params) > 0 {
+		mask = params[0]
+	}
+
+	var clients []*Client
+	channel := "*"
+	if roomOf(mask) != "" {
+		channel, clients = c.channelClients([]string{mask})
+	} else if client := c.gateway.manager.FindClientByHandle(mask); client != nil {
+		clients = []*Client{client}
+	}
+	for _, client := range clients {
+		flags := "H"
+		if isModeratorRole(client.Role) {
+			flags += "@"
+		}
+		c.numeric(rplWhoReply, channel, client.Handle, "chat", c.gateway.cfg.ServerName, client.Handle, flags, "0 "+client.Name())
+	}
+	c.numeric(rplEndOfWho, mask, "End of /WHO list")
+}
+
+func (c *ircConn) handleWhois(params []string) {
+	if len(params) == 0 {
+		c.numeric(errNoRecipient, "No nickname given")
+		return
+	}
+	nick := params[len(params)-1]
+	profile, err := c.gateway.store.ProfileByHandle(nick)
+	if err != nil {
+		c.numeric(errNoSuchNick, nick, "No such nick")
+		c.numeric(rplEndOfWhois, nick, "End of /WHOIS list")
+		return
+	}
+	name := profile.DisplayName
+	if name == "" {
+		name = profile.Handle
+	}
+	if profile.Bot {
+		name += " (bot)"
+	}
+	c.numeric(rplWhoisUser, profile.Handle, profile.Handle, "chat", "*", name)
+	c.numeric(rplWhoisServer, profile.Handle, c.gateway.cfg.ServerName, "chat-app")
+	c.numeric(rplEndOfWhois, profile.Handle, "End of /WHOIS list")
+}
+
+func (c *ircConn) handleList() {
+	rooms, err := c.gateway.store.Rooms()
+	if err != nil {
+		c.notice(c.client.Handle, "Failed to list rooms: "+err.Error())
+		return
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+
+	c.numeric(rplListStart, "Channel", "Users  Name")
+	for _, room := range rooms {
+		if strings.ContainsAny(room.Name, " ,") {
+			continue
+		}
+		users := len(c.gateway.manager.RoomClients(room.Name))
+		c.numeric(rplList, "#"+room.Name, strconv.Itoa(users), "")
+	}
+	c.numeric(rplListEnd, "End of /LIST")
+}
+
+func (c *ircConn) handleIsOn(params []string) {
+	online := make(map[string]bool)
+	for _, handle := range c.gateway.manager.OnlineHandles() {
+		online[handle] = true
+	}
+	var found []string
+	for _, param := range params {
+		for _, nick := range strings.Fields(param) {
+			if online[strings.ToLower(nick)] {
+				found = append(found, nick)
+			}
+		}
+	}
+	c.numeric(rplIsOn, strings.Join(found, " "))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestIRCConn returns a registered connection of alice and the other end
+// of it.
+func newTestIRCConn(t *testing.T) (*ircConn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	gateway := &IRCGateway{cfg: IRCConfig{ServerName: "chat.test"}}
+	c := newIRCConn(gateway, server)
+	c.client = &Client{Handle: "alice"}
+	go c.write()
+	return c, client
+}
+
+func writeTestMessage(t *testing.T, c *ircConn, m Message) error {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.WriteMessage(0, data)
+}
+
+func TestIRCWriteMessageKeepsUserTextOnItsLine(t *testing.T) {
+	c, client := newTestIRCConn(t)
+	lines := bufio.NewReader(client)
+
+	writeTestMessage(t, c, Message{Type: RegularMessage, Sender: "bob", Room: Room{Name: "general"},
+		Content: "hi\rQUIT :bye\x00 there\nsecond line"})
+	writeTestMessage(t, c, Message{Type: SystemMessage, Sender: "system", Room: Room{Name: "general"},
+		Content: "notice\r\nPRIVMSG #general :spoofed"})
+
+	want := []string{
+		":bob!bob@chat PRIVMSG #general :hi QUIT :bye  there\r\n",
+		":bob!bob@chat PRIVMSG #general :second line\r\n",
+		":chat.test NOTICE #general notice\r\n",
+		":chat.test NOTICE #general :PRIVMSG #general :spoofed\r\n",
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, w := range want {
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line: %v", err)
+		}
+		if line != w {
+			t.Errorf("got line %q, want %q", line, w)
+		}
+		if strings.ContainsAny(strings.TrimSuffix(line, "\r\n"), "\r\n\x00") {
+			t.Errorf("line %q contains a line break or NUL", line)
+		}
+	}
+}
+
+func TestIRCWriteMessageDoesNotBlockOnSlowClients(t *testing.T) {
+	c, _ := newTestIRCConn(t)
+
+	// Nobody reads the other end of the pipe
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 2 * ircSendQueue {
+			writeTestMessage(t, c, Message{Type: RegularMessage, Sender: "bob", Room: Room{Name: "general"}, Content: "hello"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteMessage blocked on a client that doesn't read")
+	}
+	select {
+	case <-c.closed:
+	default:
+		t.Error("the connection of a client that stopped reading is still open")
+	}
+}
+
+// ircTestClient is the client end of a connection to the gateway.
+type ircTestClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines *bufio.Reader
+}
+
+func dialTestIRC(t *testing.T, gateway *IRCGateway) *ircTestClient {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go newIRCConn(gateway, server).serve()
+	return &ircTestClient{t: t, conn: client, lines: bufio.NewReader(client)}
+}
+
+func (c *ircTestClient) send(lines ...string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	for _, line := range lines {
+		if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+			c.t.Fatalf("sending %q: %v", line, err)
+		}
+	}
+}
+
+// expect reads lines until one contains want and returns it.
+func (c *ircTestClient) expect(want string) string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := c.lines.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %q: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return strings.TrimSuffix(line, "\r\n")
+		}
+	}
+}
+
+func TestIRCGateway(t *testing.T) {
+	useTestJWTKeys(t)
+	useTestTOTPKey(t)
+	store := openTestSQLiteStore(t)
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := registerUser(store, user+"@example.com", user+"-password", user, ""); err != nil {
+			t.Fatalf("registerUser: %v", err)
+		}
+	}
+	carolId, _ := store.UserIdByEmail("carol@example.com")
+	secret, _ := generateTOTPSecret()
+	sealed, err := sealTOTPSecret(carolId, secret)
+	if err != nil {
+		t.Fatalf("sealTOTPSecret: %v", err)
+	}
+	if err := store.SetTOTPSecret(carolId, sealed); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+	if err := store.EnableTOTP(carolId); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+
+	manager := newTestNode(t, store, NewMemoryBroker())
+	guard := NewLoginGuard(LoginGuardConfig{FreeAttempts: 10, BackoffBase: time.Second, BackoffMax: time.Minute,
+		AccountThreshold: 20, IPThreshold: 50, LockoutDuration: time.Minute, Window: time.Hour})
+	gateway := NewIRCGateway(store, manager, guard, IRCConfig{ServerName: "chat.test", PingInterval: time.Minute}, AccountConfig{})
+
+	// bob is on a WebSocket, in general
+	mux := http.NewServeMux()
+	mux.Handle("/api/ws", tokenAuth(store, ScopeReadRooms, handleWebSocket(manager)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	header := http.Header{"Authorization": {"Bearer " + testToken(t, "bob@example.com")}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	fromWebSocket := make(chan Message, 10)
+	go func() {
+		defer close(fromWebSocket)
+		for {
+			var message Message
+			if err := ws.ReadJSON(&message); err != nil {
+				return
+			}
+			fromWebSocket <- message
+		}
+	}()
+	receive := func(messageType MessageType) Message {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case message, ok := <-fromWebSocket:
+				if !ok {
+					t.Fatalf("the WebSocket closed waiting for a %s message", messageType)
+				}
+				if message.Type == messageType {
+					return message
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for a %s message on the WebSocket", messageType)
+			}
+		}
+	}
+	receive(SystemMessage)
+
+	// Registration with a password
+	wrong := dialTestIRC(t, gateway)
+	wrong.send("PASS wrong-password", "NICK alice", "USER alice 0 * :Alice")
+	wrong.expect(" 464 ")
+	alice := dialTestIRC(t, gateway)
+	alice.send("PASS alice-password", "NICK alice", "USER alice 0 * :Alice")
+	alice.expect(" 001 alice ")
+
+	// An account with two-factor authentication needs password:code
+	for _, pass := range []string{"carol-password", "carol-password:000000"} {
+		refused := dialTestIRC(t, gateway)
+		refused.send("PASS "+pass, "NICK carol", "USER carol@example.com 0 * :Carol")
+		refused.expect(" 464 ")
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	code := totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+	carol := dialTestIRC(t, gateway)
+	carol.send("PASS carol-password:"+code, "NICK carol", "USER carol@example.com 0 * :Carol")
+	carol.expect(" 001 carol ")
+
+	// Joining lists who is in the channel
+	alice.send("JOIN #general")
+	alice.expect(":alice!alice@chat JOIN #general")
+	names := alice.expect(" 353 alice = #general ")
+	if !strings.Contains(names, "alice") || !strings.Contains(names, "bob") {
+		t.Errorf("NAMES reply %q, want alice and bob", names)
+	}
+	alice.expect(" 366 alice #general ")
+	alice.send("NAMES #general")
+	if names := alice.expect(" 353 "); !strings.Contains(names, "bob") {
+		t.Errorf("NAMES reply %q, want bob", names)
+	}
+	alice.send("WHO #general")
+	who := []string{alice.expect(" 352 "), alice.expect(" 352 ")}
+	if !strings.Contains(strings.Join(who, "\n"), " bob ") {
+		t.Errorf("WHO replies %q, want bob", who)
+	}
+	alice.expect(" 315 alice #general ")
+
+	// A channel message reaches the WebSocket client
+	alice.send("PRIVMSG #general :hello from IRC")
+	if m := receive(RegularMessage); m.Content != "hello from IRC" || m.Sender != "alice" || m.Room.Name != "general" {
+		t.Errorf("bob received %+v", m)
+	}
+
+	// A message to a nick is a direct message
+	alice.send("PRIVMSG bob :psst", "PRIVMSG carol :psst carol")
+	if m := receive(DirectMessage); m.Content != "psst" || m.Sender != "alice" {
+		t.Errorf("bob received direct message %+v", m)
+	}
+	if line := carol.expect("PRIVMSG carol"); line != ":alice!alice@chat PRIVMSG carol :psst carol" {
+		t.Errorf("carol received %q", line)
+	}
+}
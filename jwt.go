@@ -1,40 +1,329 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
 	"time"
 )
 
-var jwtSecret = []byte("secret")
+// jwtKey is a single key known to the server. Keys loaded only for
+// verification (rotated out signing keys) have a nil signKey.
+type jwtKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
 
-func validateJWT(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+type KeySet struct {
+	signing  *jwtKey
+	keys     map[string]*jwtKey
+	issuer   string
+	audience string
+	ttl      time.Duration
+}
+
+var jwtKeys *KeySet
+
+func loadKeySet(cfg JWTConfig) (*KeySet, error) {
+	ks := &KeySet{
+		keys:     make(map[string]*jwtKey),
+		issuer:   cfg.Issuer,
+		audience: cfg.Audience,
+		ttl:      cfg.TTL,
+	}
+
+	signing, err := loadSigningKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ks.signing = signing
+	ks.keys[signing.id] = signing
+
+	for kid, secret := range cfg.PreviousSecrets {
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", kid)
+		}
+		ks.keys[kid] = &jwtKey{id: kid, method: jwt.SigningMethodHS256, verifyKey: []byte(secret)}
+	}
+
+	for kid, path := range cfg.VerificationKeys {
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", kid)
+		}
+		key, err := loadVerificationKey(kid, path)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[kid] = key
+	}
+
+	log.Printf("Loaded %d JWT key(s), signing with %s key %q", len(ks.keys), signing.method.Alg(), signing.id)
+	return ks, nil
+}
+
+func loadSigningKey(cfg JWTConfig) (*jwtKey, error) {
+	switch cfg.Algorithm {
+	case "HS256":
+		secret := []byte(cfg.Secret)
+		if len(secret) == 0 {
+			// Without a configured secret tokens will not survive a restart,
+			// but at least nobody can mint them with a well-known value.
+			log.Println("Warning: JWT_SECRET is not set, generating a random signing secret")
+			secret = make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return nil, fmt.Errorf("error generating JWT secret: %v", err)
+			}
+		}
+		kid := cfg.KeyId
+		if kid == "" {
+			kid = "default"
+		}
+		return &jwtKey{id: kid, method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+	case "RS256", "EdDSA":
+		if cfg.SigningKeyFile == "" {
+			return nil, fmt.Errorf("JWT_SIGNING_KEY_FILE is required for %s", cfg.Algorithm)
+		}
+		data, err := os.ReadFile(cfg.SigningKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading signing key: %v", err)
+		}
+
+		key := &jwtKey{id: cfg.KeyId}
+		if cfg.Algorithm == "RS256" {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing RSA signing key: %v", err)
+			}
+			key.method = jwt.SigningMethodRS256
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+		} else {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing Ed25519 signing key: %v", err)
+			}
+			key.method = jwt.SigningMethodEdDSA
+			key.signKey = privateKey
+			key.verifyKey = privateKey.(crypto.Signer).Public()
+		}
+
+		if key.id == "" {
+			key.id, err = keyThumbprint(key.verifyKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", cfg.Algorithm)
+	}
+}
+
+func loadVerificationKey(kid, path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading verification key %q: %v", kid, err)
+	}
+
+	if publicKey, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &jwtKey{id: kid, method: jwt.SigningMethodRS256, verifyKey: publicKey}, nil
+	}
+	if publicKey, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &jwtKey{id: kid, method: jwt.SigningMethodEdDSA, verifyKey: publicKey}, nil
+	}
+	return nil, fmt.Errorf("verification key %q is neither an RSA nor an Ed25519 public key", kid)
+}
+
+// keyThumbprint derives a stable key id from the public key so that a
+// kid does not have to be configured explicitly.
+func keyThumbprint(publicKey interface{}) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("error encoding public key: %v", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	key := ks.signing
+	if kid, ok := token.Header["kid"].(string); ok {
+		key, ok = ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %v", kid)
 		}
-		return jwtSecret, nil
-	})
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.verifyKey, nil
+}
+
+func validateJWT(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, jwtKeys.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithIssuer(jwtKeys.issuer),
+		jwt.WithAudience(jwtKeys.audience),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
 		return "", err
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		email := claims["email"].(string)
-		return email, nil
+		sub, err := claims.GetSubject()
+		if err != nil || sub == "" {
+			return "", fmt.Errorf("token has no subject")
+		}
+		if email, ok := claims["email"].(string); !ok || email != sub {
+			return "", fmt.Errorf("token subject does not match e-mail")
+		}
+		return sub, nil
 	}
 
 	return "", fmt.Errorf("invalid token")
 }
 
 func generateJWT(email string) (string, error) {
+	now := time.Now()
 	claims := jwt.MapClaims{
+		"iss":   jwtKeys.issuer,
+		"aud":   jwtKeys.audience,
+		"sub":   email,
 		"email": email,
-		"exp":   time.Now().Add(24 * time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(jwtKeys.ttl).Unix(),
+	}
+
+	token := jwt.NewWithClaims(jwtKeys.signing.method, claims)
+	token.Header["kid"] = jwtKeys.signing.id
+
+	return token.SignedString(jwtKeys.signing.signKey)
+}
+
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposePasswordReset = "password-reset"
+)
+
+// generatePurposeToken issues a short lived token that is only good for a
+// single flow such as e-mail verification. Its audience differs from access
+// tokens, so validateJWT will never accept it as a login. The fingerprint
+// binds the token to the current account state (e.g. the password hash) so
+// that it stops working once that state changes.
+func generatePurposeToken(purpose, email, fingerprint string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":     jwtKeys.issuer,
+		"aud":     jwtKeys.audience + "/" + purpose,
+		"sub":     email,
+		"purpose": purpose,
+		"iat":     now.Unix(),
+		"exp":     now.Add(ttl).Unix(),
+	}
+	if fingerprint != "" {
+		claims["fp"] = fingerprint
+	}
+
+	token := jwt.NewWithClaims(jwtKeys.signing.method, claims)
+	token.Header["kid"] = jwtKeys.signing.id
+
+	return token.SignedString(jwtKeys.signing.signKey)
+}
+
+// validatePurposeToken returns the e-mail and fingerprint carried by a token
+// issued by generatePurposeToken for the given purpose.
+func validatePurposeToken(tokenString, purpose string) (string, string, error) {
+	token, err := jwt.Parse(tokenString, jwtKeys.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+		jwt.WithIssuer(jwtKeys.issuer),
+		jwt.WithAudience(jwtKeys.audience+"/"+purpose),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return "", "", err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || claims["purpose"] != purpose {
+		return "", "", fmt.Errorf("invalid token")
+	}
 
-	return token.SignedString(jwtSecret)
+	email, err := claims.GetSubject()
+	if err != nil || email == "" {
+		return "", "", fmt.Errorf("token has no subject")
+	}
+	fingerprint, _ := claims["fp"].(string)
+	return email, fingerprint, nil
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// publicJWKs returns every asymmetric key that may still verify tokens.
+// HMAC secrets are never published.
+func (ks *KeySet) publicJWKs() []JWK {
+	jwks := make([]JWK, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "RSA",
+				Kid: key.id,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			jwks = append(jwks, JWK{
+				Kty: "OKP",
+				Kid: key.id,
+				Use: "sig",
+				Alg: key.method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+	return jwks
+}
+
+func handleGetJWKS(ks *KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		err := json.NewEncoder(w).Encode(map[string][]JWK{
+			"keys": ks.publicJWKs(),
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeys writes a private key and its public key as PEM files and
+// returns their paths.
+func writeTestKeys(t *testing.T, name string, privateKey, publicKey any) (string, string) {
+	t.Helper()
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	dir := t.TempDir()
+	privatePath, publicPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
+
+func useKeySet(t *testing.T, cfg JWTConfig) *KeySet {
+	t.Helper()
+	if cfg.Issuer == "" {
+		cfg.Issuer, cfg.Audience, cfg.TTL = "chat-app", "chat-app", time.Hour
+	}
+	keys, err := loadKeySet(cfg)
+	if err != nil {
+		t.Fatalf("loadKeySet: %v", err)
+	}
+	previous := jwtKeys
+	jwtKeys = keys
+	t.Cleanup(func() { jwtKeys = previous })
+	return keys
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func TestJWTClaims(t *testing.T) {
+	useKeySet(t, JWTConfig{Algorithm: "HS256", Secret: "current", KeyId: "2024", PreviousSecrets: map[string]string{"2023": "previous"}})
+
+	token, err := generateJWT("alice@example.com")
+	if err != nil {
+		t.Fatalf("generateJWT: %v", err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("ParseUnverified: %v", err)
+	}
+	if parsed.Header["kid"] != "2024" {
+		t.Errorf("kid is %v, want 2024", parsed.Header["kid"])
+	}
+	if email, err := validateJWT(token); err != nil || email != "alice@example.com" {
+		t.Errorf("validateJWT = %q, %v", email, err)
+	}
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "chat-app", "aud": "chat-app", "sub": "alice@example.com", "email": "alice@example.com",
+			"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+		}
+	}
+	with := func(key string, value any) jwt.MapClaims {
+		claims := valid()
+		if value == nil {
+			delete(claims, key)
+		} else {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"current key", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), valid()), true},
+		{"rotated out key", signTestToken(t, jwt.SigningMethodHS256, "2023", []byte("previous"), valid()), true},
+		{"no kid", signTestToken(t, jwt.SigningMethodHS256, "", []byte("current"), valid()), true},
+		{"unknown kid", signTestToken(t, jwt.SigningMethodHS256, "2022", []byte("current"), valid()), false},
+		{"kid of another key", signTestToken(t, jwt.SigningMethodHS256, "2023", []byte("current"), valid()), false},
+		{"wrong issuer", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("iss", "other")), false},
+		{"wrong audience", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("aud", "chat-app/"+purposePasswordReset)), false},
+		{"expired", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("exp", now.Add(-time.Minute).Unix())), false},
+		{"without expiry", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("exp", nil)), false},
+		{"issued in the future", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("iat", now.Add(time.Hour).Unix())), false},
+		{"e-mail differs from subject", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("email", "bob@example.com")), false},
+		{"without subject", signTestToken(t, jwt.SigningMethodHS256, "2024", []byte("current"), with("sub", nil)), false},
+		{"unsigned", signTestToken(t, jwt.SigningMethodNone, "2024", jwt.UnsafeAllowNoneSignatureType, valid()), false},
+	}
+	for _, test := range tests {
+		_, err := validateJWT(test.token)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: validateJWT returned %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestPurposeTokensAreNotLogins(t *testing.T) {
+	useTestJWTKeys(t)
+
+	token, err := generatePurposeToken(purposePasswordReset, "alice@example.com", "fp", time.Hour)
+	if err != nil {
+		t.Fatalf("generatePurposeToken: %v", err)
+	}
+	if _, err := validateJWT(token); err == nil {
+		t.Errorf("a password reset token was accepted as a login")
+	}
+	if _, _, err := validatePurposeToken(token, purposeVerifyEmail); err == nil {
+		t.Errorf("a password reset token was accepted for e-mail verification")
+	}
+	if email, fingerprint, err := validatePurposeToken(token, purposePasswordReset); err != nil || email != "alice@example.com" || fingerprint != "fp" {
+		t.Errorf("validatePurposeToken = %q, %q, %v", email, fingerprint, err)
+	}
+
+	login := testToken(t, "alice@example.com")
+	if _, _, err := validatePurposeToken(login, purposePasswordReset); err == nil {
+		t.Errorf("a login token was accepted for a password reset")
+	}
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	rsaPrivate, rsaPublic := writeTestKeys(t, "rsa", rsaKey, &rsaKey.PublicKey)
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	edPrivate, _ := writeTestKeys(t, "ed", edKey, edPublicKey)
+
+	// Tokens of the old RSA key keep working after moving to Ed25519
+	old := useKeySet(t, JWTConfig{Algorithm: "RS256", SigningKeyFile: rsaPrivate})
+	rsaToken, err := generateJWT("alice@example.com")
+	if err != nil {
+		t.Fatalf("generateJWT: %v", err)
+	}
+	keys := useKeySet(t, JWTConfig{Algorithm: "EdDSA", SigningKeyFile: edPrivate, KeyId: "ed", VerificationKeys: map[string]string{old.signing.id: rsaPublic}})
+	edToken, err := generateJWT("alice@example.com")
+	if err != nil {
+		t.Fatalf("generateJWT: %v", err)
+	}
+	for name, token := range map[string]string{"RS256": rsaToken, "EdDSA": edToken} {
+		if email, err := validateJWT(token); err != nil || email != "alice@example.com" {
+			t.Errorf("%s token: validateJWT = %q, %v", name, email, err)
+		}
+	}
+
+	// An HMAC token keyed with the public key must not pass for the RSA key
+	publicPEM, _ := os.ReadFile(rsaPublic)
+	claims := jwt.MapClaims{"iss": "chat-app", "aud": "chat-app", "sub": "alice@example.com", "email": "alice@example.com",
+		"iat": time.Now().Unix(), "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := validateJWT(signTestToken(t, jwt.SigningMethodHS256, old.signing.id, publicPEM, claims)); err == nil {
+		t.Errorf("an HS256 token was accepted for an RSA key")
+	}
+
+	jwks := keys.publicJWKs()
+	kids := map[string]string{}
+	for _, jwk := range jwks {
+		kids[jwk.Kid] = jwk.Alg
+	}
+	if len(jwks) != 2 || kids["ed"] != "EdDSA" || kids[old.signing.id] != "RS256" {
+		t.Errorf("publicJWKs returned %+v", jwks)
+	}
+	if hmacKeys := useKeySet(t, JWTConfig{Algorithm: "HS256", Secret: "secret"}); len(hmacKeys.publicJWKs()) != 0 {
+		t.Errorf("an HMAC secret was published")
+	}
+}
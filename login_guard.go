@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type attemptState struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// LoginGuard tracks failed logins per account and per client IP. After a
+// few free attempts every further failure makes the caller wait twice as
+// long, and crossing a threshold locks the account or IP out for a while.
+type LoginGuard struct {
+	mu       sync.Mutex
+	cfg      LoginGuardConfig
+	accounts map[string]*attemptState
+	ips      map[string]*attemptState
+}
+
+func NewLoginGuard(cfg LoginGuardConfig) *LoginGuard {
+	g := &LoginGuard{
+		cfg:      cfg,
+		accounts: make(map[string]*attemptState),
+		ips:      make(map[string]*attemptState),
+	}
+	go g.cleanupLoop()
+	return g
+}
+
+// Check reports how long the caller has to wait before another attempt for
+// this account from this IP is allowed. Zero means the attempt may proceed.
+func (g *LoginGuard) Check(email, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(0)
+	if state, ok := g.accounts[normalizeEmail(email)]; ok && state.blockedUntil.After(now) {
+		wait = state.blockedUntil.Sub(now)
+	}
+	if state, ok := g.ips[ip]; ok && state.blockedUntil.After(now) && state.blockedUntil.Sub(now) > wait {
+		wait = state.blockedUntil.Sub(now)
+	}
+	return wait
+}
+
+// RecordFailure registers a failed attempt and returns true when it caused
+// the account or IP to be locked out.
+func (g *LoginGuard) RecordFailure(email, ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	accountLocked := g.fail(g.accounts, normalizeEmail(email), g.cfg.AccountThreshold, now)
+	ipLocked := g.fail(g.ips, ip, g.cfg.IPThreshold, now)
+	return accountLocked || ipLocked
+}
+
+// RecordSuccess clears the failures of the account. The IP counter is left
+// alone so that one valid account cannot be used to reset it.
+func (g *LoginGuard) RecordSuccess(email string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.accounts, normalizeEmail(email))
+}
+
+func (g *LoginGuard) fail(states map[string]*attemptState, key string, threshold int, now time.Time) bool {
+	state, ok := states[key]
+	if !ok || now.Sub(state.lastFailure) > g.cfg.Window {
+		state = &attemptState{}
+		states[key] = state
+	}
+
+	state.failures++
+	state.lastFailure = now
+
+	if threshold > 0 && state.failures >= threshold {
+		state.blockedUntil = now.Add(g.cfg.LockoutDuration)
+		return state.failures == threshold
+	}
+
+	if excess := state.failures - g.cfg.FreeAttempts; excess > 0 {
+		delay := time.Duration(float64(g.cfg.BackoffBase) * math.Pow(2, float64(excess-1)))
+		if delay > g.cfg.BackoffMax || delay <= 0 {
+			delay = g.cfg.BackoffMax
+		}
+		state.blockedUntil = now.Add(delay)
+	}
+	return false
+}
+
+func (g *LoginGuard) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		g.mu.Lock()
+		now := time.Now()
+		for _, states := range []map[string]*attemptState{g.accounts, g.ips} {
+			for key, state := range states {
+				if now.Sub(state.lastFailure) > g.cfg.Window && now.After(state.blockedUntil) {
+					delete(states, key)
+				}
+			}
+		}
+		g.mu.Unlock()
+	}
+}
+
+// ClientIP returns the address login attempts are attributed to.
+func (g *LoginGuard) ClientIP(r *http.Request) string {
+	return clientIP(r, g.cfg.TrustProxy)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientIP returns the address of the caller. X-Forwarded-For is only
+// trusted when the server is configured to run behind a proxy.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+func recordLoginAttempt(store Store, email, ip string, success bool, reason string) {
+	if err := store.RecordLoginAttempt(email, ip, success, reason); err != nil {
+		log.Printf("Error recording login attempt for %s: %v", email, err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testLoginGuardConfig = LoginGuardConfig{
+	FreeAttempts:     2,
+	BackoffBase:      time.Second,
+	BackoffMax:       10 * time.Second,
+	AccountThreshold: 8,
+	IPThreshold:      20,
+	LockoutDuration:  time.Hour,
+	Window:           time.Hour,
+}
+
+func TestLoginGuardBackoff(t *testing.T) {
+	g := NewLoginGuard(testLoginGuardConfig)
+	start := time.Now()
+
+	// The wait after each failure: free attempts, then doubling up to the
+	// maximum, then the lockout
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, time.Hour}
+	for i, wait := range want {
+		locked := g.fail(g.accounts, "alice@example.com", g.cfg.AccountThreshold, start)
+		state := g.accounts["alice@example.com"]
+		if got := max(state.blockedUntil.Sub(start), 0); got != wait {
+			t.Errorf("failure %d: blocked for %s, want %s", i+1, got, wait)
+		}
+		if locked != (i == len(want)-1) {
+			t.Errorf("failure %d: locked is %v", i+1, locked)
+		}
+	}
+
+	// Failures older than the window are forgotten
+	later := start.Add(2 * time.Hour)
+	g.fail(g.accounts, "alice@example.com", g.cfg.AccountThreshold, later)
+	if state := g.accounts["alice@example.com"]; state.failures != 1 {
+		t.Errorf("%d failures counted after the window, want 1", state.failures)
+	}
+}
+
+func TestLoginGuardAccountsAndIPs(t *testing.T) {
+	g := NewLoginGuard(testLoginGuardConfig)
+
+	for range 3 {
+		g.RecordFailure("Alice@example.com ", "192.0.2.1")
+	}
+	if wait := g.Check("alice@example.com", "192.0.2.2"); wait <= 0 || wait > time.Second {
+		t.Errorf("account wait is %s, want up to a second", wait)
+	}
+	if wait := g.Check("bob@example.com", "192.0.2.2"); wait != 0 {
+		t.Errorf("another account from another IP waits %s", wait)
+	}
+
+	// A successful login clears the account but not the IP
+	for range 3 {
+		g.RecordFailure("carol@example.com", "192.0.2.1")
+	}
+	g.RecordSuccess("carol@example.com")
+	if wait := g.Check("carol@example.com", "192.0.2.3"); wait != 0 {
+		t.Errorf("account waits %s after a successful login", wait)
+	}
+	if wait := g.Check("dave@example.com", "192.0.2.1"); wait <= 0 {
+		t.Errorf("IP with %d failures is not slowed down", g.ips["192.0.2.1"].failures)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+
+	if ip := clientIP(r, false); ip != "192.0.2.1" {
+		t.Errorf("without a proxy the IP is %s, want 192.0.2.1", ip)
+	}
+	if ip := clientIP(r, true); ip != "198.51.100.7" {
+		t.Errorf("behind a proxy the IP is %s, want 198.51.100.7", ip)
+	}
+	if seconds := retryAfterSeconds(1500 * time.Millisecond); seconds != 2 {
+		t.Errorf("retryAfterSeconds rounded 1.5s to %d, want 2", seconds)
+	}
+}
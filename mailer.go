@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer delivers plain text e-mails to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %v", m.Addr, err)
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + m.From + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg.String()))
+}
+
+// LogMailer writes e-mails to a file, or to the server log when no path is
+// set. It is meant for local development and tests.
+type LogMailer struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	entry := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n---\n", to, subject, body)
+
+	if m.Path == "" {
+		log.Printf("Outgoing e-mail:\n%s", entry)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(entry)
+	return err
+}
+
+func newMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		if cfg.SMTPAddr == "" || cfg.From == "" {
+			return nil, fmt.Errorf("SMTP_ADDR and MAIL_FROM are required for the smtp mailer")
+		}
+		return &SMTPMailer{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.From,
+		}, nil
+	case "log":
+		return &LogMailer{Path: cfg.LogFile}, nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", cfg.Driver)
+	}
+}
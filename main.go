@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -11,7 +12,7 @@ import (
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -98,24 +99,148 @@ func SpaHandler(staticPath string, indexPath string) http.Handler {
 }
 
 func main() {
-	db := connectDB()
-	defer db.Close()
+	cfg := loadConfig()
+
+	if len(os.Args) > 1 {
+		runCommand(cfg, os.Args[1:])
+		return
+	}
+
+	keys, err := loadKeySet(cfg.JWT)
+	if err != nil {
+		log.Fatalf("Error loading JWT keys: %v", err)
+	}
+	jwtKeys = keys
+
+	totpKey, err = loadTOTPKey(cfg.Account.TOTPEncryptionKey)
+	if err != nil {
+		log.Fatalf("Error loading TOTP key: %v", err)
+	}
+
+	mailer, err := newMailer(cfg.Mail)
+	if err != nil {
+		log.Fatalf("Error configuring mailer: %v", err)
+	}
+
+	store, err := newStore(cfg.Database)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer store.Close()
+	if err := prepareSchema(store, cfg.Database); err != nil {
+		log.Fatalf("Error preparing database schema: %v", err)
+	}
+	if err := encryptTOTPSecrets(store); err != nil {
+		log.Fatalf("Error encrypting two-factor secrets: %v", err)
+	}
 
 	mux := http.NewServeMux()
-	createUserTable(db)
-	creatRoomTable(db)
-	createMessageTable(db)
 
-	manager := NewClientManager(db)
+	if err := promoteUsers(store, cfg.Account.ModeratorEmails, RoleModerator); err != nil {
+		log.Fatalf("Error assigning moderators: %v", err)
+	}
+	if err := promoteUsers(store, cfg.Account.AdminEmails, RoleAdmin); err != nil {
+		log.Fatalf("Error assigning admins: %v", err)
+	}
+
+	storage, err := newStorage(cfg.Storage)
+	if err != nil {
+		log.Fatalf("Error configuring storage: %v", err)
+	}
+
+	filters, err := NewContentFilters(store, cfg.Filters)
+	if err != nil {
+		log.Fatalf("Error configuring content filters: %v", err)
+	}
+
+	webhooks := NewWebhookDispatcher(store, cfg.Webhooks)
+	broker, err := newBroker(cfg.Broker)
+	if err != nil {
+		log.Fatalf("Error configuring broker: %v", err)
+	}
+	defer broker.Close()
 
+	limiter := NewRateLimiter(cfg.RateLimit)
+	manager := NewClientManager(store, filters, limiter, webhooks, broker, cfg.Broker.PresenceInterval)
+	loginGuard := NewLoginGuard(cfg.LoginGuard)
+	sessions := NewSessions(manager, cfg.Sessions)
+	backups := NewBackups(store, cfg.Backups)
+	backups.Schedule()
+	if cfg.IRC.Addr != "" {
+		gateway := NewIRCGateway(store, manager, loginGuard, cfg.IRC, cfg.Account)
+		go func() {
+			if err := gateway.ListenAndServe(); err != nil {
+				log.Fatalf("Error starting IRC gateway: %v", err)
+			}
+		}()
+	}
+
+	// Public routes
 	mux.HandleFunc("/api/ping", ping)
-	mux.HandleFunc("/api/ws", handleWebSocket(manager))
-	mux.HandleFunc("POST /api/register", handleRegisterUser(db))
-	mux.HandleFunc("POST /api/login", handleLoginUser(db))
-	mux.HandleFunc("GET /api/users", handleGetUsers(db))
-	mux.HandleFunc("GET /api/messages", handleGetMessages(db))
-	mux.HandleFunc("GET /api/rooms", handleGetRooms(db))
-	mux.HandleFunc("GET /api/online-users", handleGetOnlineUsers(manager))
+	mux.HandleFunc("POST /api/register", handleRegisterUser(store, mailer, cfg.Account))
+	mux.HandleFunc("POST /api/login", handleLoginUser(store, cfg.Account, loginGuard))
+	mux.HandleFunc("POST /api/verify-email", handleVerifyEmail(store))
+	mux.HandleFunc("POST /api/password/forgot", handleForgotPassword(store, mailer, cfg.Account, limiter, cfg.RateLimit, loginGuard))
+	mux.HandleFunc("POST /api/password/reset", handleResetPassword(store))
+	mux.HandleFunc("GET /.well-known/jwks.json", handleGetJWKS(jwtKeys))
+	mux.HandleFunc("GET /api/avatars/{userId}/{version}", handleGetAvatar(storage))
+	mux.HandleFunc("POST /api/hooks/{token}", handleIncomingWebhook(store, manager, storage, cfg.Storage))
+
+	// Routes that require an authenticated user. Those behind tokenAuth are
+	// also open to bots whose API token has the given scope.
+	mux.Handle("/api/ws", tokenAuth(store, ScopeReadRooms, handleWebSocket(manager)))
+	mux.Handle("POST /api/sessions", tokenAuth(store, ScopeReadRooms, handleCreateSession(sessions)))
+	mux.Handle("DELETE /api/sessions/{id}", tokenAuth(store, ScopeReadRooms, handleDeleteSession(sessions)))
+	mux.Handle("GET /api/sessions/{id}/events", tokenAuth(store, ScopeReadRooms, handleSessionEvents(sessions)))
+	mux.Handle("GET /api/sessions/{id}/messages", tokenAuth(store, ScopeReadRooms, handleSessionPoll(sessions)))
+	mux.Handle("POST /api/sessions/{id}/messages", tokenAuth(store, ScopePostMessages, handleSessionSend(sessions)))
+	mux.Handle("GET /api/users", tokenAuth(store, ScopeReadRooms, handleGetUsers(store)))
+	mux.Handle("GET /api/users/{handle}", tokenAuth(store, ScopeReadRooms, handleGetUserProfile(store)))
+	mux.Handle("GET /api/me", tokenAuth(store, ScopeReadRooms, handleGetMe(store)))
+	mux.Handle("PATCH /api/me", authMiddleware(store, handleUpdateMe(store, manager)))
+	mux.Handle("POST /api/me/avatar", authMiddleware(store, handleUploadAvatar(store, storage, manager, cfg.Storage.MaxAvatarBytes)))
+	mux.Handle("DELETE /api/me/avatar", authMiddleware(store, handleDeleteAvatar(store, storage, manager)))
+	mux.Handle("GET /api/me/blocks", authMiddleware(store, handleGetBlocks(store)))
+	mux.Handle("PUT /api/me/blocks/{handle}", authMiddleware(store, handleBlockUser(store, manager)))
+	mux.Handle("DELETE /api/me/blocks/{handle}", authMiddleware(store, handleUnblockUser(store, manager)))
+	mux.Handle("POST /api/reports", authMiddleware(store, handleCreateReport(store, manager)))
+	mux.Handle("POST /api/rooms/{roomId}/attachments", tokenAuth(store, ScopePostMessages, handleUploadAttachment(store, storage, cfg.Storage)))
+	mux.Handle("GET /api/attachments/{id}", tokenAuth(store, ScopeReadRooms, handleGetAttachment(store, storage, false)))
+	mux.Handle("GET /api/attachments/{id}/thumbnail", tokenAuth(store, ScopeReadRooms, handleGetAttachment(store, storage, true)))
+	mux.Handle("GET /api/messages", tokenAuth(store, ScopeReadRooms, handleGetMessages(store)))
+	mux.Handle("PATCH /api/messages/{id}", tokenAuth(store, ScopePostMessages, handleEditMessage(store, manager)))
+	mux.Handle("GET /api/rooms", tokenAuth(store, ScopeReadRooms, handleGetRooms(store)))
+	mux.Handle("GET /api/online-users", tokenAuth(store, ScopeReadRooms, handleGetOnlineUsers(manager)))
+	mux.Handle("POST /api/me/totp/enroll", authMiddleware(store, handleEnrollTOTP(store, cfg.Account)))
+	mux.Handle("POST /api/me/totp/confirm", authMiddleware(store, handleConfirmTOTP(store)))
+	mux.Handle("POST /api/me/totp/disable", authMiddleware(store, handleDisableTOTP(store)))
+	mux.Handle("POST /api/me/totp/recovery-codes", authMiddleware(store, handleRegenerateRecoveryCodes(store)))
+	mux.Handle("GET /api/me/bots", authMiddleware(store, handleGetBots(store)))
+	mux.Handle("POST /api/me/bots", authMiddleware(store, handleCreateBot(store)))
+	mux.Handle("DELETE /api/me/bots/{handle}", authMiddleware(store, handleDeleteBot(store, manager)))
+	mux.Handle("GET /api/me/bots/{handle}/tokens", authMiddleware(store, handleGetBotTokens(store)))
+	mux.Handle("POST /api/me/bots/{handle}/tokens", authMiddleware(store, handleCreateBotToken(store)))
+	mux.Handle("DELETE /api/me/bots/{handle}/tokens/{id}", authMiddleware(store, handleRevokeBotToken(store, manager)))
+
+	// Moderation queue
+	mux.Handle("GET /api/moderation/reports", authMiddleware(store, requireModerator(store, handleGetReports(store))))
+	mux.Handle("GET /api/moderation/reports/{id}", authMiddleware(store, requireModerator(store, handleGetReport(store))))
+	mux.Handle("POST /api/moderation/reports/{id}/actions", authMiddleware(store, requireModerator(store, handleReportAction(store, manager))))
+	mux.Handle("GET /api/rooms/{roomId}/filters", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleGetRoomFilters(filters))))
+	mux.Handle("PUT /api/rooms/{roomId}/filters", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleSetRoomFilters(store, filters))))
+	mux.Handle("DELETE /api/rooms/{roomId}/filters", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleResetRoomFilters(filters))))
+	mux.Handle("PUT /api/rooms/{roomId}/slow-mode", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleSetSlowMode(store, manager))))
+	mux.Handle("GET /api/rooms/{roomId}/webhooks", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleGetWebhooks(store))))
+	mux.Handle("POST /api/rooms/{roomId}/webhooks", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleCreateWebhook(store, cfg.Webhooks))))
+	mux.Handle("DELETE /api/rooms/{roomId}/webhooks/{id}", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleDeleteWebhook(store))))
+	mux.Handle("GET /api/rooms/{roomId}/webhooks/{id}/deliveries", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleGetWebhookDeliveries(store))))
+	mux.Handle("GET /api/rooms/{roomId}/incoming-webhooks", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleGetIncomingWebhooks(store))))
+	mux.Handle("POST /api/rooms/{roomId}/incoming-webhooks", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleCreateIncomingWebhook(store, cfg.Account))))
+	mux.Handle("DELETE /api/rooms/{roomId}/incoming-webhooks/{id}", tokenAuth(store, ScopeManageRooms, requireModerator(store, handleDeleteIncomingWebhook(store))))
+
+	// Administration
+	mux.Handle("GET /api/admin/backups", authMiddleware(store, requireAdmin(store, handleGetBackups(backups))))
+	mux.Handle("POST /api/admin/backups", authMiddleware(store, requireAdmin(store, handleCreateBackup(backups))))
 
 	// Verify static directory exists
 	buildDir := "./static"
@@ -132,12 +257,41 @@ func main() {
 	staticFileHandler := SpaHandler(buildDir, "index.html")
 	mux.Handle("/", staticFileHandler)
 
-	fmt.Println("Server started on port 8090")
-	if err := http.ListenAndServe(":8090", corsMiddleware(mux)); err != nil {
+	fmt.Printf("Server started on %s\n", cfg.Addr)
+	if err := http.ListenAndServe(cfg.Addr, corsMiddleware(mux)); err != nil {
 		fmt.Println("Error starting server: ", err)
 	}
 }
 
+// runCommand runs a maintenance command instead of the server.
+func runCommand(cfg *Config, args []string) {
+	// restore replaces the database file, so it opens the store itself
+	if args[0] == "restore" {
+		if err := runRestore(cfg, args[1:]); err != nil {
+			log.Fatalf("%s: %v", args[0], err)
+		}
+		return
+	}
+
+	store, err := newStore(cfg.Database)
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "migrate":
+		err = runMigrate(store, args[1:])
+	case "backup":
+		err = runBackup(store, cfg.Backups, args[1:])
+	default:
+		err = fmt.Errorf("unknown command %q; available: migrate, backup, restore", args[0])
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", args[0], err)
+	}
+}
+
 // Helper function to get current working directory
 func getCurrentDir() string {
 	dir, err := os.Getwd()
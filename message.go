@@ -1,24 +1,33 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"log"
+	"strings"
 	"time"
 )
 
 type Message struct {
-	Type      MessageType       `json:"type"`
-	Content   string            `json:"content"`
-	Sender    string            `json:"sender"`
-	Id        string            `json:"id"`
-	Room      Room              `json:"room,omitempty"`
-	Target    string            `json:"target,omitempty"`
-	Timestamp string            `json:"timestamp,omitempty"`
-	Command   CommandType       `json:"command,omitempty"`
-	Reactions []MessageReaction `json:"reactions,omitempty"`
+	Type         MessageType       `json:"type"`
+	Content      string            `json:"content"`
+	Sender       string            `json:"sender"`
+	SenderName   string            `json:"sender_name,omitempty"`
+	SenderAvatar string            `json:"sender_avatar,omitempty"`
+	SenderId     int               `json:"-"`
+	WebhookId    int               `json:"-"`
+	Bot          bool              `json:"bot,omitempty"`
+	Deleted      bool              `json:"deleted,omitempty"`
+	EditedAt     string            `json:"edited_at,omitempty"`
+	RetryAfter   int               `json:"retry_after,omitempty"`
+	Id           string            `json:"id"`
+	Room         Room              `json:"room,omitempty"`
+	Target       string            `json:"target,omitempty"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Reactions    []MessageReaction `json:"reactions,omitempty"`
+	Attachments  []Attachment      `json:"attachments,omitempty"`
 }
 
 type MessageReaction struct {
@@ -27,23 +36,46 @@ type MessageReaction struct {
 	Author  string `json:"author"`
 }
 
+// Times are sent and stored in UTC with milliseconds, a fixed width so that
+// they also sort as text.
+const timestampFormat = "2006-01-02T15:04:05.000Z"
+
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampFormat)
+}
+
+// normalizeTimestamp brings a time read from the database, which each driver
+// formats its own way, to timestampFormat.
+func normalizeTimestamp(s string) string {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	return formatTimestamp(t)
+}
+
 func generateId() string {
 	return uuid.New().String()
 }
 
-func sendMessage(conn *websocket.Conn, msgType MessageType, content string, user string, room *Room) error {
+func newMessage(msgType MessageType, content string, user string, room *Room) Message {
 	message := Message{
 		Type:      msgType,
 		Content:   content,
 		Sender:    user,
 		Id:        generateId(),
-		Timestamp: time.Now().Format(time.RFC3339),
-		Room: Room{
+		Timestamp: formatTimestamp(time.Now()),
+	}
+	if room != nil {
+		message.Room = Room{
 			Name: room.Name,
 			Id:   room.Id,
-		},
+		}
 	}
+	return message
+}
 
+func writeMessage(conn ClientConn, message Message) error {
 	msgBytes, err := json.Marshal(message)
 	if err != nil {
 		return err
@@ -51,6 +83,25 @@ func sendMessage(conn *websocket.Conn, msgType MessageType, content string, user
 	return conn.WriteMessage(websocket.TextMessage, msgBytes)
 }
 
+func sendMessage(conn ClientConn, msgType MessageType, content string, user string, room *Room) error {
+	return writeMessage(conn, newMessage(msgType, content, user, room))
+}
+
+// newMessageFrom creates a message written by a user, identified by handle
+// and display name rather than e-mail.
+func newMessageFrom(msgType MessageType, content string, sender *Client, room *Room) Message {
+	message := newMessage(msgType, content, sender.Handle, room)
+	message.SenderName = sender.Name()
+	message.SenderAvatar = sender.AvatarURL
+	message.SenderId = sender.UserId
+	message.Bot = sender.IsBot
+	return message
+}
+
+func sendMessageFrom(conn ClientConn, msgType MessageType, content string, sender *Client, room *Room) error {
+	return writeMessage(conn, newMessageFrom(msgType, content, sender, room))
+}
+
 type MessageType string
 
 const (
@@ -60,15 +111,9 @@ const (
 	CommandMessage             = "command"
 	SystemMessage              = "system"
 	TypingMessage              = "typing"
-)
-
-type CommandType int
-
-const (
-	InvalidCommand CommandType = iota
-	HelpCommand
-	UsersCommand
-	JoinCommand
+	DeletedMessage             = "deleted"
+	EditedMessage              = "edited"
+	ReportMessage              = "report"
 )
 
 func parseMessage(rawMessage string) Message {
@@ -98,49 +143,45 @@ func parseMessage(rawMessage string) Message {
 			Target:  message.Target,
 		}
 	case CommandMessage:
-		switch message.Content {
-		case "help":
-			return Message{
-				Type:    CommandMessage,
-				Content: "Available commands: /dm <username> <message> - Send a direct message\n /users - List of connected users",
-				Command: HelpCommand,
+		// The command line is "name args...". Older clients send the
+		// argument of join in the room field and of block and mute in
+		// target, so those are appended to the line.
+		line := strings.TrimSpace(message.Content)
+		if !strings.Contains(line, " ") {
+			if message.Room.Name != "" {
+				line += " " + message.Room.Name
+			} else if message.Target != "" {
+				line += " " + message.Target
 			}
-		case "users":
-			return Message{
-				Type:    CommandMessage,
-				Content: "user_list",
-				Command: UsersCommand,
-			}
-		case "join":
-			if message.Room.Name == "" {
-				return Message{
-					Type:    InvalidMessage,
-					Content: "Invalid room format. Use: {\"type\": \"command\", \"content\": \"join\", \"room\": \"roomName\"}",
-				}
-			}
-			return Message{
-				Type:    CommandMessage,
-				Command: JoinCommand,
-				Content: message.Room.Name,
-			}
-
-		default:
+		}
+		if line == "" {
 			return Message{
 				Type:    InvalidMessage,
-				Content: "Unknown command.",
+				Content: "Empty command. Use /help for a list of commands.",
 			}
 		}
+		return Message{
+			Type:    CommandMessage,
+			Content: line,
+		}
 	case RegularMessage:
-		if message.Content == "" {
+		if message.Content == "" && len(message.Attachments) == 0 {
 			return Message{
 				Type:    InvalidMessage,
 				Content: "Chat message cannot be empty.",
 			}
 		}
+		if len(message.Attachments) > maxAttachmentsPerMessage {
+			return Message{
+				Type:    InvalidMessage,
+				Content: fmt.Sprintf("A message can have at most %d attachments.", maxAttachmentsPerMessage),
+			}
+		}
 		return Message{
-			Type:    RegularMessage,
-			Content: message.Content,
-			Room:    message.Room,
+			Type:        RegularMessage,
+			Content:     message.Content,
+			Room:        message.Room,
+			Attachments: message.Attachments,
 		}
 	case TypingMessage:
 		return Message{
@@ -155,65 +196,3 @@ func parseMessage(rawMessage string) Message {
 		}
 	}
 }
-
-func saveMessageToDb(db *sql.DB, message Message, roomId int, sender string) error {
-	newId := generateId()
-
-	query := `
-	INSERT INTO messages 
-	    (id, room_id, sender, content, date) 
-	VALUES (?, ?, ?, ?, ?);`
-
-	_, err := db.Exec(query, newId, roomId, sender, message.Content, time.Now().Format("2006-01-02 15:04:05"))
-	if err != nil {
-		log.Printf("Error saving message to DB: %v", err)
-		return err
-	}
-
-	log.Printf("Message saved to DB: %s", message.Content)
-	return nil
-}
-
-func getMessages(db *sql.DB, roomId int, sender string) ([]Message, error) {
-	query := "SELECT messages.id, messages.content, rooms.name, messages.sender, messages.date FROM messages LEFT JOIN rooms ON messages.room_id = rooms.id WHERE room_id = ?"
-	args := []interface{}{roomId}
-
-	if sender != "" {
-		query += " AND sender = ?"
-		args = append(args, sender)
-	}
-
-	rows, err := db.Query(query, args...)
-	if err != nil {
-		log.Printf("Error retrieving messages from DB: %v", err)
-		return nil, err
-	}
-	defer rows.Close()
-
-	var messages []Message
-	for rows.Next() {
-		var id, content, room, user, date string
-		if err := rows.Scan(&id, &content, &room, &user, &date); err != nil {
-			log.Printf("Error scanning message row: %v", err)
-			return nil, err
-		}
-		messages = append(messages, Message{
-			Id:      id,
-			Type:    RegularMessage,
-			Content: content,
-			Room: Room{
-				Id:   roomId,
-				Name: room,
-			},
-			Sender:    user,
-			Timestamp: date,
-		})
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating over message rows: %v", err)
-		return nil, err
-	}
-
-	return messages, nil
-}
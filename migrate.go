@@ -0,0 +1,365 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The schema is built by numbered migrations in migrations/<driver>, each an
+// NNNN_name.up.sql file and the NNNN_name.down.sql file that undoes it. The
+// versions applied to a database are recorded in schema_migrations. A
+// migration and its record are written in one transaction, so a failed
+// migration leaves nothing behind.
+//
+// To change the schema, add the next version for every driver; never edit a
+// migration that has been released.
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// AppliedMigration is a row of schema_migrations.
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+// loadMigrations returns the migrations for a driver ordered by version.
+func loadMigrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for driver %q", driver)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		number, label, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || !found || err != nil || version <= 0 || !strings.HasSuffix(name, ".sql") {
+			return nil, fmt.Errorf("migration file %s is not named NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+		data, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if m.Name != label {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, label)
+		}
+		switch direction {
+		case "up":
+			m.Up = string(data)
+		case "down":
+			m.Down = string(data)
+		default:
+			return nil, fmt.Errorf("migration file %s is neither up nor down", name)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	migrations []Migration
+}
+
+// newMigrator is called by the Store, which owns the database; use
+// Store.Migrator.
+func newMigrator(db *sql.DB, driver string) (*Migrator, error) {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migrator{db: db, driver: driver, migrations: migrations}
+
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err := m.db.Exec(query); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	if err := m.adoptLegacySchema(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Latest is the version the migrations of this binary lead to.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) Applied() ([]AppliedMigration, error) {
+	rows, err := m.db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var a AppliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// Current returns the highest applied version, 0 for an empty database.
+func (m *Migrator) Current() (int, error) {
+	var version int
+	err := m.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// To migrates up or down until target is the current version.
+func (m *Migrator) To(target int) error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > m.Latest() {
+		return fmt.Errorf("unknown version %d; the latest is %d", target, m.Latest())
+	}
+	if current > m.Latest() {
+		return fmt.Errorf("the database is at version %d, newer than this binary knows (%d)", current, m.Latest())
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version > current && migration.Version <= target {
+			if err := m.apply(migration, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= current && migration.Version > target {
+			if err := m.apply(migration, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) Up() error {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the last n applied migrations.
+func (m *Migrator) Down(n int) error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	target := 0
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		if m.migrations[i].Version > current {
+			continue
+		}
+		if n == 0 {
+			target = m.migrations[i].Version
+			break
+		}
+		n--
+	}
+	return m.To(target)
+}
+
+func (m *Migrator) apply(migration Migration, up bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record := migration.Down, "DELETE FROM schema_migrations WHERE version = ?"
+	args := []any{migration.Version}
+	if up {
+		script, record = migration.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)"
+		args = append(args, migration.Name)
+	}
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if up {
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+	} else {
+		log.Printf("Rolled back migration %d_%s", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// adoptLegacySchema takes over a database whose tables were created before
+// there were migrations. Its schema is brought up to the first migration and
+// that is recorded as applied.
+func (m *Migrator) adoptLegacySchema() error {
+	var tracked int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&tracked); err != nil {
+		return err
+	}
+	query := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'users'"
+	if m.driver == "postgres" {
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'users'"
+	}
+	var legacy int
+	if err := m.db.QueryRow(query).Scan(&legacy); err != nil {
+		return err
+	}
+	if tracked > 0 || legacy == 0 {
+		return nil
+	}
+
+	log.Printf("Adopting a database created before schema migrations")
+	// Postgres support arrived with the schema of the first migration
+	if m.driver == "sqlite" {
+		upgradeLegacySchema(m.db)
+	}
+	first := m.migrations[0]
+	_, err := m.db.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", first.Version, first.Name)
+	return err
+}
+
+// prepareSchema brings the database up to date at start-up or, if automatic
+// migration is off, refuses to run on an outdated schema.
+func prepareSchema(store Store, cfg DatabaseConfig) error {
+	migrator, err := store.Migrator()
+	if err != nil {
+		return err
+	}
+	if cfg.AutoMigrate {
+		return migrator.Up()
+	}
+
+	current, err := migrator.Current()
+	if err != nil {
+		return err
+	}
+	if current != migrator.Latest() {
+		return fmt.Errorf("the database schema is at version %d but %d is needed; run `chat-app migrate up`",
+			current, migrator.Latest())
+	}
+	return nil
+}
+
+const migrateUsage = "usage: migrate status | up | down [n] | to <version>"
+
+// runMigrate implements the migrate command.
+func runMigrate(store Store, args []string) error {
+	migrator, err := store.Migrator()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		return printMigrationStatus(migrator)
+	case args[0] == "up" && len(args) == 1:
+		err = migrator.Up()
+	case args[0] == "down" && len(args) <= 2:
+		n := 1
+		if len(args) == 2 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		err = migrator.Down(n)
+	case args[0] == "to" && len(args) == 2:
+		target, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = migrator.To(target)
+	default:
+		return errors.New(migrateUsage)
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := migrator.Current()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("The database is at version %d\n", current)
+	return nil
+}
+
+func printMigrationStatus(migrator *Migrator) error {
+	applied, err := migrator.Applied()
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int]string)
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	for _, migration := range migrator.migrations {
+		status := "pending"
+		if at, ok := appliedAt[migration.Version]; ok {
+			status = "applied " + at
+			delete(appliedAt, migration.Version)
+		}
+		fmt.Printf("%04d_%-30s %s\n", migration.Version, migration.Name, status)
+	}
+	// Versions a newer binary applied
+	for _, a := range applied {
+		if _, unknown := appliedAt[a.Version]; unknown {
+			fmt.Printf("%04d_%-30s applied %s, unknown to this binary\n", a.Version, a.Name, a.AppliedAt)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// queryStrings returns the first column of the rows of a query.
+func queryStrings(t *testing.T, db *sql.DB, query string, args ...any) []string {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return values
+}
+
+func TestMessageIntegrityMigrationKeepsOrphans(t *testing.T) {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer store.Close()
+	migrator, err := store.Migrator()
+	if err != nil {
+		t.Fatalf("Migrator: %v", err)
+	}
+	if err := migrator.To(1); err != nil {
+		t.Fatalf("To(1): %v", err)
+	}
+
+	aliceId, _ := createTestUsers(t, store)
+	room, err := store.CreateRoom("general")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	_, err = store.db.Exec(`
+	INSERT INTO messages (id, room_id, sender, content, date) VALUES
+		('kept', ?, 'alice@example.com', 'hello', '2024-01-01 10:00:00'),
+		('orphan', ?, 'alice@example.com', 'lost room', '2024-01-01 10:01:00')`, room.Id, room.Id+1)
+	if err != nil {
+		t.Fatalf("inserting messages: %v", err)
+	}
+
+	if err := migrator.To(2); err != nil {
+		t.Fatalf("To(2): %v", err)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM messages WHERE sender_id = ?", aliceId); !slices.Equal(got, []string{"kept"}) {
+		t.Errorf("messages after up: %v", got)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM orphaned_messages"); !slices.Equal(got, []string{"orphan"}) {
+		t.Errorf("orphaned messages after up: %v", got)
+	}
+	indexes := queryStrings(t, store.db, "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'messages'")
+	for _, index := range []string{"idx_messages_room", "idx_messages_sender", "idx_messages_created"} {
+		if !slices.Contains(indexes, index) {
+			t.Errorf("index %s is missing: %v", index, indexes)
+		}
+	}
+
+	if err := migrator.To(1); err != nil {
+		t.Fatalf("To(1): %v", err)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM messages ORDER BY rowid"); !slices.Equal(got, []string{"kept", "orphan"}) {
+		t.Errorf("messages after down: %v", got)
+	}
+	if got := queryStrings(t, store.db, "SELECT name FROM sqlite_master WHERE name = 'orphaned_messages'"); len(got) != 0 {
+		t.Errorf("orphaned_messages is left after down")
+	}
+}
+
+// Migration 2 for PostgreSQL, on the data of an earlier release. It runs
+// when DATABASE_URL is set, like the other PostgreSQL tests.
+func TestPostgresMessageIntegrityMigration(t *testing.T) {
+	store := openTestPostgresStore(t).(*PostgresStore)
+	migrator, err := store.Migrator()
+	if err != nil {
+		t.Fatalf("Migrator: %v", err)
+	}
+	if err := migrator.To(1); err != nil {
+		t.Fatalf("To(1): %v", err)
+	}
+
+	aliceId, _ := createTestUsers(t, store)
+	room, err := store.CreateRoom("general")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	var webhookId int
+	err = store.db.QueryRow(`
+	INSERT INTO incoming_webhooks (room_id, name, token_hash, created_by) VALUES (?, 'deploys', 'hash', ?)
+	RETURNING id`, room.Id, aliceId).Scan(&webhookId)
+	if err != nil {
+		t.Fatalf("inserting webhook: %v", err)
+	}
+	webhookSender := fmt.Sprintf("webhook:%d", webhookId)
+	_, err = store.db.Exec(`
+	INSERT INTO messages (id, room_id, sender, content, date) VALUES
+		('kept', ?, 'alice@example.com', 'hello', '2024-01-01 10:00:00'),
+		('hooked', ?, ?, 'deployed', '2024-01-01 10:01:00'),
+		('orphan', ?, 'alice@example.com', 'lost room', '2024-01-01 10:02:00')`, room.Id, room.Id, webhookSender, room.Id+1)
+	if err != nil {
+		t.Fatalf("inserting messages: %v", err)
+	}
+
+	if err := migrator.To(2); err != nil {
+		t.Fatalf("To(2): %v", err)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM messages WHERE sender_id = ?", aliceId); !slices.Equal(got, []string{"kept"}) {
+		t.Errorf("messages of alice after up: %v", got)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM messages WHERE webhook_id = ?", webhookId); !slices.Equal(got, []string{"hooked"}) {
+		t.Errorf("messages of the webhook after up: %v", got)
+	}
+	if got := queryStrings(t, store.db, "SELECT id FROM orphaned_messages"); !slices.Equal(got, []string{"orphan"}) {
+		t.Errorf("orphaned messages after up: %v", got)
+	}
+	var created time.Time
+	if err := store.db.QueryRow("SELECT created_at FROM messages WHERE id = 'kept'").Scan(&created); err != nil {
+		t.Fatalf("reading created_at: %v", err)
+	}
+	if want := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC); !created.Equal(want) {
+		t.Errorf("created_at after up is %s, want %s", created, want)
+	}
+
+	if err := migrator.To(1); err != nil {
+		t.Fatalf("To(1): %v", err)
+	}
+	if got := queryStrings(t, store.db, "SELECT id || ' ' || sender FROM messages ORDER BY seq"); !slices.Equal(got, []string{
+		"kept alice@example.com", "hooked " + webhookSender, "orphan alice@example.com",
+	}) {
+		t.Errorf("messages after down: %v", got)
+	}
+	if got := queryStrings(t, store.db, "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'orphaned_messages'"); len(got) != 0 {
+		t.Errorf("orphaned_messages is left after down")
+	}
+}
+
+// testSchema describes the tables and indexes of a database, other than
+// the bookkeeping of SQLite and the migrator, one line per column or index.
+func testSchema(t *testing.T, store Store) []string {
+	t.Helper()
+	if s, ok := store.(*PostgresStore); ok {
+		columns := queryStrings(t, s.db, `
+		SELECT table_name || '.' || column_name || ' ' || data_type || ' nullable=' || is_nullable || ' default=' || COALESCE(column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name != 'schema_migrations'
+		ORDER BY table_name, ordinal_position`)
+		indexes := queryStrings(t, s.db, `
+		SELECT indexdef FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename != 'schema_migrations'
+		ORDER BY indexname`)
+		return append(columns, indexes...)
+	}
+
+	db := store.(*SQLiteStore).db
+	tables := "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'"
+	columns := queryStrings(t, db, `
+	SELECT m.name || '.' || c.name || ' ' || c.type || ' notnull=' || c."notnull" || ' default=' || COALESCE(c.dflt_value, '') || ' pk=' || c.pk
+	FROM (`+tables+`) m JOIN pragma_table_info(m.name) c
+	ORDER BY m.name, c.cid`)
+	indexes := queryStrings(t, db, `
+	SELECT m.name || ' index ' || i.name || ' unique=' || i."unique" || ' (' ||
+		(SELECT group_concat(name, ', ') FROM (SELECT name FROM pragma_index_info(i.name) ORDER BY seqno)) || ')'
+	FROM (`+tables+`) m JOIN pragma_index_list(m.name) i
+	ORDER BY m.name, i.name`)
+	return append(columns, indexes...)
+}
+
+func diffSchemas(t *testing.T, got, want []string) {
+	t.Helper()
+	for _, line := range got {
+		if !slices.Contains(want, line) {
+			t.Errorf("unexpected: %s", line)
+		}
+	}
+	for _, line := range want {
+		if !slices.Contains(got, line) {
+			t.Errorf("missing: %s", line)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d columns and indexes, want %d", len(got), len(want))
+	}
+}
+
+// Databases from before migrations are adopted at version 1, so the legacy
+// upgrade has to lead to exactly the schema of the first migration.
+func TestLegacySchemaMatchesFirstMigration(t *testing.T) {
+	openAt := func(t *testing.T) *SQLiteStore {
+		store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"), 5*time.Second)
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	migrated := openAt(t)
+	migrator, err := migrated.Migrator()
+	if err != nil {
+		t.Fatalf("Migrator: %v", err)
+	}
+	if err := migrator.To(1); err != nil {
+		t.Fatalf("To(1): %v", err)
+	}
+	want := testSchema(t, migrated)
+
+	t.Run("new database", func(t *testing.T) {
+		legacy := openAt(t)
+		upgradeLegacySchema(legacy.db)
+		diffSchemas(t, testSchema(t, legacy), want)
+	})
+
+	t.Run("first release", func(t *testing.T) {
+		legacy := openAt(t)
+		_, err := legacy.db.Exec(`
+		CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT UNIQUE NOT NULL, password TEXT NOT NULL);
+		CREATE TABLE rooms (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE NOT NULL, created_at DATETIME DEFAULT CURRENT_TIMESTAMP);
+		CREATE TABLE messages (id TEXT PRIMARY KEY, room_id INTEGER NOT NULL, sender TEXT NOT NULL, content TEXT NOT NULL, date DATE NOT NULL);
+		INSERT INTO users (email, password) VALUES ('alice@example.com', 'hash');`)
+		if err != nil {
+			t.Fatalf("creating the first schema: %v", err)
+		}
+		migrator, err := legacy.Migrator()
+		if err != nil {
+			t.Fatalf("Migrator: %v", err)
+		}
+		if current, err := migrator.Current(); err != nil || current != 1 {
+			t.Fatalf("adopted at version %d (%v), want 1", current, err)
+		}
+		diffSchemas(t, testSchema(t, legacy), want)
+	})
+}
+
+// Every migration has to undo itself exactly, so that rolling back and
+// migrating again leaves the schema as it was.
+func TestMigrationsRoundTrip(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			store := backend.open(t)
+			migrator, err := store.Migrator()
+			if err != nil {
+				t.Fatalf("Migrator: %v", err)
+			}
+
+			latest := migrator.Latest()
+			schemas := make([][]string, latest+1)
+			schemas[latest] = testSchema(t, store)
+			for version := latest - 1; version >= 0; version-- {
+				if err := migrator.To(version); err != nil {
+					t.Fatalf("To(%d): %v", version, err)
+				}
+				schemas[version] = testSchema(t, store)
+			}
+			if len(schemas[0]) != 0 {
+				t.Errorf("tables left after rolling everything back: %v", schemas[0])
+			}
+
+			for version := 1; version <= latest; version++ {
+				if err := migrator.To(version); err != nil {
+					t.Fatalf("To(%d): %v", version, err)
+				}
+				t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+					diffSchemas(t, testSchema(t, store), schemas[version])
+				})
+			}
+		})
+	}
+}
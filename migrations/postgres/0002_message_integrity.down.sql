@@ -0,0 +1,21 @@
+DROP INDEX idx_messages_sender;
+DROP INDEX idx_messages_created;
+ALTER TABLE messages RENAME COLUMN created_at TO date;
+ALTER TABLE messages
+	ADD COLUMN sender TEXT,
+	DROP CONSTRAINT messages_room_id_fkey,
+	ALTER COLUMN date TYPE TIMESTAMP USING date AT TIME ZONE 'UTC',
+	ALTER COLUMN edited_at TYPE TIMESTAMP USING edited_at AT TIME ZONE 'UTC',
+	ALTER COLUMN deleted_at TYPE TIMESTAMP USING deleted_at AT TIME ZONE 'UTC';
+UPDATE messages SET sender = COALESCE(
+	(SELECT users.email FROM users WHERE users.id = messages.sender_id),
+	'webhook:' || messages.webhook_id, 'webhook');
+ALTER TABLE messages
+	ALTER COLUMN sender SET NOT NULL,
+	DROP COLUMN sender_id,
+	DROP COLUMN webhook_id;
+INSERT INTO messages (id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar)
+SELECT id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar
+FROM orphaned_messages
+ORDER BY seq;
+DROP TABLE orphaned_messages;
@@ -0,0 +1,27 @@
+-- Messages point at their room, user account or webhook by id rather than
+-- by e-mail, and are dated in UTC instead of the server's local time. Dates
+-- written so far are taken as UTC, the time zone of the Docker image.
+--
+-- Messages of rooms that no longer exist can't point at their room. They are
+-- set aside unchanged in orphaned_messages rather than dropped, and put back
+-- by the down migration.
+CREATE TABLE orphaned_messages (LIKE messages);
+INSERT INTO orphaned_messages SELECT * FROM messages WHERE room_id NOT IN (SELECT id FROM rooms);
+DELETE FROM messages WHERE room_id NOT IN (SELECT id FROM rooms);
+ALTER TABLE messages
+	ADD COLUMN sender_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+	ADD COLUMN webhook_id INTEGER REFERENCES incoming_webhooks (id) ON DELETE SET NULL;
+UPDATE messages SET sender_id = users.id FROM users WHERE users.email = messages.sender;
+UPDATE messages SET webhook_id = incoming_webhooks.id
+FROM incoming_webhooks WHERE 'webhook:' || incoming_webhooks.id = messages.sender;
+ALTER TABLE messages
+	ADD FOREIGN KEY (room_id) REFERENCES rooms (id) ON DELETE CASCADE,
+	DROP COLUMN sender,
+	ALTER COLUMN date TYPE TIMESTAMPTZ USING date AT TIME ZONE 'UTC',
+	ALTER COLUMN edited_at TYPE TIMESTAMPTZ USING edited_at AT TIME ZONE 'UTC',
+	ALTER COLUMN deleted_at TYPE TIMESTAMPTZ USING deleted_at AT TIME ZONE 'UTC';
+ALTER TABLE messages RENAME COLUMN date TO created_at;
+-- History of a room by one sender or from a date; idx_messages_room covers
+-- the whole room
+CREATE INDEX idx_messages_sender ON messages (room_id, sender_id, seq);
+CREATE INDEX idx_messages_created ON messages (room_id, created_at);
@@ -0,0 +1,16 @@
+DROP TABLE api_tokens;
+DROP TABLE incoming_webhooks;
+DROP TABLE webhook_dead_letters;
+DROP TABLE webhook_deliveries;
+DROP TABLE room_webhooks;
+DROP TABLE room_filters;
+DROP TABLE reports;
+DROP TABLE user_blocks;
+DROP TABLE attachments;
+DROP TABLE room_members;
+DROP TABLE avatars;
+DROP TABLE login_attempts;
+DROP TABLE messages;
+DROP TABLE rooms;
+DROP TABLE recovery_codes;
+DROP TABLE users;
@@ -0,0 +1,157 @@
+-- The schema as it was before migrations were introduced
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	email_verified INTEGER NOT NULL DEFAULT 0,
+	totp_secret TEXT,
+	totp_enabled INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	handle TEXT,
+	display_name TEXT,
+	avatar TEXT,
+	timezone TEXT,
+	bio TEXT,
+	role TEXT NOT NULL DEFAULT 'user',
+	banned INTEGER NOT NULL DEFAULT 0,
+	muted_until DATETIME,
+	is_bot INTEGER NOT NULL DEFAULT 0,
+	owner_id INTEGER
+);
+CREATE UNIQUE INDEX idx_users_handle ON users (handle);
+CREATE TABLE recovery_codes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at DATETIME
+);
+CREATE TABLE rooms (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	slow_mode_seconds INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE messages (
+	id TEXT PRIMARY KEY,
+	room_id INTEGER NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	date DATE NOT NULL,
+	deleted_at DATETIME,
+	edited_at DATETIME,
+	sender_name TEXT,
+	sender_avatar TEXT
+);
+CREATE TABLE login_attempts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	success INTEGER NOT NULL,
+	reason TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_login_attempts_email ON login_attempts (email, created_at);
+CREATE TABLE avatars (
+	user_id INTEGER PRIMARY KEY,
+	version TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE room_members (
+	room_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (room_id, user_id)
+);
+CREATE TABLE attachments (
+	id TEXT PRIMARY KEY,
+	room_id INTEGER NOT NULL,
+	uploader_id INTEGER NOT NULL,
+	message_id TEXT,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	storage_key TEXT NOT NULL,
+	thumbnail_key TEXT,
+	width INTEGER,
+	height INTEGER,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_attachments_message ON attachments (message_id);
+CREATE TABLE user_blocks (
+	blocker_id INTEGER NOT NULL,
+	blocked_id INTEGER NOT NULL,
+	kind TEXT NOT NULL DEFAULT 'block',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (blocker_id, blocked_id)
+);
+CREATE TABLE reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	reporter_id INTEGER NOT NULL,
+	reported_user_id INTEGER NOT NULL,
+	message_id TEXT,
+	reason TEXT NOT NULL,
+	details TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'open',
+	resolution TEXT,
+	note TEXT,
+	resolved_by INTEGER,
+	resolved_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_reports_status ON reports (status, created_at);
+CREATE TABLE room_filters (
+	room_id INTEGER PRIMARY KEY,
+	rules TEXT NOT NULL,
+	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE room_webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	events TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	created_by INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_room_webhooks_room ON room_webhooks (room_id);
+CREATE TABLE webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id INTEGER NOT NULL,
+	delivery_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
+CREATE TABLE webhook_dead_letters (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook_id INTEGER NOT NULL,
+	delivery_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	attempts INTEGER NOT NULL,
+	last_error TEXT NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_webhook_dead_letters_webhook ON webhook_dead_letters (webhook_id, id);
+CREATE TABLE incoming_webhooks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	room_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	avatar_url TEXT NOT NULL DEFAULT '',
+	token_hash TEXT UNIQUE NOT NULL,
+	created_by INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE api_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	scopes TEXT NOT NULL,
+	token_hash TEXT UNIQUE NOT NULL,
+	last_used_at DATETIME,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_api_tokens_user ON api_tokens (user_id);
@@ -0,0 +1,30 @@
+CREATE TABLE messages_old (
+	id TEXT PRIMARY KEY,
+	room_id INTEGER NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	date DATE NOT NULL,
+	deleted_at DATETIME,
+	edited_at DATETIME,
+	sender_name TEXT,
+	sender_avatar TEXT
+);
+INSERT INTO messages_old
+	(rowid, id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar)
+SELECT messages.rowid, messages.id, messages.room_id,
+	COALESCE((SELECT users.email FROM users WHERE users.id = messages.sender_id),
+		'webhook:' || messages.webhook_id, 'webhook'),
+	messages.content,
+	strftime('%Y-%m-%d %H:%M:%S', messages.created_at, 'localtime'),
+	strftime('%Y-%m-%dT%H:%M:%SZ', messages.deleted_at),
+	strftime('%Y-%m-%dT%H:%M:%SZ', messages.edited_at),
+	messages.sender_name, messages.sender_avatar
+FROM messages;
+INSERT INTO messages_old
+	(id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar)
+SELECT id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar
+FROM orphaned_messages
+ORDER BY rowid;
+DROP TABLE orphaned_messages;
+DROP TABLE messages;
+ALTER TABLE messages_old RENAME TO messages;
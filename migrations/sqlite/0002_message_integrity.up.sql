@@ -0,0 +1,55 @@
+-- Messages point at their room, user account or webhook by id rather than
+-- by e-mail, and are dated in UTC with milliseconds instead of the server's
+-- local time. SQLite can't add foreign keys to a table, so it is rebuilt;
+-- the rowids are kept as they order the messages.
+--
+-- Messages of rooms that no longer exist can't point at their room. They are
+-- set aside unchanged in orphaned_messages rather than dropped, and put back
+-- by the down migration.
+CREATE TABLE orphaned_messages (
+	id TEXT PRIMARY KEY,
+	room_id INTEGER NOT NULL,
+	sender TEXT NOT NULL,
+	content TEXT NOT NULL,
+	date DATE NOT NULL,
+	deleted_at DATETIME,
+	edited_at DATETIME,
+	sender_name TEXT,
+	sender_avatar TEXT
+);
+INSERT INTO orphaned_messages
+	(rowid, id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar)
+SELECT rowid, id, room_id, sender, content, date, deleted_at, edited_at, sender_name, sender_avatar
+FROM messages
+WHERE room_id NOT IN (SELECT id FROM rooms);
+CREATE TABLE messages_new (
+	id TEXT PRIMARY KEY,
+	room_id INTEGER NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+	sender_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+	webhook_id INTEGER REFERENCES incoming_webhooks (id) ON DELETE SET NULL,
+	content TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	edited_at TIMESTAMP,
+	deleted_at TIMESTAMP,
+	sender_name TEXT,
+	sender_avatar TEXT
+);
+INSERT INTO messages_new
+	(rowid, id, room_id, sender_id, webhook_id, content, created_at, edited_at, deleted_at, sender_name, sender_avatar)
+SELECT messages.rowid, messages.id, messages.room_id,
+	(SELECT users.id FROM users WHERE users.email = messages.sender),
+	(SELECT incoming_webhooks.id FROM incoming_webhooks WHERE 'webhook:' || incoming_webhooks.id = messages.sender),
+	messages.content,
+	strftime('%Y-%m-%dT%H:%M:%fZ', messages.date, 'utc'),
+	strftime('%Y-%m-%dT%H:%M:%fZ', messages.edited_at),
+	strftime('%Y-%m-%dT%H:%M:%fZ', messages.deleted_at),
+	messages.sender_name, messages.sender_avatar
+FROM messages
+WHERE messages.room_id IN (SELECT id FROM rooms);
+DROP TABLE messages;
+ALTER TABLE messages_new RENAME TO messages;
+-- History of a room, whole, by one sender or from a date. The first two
+-- keep the rowid order within each key, so history needs no sort.
+CREATE INDEX idx_messages_room ON messages (room_id);
+CREATE INDEX idx_messages_sender ON messages (room_id, sender_id);
+CREATE INDEX idx_messages_created ON messages (room_id, created_at);
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roles from the least to the most powerful
+var roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+func isModeratorRole(role string) bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// outranks reports whether role is more powerful than other.
+func outranks(role, other string) bool {
+	return slices.Index(roles, role) > slices.Index(roles, other)
+}
+
+const (
+	ReportOpen      = "open"
+	ReportDismissed = "dismissed"
+	ReportResolved  = "resolved"
+)
+
+// Reasons users can pick when reporting. Automatic reports use "filter".
+var reportReasons = []string{"spam", "harassment", "hate", "inappropriate", "other"}
+
+const (
+	maxReportDetailsLength = 1000
+	reportContextMessages  = 5
+	defaultMuteDuration    = 24 * time.Hour
+)
+
+// accountStatus holds the moderation state of a user.
+type accountStatus struct {
+	Role       string
+	Banned     bool
+	MutedUntil time.Time
+}
+
+// promoteUsers gives a role to the configured accounts. Accounts that have
+// a more powerful role keep it.
+func promoteUsers(store Store, emails []string, role string) error {
+	lower := roles[:slices.Index(roles, role)]
+	for _, email := range emails {
+		if err := store.PromoteUser(email, role, lower); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireModerator only lets moderators and admins through. It must be
+// wrapped by authMiddleware.
+func requireModerator(store Store, next http.Handler) http.Handler {
+	return requireRole(store, isModeratorRole, "Moderator role required", next)
+}
+
+// requireAdmin only lets admins through. It must be wrapped by
+// authMiddleware.
+func requireAdmin(store Store, next http.Handler) http.Handler {
+	isAdmin := func(role string) bool { return role == RoleAdmin }
+	return requireRole(store, isAdmin, "Admin role required", next)
+}
+
+func requireRole(store Store, allowed func(role string) bool, denied string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account", http.StatusInternalServerError)
+			return
+		}
+		status, err := store.AccountStatus(userId)
+		if err != nil {
+			http.Error(w, "Failed to load account", http.StatusInternalServerError)
+			return
+		}
+		if !allowed(status.Role) || status.Banned {
+			http.Error(w, denied, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Report struct {
+	Id           int      `json:"id"`
+	Status       string   `json:"status"`
+	Reason       string   `json:"reason"`
+	Details      string   `json:"details,omitempty"`
+	CreatedAt    string   `json:"created_at"`
+	Reporter     Profile  `json:"reporter"`
+	ReportedUser Profile  `json:"reported_user"`
+	Message      *Message `json:"message,omitempty"`
+	Resolution   string   `json:"resolution,omitempty"`
+	Note         string   `json:"note,omitempty"`
+	ResolvedBy   string   `json:"resolved_by,omitempty"`
+	ResolvedAt   string   `json:"resolved_at,omitempty"`
+
+	reporterId     int
+	reportedUserId int
+	messageId      string
+}
+
+// ReportDetail is a report together with the messages around the reported
+// one, so moderators can judge it in context.
+type ReportDetail struct {
+	Report
+	Context []Message `json:"context,omitempty"`
+}
+
+// loadReportRefs fills in the profiles and the message a report refers to.
+func loadReportRefs(store Store, r *Report) error {
+	// Reports filed by the content filters have no reporter
+	reporter := &Profile{Handle: "system"}
+	if r.reporterId != 0 {
+		var err error
+		reporter, err = store.ProfileById(r.reporterId)
+		if err != nil {
+			return err
+		}
+	}
+	reported, err := store.ProfileById(r.reportedUserId)
+	if err != nil {
+		return err
+	}
+	r.Reporter, r.ReportedUser = *reporter, *reported
+
+	if r.messageId != "" {
+		message, err := store.MessageById(r.messageId)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		r.Message = message
+	}
+	return nil
+}
+
+func getReport(store Store, id int) (*Report, error) {
+	r, err := store.Report(id)
+	if err != nil {
+		return nil, err
+	}
+	return r, loadReportRefs(store, r)
+}
+
+func listReports(store Store, status string) ([]Report, error) {
+	reports, err := store.Reports(status)
+	if err != nil {
+		return nil, err
+	}
+	for i := range reports {
+		if err := loadReportRefs(store, &reports[i]); err != nil {
+			return nil, err
+		}
+	}
+	return reports, nil
+}
+
+func handleCreateReport(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		var request struct {
+			MessageId string `json:"message_id"`
+			User      string `json:"user"`
+			Reason    string `json:"reason"`
+			Details   string `json:"details"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Details = strings.TrimSpace(request.Details)
+		if !slices.Contains(reportReasons, request.Reason) {
+			http.Error(w, fmt.Sprintf("Reason must be one of %s", strings.Join(reportReasons, ", ")), http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(request.Details) > maxReportDetailsLength {
+			http.Error(w, fmt.Sprintf("Details must be at most %d characters", maxReportDetailsLength), http.StatusBadRequest)
+			return
+		}
+
+		reporterId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// A report is about a message, whose author is then the reported
+		// user, or about a user directly
+		var reportedUserId int
+		switch {
+		case request.MessageId != "":
+			message, err := store.MessageById(request.MessageId)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Message not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to load message: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			member, err := store.IsRoomMember(message.Room.Id, reporterId)
+			if err != nil {
+				http.Error(w, "Failed to check room membership: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !member || message.SenderId == 0 {
+				http.Error(w, "Message not found", http.StatusNotFound)
+				return
+			}
+			reportedUserId = message.SenderId
+		case request.User != "":
+			reportedUserId, err = userIdByHandle(store, request.User)
+			if err == errUserNotFound {
+				http.Error(w, "User not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Failed to load user: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		default:
+			http.Error(w, "Either message_id or user is required", http.StatusBadRequest)
+			return
+		}
+		if reportedUserId == reporterId {
+			http.Error(w, "You cannot report yourself", http.StatusBadRequest)
+			return
+		}
+
+		id, err := store.CreateReport(reporterId, reportedUserId, request.MessageId, request.Reason, request.Details)
+		if err != nil {
+			http.Error(w, "Failed to create report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Report %d filed against user %d: %s", id, reportedUserId, request.Reason)
+
+		if report, err := getReport(store, id); err == nil {
+			notice := newMessage(ReportMessage, fmt.Sprintf("New report #%d against %s: %s", id, report.ReportedUser.Handle, report.Reason), "system", nil)
+			manager.NotifyModerators(notice)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(map[string]int{"id": id})
+		if err != nil {
+			http.Error(w, "Failed to encode report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleGetReports(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = ReportOpen
+		}
+
+		reports, err := listReports(store, status)
+		if err != nil {
+			http.Error(w, "Failed to get reports: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(reports)
+		if err != nil {
+			http.Error(w, "Failed to encode reports: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleGetReport(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		report, err := getReport(store, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		detail := ReportDetail{Report: *report}
+		if report.messageId != "" {
+			detail.Context, err = store.MessageContext(report.messageId, reportContextMessages)
+			if err != nil {
+				http.Error(w, "Failed to get message context: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(detail)
+		if err != nil {
+			http.Error(w, "Failed to encode report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleReportAction applies a moderation decision to a report: dismiss it,
+// delete the reported message, or mute or ban the reported user.
+func handleReportAction(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		var request struct {
+			Action   string `json:"action"`
+			Duration string `json:"duration"`
+			Note     string `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		report, err := getReport(store, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		moderatorId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Moderators can't silence their peers or those above them
+		if request.Action == "mute" || request.Action == "ban" {
+			moderator, err := store.AccountStatus(moderatorId)
+			if err != nil {
+				http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reported, err := store.AccountStatus(report.reportedUserId)
+			if err != nil {
+				http.Error(w, "Failed to load reported user: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !outranks(moderator.Role, reported.Role) {
+				http.Error(w, "You cannot "+request.Action+" a user whose role is equal to or higher than yours", http.StatusForbidden)
+				return
+			}
+		}
+
+		status := ReportResolved
+		switch request.Action {
+		case "dismiss":
+			status = ReportDismissed
+		case "delete_message":
+			if report.Message == nil {
+				http.Error(w, "Report has no message", http.StatusBadRequest)
+				return
+			}
+			if err := store.DeleteMessage(report.Message.Id); err != nil {
+				http.Error(w, "Failed to delete message: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			manager.BroadcastToRoom(report.Message.Room.Name, newMessage(DeletedMessage, report.Message.Id, "system", nil))
+			manager.Webhooks.Dispatch(report.Message.Room, EventMessageDeleted, report.Message, nil)
+		case "mute":
+			duration := defaultMuteDuration
+			if request.Duration != "" {
+				duration, err = time.ParseDuration(request.Duration)
+				if err != nil || duration <= 0 {
+					http.Error(w, "Invalid duration", http.StatusBadRequest)
+					return
+				}
+			}
+			until := time.Now().Add(duration)
+			if err := store.MuteUser(report.reportedUserId, until); err != nil {
+				http.Error(w, "Failed to mute user: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			manager.SetMutedUntil(report.reportedUserId, until)
+		case "ban":
+			if err := store.BanUser(report.reportedUserId); err != nil {
+				http.Error(w, "Failed to ban user: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			manager.DisconnectUser(report.reportedUserId, "Your account has been banned.")
+		default:
+			http.Error(w, "Action must be one of dismiss, delete_message, mute, ban", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.ResolveReport(id, status, request.Action, strings.TrimSpace(request.Note), moderatorId); err != nil {
+			http.Error(w, "Failed to update report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Report %d: %s by moderator %d", id, request.Action, moderatorId)
+
+		report, err = getReport(store, id)
+		if err != nil {
+			http.Error(w, "Failed to get report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			http.Error(w, "Failed to encode report: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
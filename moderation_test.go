@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPromoteUsers(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+
+	if err := promoteUsers(store, []string{"Alice@example.com", "bob@example.com"}, RoleModerator); err != nil {
+		t.Fatalf("promoteUsers: %v", err)
+	}
+	if err := promoteUsers(store, []string{"alice@example.com"}, RoleAdmin); err != nil {
+		t.Fatalf("promoteUsers: %v", err)
+	}
+	// Listing an admin as a moderator again must not demote them
+	if err := promoteUsers(store, []string{"alice@example.com"}, RoleModerator); err != nil {
+		t.Fatalf("promoteUsers: %v", err)
+	}
+
+	for userId, want := range map[int]string{aliceId: RoleAdmin, bobId: RoleModerator} {
+		status, err := store.AccountStatus(userId)
+		if err != nil {
+			t.Fatalf("AccountStatus: %v", err)
+		}
+		if status.Role != want {
+			t.Errorf("user %d has role %q, want %q", userId, status.Role, want)
+		}
+	}
+}
+
+// recordingConn keeps the messages written to a client.
+type recordingConn struct {
+	lock     sync.Mutex
+	messages []Message
+}
+
+func (c *recordingConn) WriteMessage(messageType int, data []byte) error {
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.messages = append(c.messages, message)
+	return nil
+}
+
+func (c *recordingConn) Close() error {
+	return nil
+}
+
+func (c *recordingConn) last() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.messages) == 0 {
+		return ""
+	}
+	return c.messages[len(c.messages)-1].Content
+}
+
+// serveAs runs a handler for a request made by the user with the given
+// e-mail address, with the path values given as name, value pairs.
+func serveAs(handler http.Handler, email, method, target, body string, pathValues ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		r.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	r = r.WithContext(context.WithValue(r.Context(), principalContextKey, &Principal{Email: email}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestReportsAndModerationQueue(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	_, messageIds := createTestRoom(t, store, aliceId, bobId)
+	for _, user := range []string{"carol", "dave"} {
+		if err := store.CreateUser(user+"@example.com", []byte("hash"), user, ""); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+	if err := promoteUsers(store, []string{"carol@example.com"}, RoleModerator); err != nil {
+		t.Fatalf("promoteUsers: %v", err)
+	}
+	if err := promoteUsers(store, []string{"dave@example.com"}, RoleAdmin); err != nil {
+		t.Fatalf("promoteUsers: %v", err)
+	}
+	carolId, _ := store.UserIdByEmail("carol@example.com")
+
+	manager := newTestNode(t, store, NewMemoryBroker())
+	carolConn, bobConn := &recordingConn{}, &recordingConn{}
+	manager.AddClient("carol-1", &Client{UserId: carolId, Email: "carol@example.com", Role: RoleModerator, Conn: carolConn})
+	manager.AddClient("bob-1", &Client{UserId: bobId, Email: "bob@example.com", Role: RoleUser, Conn: bobConn})
+
+	create := handleCreateReport(store, manager)
+	queue := requireModerator(store, handleGetReports(store))
+	action := requireModerator(store, handleReportAction(store, manager))
+
+	report := func(email, body string) int {
+		t.Helper()
+		w := serveAs(create, email, "POST", "/api/reports", body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("reporting %s: %d %s", body, w.Code, w.Body)
+		}
+		var created struct {
+			Id int `json:"id"`
+		}
+		json.NewDecoder(w.Body).Decode(&created)
+		return created.Id
+	}
+	act := func(email string, id int, body string) *httptest.ResponseRecorder {
+		return serveAs(action, email, "POST", "/", body, "id", strconv.Itoa(id))
+	}
+	listReports := func(status string) []Report {
+		t.Helper()
+		w := serveAs(queue, "carol@example.com", "GET", "/api/moderation/reports?status="+status, "")
+		var reports []Report
+		if err := json.NewDecoder(w.Body).Decode(&reports); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("listing %s reports: %d, %v", status, w.Code, err)
+		}
+		return reports
+	}
+
+	invalid := []struct {
+		email, body string
+		want        int
+	}{
+		{"alice@example.com", `{"user": "bob", "reason": "boring"}`, http.StatusBadRequest},
+		{"alice@example.com", `{"reason": "spam"}`, http.StatusBadRequest},
+		{"alice@example.com", `{"user": "alice", "reason": "spam"}`, http.StatusBadRequest},
+		{"alice@example.com", `{"user": "nobody", "reason": "spam"}`, http.StatusNotFound},
+		// carol isn't in the room, so she can't see the message
+		{"carol@example.com", `{"message_id": "` + messageIds[1] + `", "reason": "spam"}`, http.StatusNotFound},
+	}
+	for _, test := range invalid {
+		if w := serveAs(create, test.email, "POST", "/api/reports", test.body); w.Code != test.want {
+			t.Errorf("report %s by %s: %d, want %d", test.body, test.email, w.Code, test.want)
+		}
+	}
+
+	spam := report("alice@example.com", `{"message_id": "`+messageIds[1]+`", "reason": "spam", "details": "ads"}`)
+	if got := carolConn.last(); !strings.Contains(got, fmt.Sprintf("New report #%d against bob: spam", spam)) {
+		t.Errorf("moderator was notified with %q", got)
+	}
+	if strings.Contains(bobConn.last(), "New report") {
+		t.Errorf("a user was told about a report")
+	}
+	harassment := report("alice@example.com", `{"user": "bob", "reason": "harassment"}`)
+	other := report("bob@example.com", `{"user": "alice", "reason": "other"}`)
+	againstModerator := report("bob@example.com", `{"user": "carol", "reason": "other"}`)
+	againstAdmin := report("bob@example.com", `{"user": "dave", "reason": "other"}`)
+
+	if w := serveAs(queue, "alice@example.com", "GET", "/api/moderation/reports", ""); w.Code != http.StatusForbidden {
+		t.Errorf("a user could list reports: %d", w.Code)
+	}
+	open := listReports(ReportOpen)
+	if len(open) != 5 || open[0].Id != spam || open[0].Reporter.Handle != "alice" || open[0].ReportedUser.Handle != "bob" ||
+		open[0].Message == nil || open[0].Message.Content != "message 2" || open[0].Details != "ads" {
+		t.Fatalf("open reports: %+v", open)
+	}
+
+	// Moderators can't act against their peers or those above them
+	for _, id := range []int{againstModerator, againstAdmin} {
+		for _, body := range []string{`{"action": "mute"}`, `{"action": "ban"}`} {
+			if w := act("carol@example.com", id, body); w.Code != http.StatusForbidden {
+				t.Errorf("moderator took %s on report %d: %d %s", body, id, w.Code, w.Body)
+			}
+		}
+	}
+	if w := act("dave@example.com", againstModerator, `{"action": "mute", "duration": "1h"}`); w.Code != http.StatusOK {
+		t.Errorf("an admin could not mute a moderator: %d %s", w.Code, w.Body)
+	}
+
+	if w := act("carol@example.com", other, `{"action": "dismiss", "note": "not a problem"}`); w.Code != http.StatusOK {
+		t.Fatalf("dismiss: %d %s", w.Code, w.Body)
+	}
+	if w := act("carol@example.com", spam, `{"action": "mute", "duration": "forever"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("mute with an invalid duration: %d", w.Code)
+	}
+	if w := act("carol@example.com", spam, `{"action": "mute", "duration": "2h"}`); w.Code != http.StatusOK {
+		t.Fatalf("mute: %d %s", w.Code, w.Body)
+	}
+	if status, _ := store.AccountStatus(bobId); time.Until(status.MutedUntil) < time.Hour || time.Until(status.MutedUntil) > 2*time.Hour {
+		t.Errorf("bob is muted until %s, want in two hours", status.MutedUntil)
+	}
+	if w := act("carol@example.com", harassment, `{"action": "ban", "note": "repeated"}`); w.Code != http.StatusOK {
+		t.Fatalf("ban: %d %s", w.Code, w.Body)
+	}
+	if status, _ := store.AccountStatus(bobId); !status.Banned {
+		t.Errorf("bob is not banned")
+	}
+	if got := bobConn.last(); got != "Your account has been banned." {
+		t.Errorf("banned user was told %q", got)
+	}
+
+	if open := listReports(ReportOpen); len(open) != 1 || open[0].Id != againstAdmin {
+		t.Errorf("open reports after the actions: %+v", open)
+	}
+	if dismissed := listReports(ReportDismissed); len(dismissed) != 1 || dismissed[0].Note != "not a problem" || dismissed[0].ResolvedBy != "carol" {
+		t.Errorf("dismissed reports: %+v", dismissed)
+	}
+	resolved := listReports(ReportResolved)
+	resolutions := map[int]string{}
+	for _, r := range resolved {
+		resolutions[r.Id] = r.Resolution
+	}
+	if len(resolved) != 3 || resolutions[spam] != "mute" || resolutions[harassment] != "ban" || resolutions[againstModerator] != "mute" {
+		t.Errorf("resolved reports: %+v", resolved)
+	}
+}
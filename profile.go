@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode/utf8"
+)
+
+// Profile is the public view of a user. It never contains the e-mail
+// address.
+type Profile struct {
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Avatar      string `json:"avatar,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Timezone    string `json:"timezone,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Bot         bool   `json:"bot,omitempty"`
+}
+
+const (
+	maxDisplayNameLength = 64
+	maxBioLength         = 500
+	maxAvatarURLLength   = 512
+)
+
+var handlePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+func validateHandle(handle string) error {
+	if !handlePattern.MatchString(handle) {
+		return fmt.Errorf("handle must be 3-32 characters of a-z, 0-9, '_', '.' or '-' and start with a letter or digit")
+	}
+	return nil
+}
+
+func validateProfile(p *Profile) error {
+	if err := validateHandle(p.Handle); err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(p.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("display name must be at most %d characters", maxDisplayNameLength)
+	}
+	if utf8.RuneCountInString(p.Bio) > maxBioLength {
+		return fmt.Errorf("bio must be at most %d characters", maxBioLength)
+	}
+	if p.Avatar != "" {
+		u, err := url.Parse(p.Avatar)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(p.Avatar) > maxAvatarURLLength {
+			return fmt.Errorf("avatar must be an http(s) URL")
+		}
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q", p.Timezone)
+		}
+	}
+	return nil
+}
+
+var handleInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// handleFromEmail derives a handle candidate from the local part of an
+// e-mail address.
+func handleFromEmail(email string) string {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	handle := strings.Trim(handleInvalidChars.ReplaceAllString(local, ""), "_.-")
+	if len(handle) > 24 {
+		handle = handle[:24]
+	}
+	for len(handle) < 3 {
+		handle += "0"
+	}
+	return handle
+}
+
+// uniqueHandle returns base, or base with a numeric suffix if it is taken.
+func uniqueHandle(store Store, base string) (string, error) {
+	candidate := base
+	for i := 2; ; i++ {
+		exists, err := store.HandleExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s%d", base, i)
+	}
+}
+
+type meResponse struct {
+	Email string `json:"email"`
+	Profile
+}
+
+func handleGetMe(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		profile, err := store.ProfileByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to get profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(meResponse{Email: principal.Email, Profile: *profile})
+		if err != nil {
+			http.Error(w, "Failed to encode profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleUpdateMe(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		profile, err := store.ProfileByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to get profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only the fields present in the body are changed
+		var patch struct {
+			Handle      *string `json:"handle"`
+			DisplayName *string `json:"display_name"`
+			Avatar      *string `json:"avatar"`
+			Timezone    *string `json:"timezone"`
+			Bio         *string `json:"bio"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if patch.Handle != nil {
+			profile.Handle = strings.ToLower(strings.TrimSpace(*patch.Handle))
+		}
+		if patch.DisplayName != nil {
+			profile.DisplayName = strings.TrimSpace(*patch.DisplayName)
+		}
+		if patch.Avatar != nil {
+			profile.Avatar = strings.TrimSpace(*patch.Avatar)
+		}
+		if patch.Timezone != nil {
+			profile.Timezone = strings.TrimSpace(*patch.Timezone)
+		}
+		if patch.Bio != nil {
+			profile.Bio = strings.TrimSpace(*patch.Bio)
+		}
+
+		if err := validateProfile(profile); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = store.UpdateProfile(principal.Email, profile)
+		if err == errHandleTaken {
+			err = fmt.Errorf("handle %q is already taken", profile.Handle)
+		}
+		if err != nil {
+			http.Error(w, "Failed to update profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		manager.UpdateClientProfile(principal.Email, profile)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(meResponse{Email: principal.Email, Profile: *profile})
+		if err != nil {
+			http.Error(w, "Failed to encode profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleGetUserProfile(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		profile, err := store.ProfileByHandle(r.PathValue("handle"))
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(profile)
+		if err != nil {
+			http.Error(w, "Failed to encode profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
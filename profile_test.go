@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		valid   bool
+	}{
+		{"minimal", Profile{Handle: "abc"}, true},
+		{"complete", Profile{Handle: "alice.b-c_1", DisplayName: "Alice", Avatar: "https://example.com/a.png", Timezone: "Europe/Berlin", Bio: "Hi"}, true},
+		{"short handle", Profile{Handle: "ab"}, false},
+		{"upper case handle", Profile{Handle: "Alice"}, false},
+		{"handle starting with a dot", Profile{Handle: ".alice"}, false},
+		{"long handle", Profile{Handle: strings.Repeat("a", 33)}, false},
+		{"long display name", Profile{Handle: "alice", DisplayName: strings.Repeat("é", maxDisplayNameLength+1)}, false},
+		{"long bio", Profile{Handle: "alice", Bio: strings.Repeat("a", maxBioLength+1)}, false},
+		{"avatar without scheme", Profile{Handle: "alice", Avatar: "example.com/a.png"}, false},
+		{"javascript avatar", Profile{Handle: "alice", Avatar: "javascript:alert(1)"}, false},
+		{"unknown timezone", Profile{Handle: "alice", Timezone: "Mars/Olympus"}, false},
+	}
+	for _, test := range tests {
+		if err := validateProfile(&test.profile); (err == nil) != test.valid {
+			t.Errorf("%s: validateProfile returned %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestHandleFromEmail(t *testing.T) {
+	tests := map[string]string{
+		"Alice@example.com":                      "alice",
+		"jo.doe+chat@example.com":                "jo.doechat",
+		"a@example.com":                          "a00",
+		"__x__@example.com":                      "x00",
+		strings.Repeat("b", 40) + "@example.com": strings.Repeat("b", 24),
+	}
+	for email, want := range tests {
+		got := handleFromEmail(email)
+		if got != want {
+			t.Errorf("handleFromEmail(%q) = %q, want %q", email, got, want)
+		}
+		if err := validateHandle(got); err != nil {
+			t.Errorf("handleFromEmail(%q) = %q is not a valid handle: %v", email, got, err)
+		}
+	}
+}
+
+func TestRegisterUserDerivesUniqueHandles(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+
+	if handle, err := uniqueHandle(store, "carol"); err != nil || handle != "carol" {
+		t.Errorf("uniqueHandle of a free handle = %q, %v", handle, err)
+	}
+	if err := registerUser(store, "alice@example.org", "password123", "", "Other Alice"); err != nil {
+		t.Fatalf("registerUser: %v", err)
+	}
+	if err := registerUser(store, "alice@example.net", "password123", "", ""); err != nil {
+		t.Fatalf("registerUser: %v", err)
+	}
+	for email, want := range map[string]string{"alice@example.org": "alice2", "alice@example.net": "alice3"} {
+		profile, err := store.ProfileByEmail(email)
+		if err != nil || profile.Handle != want {
+			t.Errorf("handle of %s is %+v, %v, want %s", email, profile, err, want)
+		}
+	}
+
+	if err := registerUser(store, "dave@example.com", "password123", "Bob", ""); err == nil || !strings.Contains(err.Error(), "already taken") {
+		t.Errorf("registering a taken handle in another case returned %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows bursts of up to Burst events and refills at Rate
+// tokens per second.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(perMinute, burst int) *TokenBucket {
+	return &TokenBucket{
+		Rate:   float64(perMinute) / 60,
+		Burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.Burst, b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until a token is available, after refilling.
+func (b *TokenBucket) wait(now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.Rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((1 - b.tokens) / b.Rate * float64(time.Second))
+}
+
+// idle reports whether the bucket is full again, so it can be dropped.
+func (b *TokenBucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.Burst
+}
+
+// RateLimiter throttles chat messages per connection, per user and per
+// room, and enforces slow mode in rooms that have it enabled. Other
+// requests, like password resets, are throttled by key with AllowKeys.
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	mu        sync.Mutex
+	conns     map[*Client]*TokenBucket
+	users     map[int]*TokenBucket
+	rooms     map[int]*TokenBucket
+	webhooks  map[int]*TokenBucket
+	keys      map[string]*TokenBucket
+	lastPost  map[[2]int]time.Time
+	lastPrune time.Time
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		cfg:      cfg,
+		conns:    make(map[*Client]*TokenBucket),
+		users:    make(map[int]*TokenBucket),
+		rooms:    make(map[int]*TokenBucket),
+		webhooks: make(map[int]*TokenBucket),
+		keys:     make(map[string]*TokenBucket),
+		lastPost: make(map[[2]int]time.Time),
+	}
+}
+
+// RateLimitError tells the client when it can post again.
+type RateLimitError struct {
+	Wait     time.Duration
+	SlowMode bool
+}
+
+func (e *RateLimitError) Error() string {
+	seconds := int(math.Ceil(e.Wait.Seconds()))
+	if e.SlowMode {
+		return fmt.Sprintf("Slow mode is on in this room. You can post again in %ds.", seconds)
+	}
+	return fmt.Sprintf("You are sending messages too fast. You can post again in %ds.", seconds)
+}
+
+// Allow takes a token from every bucket that applies to a message from
+// client, or none if any of them is empty. roomId is 0 for direct messages.
+func (rl *RateLimiter) Allow(client *Client, roomId int, slowMode time.Duration) *RateLimitError {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	// Slow mode doesn't apply to moderators
+	slowKey := [2]int{roomId, client.UserId}
+	if roomId != 0 && slowMode > 0 && !isModeratorRole(client.Role) {
+		if last, ok := rl.lastPost[slowKey]; ok {
+			if wait := last.Add(slowMode).Sub(now); wait > 0 {
+				return &RateLimitError{Wait: wait, SlowMode: true}
+			}
+		}
+	}
+
+	buckets := []*TokenBucket{
+		bucketFor(rl.conns, client, rl.cfg.ConnectionPerMinute, rl.cfg.ConnectionBurst),
+		bucketFor(rl.users, client.UserId, rl.cfg.UserPerMinute, rl.cfg.UserBurst),
+	}
+	if roomId != 0 {
+		buckets = append(buckets, bucketFor(rl.rooms, roomId, rl.cfg.RoomPerMinute, rl.cfg.RoomBurst))
+	}
+
+	if wait := take(buckets, now); wait > 0 {
+		return &RateLimitError{Wait: wait}
+	}
+	if roomId != 0 && slowMode > 0 {
+		rl.lastPost[slowKey] = now
+	}
+	return nil
+}
+
+// AllowWebhook takes a token from the bucket of an incoming webhook and
+// from that of its room, or none if either is empty, and then returns how
+// long to wait. A webhook is limited like a user.
+func (rl *RateLimiter) AllowWebhook(webhookId, roomId int) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	return take([]*TokenBucket{
+		bucketFor(rl.webhooks, webhookId, rl.cfg.UserPerMinute, rl.cfg.UserBurst),
+		bucketFor(rl.rooms, roomId, rl.cfg.RoomPerMinute, rl.cfg.RoomBurst),
+	}, now)
+}
+
+// AllowKeys takes a token from the bucket of every key, or none if any of
+// them is empty, and then returns how long to wait. A key's bucket holds
+// burst tokens and refills at perHour tokens an hour.
+func (rl *RateLimiter) AllowKeys(keys []string, perHour, burst int) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	buckets := make([]*TokenBucket, 0, len(keys))
+	for _, key := range keys {
+		bucket, ok := rl.keys[key]
+		if !ok {
+			bucket = &TokenBucket{Rate: float64(perHour) / 3600, Burst: float64(burst), tokens: float64(burst)}
+			rl.keys[key] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+	return take(buckets, now)
+}
+
+// take takes a token from every bucket, or none if any of them is empty,
+// and then returns how long to wait.
+func take(buckets []*TokenBucket, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, bucket := range buckets {
+		wait = max(wait, bucket.wait(now))
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0
+}
+
+// Forget drops the state of a closed connection.
+func (rl *RateLimiter) Forget(client *Client) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	delete(rl.conns, client)
+}
+
+func bucketFor[K comparable](buckets map[K]*TokenBucket, key K, perMinute, burst int) *TokenBucket {
+	bucket, ok := buckets[key]
+	if !ok {
+		bucket = NewTokenBucket(perMinute, burst)
+		buckets[key] = bucket
+	}
+	return bucket
+}
+
+// prune drops buckets that have filled up again, so the maps don't grow
+// with every user and room ever seen.
+func (rl *RateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+
+	for key, bucket := range rl.users {
+		if bucket.idle(now) {
+			delete(rl.users, key)
+		}
+	}
+	for key, bucket := range rl.rooms {
+		if bucket.idle(now) {
+			delete(rl.rooms, key)
+		}
+	}
+	for key, bucket := range rl.webhooks {
+		if bucket.idle(now) {
+			delete(rl.webhooks, key)
+		}
+	}
+	for key, bucket := range rl.keys {
+		if bucket.idle(now) {
+			delete(rl.keys, key)
+		}
+	}
+	for key, last := range rl.lastPost {
+		if now.Sub(last) > time.Hour {
+			delete(rl.lastPost, key)
+		}
+	}
+}
+
+const maxSlowModeSeconds = 6 * 60 * 60
+
+func handleSetSlowMode(store Store, manager *ClientManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, err := strconv.Atoi(r.PathValue("roomId"))
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			Seconds int `json:"seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if request.Seconds < 0 || request.Seconds > maxSlowModeSeconds {
+			http.Error(w, fmt.Sprintf("Seconds must be between 0 and %d", maxSlowModeSeconds), http.StatusBadRequest)
+			return
+		}
+
+		room, err := store.RoomById(roomId)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := store.SetRoomSlowMode(roomId, request.Seconds); err != nil {
+			http.Error(w, "Failed to update room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		manager.SetRoomSlowMode(room.Name, request.Seconds)
+
+		room.SlowModeSeconds = request.Seconds
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(room)
+		if err != nil {
+			http.Error(w, "Failed to encode room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := NewTokenBucket(60, 2)
+	start := time.Now()
+
+	for i := range 2 {
+		if wait := bucket.wait(start); wait != 0 {
+			t.Fatalf("token %d: wait %s", i+1, wait)
+		}
+		bucket.tokens--
+	}
+	if wait := bucket.wait(start); wait != time.Second {
+		t.Errorf("empty bucket: wait %s, want 1s", wait)
+	}
+	if wait := bucket.wait(start.Add(500 * time.Millisecond)); wait != 500*time.Millisecond {
+		t.Errorf("half a second later: wait %s, want 500ms", wait)
+	}
+	if bucket.idle(start.Add(time.Second)) {
+		t.Errorf("bucket is idle after refilling one of two tokens")
+	}
+	if !bucket.idle(start.Add(time.Hour)) || bucket.tokens != 2 {
+		t.Errorf("bucket holds %v tokens after an hour, want the burst of 2", bucket.tokens)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{
+		ConnectionPerMinute: 1, ConnectionBurst: 2,
+		UserPerMinute: 1, UserBurst: 3,
+		RoomPerMinute: 60, RoomBurst: 100,
+	})
+	first := &Client{UserId: 1, Role: RoleUser}
+	second := &Client{UserId: 1, Role: RoleUser}
+
+	for i := range 2 {
+		if err := rl.Allow(first, 1, 0); err != nil {
+			t.Fatalf("message %d: %v", i+1, err)
+		}
+	}
+	if err := rl.Allow(first, 1, 0); err == nil || err.SlowMode {
+		t.Errorf("third message on a connection with a burst of 2: %v", err)
+	}
+	// The refused message took no token from the user, so one is left for
+	// the user's other connection
+	if err := rl.Allow(second, 1, 0); err != nil {
+		t.Errorf("third message of a user with a burst of 3: %v", err)
+	}
+	if err := rl.Allow(second, 0, 0); err == nil {
+		t.Errorf("fourth message of a user with a burst of 3 was allowed")
+	}
+
+	rl.Forget(first)
+	if _, ok := rl.conns[first]; ok {
+		t.Errorf("closed connection is still tracked")
+	}
+}
+
+func TestRateLimiterSlowMode(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{ConnectionPerMinute: 60, ConnectionBurst: 10, UserPerMinute: 60, UserBurst: 10, RoomPerMinute: 60, RoomBurst: 10})
+	user := &Client{UserId: 1, Role: RoleUser}
+	moderator := &Client{UserId: 2, Role: RoleModerator}
+
+	if err := rl.Allow(user, 1, time.Minute); err != nil {
+		t.Fatalf("first message: %v", err)
+	}
+	err := rl.Allow(user, 1, time.Minute)
+	if err == nil || !err.SlowMode || err.Wait <= 0 || err.Wait > time.Minute {
+		t.Errorf("second message in slow mode: %+v", err)
+	}
+	if err := rl.Allow(user, 2, time.Minute); err != nil {
+		t.Errorf("message in another room: %v", err)
+	}
+	if err := rl.Allow(user, 0, time.Minute); err != nil {
+		t.Errorf("direct message: %v", err)
+	}
+	for i := range 2 {
+		if err := rl.Allow(moderator, 1, time.Minute); err != nil {
+			t.Errorf("moderator message %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestRateLimiterAllowKeys(t *testing.T) {
+	rl := NewRateLimiter(RateLimitConfig{})
+
+	if wait := rl.AllowKeys([]string{"a", "b"}, 60, 1); wait != 0 {
+		t.Fatalf("first request waits %s", wait)
+	}
+	if wait := rl.AllowKeys([]string{"b", "c"}, 60, 1); wait <= 0 || wait > time.Minute {
+		t.Errorf("request for an empty key waits %s, want up to a minute", wait)
+	}
+	// The refused request took nothing from c
+	if wait := rl.AllowKeys([]string{"c"}, 60, 1); wait != 0 {
+		t.Errorf("request for c waits %s", wait)
+	}
+}
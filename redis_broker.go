@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisBroker publishes events to a Redis channel every node subscribes
+// to. It speaks the few commands it needs of the Redis protocol itself.
+type RedisBroker struct {
+	addr     string
+	password string
+	db       int
+	channel  string
+
+	// Connection for publishing, opened when first needed
+	pubLock sync.Mutex
+	pub     *redisConn
+
+	lock     sync.Mutex
+	handlers []func(ClusterEvent)
+	sub      *redisConn
+	closed   bool
+	done     chan struct{}
+}
+
+func NewRedisBroker(cfg BrokerConfig) (*RedisBroker, error) {
+	if cfg.RedisAddr == "" {
+		return nil, fmt.Errorf("REDIS_ADDR is required for the redis broker")
+	}
+	b := &RedisBroker{
+		addr:     cfg.RedisAddr,
+		password: cfg.RedisPassword,
+		db:       cfg.RedisDB,
+		channel:  cfg.Channel,
+		done:     make(chan struct{}),
+	}
+
+	// Fail early on a wrong address or password; later outages are
+	// retried
+	sub, err := b.subscribe()
+	if err != nil {
+		return nil, err
+	}
+	go b.receive(sub)
+	return b, nil
+}
+
+func (b *RedisBroker) Publish(event ClusterEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	// A connection that broke since the last publish only shows when it
+	// is used, so a failure is retried once on a new one
+	for attempt := 0; ; attempt++ {
+		if b.pub == nil {
+			if b.pub, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		_, err = b.pub.do("PUBLISH", b.channel, string(payload))
+		if err == nil {
+			return nil
+		}
+		b.pub.Close()
+		b.pub = nil
+		if attempt == 1 {
+			return err
+		}
+	}
+}
+
+func (b *RedisBroker) Subscribe(handler func(ClusterEvent)) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *RedisBroker) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.sub != nil {
+		b.sub.Close()
+	}
+	b.lock.Unlock()
+
+	b.pubLock.Lock()
+	defer b.pubLock.Unlock()
+	if b.pub != nil {
+		b.pub.Close()
+	}
+	return nil
+}
+
+func (b *RedisBroker) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", b.addr, err)
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if b.password != "" {
+		if _, err := c.do("AUTH", b.password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to authenticate with redis: %w", err)
+		}
+	}
+	if b.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(b.db)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %w", b.db, err)
+		}
+	}
+	return c, nil
+}
+
+func (b *RedisBroker) subscribe() (*redisConn, error) {
+	c, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.do("SUBSCRIBE", b.channel); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", b.channel, err)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		c.Close()
+		return nil, errBrokerClosed
+	}
+	b.sub = c
+	return c, nil
+}
+
+var errBrokerClosed = errors.New("broker closed")
+
+// receive hands the events on the subscription to the handlers and
+// resubscribes after the connection breaks. Events published in between
+// are lost; presence is announced periodically, so that heals.
+func (b *RedisBroker) receive(sub *redisConn) {
+	backoff := time.Second
+	for {
+		if sub != nil {
+			backoff = time.Second
+			err := b.read(sub)
+			sub.Close()
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+			log.Printf("Redis subscription lost: %v", err)
+		}
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		var err error
+		sub, err = b.subscribe()
+		if err == errBrokerClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("Error resubscribing to redis: %v", err)
+			backoff = min(2*backoff, 30*time.Second)
+		}
+	}
+}
+
+func (b *RedisBroker) read(sub *redisConn) error {
+	for {
+		reply, err := sub.read()
+		if err != nil {
+			return err
+		}
+		// Pushed messages are ["message", channel, payload]
+		items, ok := reply.([]any)
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+		payload, _ := items[2].(string)
+		var event ClusterEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			log.Printf("Error decoding cluster event: %v", err)
+			continue
+		}
+
+		b.lock.Lock()
+		handlers := b.handlers
+		b.lock.Unlock()
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// redisConn is a connection speaking RESP, the Redis protocol.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	return c.read()
+}
+
+// read reads one reply. Errors from the server are returned as errors,
+// bulk strings as strings and nil bulk strings as nil.
+func (c *redisConn) read() (any, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply %q", string(kind)+line)
+	}
+}
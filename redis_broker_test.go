@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedisConnRead(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    any
+		wantErr bool
+	}{
+		{"+OK\r\n", "OK", false},
+		{"-ERR unknown command\r\n", nil, true},
+		{":42\r\n", int64(42), false},
+		{"$5\r\nhello\r\n", "hello", false},
+		{"$0\r\n\r\n", "", false},
+		{"$-1\r\n", nil, false},
+		{"$8\r\nwith\r\nnl\r\n", "with\r\nnl", false},
+		{"*3\r\n$7\r\nmessage\r\n$4\r\nchat\r\n:1\r\n", []any{"message", "chat", int64(1)}, false},
+		{"*-1\r\n", nil, false},
+		{"*0\r\n", []any{}, false},
+		{"+OK\n", nil, true},
+		{"$5\r\nhel", nil, true},
+		{"$x\r\n", nil, true},
+		{"*2\r\n+OK\r\n", nil, true},
+		{"?what\r\n", nil, true},
+	}
+	for _, test := range tests {
+		c := &redisConn{reader: bufio.NewReader(strings.NewReader(test.reply))}
+		got, err := c.read()
+		if (err != nil) != test.wantErr {
+			t.Errorf("read(%q) error = %v, want error %t", test.reply, err, test.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("read(%q) = %#v, want %#v", test.reply, got, test.want)
+		}
+	}
+}
+
+// fakeRedis is a Redis server that knows the commands RedisBroker uses.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu          sync.Mutex
+	conns       map[net.Conn]bool
+	subscribers map[net.Conn]string
+	commands    []string
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	r := &fakeRedis{
+		listener:    listener,
+		password:    password,
+		conns:       make(map[net.Conn]bool),
+		subscribers: make(map[net.Conn]string),
+	}
+	go r.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		r.dropConnections()
+	})
+	return r
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns[conn] = true
+		r.mu.Unlock()
+		go r.handle(conn)
+	}
+}
+
+// dropConnections breaks every open connection, like a restarting server.
+func (r *fakeRedis) dropConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	clear(r.conns)
+	clear(r.subscribers)
+}
+
+func (r *fakeRedis) subscriberCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subscribers)
+}
+
+func (r *fakeRedis) commandNames() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, conn)
+		delete(r.subscribers, conn)
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	authenticated := r.password == ""
+	for {
+		// Commands are arrays of bulk strings, which read parses as well
+		// as replies
+		request, err := c.read()
+		if err != nil {
+			return
+		}
+		items, _ := request.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+		r.mu.Lock()
+		r.commands = append(r.commands, args[0])
+		r.mu.Unlock()
+
+		var reply string
+		switch {
+		case args[0] == "AUTH" && len(args) == 2:
+			authenticated = args[1] == r.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT" && len(args) == 2:
+			reply = "+OK\r\n"
+		case args[0] == "SUBSCRIBE" && len(args) == 2:
+			r.mu.Lock()
+			r.subscribers[conn] = args[1]
+			r.mu.Unlock()
+			reply = respArray("subscribe", args[1]) + ":1\r\n"
+		case args[0] == "PUBLISH" && len(args) == 3:
+			reply = ":" + strconv.Itoa(r.publish(args[1], args[2])) + "\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func (r *fakeRedis) publish(channel, payload string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for conn, subscribed := range r.subscribers {
+		if subscribed == channel {
+			conn.Write([]byte(respArray("message", channel) + respBulk(payload)))
+			n++
+		}
+	}
+	return n
+}
+
+// respArray starts an array of three whose first items are the given bulk
+// strings.
+func respArray(first, second string) string {
+	return "*3\r\n" + respBulk(first) + respBulk(second)
+}
+
+func respBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+// receiveEvents subscribes to a broker and returns the events it hands on.
+func receiveEvents(broker Broker) chan ClusterEvent {
+	events := make(chan ClusterEvent, 16)
+	broker.Subscribe(func(event ClusterEvent) { events <- event })
+	return events
+}
+
+func expectEvent(t *testing.T, events chan ClusterEvent, room string) {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event.Kind != ClusterSlowMode || event.Room != room {
+			t.Errorf("got event %+v, want slow mode for %s", event, room)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for %s", room)
+	}
+}
+
+func newTestRedisBroker(t *testing.T, server *fakeRedis, password string) *RedisBroker {
+	t.Helper()
+	broker, err := NewRedisBroker(BrokerConfig{
+		RedisAddr:     server.listener.Addr().String(),
+		RedisPassword: password,
+		RedisDB:       2,
+		Channel:       "chat-test",
+	})
+	if err != nil {
+		t.Fatalf("NewRedisBroker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	a := newTestRedisBroker(t, server, "secret")
+	b := newTestRedisBroker(t, server, "secret")
+	eventsA, eventsB := receiveEvents(a), receiveEvents(b)
+
+	if err := a.Publish(ClusterEvent{Kind: ClusterSlowMode, Room: "general", Seconds: 30}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	// The publishing node receives its own events too
+	expectEvent(t, eventsA, "general")
+	expectEvent(t, eventsB, "general")
+
+	commands := server.commandNames()
+	for _, want := range []string{"AUTH", "SELECT", "SUBSCRIBE", "PUBLISH"} {
+		if !strings.Contains(strings.Join(commands, " "), want) {
+			t.Errorf("the broker never sent %s: %v", want, commands)
+		}
+	}
+}
+
+func TestRedisBrokerRefusesWrongPassword(t *testing.T) {
+	server := startFakeRedis(t, "secret")
+	_, err := NewRedisBroker(BrokerConfig{RedisAddr: server.listener.Addr().String(), RedisPassword: "wrong", Channel: "chat-test"})
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("NewRedisBroker with a wrong password: %v", err)
+	}
+}
+
+func TestRedisBrokerReconnects(t *testing.T) {
+	server := startFakeRedis(t, "")
+	broker := newTestRedisBroker(t, server, "")
+	events := receiveEvents(broker)
+
+	if err := broker.Publish(ClusterEvent{Kind: ClusterSlowMode, Room: "before"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	expectEvent(t, events, "before")
+
+	server.dropConnections()
+
+	// The subscription comes back after a second
+	deadline := time.Now().Add(5 * time.Second)
+	for server.subscriberCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the broker did not resubscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The publishing connection broke as well and is replaced on first use
+	if err := broker.Publish(ClusterEvent{Kind: ClusterSlowMode, Room: "after"}); err != nil {
+		t.Fatalf("Publish after the connections dropped: %v", err)
+	}
+	expectEvent(t, events, "after")
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Session is a connection for clients that can't use WebSockets. It is a
+// Client of the ClientManager like any WebSocket connection; the messages
+// for it are buffered with increasing sequence numbers and read over
+// Server-Sent Events or by long polling, while messages are sent over REST.
+type Session struct {
+	Id       string
+	client   *Client
+	clientId string
+	sessions *Sessions
+
+	// Messages from the client are handled one at a time, as the read loop
+	// of a WebSocket connection does
+	sendLock sync.Mutex
+
+	lock     sync.Mutex
+	messages []sessionMessage
+	nextSeq  int64
+	// Closed and replaced whenever a message arrives
+	notify   chan struct{}
+	closed   bool
+	readers  int
+	lastSeen time.Time
+}
+
+type sessionMessage struct {
+	Seq     int64           `json:"seq"`
+	Message json.RawMessage `json:"message"`
+}
+
+// WriteMessage buffers a message for the next read. The oldest messages
+// are dropped once the buffer is full.
+func (s *Session) WriteMessage(_ int, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf("session %s is closed", s.Id)
+	}
+
+	s.nextSeq++
+	s.messages = append(s.messages, sessionMessage{Seq: s.nextSeq, Message: append(json.RawMessage(nil), data...)})
+	if over := len(s.messages) - s.sessions.cfg.BufferSize; over > 0 {
+		s.messages = s.messages[over:]
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
+}
+
+// Close ends the session. It may be called with the ClientManager lock
+// held, so the client is removed from the manager in the background.
+func (s *Session) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.notify)
+	go s.sessions.remove(s)
+	return nil
+}
+
+// errSessionClosed is returned by read once the session has ended.
+var errSessionClosed = fmt.Errorf("session closed")
+
+// read returns the messages after the given sequence number, waiting up to
+// timeout for one to arrive.
+func (s *Session) read(ctx context.Context, after int64, timeout time.Duration) ([]sessionMessage, error) {
+	s.lock.Lock()
+	s.readers++
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.readers--
+		s.lastSeen = time.Now()
+		s.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return nil, errSessionClosed
+		}
+		var messages []sessionMessage
+		for _, message := range s.messages {
+			if message.Seq > after {
+				messages = append(messages, message)
+			}
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		if len(messages) > 0 {
+			return messages, nil
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Sessions keeps the open sessions and ends those nobody has read for the
+// idle timeout.
+type Sessions struct {
+	manager *ClientManager
+	cfg     SessionConfig
+
+	lock     sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessions(manager *ClientManager, cfg SessionConfig) *Sessions {
+	sessions := &Sessions{
+		manager:  manager,
+		cfg:      cfg,
+		sessions: make(map[string]*Session),
+	}
+	go sessions.expire()
+	return sessions
+}
+
+// Create opens a session for a client and puts it in the general room, as
+// a WebSocket connection would be.
+func (ss *Sessions) Create(client *Client) (*Session, error) {
+	session := &Session{
+		Id:       uuid.New().String(),
+		clientId: uuid.New().String(),
+		client:   client,
+		sessions: ss,
+		notify:   make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	client.Conn = session
+
+	ss.lock.Lock()
+	ss.sessions[session.Id] = session
+	ss.lock.Unlock()
+	ss.manager.AddClient(session.clientId, client)
+
+	room, err := ss.manager.JoinRoom("general", client)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	sendMessage(session, SystemMessage, "You have joined the room: general", "system", room)
+	return session, nil
+}
+
+// Get returns the session with the given id if it belongs to the user.
+func (ss *Sessions) Get(id, email string) *Session {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	session := ss.sessions[id]
+	if session == nil || session.client.Email != email {
+		return nil
+	}
+	return session
+}
+
+func (ss *Sessions) remove(session *Session) {
+	ss.lock.Lock()
+	_, present := ss.sessions[session.Id]
+	delete(ss.sessions, session.Id)
+	ss.lock.Unlock()
+	if !present {
+		return
+	}
+
+	ss.manager.RemoveClient(session.clientId)
+	ss.manager.Limiter.Forget(session.client)
+	log.Printf("Session %s of %s ended", session.Id, session.client.Email)
+}
+
+func (ss *Sessions) expire() {
+	// Idle sessions are closed within a quarter of the timeout, but looked
+	// for no more than every second
+	ticker := time.NewTicker(max(ss.cfg.IdleTimeout/4, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		ss.lock.Lock()
+		var idle []*Session
+		for _, session := range ss.sessions {
+			session.lock.Lock()
+			if session.readers == 0 && time.Since(session.lastSeen) > ss.cfg.IdleTimeout {
+				idle = append(idle, session)
+			}
+			session.lock.Unlock()
+		}
+		ss.lock.Unlock()
+
+		for _, session := range idle {
+			session.Close()
+		}
+	}
+}
+
+// sessionFromRequest returns the session in the path, answering 404 if the
+// user has no such session.
+func sessionFromRequest(w http.ResponseWriter, r *http.Request, sessions *Sessions) *Session {
+	principal, _ := principalFromContext(r.Context())
+	session := sessions.Get(r.PathValue("id"), principal.Email)
+	if session == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+	}
+	return session
+}
+
+// sessionCursor returns the sequence number to read after, from the
+// Last-Event-ID header EventSource sends on reconnecting or the after
+// parameter.
+func sessionCursor(r *http.Request) (int64, error) {
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor == "" {
+		cursor = r.URL.Query().Get("after")
+	}
+	if cursor == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(cursor, 10, 64)
+}
+
+func handleCreateSession(sessions *Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+		client, err := loadClient(sessions.manager.Store, principal)
+		if err == errLoginBanned {
+			http.Error(w, "Account is banned", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		session, err := sessions.Create(client)
+		if err != nil {
+			http.Error(w, "Failed to join room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Session %s opened for %s", session.Id, principal.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"id":           session.Id,
+			"idle_timeout": int(sessions.cfg.IdleTimeout.Seconds()),
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode session: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleDeleteSession(sessions *Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromRequest(w, r, sessions)
+		if session == nil {
+			return
+		}
+		session.Close()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleSessionEvents streams the messages of a session as Server-Sent
+// Events, each with its sequence number as the event id.
+func handleSessionEvents(sessions *Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromRequest(w, r, sessions)
+		if session == nil {
+			return
+		}
+		after, err := sessionCursor(r)
+		if err != nil {
+			http.Error(w, "Invalid event id", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keep nginx from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		rc.Flush()
+
+		for {
+			messages, err := session.read(r.Context(), after, sessions.cfg.PollTimeout)
+			if err == errSessionClosed {
+				fmt.Fprint(w, "event: close\ndata: {}\n\n")
+				rc.Flush()
+				return
+			}
+			if err != nil {
+				return
+			}
+			if len(messages) == 0 {
+				// Comments keep proxies from closing an idle stream
+				fmt.Fprint(w, ": keep-alive\n\n")
+			}
+			for _, message := range messages {
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", message.Seq, message.Message)
+				after = message.Seq
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleSessionPoll answers with the messages after the cursor as soon as
+// there are any, or with none after the poll timeout.
+func handleSessionPoll(sessions *Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromRequest(w, r, sessions)
+		if session == nil {
+			return
+		}
+		after, err := sessionCursor(r)
+		if err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+		timeout := sessions.cfg.PollTimeout
+		if seconds := r.URL.Query().Get("timeout"); seconds != "" {
+			n, err := strconv.Atoi(seconds)
+			if err != nil || n < 0 {
+				http.Error(w, "Invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(time.Duration(n)*time.Second, timeout)
+		}
+
+		messages, err := session.read(r.Context(), after, timeout)
+		if err == errSessionClosed {
+			http.Error(w, "Session closed", http.StatusGone)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if messages == nil {
+			messages = make([]sessionMessage, 0)
+		}
+		cursor := after
+		if len(messages) > 0 {
+			cursor = messages[len(messages)-1].Seq
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"messages": messages,
+			"cursor":   cursor,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode messages: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleSessionSend takes a message in the same JSON format as WebSocket
+// frames. Answers, like errors or rate limit notices, arrive as system
+// messages on the session.
+func handleSessionSend(sessions *Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromRequest(w, r, sessions)
+		if session == nil {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+		var raw json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		session.sendLock.Lock()
+		defer session.sendLock.Unlock()
+		client := session.client
+		if err := handleClientMessage(session, client, sessions.manager, raw, client.Email); err != nil {
+			log.Printf("Error handling message: %v", err)
+			http.Error(w, "Failed to handle message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
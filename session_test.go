@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSession opens a session for alice on a node of its own.
+func newTestSession(t *testing.T, cfg SessionConfig) (*Sessions, *Session) {
+	t.Helper()
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	manager := newTestNode(t, store, NewMemoryBroker())
+
+	client, err := loadClient(store, &Principal{Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("loadClient: %v", err)
+	}
+	sessions := NewSessions(manager, cfg)
+	session, err := sessions.Create(client)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return sessions, session
+}
+
+func TestSessionsExpireWithTinyIdleTimeout(t *testing.T) {
+	sessions, session := newTestSession(t, SessionConfig{IdleTimeout: time.Nanosecond, BufferSize: 10})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for sessions.Get(session.Id, "alice@example.com") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle session was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionSendHandlesOneMessageAtATime(t *testing.T) {
+	sessions, session := newTestSession(t, SessionConfig{IdleTimeout: time.Hour, BufferSize: 100})
+
+	var running, most atomic.Int32
+	err := sessions.manager.Commands.Register(Command{
+		Name: "probe",
+		Handler: func(ctx *CommandContext) error {
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > most.Load() {
+				most.Store(n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	handler := handleSessionSend(sessions)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/api/sessions/"+session.Id+"/messages",
+				strings.NewReader(`{"type": "command", "content": "probe"}`))
+			r.SetPathValue("id", session.Id)
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey, &Principal{Email: "alice@example.com"}))
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Errorf("got status %d: %s", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if most.Load() != 1 {
+		t.Errorf("%d messages of the session were handled at once", most.Load())
+	}
+}
+
+func TestRoomMessageReachesEveryTransport(t *testing.T) {
+	useTestJWTKeys(t)
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	if err := store.CreateUser("carol@example.com", []byte("hash-c"), "carol", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	manager := newTestNode(t, store, NewMemoryBroker())
+	sessions := NewSessions(manager, SessionConfig{IdleTimeout: time.Hour, BufferSize: 10, PollTimeout: 5 * time.Second})
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/ws", tokenAuth(store, ScopeReadRooms, handleWebSocket(manager)))
+	mux.Handle("POST /api/sessions", tokenAuth(store, ScopeReadRooms, handleCreateSession(sessions)))
+	mux.Handle("GET /api/sessions/{id}/events", tokenAuth(store, ScopeReadRooms, handleSessionEvents(sessions)))
+	mux.Handle("GET /api/sessions/{id}/messages", tokenAuth(store, ScopeReadRooms, handleSessionPoll(sessions)))
+	mux.Handle("POST /api/sessions/{id}/messages", tokenAuth(store, ScopePostMessages, handleSessionSend(sessions)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	request := func(method, path, email, body string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+testToken(t, email))
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		return resp
+	}
+	createSession := func(email string) string {
+		t.Helper()
+		resp := request("POST", "/api/sessions", email, "")
+		defer resp.Body.Close()
+		var session struct {
+			Id string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&session); err != nil || resp.StatusCode != http.StatusCreated {
+			t.Fatalf("creating a session for %s: %d, %v", email, resp.StatusCode, err)
+		}
+		return session.Id
+	}
+
+	// alice on a WebSocket
+	header := http.Header{"Authorization": {"Bearer " + testToken(t, "alice@example.com")}}
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	fromWebSocket := make(chan Message, 10)
+	go func() {
+		for {
+			var message Message
+			if err := ws.ReadJSON(&message); err != nil {
+				close(fromWebSocket)
+				return
+			}
+			fromWebSocket <- message
+		}
+	}()
+
+	// bob on Server-Sent Events
+	events := request("GET", "/api/sessions/"+createSession("bob@example.com")+"/events", "bob@example.com", "")
+	defer events.Body.Close()
+	fromEvents := make(chan Message, 10)
+	go func() {
+		scanner := bufio.NewScanner(events.Body)
+		for scanner.Scan() {
+			var message Message
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok && json.Unmarshal([]byte(data), &message) == nil {
+				fromEvents <- message
+			}
+		}
+		close(fromEvents)
+	}()
+
+	// carol long-polls, and sends the message
+	carol := createSession("carol@example.com")
+	resp := request("POST", "/api/sessions/"+carol+"/messages", "carol@example.com", `{"type": "regular", "content": "hello everyone"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("sending over the session: %d", resp.StatusCode)
+	}
+
+	receive := func(messages <-chan Message, transport string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					t.Fatalf("%s closed before the message arrived", transport)
+				}
+				if message.Type == RegularMessage {
+					if message.Content != "hello everyone" || message.Sender != "carol" || message.Room.Name != "general" {
+						t.Errorf("%s got %+v", transport, message)
+					}
+					return
+				}
+			case <-timeout:
+				t.Fatalf("the message did not arrive over %s", transport)
+			}
+		}
+	}
+	receive(fromWebSocket, "the WebSocket")
+	receive(fromEvents, "Server-Sent Events")
+
+	poll := make(chan Message, 10)
+	var cursor int64
+	for len(poll) == 0 {
+		resp := request("GET", fmt.Sprintf("/api/sessions/%s/messages?after=%d", carol, cursor), "carol@example.com", "")
+		var result struct {
+			Messages []sessionMessage `json:"messages"`
+			Cursor   int64            `json:"cursor"`
+		}
+		err := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || len(result.Messages) == 0 {
+			t.Fatalf("long poll: %d messages, %v", len(result.Messages), err)
+		}
+		for _, m := range result.Messages {
+			var message Message
+			if json.Unmarshal(m.Message, &message) == nil && message.Type == RegularMessage {
+				poll <- message
+			}
+		}
+		cursor = result.Cursor
+	}
+	receive(poll, "long polling")
+}
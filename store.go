@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Store persists users, rooms, messages and room membership, and through
+// the embedded interfaces everything else the server keeps. SQLiteStore and
+// PostgresStore implement it; store_test.go runs the same tests against
+// both.
+//
+// Lookups of a single record return sql.ErrNoRows when there is none,
+// except RoomByName, which returns a nil room so callers can create it.
+type Store interface {
+	AccountStore
+	ModerationStore
+	IntegrationStore
+	AttachmentStore
+
+	// CreateUser adds an account with an already hashed password. It
+	// returns errHandleTaken or errEmailTaken for duplicates.
+	CreateUser(email string, passwordHash []byte, handle, displayName string) error
+	PasswordHash(email string) (string, error)
+	SetPasswordHash(email string, passwordHash []byte) error
+	UserIdByEmail(email string) (int, error)
+	EmailByHandle(handle string) (string, error)
+	HandleExists(handle string) (bool, error)
+	EmailVerified(email string) (bool, error)
+	MarkEmailVerified(email string) error
+	// Users returns the profiles of all users ordered by handle.
+	Users() ([]Profile, error)
+	ProfileByEmail(email string) (*Profile, error)
+	ProfileByHandle(handle string) (*Profile, error)
+	ProfileById(userId int) (*Profile, error)
+	// UpdateProfile returns errHandleTaken if another user has the handle.
+	UpdateProfile(email string, profile *Profile) error
+
+	CreateRoom(name string) (*Room, error)
+	RoomByName(name string) (*Room, error)
+	RoomById(id int) (*Room, error)
+	Rooms() ([]Room, error)
+	// AddRoomMember does nothing if the user is a member already.
+	AddRoomMember(roomId, userId int) error
+	IsRoomMember(roomId, userId int) (bool, error)
+
+	// SaveMessage stores a message under its id, or a new one if it has
+	// none. It is posted by the user SenderId or the incoming webhook
+	// WebhookId.
+	SaveMessage(message Message, roomId int) error
+	// Messages returns the history of a room as seen by viewerId, leaving
+	// out deleted messages and users the viewer has blocked or muted,
+	// optionally only those sent by one handle. A non-empty before only
+	// returns messages older than the one with that id, and a positive
+	// limit only the latest limit of them, still oldest first.
+	Messages(roomId int, sender string, viewerId int, before string, limit int) ([]Message, error)
+	MessageById(id string) (*Message, error)
+	// MessageContext returns up to n messages before and after the given
+	// one in the same room, including deleted ones.
+	MessageContext(id string, n int) ([]Message, error)
+	EditMessage(id, content string) error
+
+	// Migrator returns a Migrator for the database.
+	Migrator() (*Migrator, error)
+	// Backup writes a consistent copy of the database to path while it is
+	// in use. Only SQLite supports it; PostgreSQL returns
+	// errBackupUnsupported.
+	Backup(path string) error
+	// Driver names the database, "sqlite" or "postgres", which picks the
+	// migrations to run.
+	Driver() string
+	Close() error
+}
+
+// AccountStore keeps the security settings of accounts: roles and
+// moderation state, two-factor authentication, login attempts and avatars.
+type AccountStore interface {
+	AccountStatus(userId int) (*accountStatus, error)
+	// PromoteUser gives role to the account with the e-mail address if it
+	// has one of the roles in from.
+	PromoteUser(email, role string, from []string) error
+
+	TOTPState(email string) (*totpState, error)
+	// SetTOTPSecret stores a pending secret and forgets the last used step.
+	SetTOTPSecret(userId int, secret string) error
+	// TOTPSecrets returns the stored secret of every account that has one,
+	// by user id.
+	TOTPSecrets() (map[int]string, error)
+	// ReplaceTOTPSecret swaps the stored secret old for secret, e.g. its
+	// encrypted form, keeping the last used step.
+	ReplaceTOTPSecret(userId int, old, secret string) error
+	// RecordTOTPStep records the time step of a used code. It reports false
+	// if the step or a later one was used before.
+	RecordTOTPStep(userId int, step int64) (bool, error)
+	EnableTOTP(userId int) error
+	// DisableTOTP clears the secret and deletes the recovery codes.
+	DisableTOTP(userId int) error
+	// ReplaceRecoveryCodes discards the user's recovery codes in favour of
+	// the given hashes.
+	ReplaceRecoveryCodes(userId int, codeHashes []string) error
+	// UseRecoveryCode marks a recovery code as used. It reports false if
+	// there is no unused code with the hash.
+	UseRecoveryCode(userId int, codeHash string) (bool, error)
+
+	RecordLoginAttempt(email, ip string, success bool, reason string) error
+
+	// AvatarVersion returns the version of the user's uploaded avatar, or
+	// "" if there is none.
+	AvatarVersion(userId int) (string, error)
+	SetAvatarVersion(userId int, version string) error
+	DeleteAvatar(userId int) error
+}
+
+// ModerationStore keeps what users and moderators do about other users:
+// blocks, reports and their outcome, and per room rules.
+type ModerationStore interface {
+	UserIdByHandle(handle string) (int, error)
+	SetBlock(blockerId, blockedId int, kind string) error
+	// RemoveBlock lifts a block of the given kind, or of any kind if kind
+	// is "". It reports whether there was one to remove.
+	RemoveBlock(blockerId, blockedId int, kind string) (bool, error)
+	// BlockKind returns how blockerId treats blockedId, or "" if not at all.
+	BlockKind(blockerId, blockedId int) (string, error)
+	// IgnoredUsers returns the ids of everyone the user has blocked or muted.
+	IgnoredUsers(blockerId int) (map[int]bool, error)
+	Blocks(blockerId int) ([]BlockEntry, error)
+
+	// CreateReport files a report. A reporterId of 0 stands for the content
+	// filters.
+	CreateReport(reporterId, reportedUserId int, messageId, reason, details string) (int, error)
+	// Report and Reports leave out the profiles and message a report
+	// refers to; loadReportRefs fills them in.
+	Report(id int) (*Report, error)
+	// Reports returns the reports with a status, oldest first.
+	Reports(status string) ([]Report, error)
+	ResolveReport(id int, status, resolution, note string, moderatorId int) error
+	DeleteMessage(messageId string) error
+	MuteUser(userId int, until time.Time) error
+	BanUser(userId int) error
+
+	// RoomFilterRules returns the encoded filter rules of a room.
+	RoomFilterRules(roomId int) (string, error)
+	SetRoomFilterRules(roomId int, rules string) error
+	DeleteRoomFilterRules(roomId int) error
+	SetRoomSlowMode(roomId, seconds int) error
+}
+
+// IntegrationStore keeps bots and their API tokens, and the webhooks of
+// rooms. Secret tokens are passed in hashed.
+type IntegrationStore interface {
+	// APITokenPrincipal returns the principal of a bot's API token and
+	// records its use. It returns sql.ErrNoRows if the token is unknown or
+	// revoked, its bot deleted or the bot's owner banned.
+	APITokenPrincipal(tokenHash string) (*Principal, error)
+	// CountBots counts the bots of a user that are not deleted.
+	CountBots(ownerId int) (int, error)
+	// CreateBot returns errHandleTaken if the handle is in use.
+	CreateBot(ownerId int, handle, displayName, avatar string) error
+	// OwnedBotId returns the id of the bot with the given handle if it
+	// belongs to ownerId.
+	OwnedBotId(ownerId int, handle string) (int, error)
+	OwnedBots(ownerId int) ([]Profile, error)
+	// DeleteBot revokes all tokens of a bot and disables its account.
+	DeleteBot(botId int) error
+	CreateAPIToken(botId int, name string, scopes []string, tokenHash string) (*APIToken, error)
+	APITokens(botId int) ([]APIToken, error)
+	// RevokeAPIToken reports whether the bot had the token.
+	RevokeAPIToken(botId, tokenId int) (bool, error)
+
+	RoomWebhooks(roomId int) ([]Webhook, error)
+	Webhook(roomId, id int) (*Webhook, error)
+	// CreateWebhook stores a webhook and fills in its id and creation time.
+	CreateWebhook(hook *Webhook, createdBy int) error
+	// DeleteWebhook reports whether the room had the webhook.
+	DeleteWebhook(roomId, id int) (bool, error)
+	RecordWebhookDelivery(delivery WebhookDelivery) error
+	// WebhookDeliveries returns the latest attempts, newest first.
+	WebhookDeliveries(webhookId int) ([]WebhookDelivery, error)
+	RecordWebhookDeadLetter(letter WebhookDeadLetter) error
+	// WebhookDeadLetters returns the latest dead letters, newest first.
+	WebhookDeadLetters(webhookId int) ([]WebhookDeadLetter, error)
+
+	IncomingWebhookByTokenHash(tokenHash string) (*IncomingWebhook, error)
+	RoomIncomingWebhooks(roomId int) ([]IncomingWebhook, error)
+	// CreateIncomingWebhook stores a webhook and fills in its id and
+	// creation time.
+	CreateIncomingWebhook(hook *IncomingWebhook, tokenHash string, createdBy int) error
+	// DeleteIncomingWebhook reports whether the room had the webhook.
+	DeleteIncomingWebhook(roomId, id int) (bool, error)
+}
+
+// AttachmentStore keeps the records of uploaded files. The files are in a
+// Storage.
+type AttachmentStore interface {
+	Attachment(id string) (*storedAttachment, error)
+	// SaveAttachment records an upload that no message has claimed yet.
+	SaveAttachment(attachment *storedAttachment) error
+	// ClaimAttachments links uploaded attachments to a message. Only
+	// attachments the uploader sent to the same room and that are not part
+	// of another message can be claimed.
+	ClaimAttachments(refs []Attachment, roomId, uploaderId int, messageId string) ([]Attachment, error)
+	DeleteAttachment(id string) error
+}
+
+var (
+	errHandleTaken = errors.New("handle is already taken")
+	errEmailTaken  = errors.New("e-mail address is already registered")
+)
+
+func newStore(cfg DatabaseConfig) (Store, error) {
+	switch cfg.Driver {
+	case "sqlite":
+		return NewSQLiteStore(cfg.Path, cfg.BusyTimeout)
+	case "postgres":
+		return NewPostgresStore(cfg.URL)
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+}
+
+// isUniqueViolation reports whether err is a unique constraint failure on
+// either database, optionally on a given column.
+func isUniqueViolation(err error, column string) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	if strings.Contains(message, "UNIQUE constraint failed") {
+		// SQLite names the column as table.column
+		return column == "" || strings.Contains(message, "."+column)
+	}
+	if strings.Contains(message, "SQLSTATE 23505") {
+		// Postgres names the constraint, e.g. users_handle_key
+		return column == "" || strings.Contains(message, "_"+column+"_")
+	}
+	return false
+}
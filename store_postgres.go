@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// PostgresStore keeps everything in a PostgreSQL database, so several
+// nodes can share it.
+type PostgresStore struct {
+	sqlStore
+}
+
+// NewPostgresStore connects to the database at url, a postgres:// URL or
+// key=value connection string. The tables are made by the migrations.
+func NewPostgresStore(url string) (*PostgresStore, error) {
+	if url == "" {
+		return nil, fmt.Errorf("DATABASE_URL is required for the postgres driver")
+	}
+	config, err := pgx.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATABASE_URL: %w", err)
+	}
+	// Timestamps are UTC, like SQLite's CURRENT_TIMESTAMP
+	config.RuntimeParams["timezone"] = "UTC"
+
+	db := sql.OpenDB(rebindConnector{stdlib.GetConnector(*config)})
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return &PostgresStore{sqlStore{db: db, driver: "postgres", messageOrder: "messages.seq"}}, nil
+}
+
+// Backup is left to pg_dump.
+func (s *PostgresStore) Backup(path string) error {
+	return errBackupUnsupported
+}
+
+// rebindConnector hands out connections that accept the ? placeholders
+// the queries are written with, which Postgres spells $1, $2, ...
+type rebindConnector struct {
+	driver.Connector
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn.(*stdlib.Conn)}, nil
+}
+
+type rebindConn struct {
+	*stdlib.Conn
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebindPlaceholders(query))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.PrepareContext(ctx, rebindPlaceholders(query))
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.ExecContext(ctx, rebindPlaceholders(query), args)
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.Conn.QueryContext(ctx, rebindPlaceholders(query), args)
+}
+
+// rebindPlaceholders numbers the ? placeholders of a query, leaving those
+// in string literals and quoted identifiers alone.
+func rebindPlaceholders(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var sb strings.Builder
+	sb.Grow(len(query) + 8)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			// A doubled quote is an escaped one and toggles twice
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '?':
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String()
+}
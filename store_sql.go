@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sqlStore implements Store with SQL that runs on both SQLite and
+// Postgres. SQLiteStore and PostgresStore add connecting and the schema.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+	// Column that orders messages by arrival, as timestamps can tie
+	messageOrder string
+}
+
+func (s *sqlStore) Migrator() (*Migrator, error) {
+	return newMigrator(s.db, s.driver)
+}
+
+func (s *sqlStore) Driver() string {
+	return s.driver
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) CreateUser(email string, passwordHash []byte, handle, displayName string) error {
+	query := `INSERT INTO users (email, password, handle, display_name) VALUES (?, ?, ?, ?);`
+	_, err := s.db.Exec(query, email, string(passwordHash), handle, displayName)
+	if isUniqueViolation(err, "handle") {
+		return errHandleTaken
+	}
+	if isUniqueViolation(err, "email") {
+		return errEmailTaken
+	}
+	return err
+}
+
+func (s *sqlStore) PasswordHash(email string) (string, error) {
+	var hashedPassword string
+	err := s.db.QueryRow("SELECT password FROM users WHERE email = ?", email).Scan(&hashedPassword)
+	return hashedPassword, err
+}
+
+func (s *sqlStore) SetPasswordHash(email string, passwordHash []byte) error {
+	result, err := s.db.Exec("UPDATE users SET password = ? WHERE email = ?", string(passwordHash), email)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *sqlStore) UserIdByEmail(email string) (int, error) {
+	var userId int
+	err := s.db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userId)
+	return userId, err
+}
+
+func (s *sqlStore) EmailByHandle(handle string) (string, error) {
+	var email string
+	err := s.db.QueryRow("SELECT email FROM users WHERE handle = ?", strings.ToLower(handle)).Scan(&email)
+	return email, err
+}
+
+func (s *sqlStore) HandleExists(handle string) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE handle = ?)", handle).Scan(&exists)
+	return exists, err
+}
+
+func (s *sqlStore) EmailVerified(email string) (bool, error) {
+	var verified bool
+	err := s.db.QueryRow("SELECT email_verified FROM users WHERE email = ?", email).Scan(&verified)
+	if err != nil {
+		return false, err
+	}
+	return verified, nil
+}
+
+func (s *sqlStore) MarkEmailVerified(email string) error {
+	result, err := s.db.Exec("UPDATE users SET email_verified = 1 WHERE email = ?", email)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+const profileQuery = `
+	SELECT users.id, users.handle, COALESCE(users.display_name, ''), COALESCE(users.avatar, ''),
+	       COALESCE(users.timezone, ''), COALESCE(users.bio, ''), COALESCE(avatars.version, ''), users.is_bot
+	FROM users
+	LEFT JOIN avatars ON avatars.user_id = users.id`
+
+func scanProfile(row interface{ Scan(...any) error }) (*Profile, error) {
+	var p Profile
+	var userId int
+	var avatarVersion string
+	if err := row.Scan(&userId, &p.Handle, &p.DisplayName, &p.Avatar, &p.Timezone, &p.Bio, &avatarVersion, &p.Bot); err != nil {
+		return nil, err
+	}
+
+	// An uploaded avatar takes precedence over a linked one
+	p.AvatarURL = p.Avatar
+	if avatarVersion != "" {
+		p.AvatarURL = avatarURL(userId, avatarVersion)
+	}
+	return &p, nil
+}
+
+func (s *sqlStore) Users() ([]Profile, error) {
+	rows, err := s.db.Query(profileQuery + " ORDER BY users.handle")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []Profile
+	for rows.Next() {
+		profile, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *profile)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *sqlStore) ProfileByEmail(email string) (*Profile, error) {
+	return scanProfile(s.db.QueryRow(profileQuery+" WHERE users.email = ?", email))
+}
+
+func (s *sqlStore) ProfileByHandle(handle string) (*Profile, error) {
+	return scanProfile(s.db.QueryRow(profileQuery+" WHERE users.handle = ?", strings.ToLower(handle)))
+}
+
+func (s *sqlStore) ProfileById(userId int) (*Profile, error) {
+	return scanProfile(s.db.QueryRow(profileQuery+" WHERE users.id = ?", userId))
+}
+
+func (s *sqlStore) UpdateProfile(email string, p *Profile) error {
+	query := `UPDATE users SET handle = ?, display_name = ?, avatar = ?, timezone = ?, bio = ? WHERE email = ?`
+	_, err := s.db.Exec(query, p.Handle, p.DisplayName, p.Avatar, p.Timezone, p.Bio, email)
+	if isUniqueViolation(err, "handle") {
+		return errHandleTaken
+	}
+	return err
+}
+
+func (s *sqlStore) CreateRoom(name string) (*Room, error) {
+	query := `
+	INSERT INTO rooms (name) VALUES (?);
+	`
+	_, err := s.db.Exec(query, name)
+
+	if err != nil {
+		return nil, err
+	}
+	room, err := s.RoomByName(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	room.Clients = make(map[string]*Client)
+	room.History = make([]string, 0)
+	return room, nil
+}
+
+const roomQuery = "SELECT id, name, created_at, slow_mode_seconds FROM rooms"
+
+func (s *sqlStore) RoomByName(roomName string) (*Room, error) {
+	row := s.db.QueryRow(roomQuery+" WHERE name = ?", roomName)
+
+	var room Room
+	err := row.Scan(&room.Id, &room.Name, &room.CreatedAt, &room.SlowModeSeconds)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	room.Clients = make(map[string]*Client)
+	room.History = make([]string, 0)
+	return &room, nil
+}
+
+func (s *sqlStore) RoomById(roomId int) (*Room, error) {
+	var room Room
+	err := s.db.QueryRow(roomQuery+" WHERE id = ?", roomId).Scan(&room.Id, &room.Name, &room.CreatedAt, &room.SlowModeSeconds)
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *sqlStore) Rooms() ([]Room, error) {
+	rows, err := s.db.Query(roomQuery + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		var room Room
+		if err := rows.Scan(&room.Id, &room.Name, &room.CreatedAt, &room.SlowModeSeconds); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *sqlStore) AddRoomMember(roomId, userId int) error {
+	query := `INSERT INTO room_members (room_id, user_id) VALUES (?, ?) ON CONFLICT DO NOTHING;`
+	_, err := s.db.Exec(query, roomId, userId)
+	return err
+}
+
+func (s *sqlStore) IsRoomMember(roomId, userId int) (bool, error) {
+	var member bool
+	query := "SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id = ? AND user_id = ?)"
+	err := s.db.QueryRow(query, roomId, userId).Scan(&member)
+	return member, err
+}
+
+func (s *sqlStore) SaveMessage(message Message, roomId int) error {
+	newId := message.Id
+	if newId == "" {
+		newId = generateId()
+	}
+	createdAt := message.Timestamp
+	if createdAt == "" {
+		createdAt = formatTimestamp(time.Now())
+	}
+
+	// Messages not posted by a user account, such as those of incoming
+	// webhooks, keep the name and avatar they were posted with
+	var senderName, senderAvatar string
+	if message.SenderId == 0 {
+		senderName, senderAvatar = message.SenderName, message.SenderAvatar
+	}
+
+	query := `
+	INSERT INTO messages
+	    (id, room_id, sender_id, webhook_id, content, created_at, sender_name, sender_avatar)
+	VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, NULLIF(?, ''), NULLIF(?, ''));`
+
+	_, err := s.db.Exec(query, newId, roomId, message.SenderId, message.WebhookId, message.Content, createdAt,
+		senderName, senderAvatar)
+	if err != nil {
+		log.Printf("Error saving message to DB: %v", err)
+		return err
+	}
+
+	log.Printf("Message saved to DB: %s", message.Content)
+	return nil
+}
+
+const messageQuery = `
+	SELECT messages.id, messages.content, messages.room_id, COALESCE(rooms.name, ''), COALESCE(users.handle, ''),
+	       COALESCE(users.display_name, ''), users.id, COALESCE(users.avatar, ''), COALESCE(avatars.version, ''),
+	       messages.created_at, messages.deleted_at IS NOT NULL, messages.edited_at,
+	       COALESCE(messages.sender_name, ''), COALESCE(messages.sender_avatar, ''), COALESCE(users.is_bot, 0),
+	       COALESCE(messages.webhook_id, 0)
+	FROM messages
+	LEFT JOIN rooms ON messages.room_id = rooms.id
+	LEFT JOIN users ON messages.sender_id = users.id
+	LEFT JOIN avatars ON avatars.user_id = users.id`
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	var messages []Message
+	for rows.Next() {
+		var message Message
+		var linkedAvatar, avatarVersion, postedAs, postedAvatar string
+		var userId sql.NullInt64
+		var editedAt sql.NullString
+		err := rows.Scan(&message.Id, &message.Content, &message.Room.Id, &message.Room.Name, &message.Sender,
+			&message.SenderName, &userId, &linkedAvatar, &avatarVersion, &message.Timestamp, &message.Deleted, &editedAt,
+			&postedAs, &postedAvatar, &message.Bot, &message.WebhookId)
+		if err != nil {
+			return nil, err
+		}
+		message.Type = RegularMessage
+		message.Timestamp = normalizeTimestamp(message.Timestamp)
+		if editedAt.Valid {
+			message.EditedAt = normalizeTimestamp(editedAt.String)
+		}
+		message.SenderId = int(userId.Int64)
+		message.SenderAvatar = linkedAvatar
+		if avatarVersion != "" {
+			message.SenderAvatar = avatarURL(message.SenderId, avatarVersion)
+		}
+		if !userId.Valid && postedAs != "" {
+			message.Sender, message.SenderName, message.SenderAvatar = webhookSender, postedAs, postedAvatar
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (s *sqlStore) Messages(roomId int, sender string, viewerId int, before string, limit int) ([]Message, error) {
+	query := messageQuery + `
+	WHERE messages.room_id = ? AND messages.deleted_at IS NULL
+	  AND (users.id IS NULL OR users.id NOT IN (SELECT blocked_id FROM user_blocks WHERE blocker_id = ?))`
+	args := []interface{}{roomId, viewerId}
+
+	if sender != "" {
+		query += " AND users.handle = ?"
+		args = append(args, strings.ToLower(sender))
+	}
+	if before != "" {
+		query += fmt.Sprintf(" AND %[1]s < (SELECT %[1]s FROM messages WHERE id = ?)", s.messageOrder)
+		args = append(args, before)
+	}
+	if limit > 0 {
+		// The latest ones, put back in order below
+		query += " ORDER BY " + s.messageOrder + " DESC LIMIT ?"
+		args = append(args, limit)
+	} else {
+		query += " ORDER BY " + s.messageOrder
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error retrieving messages from DB: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		log.Printf("Error scanning message rows: %v", err)
+		return nil, err
+	}
+	if limit > 0 {
+		slices.Reverse(messages)
+	}
+
+	if err := s.loadMessageAttachments(messages); err != nil {
+		log.Printf("Error loading message attachments: %v", err)
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (s *sqlStore) MessageById(id string) (*Message, error) {
+	rows, err := s.db.Query(messageQuery+" WHERE messages.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	if err := s.loadMessageAttachments(messages); err != nil {
+		return nil, err
+	}
+	return &messages[0], nil
+}
+
+func (s *sqlStore) MessageContext(messageId string, n int) ([]Message, error) {
+	where := `
+	WHERE messages.room_id = (SELECT room_id FROM messages WHERE id = ?)
+	  AND %[1]s %[2]s (SELECT %[1]s FROM messages WHERE id = ?)
+	ORDER BY %[1]s %[3]s LIMIT ?`
+
+	var context []Message
+	for _, part := range []struct{ op, order string }{{"<=", "DESC"}, {">", "ASC"}} {
+		query := messageQuery + fmt.Sprintf(where, s.messageOrder, part.op, part.order)
+		rows, err := s.db.Query(query, messageId, messageId, n+1)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := scanMessages(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if part.order == "DESC" {
+			slices.Reverse(messages)
+		} else if len(messages) > n {
+			messages = messages[:n]
+		}
+		context = append(context, messages...)
+	}
+	return context, s.loadMessageAttachments(context)
+}
+
+func (s *sqlStore) EditMessage(messageId, content string) error {
+	query := "UPDATE messages SET content = ?, edited_at = ? WHERE id = ? AND deleted_at IS NULL"
+	_, err := s.db.Exec(query, content, formatTimestamp(time.Now()), messageId)
+	return err
+}
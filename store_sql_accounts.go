@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+func (s *sqlStore) AccountStatus(userId int) (*accountStatus, error) {
+	var status accountStatus
+	var mutedUntil sql.NullString
+	err := s.db.QueryRow("SELECT role, banned, muted_until FROM users WHERE id = ?", userId).
+		Scan(&status.Role, &status.Banned, &mutedUntil)
+	if err != nil {
+		return nil, err
+	}
+	if mutedUntil.Valid {
+		status.MutedUntil, _ = time.Parse(time.RFC3339, mutedUntil.String)
+	}
+	return &status, nil
+}
+
+func (s *sqlStore) PromoteUser(email, role string, from []string) error {
+	if len(from) == 0 {
+		return nil
+	}
+	args := []any{role, normalizeEmail(email)}
+	for _, r := range from {
+		args = append(args, r)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(from)), ",")
+	_, err := s.db.Exec("UPDATE users SET role = ? WHERE lower(email) = ? AND role IN ("+placeholders+")", args...)
+	return err
+}
+
+func (s *sqlStore) TOTPState(email string) (*totpState, error) {
+	var state totpState
+	query := "SELECT id, totp_secret, totp_enabled, totp_last_step FROM users WHERE email = ?"
+	err := s.db.QueryRow(query, email).Scan(&state.UserId, &state.Secret, &state.Enabled, &state.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *sqlStore) SetTOTPSecret(userId int, secret string) error {
+	_, err := s.db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userId)
+	return err
+}
+
+func (s *sqlStore) TOTPSecrets() (map[int]string, error) {
+	rows, err := s.db.Query("SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	secrets := make(map[int]string)
+	for rows.Next() {
+		var userId int
+		var secret string
+		if err := rows.Scan(&userId, &secret); err != nil {
+			return nil, err
+		}
+		secrets[userId] = secret
+	}
+	return secrets, rows.Err()
+}
+
+func (s *sqlStore) ReplaceTOTPSecret(userId int, old, secret string) error {
+	_, err := s.db.Exec("UPDATE users SET totp_secret = ? WHERE id = ? AND totp_secret = ?", secret, userId, old)
+	return err
+}
+
+func (s *sqlStore) RecordTOTPStep(userId int, step int64) (bool, error) {
+	result, err := s.db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userId, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqlStore) EnableTOTP(userId int) error {
+	_, err := s.db.Exec("UPDATE users SET totp_enabled = 1 WHERE id = ?", userId)
+	return err
+}
+
+func (s *sqlStore) DisableTOTP(userId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0 WHERE id = ?", userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) ReplaceRecoveryCodes(userId int, codeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userId, hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) UseRecoveryCode(userId int, codeHash string) (bool, error) {
+	query := "UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL"
+	result, err := s.db.Exec(query, userId, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqlStore) RecordLoginAttempt(email, ip string, success bool, reason string) error {
+	query := `INSERT INTO login_attempts (email, ip, success, reason) VALUES (?, ?, ?, ?);`
+	_, err := s.db.Exec(query, normalizeEmail(email), ip, success, reason)
+	return err
+}
+
+func (s *sqlStore) AvatarVersion(userId int) (string, error) {
+	var version string
+	err := s.db.QueryRow("SELECT version FROM avatars WHERE user_id = ?", userId).Scan(&version)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return version, err
+}
+
+func (s *sqlStore) SetAvatarVersion(userId int, version string) error {
+	query := `
+	INSERT INTO avatars (user_id, version) VALUES (?, ?)
+	ON CONFLICT (user_id) DO UPDATE SET version = excluded.version, created_at = CURRENT_TIMESTAMP;`
+	_, err := s.db.Exec(query, userId, version)
+	return err
+}
+
+func (s *sqlStore) DeleteAvatar(userId int) error {
+	_, err := s.db.Exec("DELETE FROM avatars WHERE user_id = ?", userId)
+	return err
+}
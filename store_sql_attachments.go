@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const attachmentQuery = `
+	SELECT id, room_id, uploader_id, COALESCE(message_id, ''), filename, content_type, size,
+	       storage_key, COALESCE(thumbnail_key, ''), COALESCE(width, 0), COALESCE(height, 0)
+	FROM attachments`
+
+func scanAttachment(row interface{ Scan(...any) error }) (*storedAttachment, error) {
+	var a storedAttachment
+	err := row.Scan(&a.Id, &a.RoomId, &a.UploaderId, &a.MessageId, &a.Filename, &a.ContentType, &a.Size,
+		&a.StorageKey, &a.ThumbnailKey, &a.Width, &a.Height)
+	if err != nil {
+		return nil, err
+	}
+	a.URL = "/api/attachments/" + a.Id
+	if a.ThumbnailKey != "" {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+	return &a, nil
+}
+
+func (s *sqlStore) Attachment(id string) (*storedAttachment, error) {
+	return scanAttachment(s.db.QueryRow(attachmentQuery+" WHERE id = ?", id))
+}
+
+func (s *sqlStore) SaveAttachment(a *storedAttachment) error {
+	query := `
+	INSERT INTO attachments
+	    (id, room_id, uploader_id, filename, content_type, size, storage_key, thumbnail_key, width, height)
+	VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, 0));`
+	_, err := s.db.Exec(query, a.Id, a.RoomId, a.UploaderId, a.Filename, a.ContentType, a.Size,
+		a.StorageKey, a.ThumbnailKey, a.Width, a.Height)
+	return err
+}
+
+func (s *sqlStore) ClaimAttachments(refs []Attachment, roomId, uploaderId int, messageId string) ([]Attachment, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	attachments := make([]Attachment, 0, len(refs))
+	for _, ref := range refs {
+		result, err := tx.Exec(`
+		UPDATE attachments SET message_id = ?
+		WHERE id = ? AND room_id = ? AND uploader_id = ? AND message_id IS NULL`,
+			messageId, ref.Id, roomId, uploaderId)
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := result.RowsAffected(); n != 1 {
+			return nil, fmt.Errorf("attachment %q not found", ref.Id)
+		}
+
+		stored, err := scanAttachment(tx.QueryRow(attachmentQuery+" WHERE id = ?", ref.Id))
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, stored.Attachment)
+	}
+	return attachments, tx.Commit()
+}
+
+func (s *sqlStore) DeleteAttachment(id string) error {
+	_, err := s.db.Exec("DELETE FROM attachments WHERE id = ?", id)
+	return err
+}
+
+// loadMessageAttachments fills in the attachments of the given messages.
+func (s *sqlStore) loadMessageAttachments(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(messages))
+	for i, message := range messages {
+		index[message.Id] = i
+	}
+
+	// Query in chunks to stay below SQLite's limit on bound parameters
+	const chunkSize = 500
+	for start := 0; start < len(messages); start += chunkSize {
+		end := min(start+chunkSize, len(messages))
+		args := make([]any, 0, end-start)
+		for _, message := range messages[start:end] {
+			args = append(args, message.Id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(args)), ",")
+
+		rows, err := s.db.Query(attachmentQuery+" WHERE message_id IN ("+placeholders+") ORDER BY created_at, id", args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			a, err := scanAttachment(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			i := index[a.MessageId]
+			messages[i].Attachments = append(messages[i].Attachments, a.Attachment)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
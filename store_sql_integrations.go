@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+func (s *sqlStore) APITokenPrincipal(tokenHash string) (*Principal, error) {
+	principal := Principal{}
+	var scopes string
+	query := `
+	SELECT api_tokens.id, users.email, api_tokens.scopes
+	FROM api_tokens
+	JOIN users ON users.id = api_tokens.user_id
+	JOIN users AS owners ON owners.id = users.owner_id
+	WHERE api_tokens.token_hash = ? AND users.banned = 0 AND owners.banned = 0`
+	err := s.db.QueryRow(query, tokenHash).Scan(&principal.TokenId, &principal.Email, &scopes)
+	if err != nil {
+		return nil, err
+	}
+	principal.Scopes = strings.Split(scopes, ",")
+
+	// Only record use once a minute to save writes
+	now := time.Now().UTC()
+	_, err = s.db.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		now.Format(time.RFC3339), principal.TokenId, now.Add(-time.Minute).Format(time.RFC3339))
+	if err != nil {
+		log.Printf("Error recording use of API token %d: %v", principal.TokenId, err)
+	}
+	return &principal, nil
+}
+
+func (s *sqlStore) CountBots(ownerId int) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE owner_id = ? AND is_bot = 1 AND banned = 0", ownerId).Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) CreateBot(ownerId int, handle, displayName, avatar string) error {
+	// Bots have no password and can only authenticate with API tokens
+	query := `
+	INSERT INTO users (email, password, email_verified, handle, display_name, avatar, is_bot, owner_id)
+	VALUES (?, '', 1, ?, ?, NULLIF(?, ''), 1, ?)`
+	_, err := s.db.Exec(query, botEmail(handle), handle, displayName, avatar, ownerId)
+	if isUniqueViolation(err, "") {
+		return errHandleTaken
+	}
+	return err
+}
+
+func (s *sqlStore) OwnedBotId(ownerId int, handle string) (int, error) {
+	var botId int
+	query := "SELECT id FROM users WHERE handle = ? AND owner_id = ? AND is_bot = 1 AND banned = 0"
+	err := s.db.QueryRow(query, strings.ToLower(handle), ownerId).Scan(&botId)
+	return botId, err
+}
+
+func (s *sqlStore) OwnedBots(ownerId int) ([]Profile, error) {
+	rows, err := s.db.Query(profileQuery+" WHERE users.owner_id = ? AND users.is_bot = 1 AND users.banned = 0 ORDER BY users.handle", ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := make([]Profile, 0)
+	for rows.Next() {
+		profile, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, *profile)
+	}
+	return bots, rows.Err()
+}
+
+// DeleteBot keeps the account itself, so its messages keep their author
+// and its handle stays reserved.
+func (s *sqlStore) DeleteBot(botId int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM api_tokens WHERE user_id = ?", botId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET banned = 1 WHERE id = ?", botId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const apiTokenQuery = "SELECT id, name, scopes, created_at, last_used_at FROM api_tokens"
+
+func scanAPIToken(row interface{ Scan(...any) error }) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	var lastUsedAt sql.NullString
+	if err := row.Scan(&t.Id, &t.Name, &scopes, &t.CreatedAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	t.LastUsedAt = lastUsedAt.String
+	t.Scopes = strings.Split(scopes, ",")
+	return &t, nil
+}
+
+func (s *sqlStore) CreateAPIToken(botId int, name string, scopes []string, tokenHash string) (*APIToken, error) {
+	query := "INSERT INTO api_tokens (user_id, name, scopes, token_hash) VALUES (?, ?, ?, ?) RETURNING id"
+	var id int
+	err := s.db.QueryRow(query, botId, name, strings.Join(scopes, ","), tokenHash).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return scanAPIToken(s.db.QueryRow(apiTokenQuery+" WHERE id = ?", id))
+}
+
+func (s *sqlStore) APITokens(botId int) ([]APIToken, error) {
+	rows, err := s.db.Query(apiTokenQuery+" WHERE user_id = ? ORDER BY id", botId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) RevokeAPIToken(botId, tokenId int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenId, botId)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+const webhookQuery = "SELECT id, room_id, url, events, secret, created_at FROM room_webhooks"
+
+func scanWebhook(row interface{ Scan(...any) error }) (*Webhook, error) {
+	var hook Webhook
+	var events string
+	if err := row.Scan(&hook.Id, &hook.RoomId, &hook.URL, &events, &hook.Secret, &hook.CreatedAt); err != nil {
+		return nil, err
+	}
+	hook.Events = strings.Split(events, ",")
+	return &hook, nil
+}
+
+func (s *sqlStore) RoomWebhooks(roomId int) ([]Webhook, error) {
+	rows, err := s.db.Query(webhookQuery+" WHERE room_id = ? ORDER BY id", roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		hook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) Webhook(roomId, id int) (*Webhook, error) {
+	return scanWebhook(s.db.QueryRow(webhookQuery+" WHERE room_id = ? AND id = ?", roomId, id))
+}
+
+func (s *sqlStore) CreateWebhook(hook *Webhook, createdBy int) error {
+	query := "INSERT INTO room_webhooks (room_id, url, events, secret, created_by) VALUES (?, ?, ?, ?, ?) RETURNING id"
+	var id int
+	err := s.db.QueryRow(query, hook.RoomId, hook.URL, strings.Join(hook.Events, ","), hook.Secret, createdBy).Scan(&id)
+	if err != nil {
+		return err
+	}
+	created, err := s.Webhook(hook.RoomId, id)
+	if err != nil {
+		return err
+	}
+	*hook = *created
+	return nil
+}
+
+func (s *sqlStore) DeleteWebhook(roomId, id int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM room_webhooks WHERE room_id = ? AND id = ?", roomId, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) RecordWebhookDelivery(d WebhookDelivery) error {
+	query := `
+	INSERT INTO webhook_deliveries (webhook_id, delivery_id, event, attempt, status_code, error)
+	VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(query, d.WebhookId, d.DeliveryId, d.Event, d.Attempt, d.StatusCode, d.Error)
+	return err
+}
+
+func (s *sqlStore) WebhookDeliveries(webhookId int) ([]WebhookDelivery, error) {
+	query := `
+	SELECT id, webhook_id, delivery_id, event, attempt, status_code, error, created_at
+	FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(query, webhookId, maxWebhookDeliveries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.Id, &d.WebhookId, &d.DeliveryId, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *sqlStore) RecordWebhookDeadLetter(l WebhookDeadLetter) error {
+	query := `
+	INSERT INTO webhook_dead_letters (webhook_id, delivery_id, event, payload, attempts, last_error)
+	VALUES (?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(query, l.WebhookId, l.DeliveryId, l.Event, string(l.Payload), l.Attempts, l.LastError)
+	return err
+}
+
+func (s *sqlStore) WebhookDeadLetters(webhookId int) ([]WebhookDeadLetter, error) {
+	query := `
+	SELECT id, webhook_id, delivery_id, event, payload, attempts, last_error, created_at
+	FROM webhook_dead_letters WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`
+	rows, err := s.db.Query(query, webhookId, maxWebhookDeliveries)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := make([]WebhookDeadLetter, 0)
+	for rows.Next() {
+		var l WebhookDeadLetter
+		var payload string
+		if err := rows.Scan(&l.Id, &l.WebhookId, &l.DeliveryId, &l.Event, &payload, &l.Attempts, &l.LastError, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		l.Payload = json.RawMessage(payload)
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
+
+const incomingWebhookQuery = "SELECT id, room_id, name, avatar_url, created_at FROM incoming_webhooks"
+
+func scanIncomingWebhook(row interface{ Scan(...any) error }) (*IncomingWebhook, error) {
+	var hook IncomingWebhook
+	if err := row.Scan(&hook.Id, &hook.RoomId, &hook.Name, &hook.AvatarURL, &hook.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (s *sqlStore) IncomingWebhookByTokenHash(tokenHash string) (*IncomingWebhook, error) {
+	return scanIncomingWebhook(s.db.QueryRow(incomingWebhookQuery+" WHERE token_hash = ?", tokenHash))
+}
+
+func (s *sqlStore) RoomIncomingWebhooks(roomId int) ([]IncomingWebhook, error) {
+	rows, err := s.db.Query(incomingWebhookQuery+" WHERE room_id = ? ORDER BY id", roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := make([]IncomingWebhook, 0)
+	for rows.Next() {
+		hook, err := scanIncomingWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) CreateIncomingWebhook(hook *IncomingWebhook, tokenHash string, createdBy int) error {
+	query := "INSERT INTO incoming_webhooks (room_id, name, avatar_url, token_hash, created_by) VALUES (?, ?, ?, ?, ?) RETURNING id"
+	var id int
+	err := s.db.QueryRow(query, hook.RoomId, hook.Name, hook.AvatarURL, tokenHash, createdBy).Scan(&id)
+	if err != nil {
+		return err
+	}
+	created, err := scanIncomingWebhook(s.db.QueryRow(incomingWebhookQuery+" WHERE id = ?", id))
+	if err != nil {
+		return err
+	}
+	created.Token = hook.Token
+	*hook = *created
+	return nil
+}
+
+func (s *sqlStore) DeleteIncomingWebhook(roomId, id int) (bool, error) {
+	result, err := s.db.Exec("DELETE FROM incoming_webhooks WHERE room_id = ? AND id = ?", roomId, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
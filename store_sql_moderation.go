@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+func (s *sqlStore) UserIdByHandle(handle string) (int, error) {
+	var userId int
+	err := s.db.QueryRow("SELECT id FROM users WHERE handle = ?", strings.ToLower(handle)).Scan(&userId)
+	return userId, err
+}
+
+func (s *sqlStore) SetBlock(blockerId, blockedId int, kind string) error {
+	query := `
+	INSERT INTO user_blocks (blocker_id, blocked_id, kind) VALUES (?, ?, ?)
+	ON CONFLICT (blocker_id, blocked_id) DO UPDATE SET kind = excluded.kind;`
+	_, err := s.db.Exec(query, blockerId, blockedId, kind)
+	return err
+}
+
+func (s *sqlStore) RemoveBlock(blockerId, blockedId int, kind string) (bool, error) {
+	query := "DELETE FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?"
+	args := []any{blockerId, blockedId}
+	if kind != "" {
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) BlockKind(blockerId, blockedId int) (string, error) {
+	var kind string
+	err := s.db.QueryRow("SELECT kind FROM user_blocks WHERE blocker_id = ? AND blocked_id = ?", blockerId, blockedId).Scan(&kind)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return kind, err
+}
+
+func (s *sqlStore) IgnoredUsers(blockerId int) (map[int]bool, error) {
+	rows, err := s.db.Query("SELECT blocked_id FROM user_blocks WHERE blocker_id = ?", blockerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ignored := make(map[int]bool)
+	for rows.Next() {
+		var userId int
+		if err := rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		ignored[userId] = true
+	}
+	return ignored, rows.Err()
+}
+
+func (s *sqlStore) Blocks(blockerId int) ([]BlockEntry, error) {
+	query := `
+	SELECT users.id, users.handle, COALESCE(users.display_name, ''), COALESCE(users.avatar, ''),
+	       COALESCE(users.timezone, ''), COALESCE(users.bio, ''), COALESCE(avatars.version, ''),
+	       user_blocks.kind, user_blocks.created_at
+	FROM user_blocks
+	JOIN users ON users.id = user_blocks.blocked_id
+	LEFT JOIN avatars ON avatars.user_id = users.id
+	WHERE user_blocks.blocker_id = ?
+	ORDER BY users.handle`
+	rows, err := s.db.Query(query, blockerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]BlockEntry, 0)
+	for rows.Next() {
+		var entry BlockEntry
+		var userId int
+		var avatarVersion string
+		err := rows.Scan(&userId, &entry.Handle, &entry.DisplayName, &entry.Avatar, &entry.Timezone, &entry.Bio,
+			&avatarVersion, &entry.Kind, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.AvatarURL = entry.Avatar
+		if avatarVersion != "" {
+			entry.AvatarURL = avatarURL(userId, avatarVersion)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+const reportQuery = `
+	SELECT reports.id, reports.status, reports.reason, reports.details, reports.created_at,
+	       reports.reporter_id, reports.reported_user_id, COALESCE(reports.message_id, ''),
+	       COALESCE(reports.resolution, ''), COALESCE(reports.note, ''),
+	       COALESCE(moderators.handle, ''), reports.resolved_at
+	FROM reports
+	LEFT JOIN users AS moderators ON moderators.id = reports.resolved_by`
+
+func scanReport(row interface{ Scan(...any) error }) (*Report, error) {
+	var r Report
+	var resolvedAt sql.NullString
+	err := row.Scan(&r.Id, &r.Status, &r.Reason, &r.Details, &r.CreatedAt, &r.reporterId, &r.reportedUserId,
+		&r.messageId, &r.Resolution, &r.Note, &r.ResolvedBy, &resolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolvedAt = resolvedAt.String
+	return &r, nil
+}
+
+func (s *sqlStore) CreateReport(reporterId, reportedUserId int, messageId, reason, details string) (int, error) {
+	query := `
+	INSERT INTO reports (reporter_id, reported_user_id, message_id, reason, details)
+	VALUES (?, ?, NULLIF(?, ''), ?, ?)
+	RETURNING id;`
+	var id int
+	err := s.db.QueryRow(query, reporterId, reportedUserId, messageId, reason, details).Scan(&id)
+	return id, err
+}
+
+func (s *sqlStore) Report(id int) (*Report, error) {
+	return scanReport(s.db.QueryRow(reportQuery+" WHERE reports.id = ?", id))
+}
+
+func (s *sqlStore) Reports(status string) ([]Report, error) {
+	rows, err := s.db.Query(reportQuery+" WHERE reports.status = ? ORDER BY reports.created_at, reports.id", status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]Report, 0)
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *r)
+	}
+	return reports, rows.Err()
+}
+
+func (s *sqlStore) ResolveReport(id int, status, resolution, note string, moderatorId int) error {
+	query := `
+	UPDATE reports SET status = ?, resolution = ?, note = ?, resolved_by = ?, resolved_at = ?
+	WHERE id = ?;`
+	_, err := s.db.Exec(query, status, resolution, note, moderatorId, time.Now().UTC().Format(time.RFC3339), id)
+	return err
+}
+
+func (s *sqlStore) DeleteMessage(messageId string) error {
+	query := "UPDATE messages SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL"
+	_, err := s.db.Exec(query, formatTimestamp(time.Now()), messageId)
+	return err
+}
+
+func (s *sqlStore) MuteUser(userId int, until time.Time) error {
+	_, err := s.db.Exec("UPDATE users SET muted_until = ? WHERE id = ?", until.UTC().Format(time.RFC3339), userId)
+	return err
+}
+
+func (s *sqlStore) BanUser(userId int) error {
+	_, err := s.db.Exec("UPDATE users SET banned = 1 WHERE id = ?", userId)
+	return err
+}
+
+func (s *sqlStore) RoomFilterRules(roomId int) (string, error) {
+	var rules string
+	err := s.db.QueryRow("SELECT rules FROM room_filters WHERE room_id = ?", roomId).Scan(&rules)
+	return rules, err
+}
+
+func (s *sqlStore) SetRoomFilterRules(roomId int, rules string) error {
+	query := `
+	INSERT INTO room_filters (room_id, rules) VALUES (?, ?)
+	ON CONFLICT (room_id) DO UPDATE SET rules = excluded.rules, updated_at = CURRENT_TIMESTAMP;`
+	_, err := s.db.Exec(query, roomId, rules)
+	return err
+}
+
+func (s *sqlStore) DeleteRoomFilterRules(roomId int) error {
+	_, err := s.db.Exec("DELETE FROM room_filters WHERE room_id = ?", roomId)
+	return err
+}
+
+func (s *sqlStore) SetRoomSlowMode(roomId, seconds int) error {
+	_, err := s.db.Exec("UPDATE rooms SET slow_mode_seconds = ? WHERE id = ?", seconds, roomId)
+	return err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore keeps everything in a single SQLite file.
+type SQLiteStore struct {
+	sqlStore
+}
+
+// NewSQLiteStore opens the database at path, creating the file if needed.
+// The tables are made by the migrations.
+//
+// Every connection enforces foreign keys and waits up to busyTimeout for
+// a lock rather than fail at once. The write-ahead log lets readers carry
+// on while a message is written.
+func NewSQLiteStore(path string, busyTimeout time.Duration) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	pragmas := url.Values{"_pragma": {
+		"foreign_keys(1)",
+		fmt.Sprintf("busy_timeout(%d)", busyTimeout.Milliseconds()),
+		"journal_mode(WAL)",
+		"synchronous(NORMAL)",
+	}}
+	dsn, err := sqliteURI(path, pragmas)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	// Messages have a text primary key, so SQLite's rowid is free to
+	// record their order
+	return &SQLiteStore{sqlStore{db: db, driver: "sqlite", messageOrder: "messages.rowid"}}, nil
+}
+
+// sqliteURI returns the file: URI that opens the database at path with the
+// given parameters. The path is escaped, so that a ? or # in it is not taken
+// for the start of the parameters.
+func sqliteURI(path string, params url.Values) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	uri := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: params.Encode()}
+	return uri.String(), nil
+}
+
+// Backup copies the database with VACUUM INTO, which reads it in a single
+// transaction and so sees a consistent state while writers carry on.
+func (s *SQLiteStore) Backup(path string) error {
+	_, err := s.db.Exec("VACUUM INTO ?", path)
+	return err
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The same tests run against every Store, so every backend can be shown to
+// behave alike. PostgreSQL is tested when DATABASE_URL points at a server;
+// `make test-postgres` starts a throwaway container for it. Each test works
+// in a schema of its own that is dropped afterwards. In CI a missing
+// DATABASE_URL fails the PostgreSQL tests instead of skipping them.
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"sqlite", openTestSQLiteStore},
+	{"postgres", openTestPostgresStore},
+}
+
+func openTestSQLiteStore(t *testing.T) Store {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"), 5*time.Second)
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	migrateTestStore(t, store)
+	return store
+}
+
+func openTestPostgresStore(t *testing.T) Store {
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("DATABASE_URL is not set, so the PostgreSQL tests can't run")
+		}
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	admin, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		t.Fatalf("opening %s: %v", databaseURL, err)
+	}
+	schema := "store_test_" + strings.ReplaceAll(generateId(), "-", "")
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		t.Fatalf("creating schema: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		admin.Close()
+	})
+
+	// Unknown connection parameters are passed on to the server
+	if u, err := url.Parse(databaseURL); err == nil && u.Scheme != "" {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		databaseURL = u.String()
+	} else {
+		databaseURL += " search_path=" + schema
+	}
+	store, err := NewPostgresStore(databaseURL)
+	if err != nil {
+		t.Fatalf("NewPostgresStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	migrateTestStore(t, store)
+	return store
+}
+
+func migrateTestStore(t *testing.T, store Store) {
+	t.Helper()
+	migrator, err := store.Migrator()
+	if err != nil {
+		t.Fatalf("Migrator: %v", err)
+	}
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("migrating up: %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"Users", testStoreUsers},
+		{"Profiles", testStoreProfiles},
+		{"Rooms", testStoreRooms},
+		{"Messages", testStoreMessages},
+		{"Blocks", testStoreBlocks},
+		{"Reports", testStoreReports},
+		{"TOTP", testStoreTOTP},
+		{"Bots", testStoreBots},
+	}
+	for _, backend := range storeBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.name, func(t *testing.T) {
+					test.run(t, backend.open(t))
+				})
+			}
+		})
+	}
+}
+
+// createTestUsers adds alice and bob and returns their ids.
+func createTestUsers(t *testing.T, s Store) (aliceId, bobId int) {
+	t.Helper()
+	if err := s.CreateUser("alice@example.com", []byte("hash-a"), "alice", "Alice"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := s.CreateUser("bob@example.com", []byte("hash-b"), "bob", ""); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	aliceId, err := s.UserIdByEmail("alice@example.com")
+	if err != nil {
+		t.Fatalf("UserIdByEmail: %v", err)
+	}
+	bobId, err = s.UserIdByEmail("bob@example.com")
+	if err != nil {
+		t.Fatalf("UserIdByEmail: %v", err)
+	}
+	if aliceId == 0 || aliceId == bobId {
+		t.Fatalf("UserIdByEmail returned ids %d and %d", aliceId, bobId)
+	}
+	return aliceId, bobId
+}
+
+// createTestRoom adds the room general with alice and bob as members and
+// five messages, alternately from alice and bob, whose ids it returns.
+func createTestRoom(t *testing.T, s Store, aliceId, bobId int) (*Room, []string) {
+	t.Helper()
+	room, err := s.CreateRoom("general")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	for _, userId := range []int{aliceId, bobId} {
+		if err := s.AddRoomMember(room.Id, userId); err != nil {
+			t.Fatalf("AddRoomMember: %v", err)
+		}
+	}
+
+	var ids []string
+	for i, senderId := range []int{aliceId, bobId, aliceId, bobId, aliceId} {
+		message := Message{Id: generateId(), Content: fmt.Sprintf("message %d", i+1), SenderId: senderId}
+		if err := s.SaveMessage(message, room.Id); err != nil {
+			t.Fatalf("SaveMessage: %v", err)
+		}
+		ids = append(ids, message.Id)
+	}
+	return room, ids
+}
+
+func messageIds(messages []Message) []string {
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		ids = append(ids, message.Id)
+	}
+	return ids
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	createTestUsers(t, s)
+
+	if err := s.CreateUser("alice@example.com", []byte("hash"), "alice2", ""); err != errEmailTaken {
+		t.Errorf("CreateUser with a registered e-mail address returned %v, want errEmailTaken", err)
+	}
+	if err := s.CreateUser("carol@example.com", []byte("hash"), "alice", ""); err != errHandleTaken {
+		t.Errorf("CreateUser with a taken handle returned %v, want errHandleTaken", err)
+	}
+
+	if hash, err := s.PasswordHash("alice@example.com"); err != nil || hash != "hash-a" {
+		t.Errorf("PasswordHash returned %q, %v", hash, err)
+	}
+	if err := s.SetPasswordHash("alice@example.com", []byte("hash-a2")); err != nil {
+		t.Errorf("SetPasswordHash: %v", err)
+	}
+	if hash, _ := s.PasswordHash("alice@example.com"); hash != "hash-a2" {
+		t.Errorf("PasswordHash after SetPasswordHash returned %q", hash)
+	}
+
+	if email, err := s.EmailByHandle("Alice"); err != nil || email != "alice@example.com" {
+		t.Errorf("EmailByHandle ignoring case returned %q, %v", email, err)
+	}
+	if exists, err := s.HandleExists("bob"); err != nil || !exists {
+		t.Errorf("HandleExists of a taken handle returned %v, %v", exists, err)
+	}
+	if exists, err := s.HandleExists("nobody"); err != nil || exists {
+		t.Errorf("HandleExists of a free handle returned %v, %v", exists, err)
+	}
+
+	if verified, err := s.EmailVerified("alice@example.com"); err != nil || verified {
+		t.Errorf("EmailVerified of a new user returned %v, %v", verified, err)
+	}
+	if err := s.MarkEmailVerified("alice@example.com"); err != nil {
+		t.Errorf("MarkEmailVerified: %v", err)
+	}
+	if verified, err := s.EmailVerified("alice@example.com"); err != nil || !verified {
+		t.Errorf("EmailVerified after MarkEmailVerified returned %v, %v", verified, err)
+	}
+
+	unknown := []struct {
+		name string
+		call func() error
+	}{
+		{"SetPasswordHash", func() error { return s.SetPasswordHash("nobody@example.com", []byte("hash")) }},
+		{"UserIdByEmail", func() error { _, err := s.UserIdByEmail("nobody@example.com"); return err }},
+		{"EmailByHandle", func() error { _, err := s.EmailByHandle("nobody"); return err }},
+		{"MarkEmailVerified", func() error { return s.MarkEmailVerified("nobody@example.com") }},
+		{"UserIdByHandle", func() error { _, err := s.UserIdByHandle("nobody"); return err }},
+	}
+	for _, test := range unknown {
+		if err := test.call(); err != sql.ErrNoRows {
+			t.Errorf("%s of an unknown user returned %v, want sql.ErrNoRows", test.name, err)
+		}
+	}
+}
+
+func testStoreProfiles(t *testing.T, s Store) {
+	aliceId, _ := createTestUsers(t, s)
+
+	users, err := s.Users()
+	if err != nil || len(users) != 2 || users[0].Handle != "alice" || users[1].Handle != "bob" {
+		t.Errorf("Users returned %v, %v, want alice and bob in that order", users, err)
+	}
+
+	profile, err := s.ProfileByEmail("alice@example.com")
+	if err != nil || profile.Handle != "alice" || profile.DisplayName != "Alice" || profile.Bot {
+		t.Errorf("ProfileByEmail returned %+v, %v", profile, err)
+	}
+	profile, err = s.ProfileById(aliceId)
+	if err != nil || profile.Handle != "alice" {
+		t.Errorf("ProfileById returned %+v, %v", profile, err)
+	}
+
+	update := &Profile{Handle: "bobby", DisplayName: "Bob", Avatar: "https://example.com/bob.png", Timezone: "Europe/Paris", Bio: "Hi"}
+	if err := s.UpdateProfile("bob@example.com", update); err != nil {
+		t.Errorf("UpdateProfile: %v", err)
+	}
+	profile, err = s.ProfileByHandle("BOBBY")
+	if err != nil || profile.DisplayName != "Bob" || profile.Timezone != "Europe/Paris" || profile.Bio != "Hi" ||
+		profile.AvatarURL != update.Avatar {
+		t.Errorf("ProfileByHandle after UpdateProfile returned %+v, %v", profile, err)
+	}
+	if err := s.UpdateProfile("bob@example.com", &Profile{Handle: "alice"}); err != errHandleTaken {
+		t.Errorf("UpdateProfile to a taken handle returned %v, want errHandleTaken", err)
+	}
+
+	// An uploaded avatar takes precedence over a linked one
+	if err := s.SetAvatarVersion(aliceId, "v1"); err != nil {
+		t.Errorf("SetAvatarVersion: %v", err)
+	}
+	if err := s.SetAvatarVersion(aliceId, "v2"); err != nil {
+		t.Errorf("SetAvatarVersion: %v", err)
+	}
+	if version, err := s.AvatarVersion(aliceId); err != nil || version != "v2" {
+		t.Errorf("AvatarVersion returned %q, %v, want v2", version, err)
+	}
+	if profile, _ := s.ProfileById(aliceId); profile == nil || profile.AvatarURL != avatarURL(aliceId, "v2") {
+		t.Errorf("ProfileById with an uploaded avatar returned %+v", profile)
+	}
+	if err := s.DeleteAvatar(aliceId); err != nil {
+		t.Errorf("DeleteAvatar: %v", err)
+	}
+	if version, err := s.AvatarVersion(aliceId); err != nil || version != "" {
+		t.Errorf("AvatarVersion after DeleteAvatar returned %q, %v", version, err)
+	}
+
+	for name, call := range map[string]func() error{
+		"ProfileByEmail":  func() error { _, err := s.ProfileByEmail("nobody@example.com"); return err },
+		"ProfileByHandle": func() error { _, err := s.ProfileByHandle("nobody"); return err },
+		"ProfileById":     func() error { _, err := s.ProfileById(-1); return err },
+	} {
+		if err := call(); err != sql.ErrNoRows {
+			t.Errorf("%s of an unknown user returned %v, want sql.ErrNoRows", name, err)
+		}
+	}
+}
+
+func testStoreRooms(t *testing.T, s Store) {
+	aliceId, _ := createTestUsers(t, s)
+
+	room, err := s.RoomByName("general")
+	if err != nil || room != nil {
+		t.Errorf("RoomByName of a missing room returned %v, %v, want nil, nil", room, err)
+	}
+
+	general, err := s.CreateRoom("general")
+	if err != nil {
+		t.Fatalf("CreateRoom: %v", err)
+	}
+	if general.Name != "general" || general.Clients == nil {
+		t.Errorf("CreateRoom returned %+v", general)
+	}
+	if _, err := s.CreateRoom("general"); err == nil {
+		t.Errorf("CreateRoom of an existing room succeeded")
+	}
+	if _, err := s.CreateRoom("random"); err != nil {
+		t.Errorf("CreateRoom: %v", err)
+	}
+
+	if room, err := s.RoomByName("general"); err != nil || room == nil || room.Id != general.Id {
+		t.Errorf("RoomByName returned %v, %v", room, err)
+	}
+	if room, err := s.RoomById(general.Id); err != nil || room.Name != "general" {
+		t.Errorf("RoomById returned %v, %v", room, err)
+	}
+	if _, err := s.RoomById(-1); err != sql.ErrNoRows {
+		t.Errorf("RoomById of a missing room returned %v, want sql.ErrNoRows", err)
+	}
+	rooms, err := s.Rooms()
+	if err != nil || len(rooms) != 2 || rooms[0].Name != "general" || rooms[1].Name != "random" {
+		t.Errorf("Rooms returned %v, %v, want general and random in that order", rooms, err)
+	}
+
+	if err := s.SetRoomSlowMode(general.Id, 30); err != nil {
+		t.Errorf("SetRoomSlowMode: %v", err)
+	}
+	if room, err := s.RoomById(general.Id); err != nil || room.SlowModeSeconds != 30 {
+		t.Errorf("RoomById after SetRoomSlowMode returned %+v, %v", room, err)
+	}
+
+	if member, err := s.IsRoomMember(general.Id, aliceId); err != nil || member {
+		t.Errorf("IsRoomMember before joining returned %v, %v", member, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.AddRoomMember(general.Id, aliceId); err != nil {
+			t.Errorf("AddRoomMember, time %d: %v", i+1, err)
+		}
+	}
+	if member, err := s.IsRoomMember(general.Id, aliceId); err != nil || !member {
+		t.Errorf("IsRoomMember after joining returned %v, %v", member, err)
+	}
+}
+
+func testStoreMessages(t *testing.T, s Store) {
+	aliceId, bobId := createTestUsers(t, s)
+	room, ids := createTestRoom(t, s, aliceId, bobId)
+
+	if err := s.SaveMessage(Message{Id: generateId(), Content: "lost", SenderId: aliceId}, -1); err == nil {
+		t.Errorf("SaveMessage to a missing room succeeded")
+	}
+	if err := s.SaveMessage(Message{Id: generateId(), Content: "lost", SenderId: -1}, room.Id); err == nil {
+		t.Errorf("SaveMessage from a missing user succeeded")
+	}
+
+	messages, err := s.Messages(room.Id, "", aliceId, "", 0)
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	if got := messageIds(messages); strings.Join(got, ",") != strings.Join(ids, ",") {
+		t.Errorf("Messages returned %v, want %v in the order they were saved", got, ids)
+	}
+	if len(messages) > 0 {
+		first := messages[0]
+		if first.Sender != "alice" || first.SenderName != "Alice" || first.SenderId != aliceId ||
+			first.Room.Name != "general" || first.Type != RegularMessage {
+			t.Errorf("Messages returned %+v", first)
+		}
+		if _, err := time.Parse(timestampFormat, first.Timestamp); err != nil {
+			t.Errorf("Messages returned the timestamp %q, want UTC with milliseconds", first.Timestamp)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		sender   string
+		viewerId int
+		want     int
+	}{
+		{"of one sender", "BOB", aliceId, 2},
+		{"of a missing sender", "nobody", aliceId, 0},
+	}
+	for _, test := range tests {
+		messages, err := s.Messages(room.Id, test.sender, test.viewerId, "", 0)
+		if err != nil || len(messages) != test.want {
+			t.Errorf("Messages %s returned %d messages, %v, want %d", test.name, len(messages), err, test.want)
+		}
+	}
+
+	pages := []struct {
+		name   string
+		sender string
+		before string
+		limit  int
+		want   []string
+	}{
+		{"latest two", "", "", 2, ids[3:]},
+		{"two before the fourth", "", ids[3], 2, ids[1:3]},
+		{"all before the second", "", ids[1], 0, ids[:1]},
+		{"more than there are", "", ids[2], 10, ids[:2]},
+		{"latest of one sender", "alice", "", 1, ids[4:]},
+		{"before a missing message", "", "missing", 2, nil},
+	}
+	for _, page := range pages {
+		messages, err := s.Messages(room.Id, page.sender, aliceId, page.before, page.limit)
+		if got := messageIds(messages); err != nil || !slices.Equal(got, page.want) {
+			t.Errorf("Messages %s returned %v, %v, want %v", page.name, got, err, page.want)
+		}
+	}
+
+	if err := s.EditMessage(ids[0], "edited"); err != nil {
+		t.Errorf("EditMessage: %v", err)
+	}
+	message, err := s.MessageById(ids[0])
+	if err != nil || message.Content != "edited" || message.EditedAt == "" || message.Deleted {
+		t.Errorf("MessageById after EditMessage returned %+v, %v", message, err)
+	}
+	if _, err := s.MessageById("missing"); err != sql.ErrNoRows {
+		t.Errorf("MessageById of a missing message returned %v, want sql.ErrNoRows", err)
+	}
+
+	context, err := s.MessageContext(ids[2], 1)
+	if got := messageIds(context); err != nil || strings.Join(got, ",") != strings.Join(ids[1:4], ",") {
+		t.Errorf("MessageContext returned %v, %v, want %v", got, err, ids[1:4])
+	}
+
+	// Deleted messages leave the history but stay in the context
+	if err := s.DeleteMessage(ids[1]); err != nil {
+		t.Errorf("DeleteMessage: %v", err)
+	}
+	if messages, err := s.Messages(room.Id, "", aliceId, "", 0); err != nil || len(messages) != 4 {
+		t.Errorf("Messages after DeleteMessage returned %d messages, %v, want 4", len(messages), err)
+	}
+	if context, err := s.MessageContext(ids[2], 1); err != nil || len(context) != 3 || !context[0].Deleted {
+		t.Errorf("MessageContext after DeleteMessage returned %+v, %v", context, err)
+	}
+}
+
+func testStoreBlocks(t *testing.T, s Store) {
+	aliceId, bobId := createTestUsers(t, s)
+	room, _ := createTestRoom(t, s, aliceId, bobId)
+
+	if kind, err := s.BlockKind(aliceId, bobId); err != nil || kind != "" {
+		t.Errorf("BlockKind before blocking returned %q, %v", kind, err)
+	}
+	if err := s.SetBlock(aliceId, bobId, BlockKindMute); err != nil {
+		t.Fatalf("SetBlock: %v", err)
+	}
+	if err := s.SetBlock(aliceId, bobId, BlockKindBlock); err != nil {
+		t.Fatalf("SetBlock over a mute: %v", err)
+	}
+	if kind, err := s.BlockKind(aliceId, bobId); err != nil || kind != BlockKindBlock {
+		t.Errorf("BlockKind returned %q, %v, want %q", kind, err, BlockKindBlock)
+	}
+	if ignored, err := s.IgnoredUsers(aliceId); err != nil || len(ignored) != 1 || !ignored[bobId] {
+		t.Errorf("IgnoredUsers returned %v, %v", ignored, err)
+	}
+	blocks, err := s.Blocks(aliceId)
+	if err != nil || len(blocks) != 1 || blocks[0].Handle != "bob" || blocks[0].Kind != BlockKindBlock {
+		t.Errorf("Blocks returned %+v, %v", blocks, err)
+	}
+
+	// Blocking hides messages from the blocker only
+	if messages, err := s.Messages(room.Id, "", aliceId, "", 0); err != nil || len(messages) != 3 {
+		t.Errorf("Messages leaving out blocked users returned %d messages, %v, want 3", len(messages), err)
+	}
+	if messages, err := s.Messages(room.Id, "", bobId, "", 0); err != nil || len(messages) != 5 {
+		t.Errorf("Messages of the blocked user returned %d messages, %v, want 5", len(messages), err)
+	}
+
+	if removed, err := s.RemoveBlock(aliceId, bobId, BlockKindMute); err != nil || removed {
+		t.Errorf("RemoveBlock of a mute returned %v, %v for a block, want false", removed, err)
+	}
+	if removed, err := s.RemoveBlock(aliceId, bobId, BlockKindBlock); err != nil || !removed {
+		t.Errorf("RemoveBlock returned %v, %v, want true", removed, err)
+	}
+	if removed, err := s.RemoveBlock(aliceId, bobId, ""); err != nil || removed {
+		t.Errorf("RemoveBlock of a lifted block returned %v, %v, want false", removed, err)
+	}
+}
+
+func testStoreReports(t *testing.T, s Store) {
+	aliceId, bobId := createTestUsers(t, s)
+	_, ids := createTestRoom(t, s, aliceId, bobId)
+
+	id, err := s.CreateReport(aliceId, bobId, ids[1], "spam", "details")
+	if err != nil {
+		t.Fatalf("CreateReport: %v", err)
+	}
+	if _, err := s.CreateReport(0, bobId, "", "filter", "flagged"); err != nil {
+		t.Fatalf("CreateReport by the filters: %v", err)
+	}
+
+	report, err := s.Report(id)
+	if err != nil || report.Status != ReportOpen || report.Reason != "spam" || report.messageId != ids[1] ||
+		report.reporterId != aliceId || report.reportedUserId != bobId {
+		t.Errorf("Report returned %+v, %v", report, err)
+	}
+	if reports, err := s.Reports(ReportOpen); err != nil || len(reports) != 2 || reports[0].Id != id {
+		t.Errorf("Reports returned %+v, %v, want both, oldest first", reports, err)
+	}
+
+	if err := s.ResolveReport(id, ReportResolved, "ban", "note", aliceId); err != nil {
+		t.Fatalf("ResolveReport: %v", err)
+	}
+	report, err = s.Report(id)
+	if err != nil || report.Status != ReportResolved || report.ResolvedBy != "alice" || report.ResolvedAt == "" {
+		t.Errorf("Report after ResolveReport returned %+v, %v", report, err)
+	}
+	if reports, err := s.Reports(ReportOpen); err != nil || len(reports) != 1 {
+		t.Errorf("Reports after ResolveReport returned %d open reports, %v, want 1", len(reports), err)
+	}
+	if _, err := s.Report(-1); err != sql.ErrNoRows {
+		t.Errorf("Report of a missing report returned %v, want sql.ErrNoRows", err)
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := s.MuteUser(bobId, until); err != nil {
+		t.Errorf("MuteUser: %v", err)
+	}
+	if err := s.BanUser(bobId); err != nil {
+		t.Errorf("BanUser: %v", err)
+	}
+	status, err := s.AccountStatus(bobId)
+	if err != nil || status.Role != RoleUser || !status.Banned || !status.MutedUntil.Equal(until) {
+		t.Errorf("AccountStatus returned %+v, %v", status, err)
+	}
+}
+
+func testStoreTOTP(t *testing.T, s Store) {
+	aliceId, _ := createTestUsers(t, s)
+
+	if err := s.SetTOTPSecret(aliceId, "SECRET"); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+	if err := s.EnableTOTP(aliceId); err != nil {
+		t.Fatalf("EnableTOTP: %v", err)
+	}
+	state, err := s.TOTPState("alice@example.com")
+	if err != nil || state.UserId != aliceId || !state.Enabled || state.Secret.String != "SECRET" {
+		t.Errorf("TOTPState returned %+v, %v", state, err)
+	}
+
+	steps := []struct {
+		step int64
+		want bool
+	}{
+		{100, true},
+		{100, false},
+		{99, false},
+		{101, true},
+	}
+	for _, test := range steps {
+		if ok, err := s.RecordTOTPStep(aliceId, test.step); err != nil || ok != test.want {
+			t.Errorf("RecordTOTPStep(%d) returned %v, %v, want %v", test.step, ok, err, test.want)
+		}
+	}
+
+	if err := s.ReplaceRecoveryCodes(aliceId, []string{"hash-1", "hash-2"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if ok, err := s.UseRecoveryCode(aliceId, "hash-1"); err != nil || !ok {
+		t.Errorf("UseRecoveryCode returned %v, %v, want true", ok, err)
+	}
+	if ok, err := s.UseRecoveryCode(aliceId, "hash-1"); err != nil || ok {
+		t.Errorf("UseRecoveryCode of a used code returned %v, %v, want false", ok, err)
+	}
+	if err := s.ReplaceRecoveryCodes(aliceId, []string{"hash-3"}); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if ok, err := s.UseRecoveryCode(aliceId, "hash-2"); err != nil || ok {
+		t.Errorf("UseRecoveryCode of a replaced code returned %v, %v, want false", ok, err)
+	}
+
+	if err := s.DisableTOTP(aliceId); err != nil {
+		t.Fatalf("DisableTOTP: %v", err)
+	}
+	state, err = s.TOTPState("alice@example.com")
+	if err != nil || state.Enabled || state.Secret.Valid || state.LastStep != 0 {
+		t.Errorf("TOTPState after DisableTOTP returned %+v, %v", state, err)
+	}
+	if ok, err := s.UseRecoveryCode(aliceId, "hash-3"); err != nil || ok {
+		t.Errorf("UseRecoveryCode after DisableTOTP returned %v, %v, want false", ok, err)
+	}
+}
+
+func testStoreBots(t *testing.T, s Store) {
+	aliceId, _ := createTestUsers(t, s)
+
+	if err := s.CreateBot(aliceId, "robot", "Robot", ""); err != nil {
+		t.Fatalf("CreateBot: %v", err)
+	}
+	if err := s.CreateBot(aliceId, "bob", "", ""); err != errHandleTaken {
+		t.Errorf("CreateBot with a taken handle returned %v, want errHandleTaken", err)
+	}
+	if count, err := s.CountBots(aliceId); err != nil || count != 1 {
+		t.Errorf("CountBots returned %d, %v, want 1", count, err)
+	}
+	botId, err := s.OwnedBotId(aliceId, "Robot")
+	if err != nil {
+		t.Fatalf("OwnedBotId: %v", err)
+	}
+	if bots, err := s.OwnedBots(aliceId); err != nil || len(bots) != 1 || bots[0].Handle != "robot" || !bots[0].Bot {
+		t.Errorf("OwnedBots returned %+v, %v", bots, err)
+	}
+
+	token, err := s.CreateAPIToken(botId, "deploy", []string{ScopeReadRooms, ScopePostMessages}, "token-hash")
+	if err != nil || token.Name != "deploy" || len(token.Scopes) != 2 {
+		t.Fatalf("CreateAPIToken returned %+v, %v", token, err)
+	}
+	principal, err := s.APITokenPrincipal("token-hash")
+	if err != nil || principal.Email != botEmail("robot") || principal.TokenId != token.Id || !principal.Can(ScopePostMessages) {
+		t.Errorf("APITokenPrincipal returned %+v, %v", principal, err)
+	}
+	if tokens, err := s.APITokens(botId); err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == "" {
+		t.Errorf("APITokens after use returned %+v, %v", tokens, err)
+	}
+	if _, err := s.APITokenPrincipal("unknown"); err != sql.ErrNoRows {
+		t.Errorf("APITokenPrincipal of an unknown token returned %v, want sql.ErrNoRows", err)
+	}
+
+	if err := s.DeleteBot(botId); err != nil {
+		t.Fatalf("DeleteBot: %v", err)
+	}
+	if _, err := s.APITokenPrincipal("token-hash"); err != sql.ErrNoRows {
+		t.Errorf("APITokenPrincipal of a deleted bot returned %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.OwnedBotId(aliceId, "robot"); err != sql.ErrNoRows {
+		t.Errorf("OwnedBotId of a deleted bot returned %v, want sql.ErrNoRows", err)
+	}
+	if revoked, err := s.RevokeAPIToken(botId, token.Id); err != nil || revoked {
+		t.Errorf("RevokeAPIToken of a deleted token returned %v, %v, want false", revoked, err)
+	}
+
+	// A banned owner's bots lose access as well
+	if err := s.CreateBot(aliceId, "robot2", "", ""); err != nil {
+		t.Fatalf("CreateBot: %v", err)
+	}
+	botId, _ = s.OwnedBotId(aliceId, "robot2")
+	if _, err := s.CreateAPIToken(botId, "deploy", []string{ScopeReadRooms}, "token-hash-2"); err != nil {
+		t.Fatalf("CreateAPIToken: %v", err)
+	}
+	if _, err := s.APITokenPrincipal("token-hash-2"); err != nil {
+		t.Fatalf("APITokenPrincipal: %v", err)
+	}
+	if err := s.BanUser(aliceId); err != nil {
+		t.Fatalf("BanUser: %v", err)
+	}
+	if _, err := s.APITokenPrincipal("token-hash-2"); err != sql.ErrNoRows {
+		t.Errorf("APITokenPrincipal of a banned owner's bot returned %v, want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP parameters as used by common authenticator apps (RFC 6238)
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpModulus       = 1000000
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Secrets are stored encrypted with AES-GCM under TOTP_ENCRYPTION_KEY, as
+// the prefix followed by the nonce and ciphertext in base64. Secrets from
+// before encryption was introduced are plain base32 without the prefix.
+const totpSecretPrefix = "enc:"
+
+// totpKey is nil when TOTP_ENCRYPTION_KEY is not set
+var totpKey cipher.AEAD
+
+var errTOTPKeyMissing = errors.New("TOTP_ENCRYPTION_KEY is not set")
+
+func loadTOTPKey(encoded string) (cipher.AEAD, error) {
+	if encoded == "" {
+		log.Println("Warning: TOTP_ENCRYPTION_KEY is not set, two-factor enrollment is disabled")
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("TOTP_ENCRYPTION_KEY must be 32 bytes in base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealTOTPSecret encrypts a secret for the user. The user id is
+// authenticated along with it, so a secret copied to another account does
+// not decrypt.
+func sealTOTPSecret(userId int, secret string) (string, error) {
+	if totpKey == nil {
+		return "", errTOTPKeyMissing
+	}
+	nonce := make([]byte, totpKey.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := totpKey.Seal(nonce, nonce, []byte(secret), []byte(strconv.Itoa(userId)))
+	return totpSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openTOTPSecret returns the base32 secret of a stored one.
+func openTOTPSecret(userId int, stored string) (string, error) {
+	encoded, encrypted := strings.CutPrefix(stored, totpSecretPrefix)
+	if !encrypted {
+		return stored, nil
+	}
+	if totpKey == nil {
+		return "", errTOTPKeyMissing
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < totpKey.NonceSize() {
+		return "", fmt.Errorf("malformed TOTP secret")
+	}
+	nonce, ciphertext := sealed[:totpKey.NonceSize()], sealed[totpKey.NonceSize():]
+	secret, err := totpKey.Open(nil, nonce, ciphertext, []byte(strconv.Itoa(userId)))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// encryptTOTPSecrets encrypts the secrets stored before encryption was
+// introduced. Without a key it only checks that no secret needs one.
+func encryptTOTPSecrets(store Store) error {
+	secrets, err := store.TOTPSecrets()
+	if err != nil {
+		return err
+	}
+	encrypted := 0
+	for userId, stored := range secrets {
+		if strings.HasPrefix(stored, totpSecretPrefix) {
+			if totpKey == nil {
+				return fmt.Errorf("two-factor secrets are encrypted but %w", errTOTPKeyMissing)
+			}
+			continue
+		}
+		if totpKey == nil {
+			continue
+		}
+		sealed, err := sealTOTPSecret(userId, stored)
+		if err != nil {
+			return err
+		}
+		if err := store.ReplaceTOTPSecret(userId, stored, sealed); err != nil {
+			return err
+		}
+		encrypted++
+	}
+	if encrypted > 0 {
+		log.Printf("Encrypted %d two-factor secret(s)", encrypted)
+	}
+	return nil
+}
+
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpCode(secret []byte, step uint64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], step)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// matchTOTP checks a code against the steps around t and returns the
+// matching time step.
+func matchTOTP(secretB32, code string, t time.Time) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(secretB32))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected := totpCode(secret, uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(issuer, email, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(email)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	// Authenticator apps expect %20 rather than + for spaces
+	return "otpauth://totp/" + label + "?" + strings.ReplaceAll(params.Encode(), "+", "%20")
+}
+
+type totpState struct {
+	UserId   int
+	Secret   sql.NullString
+	Enabled  bool
+	LastStep int64
+}
+
+// verifyTOTP validates a code for the user and records its time step so the
+// same code cannot be replayed.
+func verifyTOTP(store Store, state *totpState, code string) (bool, error) {
+	if !state.Secret.Valid {
+		return false, nil
+	}
+
+	secret, err := openTOTPSecret(state.UserId, state.Secret.String)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return store.RecordTOTPStep(state.UserId, step)
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes discards all existing codes of the user and returns a
+// fresh set. Only hashes are stored.
+func replaceRecoveryCodes(store Store, userId int) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	if err := store.ReplaceRecoveryCodes(userId, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code.
+func verifySecondFactor(store Store, state *totpState, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		return verifyTOTP(store, state, code)
+	}
+	if recoveryCode != "" {
+		return store.UseRecoveryCode(state.UserId, hashRecoveryCode(recoveryCode))
+	}
+	return false, nil
+}
+
+func handleEnrollTOTP(store Store, cfg AccountConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		state, err := store.TOTPState(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if state.Enabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		if totpKey == nil {
+			http.Error(w, "Two-factor authentication is not configured on this server", http.StatusServiceUnavailable)
+			return
+		}
+
+		// The secret stays pending until it is confirmed with a valid code
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+			return
+		}
+		sealed, err := sealTOTPSecret(state.UserId, secret)
+		if err != nil {
+			http.Error(w, "Failed to encrypt secret: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := store.SetTOTPSecret(state.UserId, sealed); err != nil {
+			http.Error(w, "Failed to save secret: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totpURI(cfg.TOTPIssuer, principal.Email, secret),
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode secret: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleConfirmTOTP(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		state, err := store.TOTPState(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if state.Enabled {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		if !state.Secret.Valid {
+			http.Error(w, "Start enrollment first", http.StatusBadRequest)
+			return
+		}
+
+		ok, err := verifyTOTP(store, state, req.Code)
+		if err != nil {
+			http.Error(w, "Failed to verify code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(store, state.UserId)
+		if err != nil {
+			http.Error(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := store.EnableTOTP(state.UserId); err != nil {
+			http.Error(w, "Failed to enable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Two-factor authentication enabled for %s", principal.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string][]string{
+			"recovery_codes": codes,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+type secondFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func handleDisableTOTP(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		var req secondFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		state, err := store.TOTPState(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !state.Enabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+			return
+		}
+
+		ok, err := verifySecondFactor(store, state, req.Code, req.RecoveryCode)
+		if err != nil {
+			http.Error(w, "Failed to verify code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		if err := store.DisableTOTP(state.UserId); err != nil {
+			http.Error(w, "Failed to disable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Two-factor authentication disabled for %s", principal.Email)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleRegenerateRecoveryCodes(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := principalFromContext(r.Context())
+
+		var req secondFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		state, err := store.TOTPState(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to load account: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !state.Enabled {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+			return
+		}
+
+		ok, err := verifyTOTP(store, state, req.Code)
+		if err != nil {
+			http.Error(w, "Failed to verify code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+
+		codes, err := replaceRecoveryCodes(store, state.UserId)
+		if err != nil {
+			http.Error(w, "Failed to generate recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string][]string{
+			"recovery_codes": codes,
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode recovery codes: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
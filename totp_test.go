@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestTOTPKey encrypts TOTP secrets with a fixed key for the duration of
+// a test.
+func useTestTOTPKey(t *testing.T) {
+	t.Helper()
+	key, err := loadTOTPKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	if err != nil {
+		t.Fatalf("loadTOTPKey: %v", err)
+	}
+	previous := totpKey
+	totpKey = key
+	t.Cleanup(func() { totpKey = previous })
+}
+
+func TestMatchTOTPWindow(t *testing.T) {
+	// The SHA-1 test vector of RFC 6238, truncated to six digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	at := time.Unix(1111111109, 0)
+
+	tests := []struct {
+		name   string
+		offset time.Duration
+		code   string
+		want   bool
+	}{
+		{"current step", 0, "081804", true},
+		{"with a space", 0, "081 804", true},
+		{"wrong code", 0, "081805", false},
+		{"clock behind by a step", -30 * time.Second, "081804", true},
+		{"clock ahead by a step", 30 * time.Second, "081804", true},
+		{"two steps late", 60 * time.Second, "081804", false},
+		{"two steps early", -60 * time.Second, "081804", false},
+	}
+	for _, test := range tests {
+		step, ok := matchTOTP(secret, test.code, at.Add(test.offset))
+		if ok != test.want {
+			t.Errorf("%s: matched %v, want %v", test.name, ok, test.want)
+		}
+		if ok && step != 37037036 {
+			t.Errorf("%s: matched step %d, want 37037036", test.name, step)
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsReplays(t *testing.T) {
+	useTestTOTPKey(t)
+	store := openTestSQLiteStore(t)
+	aliceId, _ := createTestUsers(t, store)
+	secret, _ := generateTOTPSecret()
+	sealed, err := sealTOTPSecret(aliceId, secret)
+	if err != nil {
+		t.Fatalf("sealTOTPSecret: %v", err)
+	}
+	if err := store.SetTOTPSecret(aliceId, sealed); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+
+	key, _ := totpEncoding.DecodeString(secret)
+	step := time.Now().Unix() / totpPeriod
+	verify := func(code string) bool {
+		t.Helper()
+		state, err := store.TOTPState("alice@example.com")
+		if err != nil {
+			t.Fatalf("TOTPState: %v", err)
+		}
+		ok, err := verifyTOTP(store, state, code)
+		if err != nil {
+			t.Fatalf("verifyTOTP: %v", err)
+		}
+		return ok
+	}
+
+	if !verify(totpCode(key, uint64(step))) {
+		t.Errorf("current code was refused")
+	}
+	if verify(totpCode(key, uint64(step))) {
+		t.Errorf("current code was accepted twice")
+	}
+	if verify(totpCode(key, uint64(step-1))) {
+		t.Errorf("code of an earlier step was accepted after a later one")
+	}
+}
+
+func TestTOTPSecretEncryption(t *testing.T) {
+	useTestTOTPKey(t)
+	secret, _ := generateTOTPSecret()
+
+	sealed, err := sealTOTPSecret(1, secret)
+	if err != nil {
+		t.Fatalf("sealTOTPSecret: %v", err)
+	}
+	if !strings.HasPrefix(sealed, totpSecretPrefix) || strings.Contains(sealed, secret) {
+		t.Errorf("secret is not encrypted: %s", sealed)
+	}
+	if opened, err := openTOTPSecret(1, sealed); err != nil || opened != secret {
+		t.Errorf("openTOTPSecret = %q, %v, want %q", opened, err, secret)
+	}
+	if _, err := openTOTPSecret(2, sealed); err == nil {
+		t.Errorf("secret of user 1 opened for user 2")
+	}
+	if opened, err := openTOTPSecret(1, secret); err != nil || opened != secret {
+		t.Errorf("plain secret opened as %q, %v", opened, err)
+	}
+
+	totpKey = nil
+	if _, err := openTOTPSecret(1, sealed); err != errTOTPKeyMissing {
+		t.Errorf("opening without a key returned %v, want errTOTPKeyMissing", err)
+	}
+}
+
+func TestEncryptTOTPSecrets(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, _ := createTestUsers(t, store)
+	secret, _ := generateTOTPSecret()
+	if err := store.SetTOTPSecret(aliceId, secret); err != nil {
+		t.Fatalf("SetTOTPSecret: %v", err)
+	}
+	if _, err := store.RecordTOTPStep(aliceId, 42); err != nil {
+		t.Fatalf("RecordTOTPStep: %v", err)
+	}
+
+	// Without a key plain secrets are left alone
+	if err := encryptTOTPSecrets(store); err != nil {
+		t.Fatalf("encryptTOTPSecrets without a key: %v", err)
+	}
+
+	useTestTOTPKey(t)
+	if err := encryptTOTPSecrets(store); err != nil {
+		t.Fatalf("encryptTOTPSecrets: %v", err)
+	}
+	state, err := store.TOTPState("alice@example.com")
+	if err != nil {
+		t.Fatalf("TOTPState: %v", err)
+	}
+	if !strings.HasPrefix(state.Secret.String, totpSecretPrefix) {
+		t.Errorf("secret was not encrypted: %s", state.Secret.String)
+	}
+	if opened, err := openTOTPSecret(aliceId, state.Secret.String); err != nil || opened != secret {
+		t.Errorf("encrypted secret opened as %q, %v, want %q", opened, err, secret)
+	}
+	if state.LastStep != 42 {
+		t.Errorf("last step is %d after encrypting, want 42", state.LastStep)
+	}
+
+	totpKey = nil
+	if err := encryptTOTPSecrets(store); err == nil {
+		t.Errorf("encrypted secrets were accepted without a key")
+	}
+}
+
+func TestEnrollTOTPNeedsKey(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	createTestUsers(t, store)
+	handler := handleEnrollTOTP(store, AccountConfig{TOTPIssuer: "Chat App"})
+
+	enroll := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/api/me/totp/enroll", nil)
+		r = r.WithContext(context.WithValue(r.Context(), principalContextKey, &Principal{Email: "alice@example.com"}))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	totpKey = nil
+	if code := enroll(); code != http.StatusServiceUnavailable {
+		t.Errorf("enrolling without a key returned %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	useTestTOTPKey(t)
+	if code := enroll(); code != http.StatusOK {
+		t.Errorf("enrolling returned %d, want %d", code, http.StatusOK)
+	}
+}
@@ -1,36 +1,79 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	"net/mail"
+	"strings"
 )
 
 type User struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	Handle      string `json:"handle,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
 }
 
-func registerUser(db *sql.DB, email, password string) error {
+const minPasswordLength = 8
+
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return fmt.Errorf("invalid e-mail address")
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	return nil
+}
+
+func registerUser(store Store, email, password, handle, displayName string) error {
+	if err := validateEmail(email); err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	if isBotEmail(email) {
+		return fmt.Errorf("e-mail addresses @%s are reserved for bots", botEmailDomain)
+	}
+
+	// Without an explicit handle one is derived from the e-mail address
+	if handle == "" {
+		generated, err := uniqueHandle(store, handleFromEmail(email))
+		if err != nil {
+			return err
+		}
+		handle = generated
+	}
+	handle = strings.ToLower(handle)
+	if err := validateProfile(&Profile{Handle: handle, DisplayName: displayName}); err != nil {
+		return err
+	}
+
 	// hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	query := `INSERT INTO users (email, password) VALUES (?, ?);`
-	_, err = db.Exec(query, email, hashedPassword)
-	if err != nil {
-		return err
+	err = store.CreateUser(email, hashedPassword, handle, displayName)
+	if err == errHandleTaken {
+		return fmt.Errorf("handle %q is already taken", handle)
 	}
-	return nil
+	return err
 }
 
-func loginUser(db *sql.DB, email, password string) (bool, error) {
-	var hashedPassword string
-
+func loginUser(store Store, email, password string) (bool, error) {
 	// retrieve the hashed password from the database
-	query := `SELECT password FROM users WHERE email = ?`
-	err := db.QueryRow(query, email).Scan(&hashedPassword)
+	hashedPassword, err := store.PasswordHash(email)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil // user does not exist
@@ -49,26 +92,71 @@ func loginUser(db *sql.DB, email, password string) (bool, error) {
 	return true, nil
 }
 
-func getAllUsers(db *sql.DB) ([]User, error) {
-	rows, err := db.Query("SELECT email FROM users")
+// passwordFingerprint returns a short digest of the stored password hash.
+// Password reset tokens carry it so they become invalid once used.
+func passwordFingerprint(store Store, email string) (string, error) {
+	hashedPassword, err := store.PasswordHash(email)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	defer rows.Close()
+	sum := sha256.Sum256([]byte(hashedPassword))
+	return hex.EncodeToString(sum[:8]), nil
+}
 
-	var users []User
-	for rows.Next() {
-		var user User
-		err := rows.Scan(&user.Email)
-		if err != nil {
-			return nil, err
-		}
-		users = append(users, user)
+func updatePassword(store Store, email, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return store.SetPasswordHash(email, hashedPassword)
+}
+
+func sendVerificationEmail(mailer Mailer, cfg AccountConfig, email string) error {
+	token, err := generatePurposeToken(purposeVerifyEmail, email, "", cfg.VerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Welcome to the chat!\n\n"+
+		"Please confirm your e-mail address by opening the link below:\n\n"+
+		"%s/verify-email?token=%s\n\n"+
+		"The link expires in %s.", cfg.PublicURL, token, cfg.VerificationTokenTTL)
+	return mailer.Send(email, "Confirm your e-mail address", body)
+}
+
+// sendAlreadyRegisteredEmail answers a registration with an address that
+// already has an account.
+func sendAlreadyRegisteredEmail(mailer Mailer, cfg AccountConfig, email string) error {
+	body := fmt.Sprintf("Someone tried to register a chat account with this e-mail address, which already has one.\n\n"+
+		"If it was you, sign in at %s, or ask for a password reset there if you forgot your password. "+
+		"If not, you can ignore this e-mail.", cfg.PublicURL)
+	return mailer.Send(email, "You already have an account", body)
+}
+
+func sendPasswordResetEmail(store Store, mailer Mailer, cfg AccountConfig, email string) error {
+	// Bots have no password to reset
+	if isBotEmail(email) {
+		return sql.ErrNoRows
+	}
+	fingerprint, err := passwordFingerprint(store, email)
+	if err != nil {
+		return err
+	}
+
+	token, err := generatePurposeToken(purposePasswordReset, email, fingerprint, cfg.PasswordResetTokenTTL)
+	if err != nil {
+		return err
 	}
 
-	return users, nil
+	body := fmt.Sprintf("Someone asked to reset the password for your chat account.\n\n"+
+		"To choose a new password open the link below:\n\n"+
+		"%s/reset-password?token=%s\n\n"+
+		"The link expires in %s. If you did not ask for this you can ignore this e-mail.",
+		cfg.PublicURL, token, cfg.PasswordResetTokenTTL)
+	return mailer.Send(email, "Reset your password", body)
 }
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Room events outgoing webhooks can subscribe to
+const (
+	EventMessageCreated = "message.created"
+	EventMessageEdited  = "message.edited"
+	EventMessageDeleted = "message.deleted"
+	EventMemberJoined   = "member.joined"
+	EventMemberLeft     = "member.left"
+)
+
+var webhookEvents = []string{EventMessageCreated, EventMessageEdited, EventMessageDeleted, EventMemberJoined, EventMemberLeft}
+
+// Webhook is an outgoing subscription of a room. The secret is only shown
+// when the webhook is created.
+type Webhook struct {
+	Id        int      `json:"id"`
+	RoomId    int      `json:"room_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type WebhookUser struct {
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// WebhookPayload is the JSON body posted to a webhook.
+type WebhookPayload struct {
+	Id        string       `json:"id"`
+	Event     string       `json:"event"`
+	Timestamp string       `json:"timestamp"`
+	Room      Room         `json:"room"`
+	Message   *Message     `json:"message,omitempty"`
+	User      *WebhookUser `json:"user,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id         int    `json:"id"`
+	WebhookId  int    `json:"webhook_id"`
+	DeliveryId string `json:"delivery_id"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// WebhookDeadLetter keeps a payload that could not be delivered after all
+// attempts.
+type WebhookDeadLetter struct {
+	Id         int             `json:"id"`
+	WebhookId  int             `json:"webhook_id"`
+	DeliveryId string          `json:"delivery_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	CreatedAt  string          `json:"created_at"`
+}
+
+func generateSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// hashToken is how secret tokens are stored, so a copy of the database
+// can't be used to authenticate.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// signWebhook returns the value of the X-Chat-Signature header.
+func signWebhook(secret string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(hmacSHA256([]byte(secret), string(body)))
+}
+
+// validateWebhookURL checks a webhook URL when it is created. Host names are
+// only resolved when delivering, where webhookDialControl checks the address
+// actually connected to.
+func validateWebhookURL(raw string, allowPrivate bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if allowPrivate {
+		return nil
+	}
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		return fmt.Errorf("url must not point at this server")
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !isPublicAddr(ip) {
+		return fmt.Errorf("url must not point at a private address")
+	}
+	return nil
+}
+
+// Ranges outside the public internet that netip.Addr has no method for
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// isPublicAddr reports whether ip is on the public internet rather than
+// loopback, link-local, private or otherwise reserved.
+func isPublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl refuses connections to addresses that aren't public,
+// so that webhooks can't reach services on the server's own network. It
+// runs after name resolution, for redirects too.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addrPort.Addr())
+	}
+	return nil
+}
+
+const maxWebhookDeliveries = 100
+
+type webhookJob struct {
+	hook       Webhook
+	deliveryId string
+	event      string
+	body       []byte
+	attempt    int
+}
+
+// WebhookDispatcher posts room events to the webhooks subscribed to them.
+// Failed deliveries are retried with exponential backoff and end up in the
+// dead letter table once all attempts are used up.
+type WebhookDispatcher struct {
+	store  Store
+	cfg    WebhookConfig
+	client *http.Client
+	queue  chan *webhookJob
+}
+
+func NewWebhookDispatcher(store Store, cfg WebhookConfig) *WebhookDispatcher {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if !cfg.AllowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Deliveries connect to the webhook itself, so that its address is
+	// the one checked
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	d := &WebhookDispatcher{
+		store:  store,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+		queue:  make(chan *webhookJob, cfg.QueueSize),
+	}
+	for i := 0; i < max(cfg.Workers, 1); i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch sends an event of a room to its webhooks in the background.
+func (d *WebhookDispatcher) Dispatch(room Room, event string, message *Message, user *WebhookUser) {
+	if room.Id == 0 {
+		return
+	}
+	payload := WebhookPayload{
+		Event:     event,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Room:      Room{Id: room.Id, Name: room.Name},
+		Message:   message,
+		User:      user,
+	}
+	go d.fanOut(payload)
+}
+
+func (d *WebhookDispatcher) fanOut(payload WebhookPayload) {
+	hooks, err := d.store.RoomWebhooks(payload.Room.Id)
+	if err != nil {
+		log.Printf("Error loading webhooks of room %d: %v", payload.Room.Id, err)
+		return
+	}
+	for _, hook := range hooks {
+		if !slices.Contains(hook.Events, payload.Event) {
+			continue
+		}
+		payload.Id = generateId()
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error encoding webhook payload: %v", err)
+			return
+		}
+		d.enqueue(&webhookJob{hook: hook, deliveryId: payload.Id, event: payload.Event, body: body})
+	}
+}
+
+func (d *WebhookDispatcher) enqueue(job *webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		d.deadLetter(job, "delivery queue is full")
+	}
+}
+
+func (d *WebhookDispatcher) work() {
+	for job := range d.queue {
+		// Retries go to the webhook as it is now, if it still exists
+		hook, err := d.store.Webhook(job.hook.RoomId, job.hook.Id)
+		if err == sql.ErrNoRows {
+			log.Printf("Webhook %d: dropping delivery %s, the webhook was deleted", job.hook.Id, job.deliveryId)
+			continue
+		}
+		if err != nil {
+			log.Printf("Error loading webhook %d: %v", job.hook.Id, err)
+		} else {
+			job.hook = *hook
+		}
+
+		job.attempt++
+		status, err := d.deliver(job)
+
+		delivery := WebhookDelivery{
+			WebhookId:  job.hook.Id,
+			DeliveryId: job.deliveryId,
+			Event:      job.event,
+			Attempt:    job.attempt,
+			StatusCode: status,
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		if err := d.store.RecordWebhookDelivery(delivery); err != nil {
+			log.Printf("Error recording webhook delivery: %v", err)
+		}
+		if err == nil {
+			continue
+		}
+
+		if job.attempt >= d.cfg.MaxAttempts {
+			d.deadLetter(job, err.Error())
+			continue
+		}
+		time.AfterFunc(d.backoff(job.attempt), func() { d.enqueue(job) })
+	}
+}
+
+func (d *WebhookDispatcher) backoff(attempt int) time.Duration {
+	wait := d.cfg.BackoffBase << (attempt - 1)
+	if wait <= 0 || wait > d.cfg.BackoffMax {
+		return d.cfg.BackoffMax
+	}
+	return wait
+}
+
+// deliver posts the payload once and returns the status code of the response.
+func (d *WebhookDispatcher) deliver(job *webhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, job.hook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-app-webhooks")
+	req.Header.Set("X-Chat-Event", job.event)
+	req.Header.Set("X-Chat-Delivery", job.deliveryId)
+	req.Header.Set("X-Chat-Signature", signWebhook(job.hook.Secret, job.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *WebhookDispatcher) deadLetter(job *webhookJob, lastError string) {
+	log.Printf("Webhook %d: giving up on delivery %s after %d attempts: %s", job.hook.Id, job.deliveryId, job.attempt, lastError)
+	letter := WebhookDeadLetter{
+		WebhookId:  job.hook.Id,
+		DeliveryId: job.deliveryId,
+		Event:      job.event,
+		Payload:    job.body,
+		Attempts:   job.attempt,
+		LastError:  lastError,
+	}
+	if err := d.store.RecordWebhookDeadLetter(letter); err != nil {
+		log.Printf("Error recording webhook dead letter: %v", err)
+	}
+}
+
+func webhookUserOf(client *Client) *WebhookUser {
+	return &WebhookUser{Handle: client.Handle, DisplayName: client.DisplayName}
+}
+
+// webhookPathIds reads the room and, if present, webhook id from the path.
+func webhookPathIds(r *http.Request) (roomId, webhookId int, err error) {
+	roomId, err = strconv.Atoi(r.PathValue("roomId"))
+	if err != nil {
+		return 0, 0, err
+	}
+	if r.PathValue("id") != "" {
+		webhookId, err = strconv.Atoi(r.PathValue("id"))
+	}
+	return roomId, webhookId, err
+}
+
+func handleGetWebhooks(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, _, err := webhookPathIds(r)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		hooks, err := store.RoomWebhooks(roomId)
+		if err != nil {
+			http.Error(w, "Failed to get webhooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(hooks)
+		if err != nil {
+			http.Error(w, "Failed to encode webhooks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleCreateWebhook(store Store, cfg WebhookConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, _, err := webhookPathIds(r)
+		if err != nil {
+			http.Error(w, "Invalid room id", http.StatusBadRequest)
+			return
+		}
+		var request struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+			Secret string   `json:"secret"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhookURL(request.URL, cfg.AllowPrivate); err != nil {
+			http.Error(w, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(request.Events) == 0 {
+			request.Events = webhookEvents
+		}
+		for _, event := range request.Events {
+			if !slices.Contains(webhookEvents, event) {
+				http.Error(w, "Unknown event "+event+", expected one of "+strings.Join(webhookEvents, ", "), http.StatusBadRequest)
+				return
+			}
+		}
+		if request.Secret == "" {
+			if request.Secret, err = generateSecret(); err != nil {
+				http.Error(w, "Failed to generate secret: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if len(request.Secret) < 16 {
+			http.Error(w, "Secret must be at least 16 characters", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := store.RoomById(roomId); err == sql.ErrNoRows {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		principal, _ := principalFromContext(r.Context())
+		userId, err := store.UserIdByEmail(principal.Email)
+		if err != nil {
+			http.Error(w, "Failed to get user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		hook := Webhook{RoomId: roomId, URL: request.URL, Events: slices.Compact(slices.Sorted(slices.Values(request.Events))), Secret: request.Secret}
+		if err := store.CreateWebhook(&hook, userId); err != nil {
+			http.Error(w, "Failed to create webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Webhook %d created for room %d by %s", hook.Id, roomId, principal.Email)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(hook)
+		if err != nil {
+			http.Error(w, "Failed to encode webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func handleDeleteWebhook(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, id, err := webhookPathIds(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		deleted, err := store.DeleteWebhook(roomId, id)
+		if err != nil {
+			http.Error(w, "Failed to delete webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleGetWebhookDeliveries lists the latest delivery attempts of a webhook,
+// or with ?dead=true the deliveries that were given up on.
+func handleGetWebhookDeliveries(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomId, id, err := webhookPathIds(r)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if _, err := store.Webhook(roomId, id); err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get webhook: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var result any
+		if dead, _ := strconv.ParseBool(r.URL.Query().Get("dead")); dead {
+			result, err = store.WebhookDeadLetters(id)
+		} else {
+			result, err = store.WebhookDeliveries(id)
+		}
+		if err != nil {
+			http.Error(w, "Failed to get deliveries: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			http.Error(w, "Failed to encode deliveries: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
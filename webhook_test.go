@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowPrivate bool
+		valid        bool
+	}{
+		{"https://ci.example.com/hook", false, true},
+		{"http://93.184.216.34:8080/hook", false, true},
+		{"ftp://example.com/hook", false, false},
+		{"/relative", false, false},
+		{"http://localhost:8080/hook", false, false},
+		{"http://127.0.0.1/hook", false, false},
+		{"http://10.1.2.3/hook", false, false},
+		{"http://192.168.0.10/hook", false, false},
+		{"http://169.254.169.254/latest/meta-data", false, false},
+		{"http://[::1]/hook", false, false},
+		{"http://[fd00::1]/hook", false, false},
+		{"http://[::ffff:127.0.0.1]/hook", false, false},
+		{"http://0.0.0.0/hook", false, false},
+		{"http://localhost:8080/hook", true, true},
+		{"http://10.1.2.3/hook", true, true},
+	}
+	for _, test := range tests {
+		err := validateWebhookURL(test.url, test.allowPrivate)
+		if (err == nil) != test.valid {
+			t.Errorf("validateWebhookURL(%q, %t) = %v, want valid %t", test.url, test.allowPrivate, err, test.valid)
+		}
+	}
+}
+
+func TestWebhookDeliveryRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// The same server by name, resolved when delivering
+	byName := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	cfg := WebhookConfig{QueueSize: 1, Timeout: 5 * time.Second}
+	for _, allowPrivate := range []bool{false, true} {
+		cfg.AllowPrivate = allowPrivate
+		d := NewWebhookDispatcher(nil, cfg)
+		for _, url := range []string{server.URL, byName} {
+			job := &webhookJob{hook: Webhook{URL: url, Secret: "0123456789abcdef"}, deliveryId: "d1", event: EventMessageCreated, body: []byte("{}")}
+			status, err := d.deliver(job)
+			if allowPrivate && (err != nil || status != http.StatusOK) {
+				t.Errorf("delivery to %s with private addresses allowed: %d, %v", url, status, err)
+			}
+			if !allowPrivate && (err == nil || !strings.Contains(err.Error(), "not public")) {
+				t.Errorf("delivery to %s: %d, %v; want it refused", url, status, err)
+			}
+		}
+	}
+}
+
+// waitFor polls until done reports true or a few seconds have passed.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+
+	// /flaky fails each delivery twice before accepting it, /down always fails
+	type request struct {
+		path   string
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 10)
+	failures := map[string]int{}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.URL.Path, r.Header, body}
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/flaky" && failures[r.Header.Get("X-Chat-Delivery")] < 2 {
+			failures[r.Header.Get("X-Chat-Delivery")]++
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	flaky := Webhook{RoomId: room.Id, URL: server.URL + "/flaky", Events: []string{EventMessageCreated}, Secret: "flaky-secret"}
+	down := Webhook{RoomId: room.Id, URL: server.URL + "/down", Events: []string{EventMessageCreated}, Secret: "down-secret"}
+	other := Webhook{RoomId: room.Id, URL: server.URL + "/other", Events: []string{EventMemberJoined}, Secret: "other-secret"}
+	for _, hook := range []*Webhook{&flaky, &down, &other} {
+		if err := store.CreateWebhook(hook, aliceId); err != nil {
+			t.Fatalf("CreateWebhook: %v", err)
+		}
+	}
+
+	d := NewWebhookDispatcher(store, WebhookConfig{Workers: 2, QueueSize: 10, Timeout: 5 * time.Second, MaxAttempts: 3,
+		BackoffBase: 10 * time.Millisecond, BackoffMax: 20 * time.Millisecond, AllowPrivate: true})
+	d.Dispatch(*room, EventMessageCreated, &Message{Id: "m1", Content: "hello"}, nil)
+
+	for _, hook := range []Webhook{flaky, down} {
+		waitFor(t, "three attempts", func() bool {
+			deliveries, _ := store.WebhookDeliveries(hook.Id)
+			return len(deliveries) == 3
+		})
+	}
+	waitFor(t, "a dead letter", func() bool {
+		letters, _ := store.WebhookDeadLetters(down.Id)
+		return len(letters) == 1
+	})
+
+	deliveries, _ := store.WebhookDeliveries(flaky.Id)
+	for i, delivery := range deliveries {
+		wantStatus := http.StatusServiceUnavailable
+		if i == 0 {
+			wantStatus = http.StatusOK
+		}
+		if delivery.Attempt != 3-i || delivery.StatusCode != wantStatus || delivery.DeliveryId != deliveries[0].DeliveryId {
+			t.Errorf("delivery %d: %+v", i, delivery)
+		}
+	}
+	if letters, _ := store.WebhookDeadLetters(flaky.Id); len(letters) != 0 {
+		t.Errorf("a delivery that succeeded was dead lettered: %+v", letters)
+	}
+	letters, _ := store.WebhookDeadLetters(down.Id)
+	if letters[0].Attempts != 3 || !strings.Contains(letters[0].LastError, "500") {
+		t.Errorf("dead letter: %+v", letters[0])
+	}
+	if deliveries, _ := store.WebhookDeliveries(other.Id); len(deliveries) != 0 {
+		t.Errorf("a webhook got an event it did not subscribe to")
+	}
+
+	// Every attempt is signed with the secret of its webhook
+	secrets := map[string]string{"/flaky": flaky.Secret, "/down": down.Secret}
+	close(requests)
+	for r := range requests {
+		mac := hmac.New(sha256.New, []byte(secrets[r.path]))
+		mac.Write(r.body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.header.Get("X-Chat-Signature") != want {
+			t.Errorf("%s: signature %q, want %q", r.path, r.header.Get("X-Chat-Signature"), want)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(r.body, &payload); err != nil || payload.Event != EventMessageCreated || payload.Message == nil || payload.Message.Id != "m1" ||
+			payload.Room.Id != room.Id || payload.Id != r.header.Get("X-Chat-Delivery") || r.header.Get("X-Chat-Event") != EventMessageCreated {
+			t.Errorf("%s: payload %s, %v", r.path, r.body, err)
+		}
+	}
+}
+
+func TestWebhookRetriesStopWhenTheWebhookIsDeleted(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	aliceId, bobId := createTestUsers(t, store)
+	room, _ := createTestRoom(t, store, aliceId, bobId)
+
+	// Both fail every delivery; /deleted deletes its webhook on the first one
+	var deleted Webhook
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/deleted" {
+			store.DeleteWebhook(deleted.RoomId, deleted.Id)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deleted = Webhook{RoomId: room.Id, URL: server.URL + "/deleted", Events: []string{EventMessageCreated}, Secret: "secret"}
+	down := Webhook{RoomId: room.Id, URL: server.URL + "/down", Events: []string{EventMessageCreated}, Secret: "secret"}
+	for _, hook := range []*Webhook{&deleted, &down} {
+		if err := store.CreateWebhook(hook, aliceId); err != nil {
+			t.Fatalf("CreateWebhook: %v", err)
+		}
+	}
+
+	d := NewWebhookDispatcher(store, WebhookConfig{Workers: 2, QueueSize: 10, Timeout: 5 * time.Second, MaxAttempts: 3,
+		BackoffBase: 10 * time.Millisecond, BackoffMax: 20 * time.Millisecond, AllowPrivate: true})
+	d.Dispatch(*room, EventMessageCreated, &Message{Id: "m1", Content: "hello"}, nil)
+
+	// By the time /down is given up on, /deleted would have been retried too
+	waitFor(t, "a dead letter", func() bool {
+		letters, _ := store.WebhookDeadLetters(down.Id)
+		return len(letters) == 1
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["/deleted"] != 1 || attempts["/down"] != 3 {
+		t.Errorf("attempts %v, want one for the deleted webhook", attempts)
+	}
+	if letters, _ := store.WebhookDeadLetters(deleted.Id); len(letters) != 0 {
+		t.Errorf("the delivery to a deleted webhook was dead lettered: %+v", letters)
+	}
+}